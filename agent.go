@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+var (
+	ErrNoAgentAddr  = errors.New("agent mode requires a -listen-addr")
+	ErrNoAgentToken = errors.New("-agent-token must be specified with -agent-url, and in agent mode")
+)
+
+// agentCommand is the name of the stop and start commands of a job backing up
+// an agent, which agentClient sends to the agent rather than running.
+const agentCommand = "plexbackup-agent"
+
+// agentErrorTrailer carries the error of an archive that failed after the
+// response started streaming.
+const agentErrorTrailer = "Plexbackup-Error"
+
+// serveAgent serves requests from a coordinator to stop and start the service
+// described by c, and stream an archive of its directories, on addr until ctx
+// is cancelled. The coordinator compresses and uploads the archive, so the
+// agent needs no AWS credentials, and the coordinator no access to the data.
+// Requests are served over HTTPS if -agent-tls-cert is set. If the
+// coordinator stops the service, then does not start it again within
+// -restart-after, the agent does.
+func serveAgent(ctx context.Context, logger *slog.Logger, addr string, c *jobConfig) error {
+	o := c.opts()
+	watchdog := &restartWatchdog{
+		after: agentRestartAfter,
+		start: func() {
+			logger.WarnContext(ctx, "coordinator did not start service, starting it",
+				slog.String("service", o.Service),
+				slog.Duration("after", agentRestartAfter))
+			startCtx := context.WithoutCancel(ctx)
+			if err := o.ControlService(startCtx, "start"); err != nil {
+				logger.ErrorContext(startCtx, "failed to start service",
+					slog.String("error", err.Error()))
+				return
+			}
+			o.AwaitPlex(startCtx, logger)
+		},
+	}
+	defer watchdog.disarm()
+	mux := http.NewServeMux()
+	for _, action := range []string{"stop", "start"} {
+		mux.HandleFunc("POST /"+action, func(w http.ResponseWriter, r *http.Request) {
+			logger.InfoContext(r.Context(), "received "+action+" request",
+				slog.String("service", o.Service))
+			if o.NoPause {
+				return
+			}
+			// Starting must not be abandoned if the coordinator goes away.
+			ctx := r.Context()
+			if action == "start" {
+				ctx = context.WithoutCancel(ctx)
+				watchdog.started()
+			}
+			if err := o.ControlService(ctx, action); err != nil {
+				logger.ErrorContext(ctx, "failed to "+action+" service",
+					slog.String("error", err.Error()))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if action == "start" {
+				o.AwaitPlex(ctx, logger)
+			} else {
+				watchdog.stopped()
+			}
+		})
+	}
+	mux.HandleFunc("GET /archive", func(w http.ResponseWriter, r *http.Request) {
+		logger.InfoContext(r.Context(), "streaming archive")
+		// A large archive may take longer than -restart-after.
+		watchdog.pause()
+		defer watchdog.resume()
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Trailer", agentErrorTrailer)
+		name, args := o.ArchiveCommand()
+		if err := (backup.ExecRunner{}).Run(r.Context(), w, name, args...); err != nil {
+			logger.ErrorContext(r.Context(), "failed to archive",
+				slog.String("error", err.Error()))
+			w.Header().Set(agentErrorTrailer, err.Error())
+		}
+	})
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           authenticate(c.agentToken, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	var err error
+	if agentTLSCert != "" {
+		logger.InfoContext(ctx, "serving agent over HTTPS", slog.String("addr", addr))
+		err = server.ListenAndServeTLS(agentTLSCert, agentTLSKey)
+	} else {
+		logger.WarnContext(ctx, "serving agent without TLS, so the token and archive are sent in cleartext; set -agent-tls-cert on an untrusted network",
+			slog.String("addr", addr))
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// restartWatchdog calls start if the service is left stopped for longer than
+// after without an archive in progress, e.g. as the coordinator crashed
+// between stopping and starting it. A zero after disables it.
+type restartWatchdog struct {
+	after time.Duration
+	start func()
+
+	mu        sync.Mutex
+	isStopped bool
+	archives  int
+	timer     *time.Timer
+}
+
+// stopped records that the service has been stopped.
+func (d *restartWatchdog) stopped() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.isStopped = true
+	d.arm()
+}
+
+// started records that the coordinator has asked for the service to be
+// started.
+func (d *restartWatchdog) started() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.isStopped = false
+	d.arm()
+}
+
+// pause suspends the watchdog while an archive is streamed.
+func (d *restartWatchdog) pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.archives++
+	d.arm()
+}
+
+// resume restarts the watchdog once an archive has been streamed.
+func (d *restartWatchdog) resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.archives--
+	d.arm()
+}
+
+// disarm stops the watchdog, e.g. when the agent exits.
+func (d *restartWatchdog) disarm() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.after = 0
+	d.arm()
+}
+
+// arm starts the timer if the service is stopped and no archive is in
+// progress, and stops it otherwise. d.mu must be held.
+func (d *restartWatchdog) arm() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.after <= 0 || !d.isStopped || d.archives > 0 {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(d.after, func() {
+		d.mu.Lock()
+		// The timer may have been replaced after firing, but before the
+		// lock was acquired, e.g. as the coordinator started a new backup.
+		if d.timer != timer {
+			d.mu.Unlock()
+			return
+		}
+		d.isStopped = false
+		d.timer = nil
+		d.mu.Unlock()
+		d.start()
+	})
+	d.timer = timer
+}
+
+// authenticate rejects requests that are not authorised by token.
+func authenticate(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorised(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorised returns whether r carries token as a bearer token, or as the
+// password of basic auth, which browsers can prompt for. token must not be
+// empty.
+func authorised(r *http.Request, token string) bool {
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, provided, ok = r.BasicAuth()
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// agentClient is a backup.Runner sending the commands of a job to an agent.
+// The agent runs its own stop, start and tar commands, so only which is
+// requested is significant.
+type agentClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// Run implements backup.Runner.
+func (a *agentClient) Run(ctx context.Context, stdout io.Writer, name string, args ...string) error {
+	switch {
+	case name == agentCommand && len(args) == 1:
+		_, err := a.do(ctx, http.MethodPost, "/"+args[0], io.Discard)
+		return err
+	case name == "tar":
+		trailer, err := a.do(ctx, http.MethodGet, "/archive", stdout)
+		if err != nil {
+			return err
+		}
+		if msg := trailer.Get(agentErrorTrailer); msg != "" {
+			return fmt.Errorf("agent: %v", msg)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%v is not supported by the agent", name)
+	}
+}
+
+// do sends a request to the agent, copying the response body to w, and
+// returns the trailer.
+func (a *agentClient) do(ctx context.Context, method, path string, w io.Writer) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(a.url, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("agent returned %v: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return nil, err
+	}
+	return resp.Trailer, nil
+}
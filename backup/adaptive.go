@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressor compresses everything read from a reader, then flushes the
+// remainder on Close. *zstd.Encoder is the default.
+type compressor interface {
+	ReadFrom(io.Reader) (int64, error)
+	Close() error
+}
+
+// Parameters of the sample taken of each chunk by adaptiveEncoder, to decide
+// whether it is worth compressing properly.
+const (
+	sampleCount = 4
+	sampleBytes = 16 << 10
+
+	// incompressiblePercent is the compressed size of a sample, as a
+	// percentage of the original, above which the chunk is deemed already
+	// compressed.
+	incompressiblePercent = 97
+)
+
+// adaptiveEncoder compresses a stream as a series of independent zstd frames,
+// one per chunk, which any zstd decoder reads as a single stream. Each chunk
+// is sampled with the fastest level first: if that barely shrinks it, as with
+// the JPEG artwork and video thumbnails that make up much of Plex's metadata,
+// it is compressed at the fastest level, which stores blocks it cannot shrink
+// as they are. Otherwise it is compressed at the default level. Chunks are
+// compressed concurrently, and written in order.
+type adaptiveEncoder struct {
+	w           io.Writer
+	chunkBytes  int
+	concurrency int
+	full, fast  *zstd.Encoder
+
+	// chunks and stored count the chunks compressed, and those deemed
+	// incompressible.
+	chunks, stored atomic.Uint64
+}
+
+// newAdaptiveEncoder returns an adaptiveEncoder writing to w, buffering chunks
+// of chunkBytes, at most concurrency of which are compressed at once.
+func newAdaptiveEncoder(w io.Writer, chunkBytes, concurrency int) (*adaptiveEncoder, error) {
+	full, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(concurrency))
+	if err != nil {
+		return nil, err
+	}
+	fast, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(concurrency), zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		return nil, err
+	}
+	return &adaptiveEncoder{
+		w:           w,
+		chunkBytes:  chunkBytes,
+		concurrency: concurrency,
+		full:        full,
+		fast:        fast,
+	}, nil
+}
+
+// ReadFrom compresses everything read from r, returning the number of bytes
+// read. It stops reading if writing fails.
+func (a *adaptiveEncoder) ReadFrom(r io.Reader) (int64, error) {
+	// Each chunk's frame is delivered on its own channel, queued in the
+	// order the chunks were read.
+	pending := make(chan chan []byte, a.concurrency)
+	stop := make(chan struct{})
+	var read int64
+	var readErr error
+	go func() {
+		defer close(pending)
+		for {
+			chunk := make([]byte, a.chunkBytes)
+			n, err := io.ReadFull(r, chunk)
+			if n > 0 {
+				frame := make(chan []byte, 1)
+				select {
+				case pending <- frame:
+				case <-stop:
+					return
+				}
+				go func() {
+					frame <- a.encode(chunk[:n])
+				}()
+				read += int64(n)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+		}
+	}()
+
+	var writeErr error
+	for frame := range pending {
+		compressed := <-frame
+		if writeErr != nil {
+			continue
+		}
+		if _, writeErr = a.w.Write(compressed); writeErr != nil {
+			close(stop)
+		}
+	}
+	if writeErr != nil {
+		return read, writeErr
+	}
+	return read, readErr
+}
+
+// encode returns chunk as a zstd frame, compressed at the level its samples
+// suggest.
+func (a *adaptiveEncoder) encode(chunk []byte) []byte {
+	a.chunks.Add(1)
+	sampled, compressed := 0, 0
+	stride := max(len(chunk)/sampleCount, sampleBytes)
+	for offset := 0; offset < len(chunk); offset += stride {
+		sample := chunk[offset:min(offset+sampleBytes, len(chunk))]
+		sampled += len(sample)
+		compressed += len(a.fast.EncodeAll(sample, nil))
+	}
+	if compressed*100 > sampled*incompressiblePercent {
+		a.stored.Add(1)
+		return a.fast.EncodeAll(chunk, make([]byte, 0, len(chunk)+len(chunk)/128+64))
+	}
+	return a.full.EncodeAll(chunk, nil)
+}
+
+// Close releases the encoders. Every frame is complete once ReadFrom returns,
+// so there is nothing to flush.
+func (a *adaptiveEncoder) Close() error {
+	return errors.Join(a.full.Close(), a.fast.Close())
+}
@@ -1,26 +1,122 @@
 // Package backup creates and uploads Plex Media Server backups to S3.
 // Plex will be stopped before the backup begins, and started again after it
-// finishes.
+// finishes. Although the defaults are tailored to Plex, any service with its
+// state in a single directory, e.g. Tautulli, Sonarr or Home Assistant, can be
+// backed up by setting Opts.Service, Opts.Directory and Opts.Excludes.
 package backup
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
+	"maps"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gebn/plexbackup/internal/pkg/countingreader"
+	"github.com/gebn/plexbackup/internal/pkg/ratelimit"
+	"github.com/gebn/plexbackup/internal/pkg/schedule"
+	"github.com/gebn/plexbackup/internal/pkg/staging"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 )
 
+// tracer creates spans for each phase of the backup. It uses the global
+// provider, so is a no-op unless the caller has configured one.
+var tracer = otel.Tracer("github.com/gebn/plexbackup/backup")
+
+// endSpan records err against span if non-nil, then ends the span. It returns
+// err unchanged, so can be used in return statements.
+func endSpan(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+// Errors returned by Opts.Validate wrap one of the following, indicating the
+// invalid option.
+var (
+	ErrNoBucket     = errors.New("no bucket specified")
+	ErrNoService    = errors.New("no service specified")
+	ErrBadDirectory = errors.New("invalid directory")
+	ErrBadPrefix    = errors.New("invalid prefix")
+	ErrBadReplica   = errors.New("invalid replica bucket")
+	ErrBadLabel     = errors.New("invalid label")
+	ErrBadPart      = errors.New("invalid part")
+	ErrBadRetention = errors.New("invalid retention policy")
+	ErrBadVacuum    = errors.New("cannot vacuum databases")
+	ErrBadSeed      = errors.New("invalid seed")
+	ErrBadRetry     = errors.New("invalid retry policy")
+	ErrBadReflink   = errors.New("cannot reflink databases")
+	ErrBadMargin    = errors.New("invalid space margin")
+)
+
+// Errors returned by Run wrap one of the following to indicate the phase that
+// failed, so callers can distinguish, e.g. a failed upload from Plex being
+// left stopped.
+var (
+	ErrStop      = errors.New("failed to stop")
+	ErrArchive   = errors.New("failed to archive")
+	ErrUpload    = errors.New("failed to upload new backup")
+	ErrStart     = errors.New("failed to start")
+	ErrPrune     = errors.New("failed to delete old backup")
+	ErrReplicate = errors.New("failed to replicate")
+	ErrVerify    = errors.New("failed to verify")
+)
+
+// S3API is the subset of *s3.Client used by the package, allowing it to be
+// stubbed or wrapped.
+type S3API interface {
+	s3manager.UploadAPIClient
+	ListObjectsV2(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObject(context.Context, *s3.DeleteObjectInput, ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	ListObjectVersions(context.Context, *s3.ListObjectVersionsInput, ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+	CopyObject(context.Context, *s3.CopyObjectInput, ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	UploadPartCopy(context.Context, *s3.UploadPartCopyInput, ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+}
+
+// PlexExcludes are the tar exclude patterns used if Opts.Excludes is nil. They
+// match regenerable or transient content within the 'Plex Media Server'
+// directory. Drivers and Updates hold hardware transcoding drivers and server
+// updates, both downloaded again on demand, and Transcode the transcoder's
+// temporary files, should they have been moved out of Cache. The -shm file of
+// each database is an index of its -wal file, which SQLite rebuilds when the
+// database is first opened; a stale one is of no use.
+var PlexExcludes = []string{
+	"*.db-shm",
+	"Cache",
+	"Crash Reports",
+	"Diagnostics",
+	"Drivers",
+	"plexmediaserver.pid",
+	"Transcode",
+	"Updates",
+}
+
 // Opts encapsulates parameters for backing up Plex's database.
 type Opts struct {
 
@@ -35,15 +131,263 @@ type Opts struct {
 	// after it completes.
 	Service string
 
-	// Directory is the path to the 'Plex Media Server' directory, which will
-	// form the root directory of the produced backup.
-	Directory string
+	// ExtraServices are the names of further units stopped after Service, in
+	// order, and started before it, in reverse order, e.g. companions such as
+	// xTeVe or Kitana that must be quiesced with Plex. They are always
+	// controlled with sudo systemctl.
+	ExtraServices []string
+
+	// StopCommand and StartCommand, if non-empty, are the name and arguments of
+	// commands run to stop and start the service instead of sudo systemctl,
+	// e.g. on platforms running Plex in Docker. Service is then only used to
+	// identify the service in logs and errors.
+	StopCommand  []string
+	StartCommand []string
+
+	// StopTimeout, if non-zero, bounds how long stopping the services may
+	// take before the backup is abandoned. Plex can take minutes to
+	// checkpoint a large database when stopped.
+	StopTimeout time.Duration
+
+	// StartGrace, if non-zero and PlexURL is set, is how long Plex is given
+	// to finish booting and respond to requests after being started. Run
+	// waits for it to respond, so the service is not considered started
+	// while it is still unavailable; if it does not within StartGrace, a
+	// warning is logged.
+	StartGrace time.Duration
+
+	// Directories are the paths of the directories to back up, usually just
+	// the 'Plex Media Server' directory. Each forms a top-level directory of
+	// the produced backup, so their base names must be unique. Capturing
+	// related paths in one backup ensures they are consistent with each
+	// other, and means the service only needs to be stopped once.
+	Directories []string
+
+	// Parts are paths of subtrees within the backup, starting with the base
+	// name of one of Directories, e.g. "Plex Media Server/Metadata", archived
+	// concurrently with the rest, each by its own tar, compressor and
+	// upload, into an object whose key is the backup's followed by ".part1",
+	// ".part2" etc. This uses more cores and connections, shortening the
+	// backup of large libraries. Restore, Verify and ReadManifest read the
+	// parts along with the backup, and Prune deletes them. The parts must
+	// not overlap. They are passed to tar as exclude patterns when archiving
+	// the rest.
+	Parts []string
+
+	// Excludes are patterns of files and directories within Directories to
+	// omit from the backup, in the format accepted by tar's --exclude option.
+	// If nil, PlexExcludes is used; provide an empty slice to back up
+	// everything.
+	Excludes []string
+
+	// ConfigPaths are absolute paths of files and directories configuring
+	// Plex outside Directories, e.g. LinuxConfigPaths, archived under their
+	// path relative to the root, so a rebuilt server can be restored with
+	// its configuration as well as its library. Restore extracts
+	// /etc/default/plexmediaserver to etc/default/plexmediaserver within the
+	// restore directory, for example. Those that do not exist are skipped.
+	ConfigPaths []string
 
 	// Bucket is the name of the S3 bucket to upload the backup to.
 	Bucket string
 
+	// ProgressInterval is how often OnProgress and Hooks.OnUploadProgress are
+	// called while the backup is in progress. Progress is not reported if it
+	// is zero.
+	ProgressInterval time.Duration
+
+	// OnProgress, if non-nil, is called every ProgressInterval with a
+	// snapshot of the backup's progress. It is called from a separate
+	// goroutine, and should return promptly.
+	OnProgress func(Progress)
+
+	// Hooks, if non-nil, is notified of each phase of the backup.
+	Hooks Hooks
+
+	// PlexURL is the address of Plex Media Server, usually DefaultPlexURL. If
+	// set, the server's version is detected before it is stopped, and
+	// recorded in the Result and the "plex-version" metadata of the backup
+	// object, so it is known which version a restored database belongs to.
+	PlexURL string
+
+	// Runner runs systemctl and tar. If nil, ExecRunner is used.
+	Runner Runner
+
+	// RemoteDirectories indicates Directories are on another host, where
+	// Runner runs tar, so they are not checked to exist, and progress is
+	// reported without an estimated size.
+	RemoteDirectories bool
+
+	// Nice, if non-zero, is the niceness tar is run with via nice(1), e.g.
+	// 19 for the lowest CPU priority.
+	Nice int
+
+	// IdleIO runs tar in the idle I/O scheduling class via ionice(1), so it
+	// only reads from disk when no other process is. This is only available
+	// on Linux.
+	IdleIO bool
+
+	// MaxReadRate, if positive, limits the rate at which the archive is
+	// produced, and so the directories are read, in bytes per second. This
+	// leaves disk bandwidth for other processes, e.g. Plex clients streaming
+	// from the same disks.
+	MaxReadRate int64
+
+	// UploadWindow, if not the zero value, is the time of day the upload may
+	// use all available bandwidth, e.g. overnight, in the local time zone.
+	// Outside it, the upload is limited to OutsideWindowRate bytes per
+	// second, or paused until the window opens if that is zero, so a large
+	// backup can finish over several nights. As the archive is streamed,
+	// tar waits on the upload, so the service remains stopped while it is
+	// throttled unless NoPause is set.
+	UploadWindow schedule.Window
+
+	// OutsideWindowRate is the rate the upload is limited to outside
+	// UploadWindow, in bytes per second. Zero pauses it.
+	OutsideWindowRate int64
+
+	// SeedDir, if set, is a directory to stage the backup in before it is
+	// uploaded, for a first backup too large to upload in one run. The
+	// service is only stopped while the archive is written to disk. It is
+	// then uploaded in chunks of SeedChunkBytes, each its own object, which
+	// are assembled into the backup object server-side once all have been
+	// uploaded. If interrupted, running again with the same SeedDir resumes
+	// the upload from the first chunk not uploaded, without stopping the
+	// service or archiving again. The directory must have space for the
+	// compressed backup. Parts cannot be seeded.
+	SeedDir string
+
+	// SeedChunkBytes is the size of each chunk of a seed, between
+	// MinSeedChunkBytes and MaxSeedChunkBytes. It is raised if the backup
+	// would otherwise have more than 10,000 chunks.
+	SeedChunkBytes int64
+
+	// MaxMemory, if positive, is the approximate number of bytes the
+	// compressor and uploader may buffer between them. Compression is less
+	// effective, and upload slower, at low values. It does not limit the Go
+	// runtime as a whole; see runtime/debug.SetMemoryLimit.
+	MaxMemory int64
+
+	// AdaptiveCompression samples each window of the archive before
+	// compressing it, storing windows that barely compress, e.g. of JPEG
+	// artwork, with the least effort instead of spending CPU on them at the
+	// default level. The output is a series of zstd frames, which restores
+	// as any other backup.
+	AdaptiveCompression bool
+
+	// Vacuum compacts Plex's library databases with PlexSQLite once the
+	// service has been stopped, checkpointing and truncating their
+	// write-ahead logs, and rebuilding them without free pages, which
+	// shrinks the largest component of the archive. This extends the
+	// downtime, by minutes for a large library. Failure is logged, and the
+	// backup continues. It cannot be combined with NoPause or
+	// RemoteDirectories.
+	Vacuum bool
+
+	// Reflink backs up the library databases from reflink copies, e.g. on
+	// XFS or Btrfs, rather than stopping the service. Each database and its
+	// write-ahead log are cloned alongside the originals in an instant,
+	// sharing their blocks, and the clones archived in their place, so the
+	// databases are crash-consistent with no downtime. The rest of the
+	// directories are archived live, as with NoPause. The backup fails if
+	// the filesystem does not support reflinks. It cannot be combined with
+	// Vacuum or RemoteDirectories.
+	Reflink bool
+
+	// SpaceMargin, if non-zero, is how many times the estimated size of the
+	// files written locally before the backup is uploaded must be free on
+	// their filesystem: the archive staged in SeedDir, and the copies of the
+	// databases written by Vacuum and Reflink. It is checked before the
+	// service is stopped, and must be zero or at least 1. RepairDatabases
+	// also checks there is room for each database it downloads.
+	SpaceMargin float64
+
+	// Staging records the files created alongside Plex's, by Reflink and
+	// RepairDatabases, so any left by a crashed run can be removed by the
+	// next. If nil, they are not recorded.
+	Staging *staging.Registry
+
+	// PlexSQLite is the path of the SQLite command line shell used by
+	// Vacuum. If empty, DefaultPlexSQLite is used.
+	PlexSQLite string
+
+	// Deduplicate stores the content of each regular file of up to 16 MiB
+	// only once per object, replacing later files with the same content by
+	// hard links to the first, as Plex's metadata contains many identical
+	// images. Restored duplicates are hard links sharing one copy.
+	Deduplicate bool
+
+	// Catalog maintains an index of the backups under Prefix, named
+	// CatalogName, recording details of each that cannot be derived from its
+	// key. Failure to update it is logged rather than returned.
+	Catalog bool
+
+	// PurgeVersions permanently deletes noncurrent versions and delete
+	// markers of backups under Prefix after pruning, so retention frees space
+	// in buckets with versioning enabled. See PurgeVersions.
+	PurgeVersions bool
+
+	// Verify downloads the new backup after uploading it and reads every
+	// entry of the archive, checking its digest. Old backups are only pruned
+	// if this succeeds. See Verify.
+	Verify bool
+
+	// KMSKeyIDs, if non-empty, are the IDs, aliases or ARNs of KMS keys to
+	// encrypt backups with client-side. Each backup is encrypted with a new
+	// data key generated by the first, which is also wrapped by each of the
+	// rest, e.g. a recovery key in another account. The wrapped keys are
+	// stored in the object's metadata, so the backup can be decrypted with
+	// access to any of them. See Rekey to change them.
+	KMSKeyIDs []string
+
+	// KMS is used to generate data keys if KMSKeyIDs is set, and to decrypt
+	// encrypted backups when they are read back, e.g. by Verify.
+	KMS KMSAPI
+
+	// ReplicaBucket, if set, is the name of a second bucket, usually in
+	// another region, the backup is copied to after upload. Old backups are
+	// pruned from it alongside those in Bucket.
+	ReplicaBucket string
+
+	// ReplicaClient is used to copy backups to ReplicaBucket, so must be for
+	// its region. If nil, the client passed to Run is used.
+	ReplicaClient S3API
+
+	// ToolVersion, if set, is recorded in the catalog alongside each backup.
+	ToolVersion string
+
+	// Now returns the time used to name the backup. If nil, time.Now is
+	// used. It is called once per backup, so may return a fixed time, e.g.
+	// the start of the maintenance window.
+	Now func() time.Time
+
+	// Label, if set, marks the backup as a deliberate snapshot, e.g.
+	// "pre-upgrade-1.40". It is appended to the date in the key, and
+	// recorded in the "label" metadata and the catalog. Labelled backups are
+	// never pruned, and a labelled run does not prune any backup, so it
+	// does not displace the regular one. See ValidLabel.
+	Label string
+
+	// Retry decides whether Run retries a failed run. The zero value does
+	// not. Retries of requests to S3 are configured on the client instead.
+	Retry RetryPolicy
+
+	// NoPrune disables deleting old backups, leaving them to be expired by
+	// the bucket's lifecycle rules, e.g. once Object Lock retention lapses,
+	// so the credentials need no permission to delete. It cannot be combined
+	// with a non-zero Retention or PurgeVersions.
+	NoPrune bool
+
+	// Retention is the policy deciding which backups are deleted after each
+	// successful one. With the zero value, only the oldest backup at the
+	// start of the run is deleted, so backups left behind by earlier
+	// failures accumulate until PrunePlan is acted on. Otherwise, every
+	// backup the policy does not keep is deleted.
+	Retention Retention
+
 	// Prefix is prepended to "<RFC3339 date>.tar.zst" to form the path of the
-	// backup object, e.g. "2019-01-06T22:38:21Z.tar.zst". N.B. no slash is
+	// backup object, e.g. "2019-01-06T22:38:21Z.tar.zst", or
+	// "<RFC3339 date>-<label>.tar.zst" if Label is set. N.B. no slash is
 	// automatically added to the end of the prefix. This is also the prefix
 	// under which we query for old backups - if it changes, unless the new
 	// value is a prefix of the old one, the previous backup will not be
@@ -51,10 +395,223 @@ type Opts struct {
 	Prefix string
 }
 
-// oldestObject returns the object with the oldest LastModified attribute within
-// a given bucket under a given prefix, or nil if no objects exist there. It
-// assumes the prefix contains <=1000 objects (no pagination is attempted).
-func oldestObject(ctx context.Context, client *s3.Client, bucket, prefix string) (*s3types.Object, error) {
+// Result describes a successfully uploaded backup. It is returned by Run, so
+// callers can record the outcome without parsing logs.
+type Result struct {
+
+	// Key is the key of the uploaded backup object within Opts.Bucket.
+	Key string
+
+	// Time is the time the key was derived from, returned by Opts.Now.
+	Time time.Time
+
+	// UncompressedBytes is the size of the tar stream.
+	UncompressedBytes uint64
+
+	// CompressedBytes is the size of the uploaded object.
+	CompressedBytes uint64
+
+	// DatabaseBytes is the size of Plex's library databases when the backup
+	// was taken, which grows with metadata rather than media. It is 0 if
+	// Opts.RemoteDirectories was set, or the databases were not found.
+	DatabaseBytes uint64
+
+	// DirectoryBytes is the total size of the files archived within each
+	// top-level directory of the backup, e.g. "Plex Media Server/Metadata",
+	// with files directly within a backed up directory counted under its
+	// base name.
+	DirectoryBytes map[string]uint64
+
+	// ExcludedBytes is the total size of the files omitted by each of the
+	// exclude patterns, so ineffective or costly ones can be spotted. A file
+	// matching several is counted under the first. It is nil if
+	// Opts.RemoteDirectories was set.
+	ExcludedBytes map[string]uint64
+
+	// Elapsed is the time taken to archive, compress and upload the backup.
+	Elapsed time.Duration
+
+	// ArchiveElapsed is the time taken by tar to read the directories. As
+	// the stages run concurrently, this is less than Elapsed only if
+	// compression or upload was the bottleneck.
+	ArchiveElapsed time.Duration
+
+	// Downtime is the time between the service being stopped and started
+	// again. It is zero if Opts.NoPause was set.
+	Downtime time.Duration
+
+	// PlexRunning is whether Plex was running when a backup was taken with
+	// Opts.NoPause, in which case it is recorded in the "plex-running"
+	// metadata of the backup object. It is false if Opts.NoPause was not set,
+	// or it could not be determined.
+	PlexRunning bool
+
+	// ChangedDatabases are the paths, relative to the parent of the
+	// directory, of the library databases and write-ahead logs modified
+	// while a backup was taken with Opts.NoPause, in which case the backup
+	// may be inconsistent. It is nil if Opts.NoPause was not set, or
+	// Opts.RemoteDirectories was.
+	ChangedDatabases []string
+
+	// PlexVersion is the version of Plex Media Server the backup was taken
+	// from, or empty if Opts.PlexURL was not set or detection failed.
+	PlexVersion string
+
+	// Label is Opts.Label.
+	Label string
+
+	// SHA256 is the hex-encoded SHA-256 digest of the uploaded object.
+	SHA256 string
+
+	// Parts are the objects holding each of Opts.Parts, in order. The sizes
+	// above are totals including them.
+	Parts []*Part
+
+	// PrunedKeys are the keys of old backups deleted after the new one was
+	// uploaded.
+	PrunedKeys []string
+
+	// PruneErr wraps ErrPrune if an old backup could not be deleted. This
+	// does not make the backup itself unsuccessful, so is not returned by
+	// Run.
+	PruneErr error
+
+	// ReplicaErr wraps ErrReplicate if the backup could not be copied to
+	// Opts.ReplicaBucket. Like PruneErr, it is not returned by Run.
+	ReplicaErr error
+
+	// VerifyErr wraps ErrVerify if Opts.Verify was set and the uploaded
+	// backup could not be read back. It is then neither replicated nor are
+	// old backups pruned. Like PruneErr, it is not returned by Run.
+	VerifyErr error
+
+	// metadata is the user-defined metadata of the backup object, which
+	// must be preserved when it is copied.
+	metadata map[string]string
+
+	// objectBytes is the size of the backup object, excluding its parts.
+	objectBytes uint64
+}
+
+// CompressionRatio returns UncompressedBytes divided by CompressedBytes, or 0
+// if the backup is empty.
+func (r *Result) CompressionRatio() float64 {
+	if r.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(r.UncompressedBytes) / float64(r.CompressedBytes)
+}
+
+// Throughput returns the mean upload rate in bytes per second, or 0 if
+// Elapsed is zero.
+func (r *Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.CompressedBytes) / r.Elapsed.Seconds()
+}
+
+// now returns the time to name the backup after.
+func (o *Opts) now() time.Time {
+	if o.Now == nil {
+		return time.Now()
+	}
+	return o.Now()
+}
+
+// Validate checks the options are complete and consistent, so problems are
+// discovered before the service is stopped. Errors wrap ErrNoBucket,
+// ErrNoService, ErrBadDirectory, ErrBadPrefix, ErrBadReplica, ErrBadLabel,
+// ErrBadPart, ErrBadRetention, ErrBadVacuum, ErrBadSeed, ErrBadRetry,
+// ErrBadReflink or ErrBadMargin. Run and Archive call this before doing
+// anything else.
+func (o *Opts) Validate() error {
+	if o.Bucket == "" {
+		return ErrNoBucket
+	}
+	if o.ReplicaBucket == o.Bucket {
+		return fmt.Errorf("%w: must differ from the bucket", ErrBadReplica)
+	}
+	if !o.NoPause && !o.Reflink && o.Service == "" {
+		return ErrNoService
+	}
+	if (len(o.StopCommand) == 0) != (len(o.StartCommand) == 0) {
+		return fmt.Errorf("%w: StopCommand and StartCommand must be specified together", ErrNoService)
+	}
+	if len(o.Directories) == 0 {
+		return fmt.Errorf("%w: no directories to back up", ErrBadDirectory)
+	}
+	seen := map[string]string{}
+	for _, directory := range o.Directories {
+		if !o.RemoteDirectories {
+			info, err := os.Stat(directory)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrBadDirectory, err)
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("%w: %v is not a directory", ErrBadDirectory, directory)
+			}
+		}
+		base := filepath.Base(directory)
+		if other, ok := seen[base]; ok {
+			return fmt.Errorf("%w: %v and %v have the same base name", ErrBadDirectory, other, directory)
+		}
+		seen[base] = directory
+	}
+	// S3 keys are at most 1024 bytes of UTF-8; we append the date, label
+	// and extension.
+	if !utf8.ValidString(o.Prefix) {
+		return fmt.Errorf("%w: not valid UTF-8", ErrBadPrefix)
+	}
+	if err := ValidLabel(o.Label); err != nil {
+		return err
+	}
+	if err := o.validateParts(); err != nil {
+		return err
+	}
+	if err := o.validateConfigPaths(); err != nil {
+		return err
+	}
+	if o.Vacuum && o.NoPause {
+		return fmt.Errorf("%w: the service must be stopped", ErrBadVacuum)
+	}
+	if o.Vacuum && o.RemoteDirectories {
+		return fmt.Errorf("%w: the databases are on another host", ErrBadVacuum)
+	}
+	if o.Reflink && o.Vacuum {
+		return fmt.Errorf("%w: the service is not stopped to vacuum them", ErrBadReflink)
+	}
+	if o.Reflink && o.RemoteDirectories {
+		return fmt.Errorf("%w: the databases are on another host", ErrBadReflink)
+	}
+	if err := o.validateSeed(); err != nil {
+		return err
+	}
+	if o.SpaceMargin != 0 && o.SpaceMargin < 1 {
+		return fmt.Errorf("%w: must be 0 or at least 1", ErrBadMargin)
+	}
+	if err := o.Retention.Validate(); err != nil {
+		return err
+	}
+	if o.NoPrune && (!o.Retention.IsZero() || o.PurgeVersions) {
+		return fmt.Errorf("%w: backups are not pruned", ErrBadRetention)
+	}
+	if err := o.Retry.Validate(); err != nil {
+		return err
+	}
+	if maxLen := 1024 - len(backupKey("", time.Time{}, o.Label)); len(o.Prefix) > maxLen {
+		return fmt.Errorf("%w: longer than %v bytes", ErrBadPrefix, maxLen)
+	}
+	return nil
+}
+
+// OldestObject returns the backup with the oldest LastModified attribute within
+// a given bucket under a given prefix, or nil if no backups exist there. Other
+// objects, such as the catalog, and labelled backups, which are never pruned,
+// are ignored. It assumes the prefix contains <=1000 objects (no pagination is
+// attempted). Run calls this before backing up to find the backup to prune
+// afterwards.
+func OldestObject(ctx context.Context, client S3API, bucket, prefix string) (*s3types.Object, error) {
 	result, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
 		Bucket: &bucket,
 		Prefix: &prefix,
@@ -65,6 +622,9 @@ func oldestObject(ctx context.Context, client *s3.Client, bucket, prefix string)
 
 	var oldest *s3types.Object
 	for _, object := range result.Contents {
+		if !isBackupKey(*object.Key) || KeyLabel(prefix, *object.Key) != "" {
+			continue
+		}
 		if oldest == nil || object.LastModified.Before(*oldest.LastModified) {
 			oldest = &object
 		}
@@ -72,133 +632,997 @@ func oldestObject(ctx context.Context, client *s3.Client, bucket, prefix string)
 	return oldest, nil
 }
 
-// backup performs the actual archive, compression and upload of the backup. It
-// blocks until the operation is complete.
-func (o *Opts) backup(ctx context.Context, logger *slog.Logger, client *s3.Client) error {
-	tar := exec.CommandContext(ctx,
-		"tar", "-cf", "-",
-		"-C", filepath.Dir(o.Directory),
-		"--exclude", "Cache",
-		"--exclude", "Crash Reports",
-		"--exclude", "Diagnostics",
-		"--exclude", "plexmediaserver.pid",
-		filepath.Base(o.Directory))
-	tar.Stderr = os.Stderr
-	tarStdoutReader, err := tar.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to get stdout pipe from tar: %w", err)
+// NewestObject returns the backup with the newest LastModified attribute
+// within a given bucket under a given prefix, or nil if no backups exist
+// there. Other objects, such as the catalog, are ignored.
+func NewestObject(ctx context.Context, client S3API, bucket, prefix string) (*s3types.Object, error) {
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	var newest *s3types.Object
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			if !isBackupKey(*object.Key) {
+				continue
+			}
+			if newest == nil || object.LastModified.After(*newest.LastModified) {
+				newest = &object
+			}
+		}
+	}
+	return newest, nil
+}
+
+// ListBackups returns the backups within a given bucket under a given prefix,
+// oldest first. Other objects, such as the catalog, are ignored.
+func ListBackups(ctx context.Context, client S3API, bucket, prefix string) ([]s3types.Object, error) {
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	var backups []s3types.Object
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			if isBackupKey(*object.Key) {
+				backups = append(backups, object)
+			}
+		}
 	}
+	slices.SortFunc(backups, func(a, b s3types.Object) int {
+		return a.LastModified.Compare(*b.LastModified)
+	})
+	return backups, nil
+}
+
+// Archive performs the archive, compression and upload of a backup, without
+// stopping the service or pruning old backups. It blocks until the operation
+// is complete. Most callers should use Run instead; this is exposed for those
+// composing their own workflow. Seeds, spanning several runs, are only
+// supported by Run.
+func Archive(ctx context.Context, logger *slog.Logger, client S3API, o *Opts) (*Result, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	if o.SeedDir != "" {
+		return nil, fmt.Errorf("%w: only supported by Run", ErrBadSeed)
+	}
+	return o.backup(ctx, logger, client, o.plexVersion(ctx, logger))
+}
+
+// abortTimeout is how long an incomplete multipart upload is given to be
+// aborted after the upload fails.
+const abortTimeout = time.Minute
+
+// abortingClient ensures an incomplete multipart upload is aborted even if the
+// upload failed because its context was cancelled, which is how the pipeline
+// stops the uploader when another stage fails. The uploader would otherwise
+// make the abort request with the cancelled context, leaving the parts
+// uploaded so far to incur storage costs indefinitely.
+type abortingClient struct {
+	S3API
+}
+
+func (c abortingClient) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+	return c.S3API.AbortMultipartUpload(ctx, in, optFns...)
+}
+
+// errAborted is passed between the stages of the backup pipeline when one
+// fails, so the others stop and are not reported as failing themselves.
+var errAborted = errors.New("aborted due to failure of another stage")
+
+// stream is a single pipeline of tar, compression and upload, producing the
+// backup object or one of its parts.
+type stream struct {
+	key      string
+	name     string
+	args     []string
+	metadata map[string]string
+
+	tarStdoutReader, zstdReader *io.PipeReader
+	tarStdoutWriter, zstdWriter *io.PipeWriter
+	enc                         compressor
+	encrypter                   *encrypter
+
+	// summer computes the trailer appended to the output of enc, counted
+	// by compressed.
+	summer     *archiveSummer
+	compressed *countingWriter
+
+	// archived counts the bytes produced by tar, and uploaded those
+	// consumed by the uploader.
+	archived, uploaded *countingreader.Reader
+	digest             hash.Hash
+
+	// dedup, if non-nil, deduplicates the files in archived before they
+	// are compressed.
+	dedup *deduplicator
 
-	// Turns the bytes written by zstd into something that can be read by the
-	// AWS SDK.
-	zstdReader, zstdWriter := io.Pipe()
+	// staged, if non-nil, is the file in Opts.SeedDir the object is written
+	// to instead of being uploaded.
+	staged *os.File
 
-	enc, err := zstd.NewWriter(zstdWriter)
+	uncompressedBytes int64
+	archiveElapsed    time.Duration
+
+	// complete is set once the object has been uploaded.
+	complete bool
+
+	// Each stage's error is recorded separately, so all root causes are
+	// reported rather than only the first. Errors caused by another stage
+	// failing are replaced by errAborted.
+	tarErr, compressErr, uploadErr error
+}
+
+// newStream prepares a stream running the tar command name with args, and
+// uploading its output to key. Nothing is started.
+func (o *Opts) newStream(ctx, groupCtx context.Context, logger *slog.Logger, key, name string, args []string, metadata map[string]string) (*stream, error) {
+	s := &stream{
+		key:      key,
+		name:     name,
+		args:     args,
+		metadata: metadata,
+		digest:   sha256.New(),
+	}
+	s.tarStdoutReader, s.tarStdoutWriter = io.Pipe()
+	// Turns the bytes written by zstd into something that can be read by
+	// the AWS SDK.
+	s.zstdReader, s.zstdWriter = io.Pipe()
+
+	// With encryption, zstd writes to the encrypter, which writes to the
+	// pipe. Each stream has its own data key, as segment nonces are only
+	// unique within a stream.
+	var compressed io.Writer = s.zstdWriter
+	if len(o.KMSKeyIDs) > 0 {
+		dataKey, err := generateDataKey(ctx, o.KMS, o.KMSKeyIDs)
+		if err != nil {
+			return nil, err
+		}
+		if s.encrypter, err = newEncrypter(s.zstdWriter, dataKey.plaintext); err != nil {
+			return nil, err
+		}
+		compressed = s.encrypter
+		if s.metadata == nil {
+			s.metadata = map[string]string{}
+		}
+		maps.Copy(s.metadata, dataKey.metadata)
+	}
+	s.compressed = &countingWriter{w: compressed}
+	var err error
+	if o.AdaptiveCompression {
+		window, concurrency := o.encoderLimits()
+		s.enc, err = newAdaptiveEncoder(s.compressed, window, concurrency)
+	} else {
+		s.enc, err = zstd.NewWriter(s.compressed, o.encoderOptions()...)
+	}
 	if err != nil {
+		return nil, err
+	}
+	var tarOutput io.Reader = s.tarStdoutReader
+	if o.MaxReadRate > 0 {
+		// tar blocks writing to the pipe, so this also limits its reads.
+		tarOutput = ratelimit.New(groupCtx, tarOutput, o.MaxReadRate)
+	}
+	s.archived = countingreader.New(tarOutput)
+	if o.SeedDir != "" {
+		// The upload window applies to the chunks, not staging.
+		if s.staged, err = os.Create(filepath.Join(o.SeedDir, seedArchiveName)); err != nil {
+			return nil, fmt.Errorf("failed to stage archive: %w", err)
+		}
+		s.uploaded = countingreader.New(s.zstdReader)
+	} else {
+		s.uploaded = countingreader.New(o.newWindowReader(groupCtx, logger, key, s.zstdReader))
+	}
+	if o.Deduplicate {
+		s.dedup = newDeduplicator(s.archived)
+	}
+	return s, nil
+}
+
+// runStream starts the stages of s in group. If one stage fails, the others are
+// aborted via the pipes and the group's context, so none are left blocked;
+// the same happens to every other stream in the group.
+func (o *Opts) runStream(ctx, groupCtx context.Context, group *errgroup.Group, client S3API, s *stream, start time.Time) {
+	group.Go(func() error {
+		_, span := tracer.Start(ctx, "tar", trace.WithAttributes(
+			attribute.String("key", s.key)))
+		err := endSpan(span, o.runner().Run(groupCtx, s.tarStdoutWriter, s.name, s.args...))
+		if err == nil {
+			s.archiveElapsed = time.Since(start)
+			// Signals EOF to the compressor.
+			s.tarStdoutWriter.Close()
+			return nil
+		}
+		if groupCtx.Err() != nil {
+			// Killed because another stage failed.
+			err = errAborted
+		}
+		s.tarStdoutWriter.CloseWithError(errAborted)
+		s.tarErr = err
 		return err
+	})
+	group.Go(func() error {
+		_, span := tracer.Start(ctx, "compress", trace.WithAttributes(
+			attribute.String("key", s.key)))
+		var err error
+		var archive io.Reader = s.archived
+		if s.dedup != nil {
+			archive = s.dedup
+		}
+		s.summer = newArchiveSummer()
+		s.uncompressedBytes, err = s.enc.ReadFrom(io.TeeReader(archive, s.summer))
+		// Close flushes the final frame, so must complete before the
+		// uploader sees EOF.
+		err = errors.Join(err, s.enc.Close())
+		trailer := s.summer.Close(s.compressed.bytes)
+		if err == nil {
+			err = appendTrailer(s.compressed, trailer)
+		}
+		if s.encrypter != nil && err == nil {
+			err = s.encrypter.Close()
+		}
+		span.SetAttributes(attribute.Int64("uncompressed_bytes", s.uncompressedBytes))
+		if endSpan(span, err) == nil {
+			s.zstdWriter.Close()
+			return nil
+		}
+		// Checked before closing the pipes, which causes the other
+		// stages to fail and cancel groupCtx. The read rate limit fails
+		// with groupCtx's error if another stage already has.
+		if errors.Is(err, errAborted) || groupCtx.Err() != nil {
+			err = errAborted
+		}
+		s.zstdWriter.CloseWithError(errAborted)
+		s.tarStdoutReader.CloseWithError(errAborted)
+		s.compressErr = err
+		return err
+	})
+	group.Go(func() error {
+		uploadCtx, span := tracer.Start(groupCtx, "upload", trace.WithAttributes(
+			attribute.String("bucket", o.Bucket),
+			attribute.String("key", s.key)))
+		input := &s3.PutObjectInput{
+			Bucket: &o.Bucket,
+			Key:    &s.key,
+			Body:   io.TeeReader(s.uploaded, s.digest),
+			// Keys only have second precision, so may collide, e.g. if
+			// two hosts share a prefix. Fail rather than silently replace
+			// the existing backup.
+			IfNoneMatch: aws.String("*"),
+		}
+		input.Metadata = s.metadata
+		var err error
+		if s.staged != nil {
+			_, err = io.Copy(s.staged, input.Body)
+			err = errors.Join(err, s.staged.Sync(), s.staged.Close())
+		} else {
+			_, err = s3manager.NewUploader(abortingClient{client}, o.uploaderOptions()...).Upload(uploadCtx, input)
+		}
+		span.SetAttributes(attribute.Int64("compressed_bytes", int64(s.uploaded.ReadBytes.Load())))
+		if endSpan(span, err) == nil {
+			s.complete = true
+			return nil
+		}
+		// Checked before closing the pipe, which causes the compressor to
+		// fail and cancel groupCtx.
+		if errors.Is(err, errAborted) || groupCtx.Err() != nil {
+			err = errAborted
+		}
+		if isConflict(err) {
+			err = fmt.Errorf("%v already exists: %w", s.key, err)
+		}
+		s.zstdReader.CloseWithError(errAborted)
+		s.uploadErr = err
+		return err
+	})
+}
+
+// errs returns the root causes of the stream's failure, or nil if it did not
+// fail, or was only aborted. part indicates the stream is of a part, whose
+// key is then included.
+func (s *stream) errs(part bool) []error {
+	of := ""
+	if part {
+		of = " of " + s.key
+	}
+	var errs []error
+	if s.tarErr != nil && s.tarErr != errAborted {
+		errs = append(errs, fmt.Errorf("%w: tar%v failed with error: %w", ErrArchive, of, s.tarErr))
+	}
+	if s.compressErr != nil && s.compressErr != errAborted {
+		errs = append(errs, fmt.Errorf("%w: zstd%v completed with error: %w", ErrArchive, of, s.compressErr))
+	}
+	if s.uploadErr != nil && s.uploadErr != errAborted {
+		errs = append(errs, fmt.Errorf("%w: %w", ErrUpload, s.uploadErr))
 	}
+	return errs
+}
+
+// backup performs the actual archive, compression and upload of the backup. It
+// blocks until the operation is complete. plexVersion is recorded in the
+// object's metadata if non-empty. Each of o.Parts is archived, compressed and
+// uploaded concurrently with the rest.
+func (o *Opts) backup(ctx context.Context, logger *slog.Logger, client S3API, plexVersion string) (*Result, error) {
+	excludes := o.excludes()
+	// Streams run concurrently in one group, so if one fails, the rest are
+	// aborted.
+	group, groupCtx := errgroup.WithContext(ctx)
 
-	type compressResult struct {
-		UncompressedBytes uint64
-		Error             error
+	now := o.now().UTC().Truncate(time.Second)
+	key := backupKey(o.Prefix, now, o.Label)
+	metadata := objectMetadata(plexVersion, o.Label, len(o.Parts))
+	check := o.checkConsistency(ctx, logger)
+	if check != nil && check.running {
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata["plex-running"] = "true"
 	}
 
-	compressResultChan := make(chan compressResult)
-	go func() {
-		uncompressedBytes, err := enc.ReadFrom(tarStdoutReader)
-		compressResultChan <- compressResult{uint64(uncompressedBytes), err}
-	}()
+	// The memory and rate limits are shared between the streams.
+	so := *o
+	if n := int64(1 + len(o.Parts)); n > 1 {
+		if so.MaxMemory > 0 {
+			so.MaxMemory = max(so.MaxMemory/n, 1)
+		}
+		if so.MaxReadRate > 0 {
+			so.MaxReadRate = max(so.MaxReadRate/n, 1)
+		}
+		if so.OutsideWindowRate > 0 {
+			so.OutsideWindowRate = max(so.OutsideWindowRate/n, 1)
+		}
+	}
+	name, args := o.ArchiveCommand()
+	main, err := so.newStream(ctx, groupCtx, logger, key, name, args, metadata)
+	if err != nil {
+		return nil, err
+	}
+	streams := []*stream{main}
+	for i, part := range o.Parts {
+		name, args := o.partArchiveCommand(part)
+		s, err := so.newStream(ctx, groupCtx, logger, partKey(key, i+1), name, args, objectMetadata(plexVersion, o.Label, 0))
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, s)
+	}
+	start := time.Now()
+
+	// The directories are measured in the background, so as not to delay
+	// the start of the backup, both to estimate its progress and to report
+	// what the excludes omitted.
+	var estimate atomic.Uint64
+	var measured chan *treeSize
+	if !o.RemoteDirectories {
+		measured = make(chan *treeSize, 1)
+		go func() {
+			size := measureTree(ctx, o.Directories, excludes)
+			estimate.Store(size.included)
+			measured <- size
+		}()
+	}
+	if (o.OnProgress != nil || o.Hooks != nil) && o.ProgressInterval > 0 {
+		progressCtx, stopProgress := context.WithCancel(ctx)
+		defer stopProgress()
+		go o.reportProgress(progressCtx, start, &estimate, streams)
+	}
+
+	var dbBytes uint64
+	if !o.RemoteDirectories {
+		dbBytes = databaseBytes(o.Directories)
+	}
+
+	o.hooks().OnArchiveStarted(ctx, key)
+	for _, s := range streams {
+		so.runStream(ctx, groupCtx, group, client, s, start)
+	}
+
+	if err := group.Wait(); err != nil {
+		var errs []error
+		for i, s := range streams {
+			errs = append(errs, s.errs(i > 0)...)
+		}
+		o.deleteStreams(ctx, logger, client, streams)
+		if len(errs) == 0 {
+			// Every stage was aborted, so the caller must have cancelled
+			// ctx.
+			return nil, cancelled(ctx, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	for _, s := range streams {
+		if s.staged != nil {
+			continue
+		}
+		if err := o.checkUploaded(ctx, client, s.key, s.uploaded.ReadBytes.Load()); err != nil {
+			o.deleteStreams(ctx, logger, client, streams)
+			return nil, fmt.Errorf("%w: %w", ErrUpload, err)
+		}
+	}
+
+	result := &Result{
+		Key:         key,
+		Time:        now,
+		SHA256:      hex.EncodeToString(main.digest.Sum(nil)),
+		PlexVersion: plexVersion,
+		Label:       o.Label,
+		metadata:    main.metadata,
+		objectBytes: main.uploaded.ReadBytes.Load(),
+
+		DirectoryBytes: map[string]uint64{},
+	}
+	for i, s := range streams {
+		for directory, bytes := range s.summer.directoryBytes {
+			result.DirectoryBytes[directory] += bytes
+		}
+		result.UncompressedBytes += uint64(s.uncompressedBytes)
+		result.CompressedBytes += s.uploaded.ReadBytes.Load()
+		result.ArchiveElapsed = max(result.ArchiveElapsed, s.archiveElapsed)
+		if i > 0 {
+			result.Parts = append(result.Parts, &Part{
+				Key:               s.key,
+				UncompressedBytes: uint64(s.uncompressedBytes),
+				CompressedBytes:   s.uploaded.ReadBytes.Load(),
+				SHA256:            hex.EncodeToString(s.digest.Sum(nil)),
+				metadata:          s.metadata,
+			})
+		}
+	}
+	result.DatabaseBytes = dbBytes
+	if check != nil {
+		result.PlexRunning = check.running
+		result.ChangedDatabases = check.finish(ctx, logger, o.Directories)
+	}
+	if measured != nil {
+		result.ExcludedBytes = (<-measured).excluded
+	}
+	result.Elapsed = time.Since(start)
+	message := "uploaded backup"
+	if o.SeedDir != "" {
+		message = "staged seed"
+	}
+	logger.InfoContext(ctx, message,
+		slog.String("key", result.Key),
+		slog.Int("parts", len(result.Parts)),
+		slog.String("plex_version", result.PlexVersion),
+		slog.Duration("elapsed", result.Elapsed),
+		slog.Duration("archive_elapsed", result.ArchiveElapsed),
+		slog.Uint64("uncompressed_bytes", result.UncompressedBytes),
+		slog.Uint64("compressed_bytes", result.CompressedBytes),
+		slog.Float64("compression_ratio", result.CompressionRatio()),
+		slog.Uint64("database_bytes", result.DatabaseBytes),
+		slog.Float64("upload_mb_per_second", result.Throughput()/1e6))
+	logger.InfoContext(ctx, "archived directories",
+		slog.Any("directory_bytes", result.DirectoryBytes),
+		slog.Any("excluded_bytes", result.ExcludedBytes))
+	if o.AdaptiveCompression {
+		var chunks, stored uint64
+		for _, s := range streams {
+			a := s.enc.(*adaptiveEncoder)
+			chunks += a.chunks.Load()
+			stored += a.stored.Load()
+		}
+		logger.InfoContext(ctx, "compressed adaptively",
+			slog.Uint64("chunks", chunks),
+			slog.Uint64("stored_chunks", stored))
+	}
+	if o.Deduplicate {
+		var linked, linkedBytes uint64
+		for _, s := range streams {
+			linked += s.dedup.linked.Load()
+			linkedBytes += s.dedup.linkedBytes.Load()
+		}
+		logger.InfoContext(ctx, "deduplicated files",
+			slog.Uint64("linked_files", linked),
+			slog.Uint64("linked_bytes", linkedBytes))
+	}
 
-	uploader := s3manager.NewUploader(client)
-	key := o.Prefix + time.Now().UTC().Format(time.RFC3339) + ".tar.zst"
-	reader := countingreader.New(zstdReader)
-	uploadErr := make(chan error)
-	go func() {
-		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+	return result, nil
+}
+
+// deleteStreams deletes the objects of a failed backup with parts that were
+// uploaded before the failure, so an incomplete backup is not mistaken for the
+// newest. A backup without parts is a single object, so nothing is uploaded
+// if it fails. Failure is only logged.
+func (o *Opts) deleteStreams(ctx context.Context, logger *slog.Logger, client S3API, streams []*stream) {
+	if len(streams) == 1 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+	for _, s := range streams {
+		if !s.complete {
+			continue
+		}
+		if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
 			Bucket: &o.Bucket,
-			Key:    &key,
-			Body:   reader,
-		})
-		uploadErr <- err
+			Key:    &s.key,
+		}); err != nil {
+			logger.WarnContext(ctx, "failed to delete object of failed backup",
+				slog.String("key", s.key),
+				slog.String("error", err.Error()))
+		}
+	}
+}
+
+// checkUploaded confirms the object at key exists with the expected size once
+// the uploader has returned, catching silent truncation, e.g. by a proxy,
+// before the previous backup is pruned. A truncated object is deleted, so it
+// is not mistaken for the newest backup later.
+func (o *Opts) checkUploaded(ctx context.Context, client S3API, key string, size uint64) (err error) {
+	ctx, span := tracer.Start(ctx, "check upload", trace.WithAttributes(
+		attribute.String("key", key)))
+	defer func() {
+		endSpan(span, err)
 	}()
 
-	start := time.Now()
+	output, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &o.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to find %v after uploading: %w", key, err)
+	}
+	if output.ContentLength != nil && uint64(*output.ContentLength) == size {
+		return nil
+	}
+	length := int64(-1)
+	if output.ContentLength != nil {
+		length = *output.ContentLength
+	}
+	err = fmt.Errorf("%v is %v bytes, expected %v", key, length, size)
+	if _, deleteErr := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &o.Bucket,
+		Key:    &key,
+	}); deleteErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to delete %v: %w", key, deleteErr))
+	}
+	return err
+}
 
-	if err = tar.Run(); err != nil {
-		return fmt.Errorf("tar failed with error: %w", err)
+// reportProgress calls OnProgress and Hooks every ProgressInterval until ctx is
+// cancelled. estimate holds the expected size of the archive once known.
+func (o *Opts) reportProgress(ctx context.Context, start time.Time, estimate *atomic.Uint64, streams []*stream) {
+	ticker := time.NewTicker(o.ProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			progress := Progress{
+				EstimatedBytes: estimate.Load(),
+				Elapsed:        time.Since(start),
+			}
+			for _, s := range streams {
+				progress.ArchivedBytes += s.archived.ReadBytes.Load()
+				progress.UploadedBytes += s.uploaded.ReadBytes.Load()
+			}
+			if o.OnProgress != nil {
+				o.OnProgress(progress)
+			}
+			o.hooks().OnUploadProgress(ctx, progress)
+		}
 	}
+}
+
+// StopService stops the named systemd unit by using r to run sudo systemctl.
+// The error wraps ErrStop.
+func StopService(ctx context.Context, r Runner, service string) error {
+	return controlService(ctx, r, "stop", service, []string{"sudo", "systemctl", "stop", service})
+}
 
-	zstdResult := <-compressResultChan
-	if err := zstdResult.Error; err != nil {
-		return fmt.Errorf("zstd completed with error: %w", err)
+// StartService starts the named systemd unit by using r to run sudo
+// systemctl. The error wraps ErrStart.
+func StartService(ctx context.Context, r Runner, service string) error {
+	return controlService(ctx, r, "start", service, []string{"sudo", "systemctl", "start", service})
+}
+
+// controlService uses r to run command, which stops or starts service
+// depending on action. The error wraps ErrStop or ErrStart accordingly.
+func controlService(ctx context.Context, r Runner, action, service string, command []string) error {
+	ctx, span := tracer.Start(ctx, action+" service", trace.WithAttributes(
+		attribute.String("service", service)))
+	err := r.Run(ctx, nil, command[0], command[1:]...)
+	if err != nil && ctx.Err() != nil {
+		// The command was killed, which is only a symptom.
+		err = context.Cause(ctx)
+	}
+	if endSpan(span, err) != nil {
+		sentinel := ErrStop
+		if action == "start" {
+			sentinel = ErrStart
+		}
+		return fmt.Errorf("%w %v: %w", sentinel, service, err)
+	}
+	return nil
+}
+
+// ControlService stops or starts the service and o.ExtraServices depending on
+// action, "stop" or "start". The error wraps ErrStop or ErrStart accordingly.
+// Stopping is bounded by o.StopTimeout. If a service fails to stop, it and
+// those already stopped are started again. All services are started even if
+// some fail to.
+func (o *Opts) ControlService(ctx context.Context, action string) error {
+	services := append([]string{o.Service}, o.ExtraServices...)
+	if action == "start" {
+		return o.startServices(ctx, services)
+	}
+	if o.StopTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, o.StopTimeout,
+			fmt.Errorf("did not stop within %v", o.StopTimeout))
+		defer cancel()
+	}
+	for i, service := range services {
+		if err := controlService(ctx, o.runner(), action, service, o.serviceCommand(action, service)); err != nil {
+			// Leave things as we found them. The failed service is
+			// included, as it may still be stopping, e.g. if it timed out.
+			startCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), startTimeout)
+			defer cancel()
+			return errors.Join(err, o.startServices(startCtx, services[:i+1]))
+		}
 	}
+	return nil
+}
 
-	if err := enc.Close(); err != nil {
-		return fmt.Errorf("failed to close zstd stream: %w", err)
+// startServices starts services in reverse order, continuing past failures.
+func (o *Opts) startServices(ctx context.Context, services []string) error {
+	var errs []error
+	for _, service := range slices.Backward(services) {
+		errs = append(errs, controlService(ctx, o.runner(), "start", service, o.serviceCommand("start", service)))
 	}
+	return errors.Join(errs...)
+}
 
-	// Should indicate to the S3 uploader that we are done, so it returns.
-	zstdWriter.Close()
+// serviceCommand returns the command to stop or start service, depending on
+// action. o.StopCommand and o.StartCommand only apply to o.Service.
+func (o *Opts) serviceCommand(action, service string) []string {
+	command := o.StopCommand
+	if action == "start" {
+		command = o.StartCommand
+	}
+	if len(command) == 0 || service != o.Service {
+		command = []string{"sudo", "systemctl", action, service}
+	}
+	return command
+}
 
-	if err := <-uploadErr; err != nil {
-		return fmt.Errorf("failed to upload new backup: %w", err)
+// replicaClient returns o.ReplicaClient, or client if it is nil.
+func (o *Opts) replicaClient(client S3API) S3API {
+	if o.ReplicaClient == nil {
+		return client
+	}
+	return o.ReplicaClient
+}
+
+// objectMetadata returns the user-defined metadata of a backup object, or
+// one of its parts, which have no parts of their own.
+func objectMetadata(plexVersion, label string, parts int) map[string]string {
+	metadata := map[string]string{}
+	if plexVersion != "" {
+		metadata["plex-version"] = plexVersion
+	}
+	if label != "" {
+		metadata["label"] = label
+	}
+	if parts > 0 {
+		metadata["parts"] = strconv.Itoa(parts)
 	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
 
-	logger.InfoContext(ctx, "uploaded backup",
-		slog.String("key", key),
-		slog.Duration("elapsed", time.Since(start)),
-		slog.Uint64("uncompressed_bytes", zstdResult.UncompressedBytes),
-		slog.Uint64("compressed_bytes", reader.ReadBytes))
+// Prune deletes the backup with the provided key, usually that returned by
+// OldestObject before the latest backup was taken, along with its parts. The
+// parts are deleted first, so a failure part way leaves the backup listed
+// to be pruned again. The error wraps ErrPrune.
+func Prune(ctx context.Context, client S3API, bucket, key string) (err error) {
+	ctx, span := tracer.Start(ctx, "prune", trace.WithAttributes(
+		attribute.String("key", key)))
+	defer func() {
+		endSpan(span, err)
+	}()
 
+	parts, err := PartKeys(ctx, client, bucket, key)
+	if err != nil {
+		return fmt.Errorf("%w %v: failed to list parts: %w", ErrPrune, key, err)
+	}
+	for _, object := range append(parts, key) {
+		if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &bucket,
+			Key:    &object,
+		}); err != nil {
+			return fmt.Errorf("%w %v: %w", ErrPrune, object, err)
+		}
+	}
 	return nil
 }
 
+// startTimeout is how long the service is given to start after the backup,
+// which is independent of the context passed to Run.
+const startTimeout = 5 * time.Minute
+
+// cancelled returns ctx.Err() if ctx has been cancelled, otherwise err. When
+// ctx is cancelled, the killed tar or aborted upload is only a symptom.
+func cancelled(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
 // Run stops Plex, performs the backup, then starts Plex again. It should
-// ideally be run soon after the server maintenance period.
-func Run(ctx context.Context, logger *slog.Logger, client *s3.Client, o *Opts) error {
-	oldest, err := oldestObject(ctx, client, o.Bucket, o.Prefix)
-	if err != nil {
-		return fmt.Errorf("failed to retrieve oldest backup: %w", err)
+// ideally be run soon after the server maintenance period. A description of
+// the new backup is returned if the operation succeeds, or alongside the error
+// if only starting Plex again failed. If a TracerProvider has been registered
+// with the otel package, a span is created for each phase. With
+// Opts.SeedDir, Plex is started again once the archive has been staged, before
+// it is uploaded.
+//
+// If ctx is cancelled, tar is killed and the upload aborted, but the service
+// is still started again before Run returns ctx.Err() (joined with any error
+// starting the service). Callers should therefore allow Run to return rather
+// than exiting as soon as they cancel ctx.
+//
+// If the run fails with an error Opts.Retry retries, it is repeated from the
+// start after a delay, and the outcome of the last attempt returned.
+//
+// Run is a composition of OldestObject, StopService, Archive, StartService,
+// Replicate and Prune, which may be called individually to build a different
+// workflow.
+func Run(ctx context.Context, logger *slog.Logger, client S3API, o *Opts) (*Result, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
 	}
+	return o.Retry.retry(ctx, logger, func() (*Result, error) {
+		return o.run(ctx, logger, client)
+	})
+}
+
+// run performs a single attempt of Run.
+func (o *Opts) run(ctx context.Context, logger *slog.Logger, client S3API) (result *Result, err error) {
+	ctx, span := tracer.Start(ctx, "Run", trace.WithAttributes(
+		attribute.String("bucket", o.Bucket),
+		attribute.String("prefix", o.Prefix),
+		attribute.Bool("no_pause", o.NoPause)))
+	defer func() {
+		endSpan(span, err)
+	}()
 
-	if !o.NoPause {
-		logger.DebugContext(ctx, "stopping Plex")
-		if err = exec.CommandContext(ctx, "sudo", "systemctl", "stop", o.Service).Run(); err != nil {
-			return fmt.Errorf("failed to stop plex: %w", err)
+	// A labelled backup is taken in addition to the regular one, so does
+	// not replace it.
+	var oldest *s3types.Object
+	if o.Label == "" && o.Retention.IsZero() && !o.NoPrune {
+		if oldest, err = OldestObject(ctx, client, o.Bucket, o.Prefix); err != nil {
+			return nil, fmt.Errorf("failed to retrieve oldest backup: %w", err)
 		}
-		logger.DebugContext(ctx, "stopped Plex")
 	}
 
-	if err = o.backup(ctx, logger, client); err != nil {
-		return err
+	// A seed staged by an earlier run is resumed without stopping the
+	// service or archiving again.
+	var seed *seedState
+	if o.SeedDir != "" {
+		if seed, err = o.loadSeed(); err != nil {
+			return nil, err
+		}
+	}
+	pause := !o.NoPause && !o.Reflink && seed == nil
+	if seed == nil {
+		if err = o.ensureSpace(ctx, logger, client); err != nil {
+			return nil, err
+		}
 	}
 
-	// We could have deferred this after stopping plex, however this would not
-	// allow us to report an error - this way the caller can be confident Plex
-	// is running if they get back a nil error.
-	if !o.NoPause {
-		logger.DebugContext(ctx, "starting Plex")
-		if err = exec.CommandContext(ctx, "sudo", "systemctl", "start", o.Service).Run(); err != nil {
-			return fmt.Errorf("failed to start plex: %w", err)
+	// The API is only available while Plex is running.
+	plexVersion := o.plexVersion(ctx, logger)
+
+	var stopped time.Time
+	if pause {
+		logger.DebugContext(ctx, "stopping service", slog.String("service", o.Service))
+		if err = o.ControlService(ctx, "stop"); err != nil {
+			return nil, err
+		}
+		stopped = time.Now()
+		logger.DebugContext(ctx, "stopped service", slog.String("service", o.Service))
+		o.hooks().OnServiceStopped(ctx, o.Service)
+	}
+	if o.Vacuum && seed == nil {
+		o.vacuum(ctx, logger)
+	}
+	if o.Reflink && seed == nil {
+		var remove func()
+		if remove, err = o.reflinkDatabases(ctx, logger); err != nil {
+			return nil, err
+		}
+		defer remove()
+	}
+
+	var backupErr error
+	if seed == nil {
+		result, backupErr = o.backup(ctx, logger, client, plexVersion)
+	}
+
+	// The service is started again whether or not the backup succeeded, even
+	// if ctx has been cancelled. We could have deferred this after stopping
+	// the service, however this would not allow us to report an error - this
+	// way the caller can be confident it is running if they get back a nil
+	// error, or an error not wrapping ErrStart.
+	if pause {
+		logger.DebugContext(ctx, "starting service", slog.String("service", o.Service))
+		startCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), startTimeout)
+		defer cancel()
+		if err = o.ControlService(startCtx, "start"); err != nil {
+			if backupErr != nil {
+				return nil, errors.Join(cancelled(ctx, backupErr), err)
+			}
+			// The backup itself succeeded, so the caller may still want
+			// to record it.
+			return result, err
+		}
+		o.AwaitPlex(startCtx, logger)
+		downtime := time.Since(stopped)
+		// Logged at info level so the window can be tracked over time.
+		logger.InfoContext(ctx, "started service",
+			slog.String("service", o.Service),
+			slog.Duration("downtime", downtime))
+		o.hooks().OnServiceStarted(ctx, o.Service, downtime)
+		if result != nil {
+			result.Downtime = downtime
+		}
+	}
+	if backupErr != nil {
+		if o.SeedDir != "" {
+			os.Remove(filepath.Join(o.SeedDir, seedArchiveName))
+		}
+		return nil, cancelled(ctx, backupErr)
+	}
+	if o.SeedDir != "" {
+		staged := result
+		if seed == nil {
+			if seed, err = o.newSeed(staged); err != nil {
+				return nil, err
+			}
+		}
+		if result, err = o.uploadSeed(ctx, logger, client, seed); err != nil {
+			return nil, cancelled(ctx, err)
+		}
+		if staged != nil {
+			result.Downtime = staged.Downtime
+		}
+	}
+
+	// Failures from here on are logged rather than returned, as they are not
+	// failures of the backup itself.
+	if o.Verify {
+		logger.DebugContext(ctx, "verifying backup", slog.String("key", result.Key))
+		entries, err := o.verifyResult(ctx, client, result)
+		if err != nil {
+			result.VerifyErr = err
+			logger.ErrorContext(ctx, "failed to verify backup",
+				slog.String("key", result.Key),
+				slog.String("error", err.Error()))
+		} else {
+			logger.DebugContext(ctx, "verified backup",
+				slog.String("key", result.Key),
+				slog.Int("entries", entries))
 		}
-		logger.DebugContext(ctx, "started Plex")
 	}
 
+	if o.ReplicaBucket != "" && result.VerifyErr == nil {
+		if result.ReplicaErr = Replicate(ctx, o.replicaClient(client), o.Bucket, o.ReplicaBucket, result); result.ReplicaErr != nil {
+			logger.WarnContext(ctx, "failed to replicate backup",
+				slog.String("replica_bucket", o.ReplicaBucket),
+				slog.String("error", result.ReplicaErr.Error()))
+		} else {
+			logger.DebugContext(ctx, "replicated backup",
+				slog.String("replica_bucket", o.ReplicaBucket))
+		}
+	}
+
+	// With the default policy, the oldest backup is known before the run;
+	// otherwise, the new backup changes which the policy keeps, so they are
+	// only listed now.
+	var candidates []*PruneCandidate
 	if oldest != nil {
-		_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
-			Bucket: &o.Bucket,
-			Key:    oldest.Key,
+		candidates = append(candidates, &PruneCandidate{
+			Key:          *oldest.Key,
+			LastModified: *oldest.LastModified,
+			Reason:       RetentionRule,
 		})
-		if err != nil {
-			// Not regarded as significant enough to report.
+	} else if o.Label == "" && !o.NoPrune && result.VerifyErr != nil {
+		logger.WarnContext(ctx, "not deleting old backups as the new one failed verification")
+	} else if o.Label == "" && !o.NoPrune {
+		var err error
+		if candidates, err = PrunePlan(ctx, client, o.Bucket, o.Prefix, o.Retention); err != nil {
+			result.PruneErr = fmt.Errorf("failed to list backups: %w", err)
+			logger.WarnContext(ctx, "failed to list old backups",
+				slog.String("error", err.Error()))
+		}
+	}
+	if len(candidates) > 0 && result.VerifyErr != nil {
+		logger.WarnContext(ctx, "not deleting old backup as the new one failed verification",
+			slog.String("key", candidates[0].Key))
+		candidates = nil
+	}
+	for _, candidate := range candidates {
+		if err := Prune(ctx, client, o.Bucket, candidate.Key); err != nil {
 			logger.WarnContext(ctx, "failed to delete old backup",
-				slog.String("key", *oldest.Key),
+				slog.String("key", candidate.Key),
 				slog.String("error", err.Error()))
+			result.PruneErr = errors.Join(result.PruneErr, err)
 		} else {
-			logger.DebugContext(ctx, "deleted oldest backup",
-				slog.String("key", *oldest.Key))
+			// Logged at info level so every deletion is accounted for.
+			logger.InfoContext(ctx, "deleted old backup",
+				slog.String("key", candidate.Key),
+				slog.Time("last_modified", candidate.LastModified),
+				slog.String("reason", candidate.Reason))
+			result.PrunedKeys = append(result.PrunedKeys, candidate.Key)
+			o.hooks().OnPruned(ctx, candidate.Key)
+		}
+		// The replica is pruned even if the backup failed to replicate, so
+		// it does not accumulate backups.
+		if o.ReplicaBucket != "" {
+			if err := Prune(ctx, o.replicaClient(client), o.ReplicaBucket, candidate.Key); err != nil {
+				logger.WarnContext(ctx, "failed to delete old backup from replica",
+					slog.String("key", candidate.Key),
+					slog.String("replica_bucket", o.ReplicaBucket),
+					slog.String("error", err.Error()))
+				result.PruneErr = errors.Join(result.PruneErr, err)
+			}
 		}
 	}
 
-	return nil
+	if o.PurgeVersions && result.VerifyErr == nil {
+		purged, err := PurgeVersions(ctx, client, o.Bucket, o.Prefix)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to purge old versions",
+				slog.String("error", err.Error()))
+			result.PruneErr = errors.Join(result.PruneErr, err)
+		} else {
+			logger.DebugContext(ctx, "purged old versions",
+				slog.Int("versions", purged))
+		}
+	}
+
+	if o.Catalog {
+		o.updateCatalog(ctx, logger, client, func(catalog *Catalog) {
+			catalog.Backups = append(catalog.Backups, &CatalogEntry{
+				Key:               result.Key,
+				Time:              result.Time,
+				UncompressedBytes: result.UncompressedBytes,
+				CompressedBytes:   result.CompressedBytes,
+				DatabaseBytes:     result.DatabaseBytes,
+				SHA256:            result.SHA256,
+				PlexVersion:       result.PlexVersion,
+				Label:             result.Label,
+				Parts:             len(result.Parts),
+				ToolVersion:       o.ToolVersion,
+				DurationSeconds:   result.Elapsed.Seconds(),
+				DowntimeSeconds:   result.Downtime.Seconds(),
+				ChangedDatabases:  result.ChangedDatabases,
+				Status:            CatalogAvailable,
+			})
+			for _, key := range result.PrunedKeys {
+				if entry := catalog.Entry(key); entry != nil {
+					entry.Status = CatalogPruned
+				}
+			}
+		})
+	}
+
+	return result, nil
 }
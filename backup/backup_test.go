@@ -0,0 +1,218 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3 is an in-memory bucket implementing the subset of S3API needed to
+// take a backup. Other methods panic.
+type fakeS3 struct {
+	S3API
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:  map[string][]byte{},
+		metadata: map[string]map[string]string{},
+	}
+}
+
+func (f *fakeS3) PutObject(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[*input.Key] = body
+	f.metadata[*input.Key] = maps.Clone(input.Metadata)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, input *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.objects[*input.Key]
+	if !ok {
+		return nil, &s3types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(body))),
+		Metadata:      maps.Clone(f.metadata[*input.Key]),
+	}, nil
+}
+
+func (f *fakeS3) GetObject(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.objects[*input.Key]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: aws.Int64(int64(len(body))),
+		Metadata:      maps.Clone(f.metadata[*input.Key]),
+	}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(_ context.Context, input *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &s3.ListObjectsV2Output{}
+	for _, key := range slices.Sorted(maps.Keys(f.objects)) {
+		if strings.HasPrefix(key, aws.ToString(input.Prefix)) {
+			output.Contents = append(output.Contents, s3types.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(f.objects[key]))),
+				LastModified: aws.Time(time.Now()),
+			})
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeS3) DeleteObject(_ context.Context, input *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, *input.Key)
+	delete(f.metadata, *input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// fakeTar returns a run func writing an archive of files to stdout for tar,
+// and running any other command without output.
+func fakeTar(files map[string]string) func(io.Writer, string) error {
+	return func(stdout io.Writer, command string) error {
+		if !strings.HasPrefix(command, "tar ") {
+			return nil
+		}
+		archive := tar.NewWriter(stdout)
+		for _, name := range slices.Sorted(maps.Keys(files)) {
+			if err := archive.WriteHeader(&tar.Header{
+				Name:     name,
+				Mode:     0644,
+				Size:     int64(len(files[name])),
+				Typeflag: tar.TypeReg,
+			}); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(archive, files[name]); err != nil {
+				return err
+			}
+		}
+		return archive.Close()
+	}
+}
+
+func TestRun(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		now      time.Time
+		label    string
+		noPause  bool
+		key      string
+		metadata map[string]string
+		commands []string
+	}{
+		{
+			name: "paused",
+			now:  time.Date(2024, 4, 20, 6, 22, 1, 0, time.UTC),
+			key:  "plex/2024-04-20T06:22:01Z.tar.zst",
+			commands: []string{
+				"sudo systemctl stop plexmediaserver.service",
+				"tar",
+				"sudo systemctl start plexmediaserver.service",
+			},
+		},
+		{
+			name:     "no pause",
+			now:      time.Date(2024, 4, 20, 6, 22, 1, 0, time.UTC),
+			noPause:  true,
+			key:      "plex/2024-04-20T06:22:01Z.tar.zst",
+			metadata: map[string]string{"plex-running": "true"},
+			commands: []string{
+				"systemctl is-active --quiet plexmediaserver.service",
+				"tar",
+			},
+		},
+		{
+			name:     "local time, truncated and labelled",
+			now:      time.Date(2024, 4, 20, 7, 22, 1, 999, time.FixedZone("BST", 60*60)),
+			label:    "pre-upgrade",
+			key:      "plex/2024-04-20T06:22:01Z-pre-upgrade.tar.zst",
+			metadata: map[string]string{"label": "pre-upgrade"},
+			commands: []string{
+				"sudo systemctl stop plexmediaserver.service",
+				"tar",
+				"sudo systemctl start plexmediaserver.service",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeS3()
+			runner := &fakeRunner{run: fakeTar(map[string]string{
+				"Plex Media Server/Preferences.xml": "<Preferences/>",
+			})}
+			o := &Opts{
+				Bucket:      "bucket",
+				Prefix:      "plex/",
+				Service:     "plexmediaserver.service",
+				NoPause:     tc.noPause,
+				Directories: []string{t.TempDir()},
+				Excludes:    []string{},
+				Label:       tc.label,
+				Runner:      runner,
+				Verify:      true,
+				Now: func() time.Time {
+					return tc.now
+				},
+			}
+			result, err := Run(context.Background(), slog.New(slog.DiscardHandler), client, o)
+			if err != nil {
+				t.Fatalf("Run() = %v", err)
+			}
+			if result.VerifyErr != nil {
+				t.Errorf("VerifyErr = %v", result.VerifyErr)
+			}
+			if result.Key != tc.key {
+				t.Errorf("Key = %v, want %v", result.Key, tc.key)
+			}
+			if _, ok := client.objects[tc.key]; !ok {
+				t.Errorf("%v not uploaded", tc.key)
+			}
+			if metadata := client.metadata[tc.key]; !maps.Equal(metadata, tc.metadata) {
+				t.Errorf("metadata = %v, want %v", metadata, tc.metadata)
+			}
+			var commands []string
+			for _, command := range runner.commands {
+				name, _, _ := strings.Cut(command, " ")
+				if name == "tar" {
+					command = name
+				}
+				commands = append(commands, command)
+			}
+			if !slices.Equal(commands, tc.commands) {
+				t.Errorf("ran %q, want %q", commands, tc.commands)
+			}
+		})
+	}
+}
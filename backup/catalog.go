@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// CatalogName is appended to Opts.Prefix to form the key of the catalog.
+const CatalogName = "index.json"
+
+// backupSuffix ends the key of every backup, distinguishing them from the
+// catalog and any other objects sharing the prefix.
+const backupSuffix = ".tar.zst"
+
+// catalogAttempts is how many times an update is attempted if the catalog is
+// modified concurrently.
+const catalogAttempts = 5
+
+// Catalog statuses.
+const (
+	CatalogAvailable = "available"
+	CatalogPruned    = "pruned"
+)
+
+// Catalog is an index of the backups under a prefix, stored alongside them as
+// JSON. It records details that cannot be derived from the key or a listing,
+// such as the checksum and Plex version.
+type Catalog struct {
+	Backups []*CatalogEntry `json:"backups"`
+}
+
+// CatalogEntry describes a single backup.
+type CatalogEntry struct {
+	Key               string    `json:"key"`
+	Time              time.Time `json:"time"`
+	UncompressedBytes uint64    `json:"uncompressed_bytes"`
+	CompressedBytes   uint64    `json:"compressed_bytes"`
+	DatabaseBytes     uint64    `json:"database_bytes,omitempty"`
+	SHA256            string    `json:"sha256"`
+	PlexVersion       string    `json:"plex_version,omitempty"`
+	Label             string    `json:"label,omitempty"`
+	Parts             int       `json:"parts,omitempty"`
+	ToolVersion       string    `json:"tool_version,omitempty"`
+	DurationSeconds   float64   `json:"duration_seconds,omitempty"`
+	DowntimeSeconds   float64   `json:"downtime_seconds,omitempty"`
+
+	// ChangedDatabases lists the databases modified while the backup was
+	// taken without stopping Plex, so it may be inconsistent.
+	ChangedDatabases []string `json:"changed_databases,omitempty"`
+
+	// Status is CatalogAvailable, or CatalogPruned once the backup has been
+	// deleted.
+	Status string `json:"status"`
+}
+
+// Entry returns the entry for key, or nil if there is none.
+func (c *Catalog) Entry(key string) *CatalogEntry {
+	for _, entry := range c.Backups {
+		if entry.Key == key {
+			return entry
+		}
+	}
+	return nil
+}
+
+// ReadCatalog returns the catalog of the backups under prefix, which is empty
+// if it does not exist yet. The returned ETag is empty in that case.
+func ReadCatalog(ctx context.Context, client S3API, bucket, prefix string) (*Catalog, string, error) {
+	key := prefix + CatalogName
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if errors.As(err, new(*s3types.NoSuchKey)) {
+		return &Catalog{}, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer output.Body.Close()
+	catalog := &Catalog{}
+	if err := json.NewDecoder(output.Body).Decode(catalog); err != nil {
+		return nil, "", fmt.Errorf("failed to parse %v: %w", key, err)
+	}
+	etag := ""
+	if output.ETag != nil {
+		etag = *output.ETag
+	}
+	return catalog, etag, nil
+}
+
+// UpdateCatalog applies update to the catalog of the backups under prefix.
+// The catalog is written with a conditional PUT, so a concurrent update by
+// another process is never lost: if the catalog changed since it was read,
+// it is read again and update reapplied.
+func UpdateCatalog(ctx context.Context, client S3API, bucket, prefix string, update func(*Catalog)) error {
+	key := prefix + CatalogName
+	for attempt := 1; ; attempt++ {
+		catalog, etag, err := ReadCatalog(ctx, client, bucket, prefix)
+		if err != nil {
+			return err
+		}
+		update(catalog)
+		body, err := json.MarshalIndent(catalog, "", "  ")
+		if err != nil {
+			return err
+		}
+		input := &s3.PutObjectInput{
+			Bucket:      &bucket,
+			Key:         &key,
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		}
+		if etag == "" {
+			input.IfNoneMatch = aws.String("*")
+		} else {
+			input.IfMatch = &etag
+		}
+		_, err = client.PutObject(ctx, input)
+		if err == nil {
+			return nil
+		}
+		if !isConflict(err) || attempt == catalogAttempts {
+			return err
+		}
+	}
+}
+
+// isConflict returns whether err indicates a conditional write failed
+// because the object was modified concurrently.
+func isConflict(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	default:
+		return false
+	}
+}
+
+// isBackupKey returns whether key is that of a backup, rather than the
+// catalog or an unrelated object.
+func isBackupKey(key string) bool {
+	return strings.HasSuffix(key, backupSuffix)
+}
+
+// updateCatalog calls UpdateCatalog for o.Prefix, logging failure.
+func (o *Opts) updateCatalog(ctx context.Context, logger *slog.Logger, client S3API, update func(*Catalog)) {
+	if err := UpdateCatalog(ctx, client, o.Bucket, o.Prefix, update); err != nil {
+		logger.WarnContext(ctx, "failed to update catalog",
+			slog.String("error", err.Error()))
+	}
+}
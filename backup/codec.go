@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// codec is a compression format a backup may be read from. Backups are only
+// written with zstd, but those taken by other tools, or by hand during the
+// gzip era, may be restored and verified too.
+type codec int
+
+const (
+	codecZstd codec = iota
+	codecGzip
+	codecXz
+)
+
+func (c codec) String() string {
+	switch c {
+	case codecGzip:
+		return "gzip"
+	case codecXz:
+		return "xz"
+	default:
+		return "zstd"
+	}
+}
+
+// Magic numbers beginning each format. A zstd object may instead begin with a
+// skippable frame, whose magic number varies in its first byte.
+var (
+	zstdMagic          = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zstdSkippableMagic = []byte{0x2a, 0x4d, 0x18}
+	gzipMagic          = []byte{0x1f, 0x8b}
+	xzMagic            = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// keyCodec returns the codec implied by the suffix of key, defaulting to zstd.
+func keyCodec(key string) codec {
+	switch {
+	case strings.HasSuffix(key, ".tar.gz"), strings.HasSuffix(key, ".tgz"):
+		return codecGzip
+	case strings.HasSuffix(key, ".tar.xz"), strings.HasSuffix(key, ".txz"):
+		return codecXz
+	default:
+		return codecZstd
+	}
+}
+
+// detectCodec returns the codec whose magic number begins header, or that
+// implied by key if none does, e.g. as the object is empty.
+func detectCodec(header []byte, key string) codec {
+	switch {
+	case bytes.HasPrefix(header, zstdMagic),
+		len(header) >= 4 && header[0]&0xf0 == 0x50 && bytes.Equal(header[1:4], zstdSkippableMagic):
+		return codecZstd
+	case bytes.HasPrefix(header, gzipMagic):
+		return codecGzip
+	case bytes.HasPrefix(header, xzMagic):
+		return codecXz
+	default:
+		return keyCodec(key)
+	}
+}
+
+// decompress returns the archive within r, the decrypted body of the object at
+// key, detecting its compression from its magic number. opts apply if it is
+// compressed with zstd. xz is decompressed by the xz command, which must be
+// installed. The returned reader must be closed.
+func decompress(ctx context.Context, r io.Reader, key string, opts ...zstd.DOption) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	// An error is returned by Peek if the object is shorter, which the
+	// decompressor will report in more detail.
+	header, _ := buffered.Peek(len(xzMagic))
+	switch detectCodec(header, key) {
+	case codecGzip:
+		return gzip.NewReader(buffered)
+	case codecXz:
+		return newXzReader(ctx, buffered)
+	default:
+		dec, err := zstd.NewReader(buffered, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+}
+
+// xzReader reads the output of an xz process decompressing its input.
+type xzReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+
+	// exited is set once xz has been waited for, and err to the error
+	// every subsequent Read returns.
+	exited bool
+	err    error
+}
+
+// newXzReader starts xz decompressing r.
+func newXzReader(ctx context.Context, r io.Reader) (*xzReader, error) {
+	x := &xzReader{
+		cmd: exec.CommandContext(ctx, "xz", "-dc"),
+	}
+	x.cmd.Stdin = r
+	x.cmd.Stderr = &x.stderr
+	stdout, err := x.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	x.ReadCloser = stdout
+	if err := x.cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("xz must be installed to read xz-compressed backups: %w", err)
+		}
+		return nil, err
+	}
+	return x, nil
+}
+
+// Read returns the error xz exited with, if any, once its output is exhausted,
+// so a corrupt archive is not mistaken for a short one.
+func (x *xzReader) Read(p []byte) (int, error) {
+	if x.exited {
+		return 0, x.err
+	}
+	n, err := x.ReadCloser.Read(p)
+	if err == io.EOF {
+		x.exited = true
+		x.err = io.EOF
+		if waitErr := x.cmd.Wait(); waitErr != nil {
+			x.err = fmt.Errorf("xz failed: %w: %v", waitErr, strings.TrimSpace(x.stderr.String()))
+		}
+		return n, x.err
+	}
+	return n, err
+}
+
+// Close stops xz if it is still running.
+func (x *xzReader) Close() error {
+	if !x.exited {
+		x.exited = true
+		x.cmd.Process.Kill()
+		x.cmd.Wait()
+	}
+	return nil
+}
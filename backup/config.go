@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LinuxConfigPaths returns the paths configuring Plex when installed from its
+// Linux packages: the environment file read by the unit, which sets e.g. the
+// location of the data directory, and the directory of drop-ins overriding
+// each of services' units, as created by systemctl edit.
+func LinuxConfigPaths(services ...string) []string {
+	paths := []string{"/etc/default/plexmediaserver"}
+	for _, service := range services {
+		// Snap units contain dots, so only the type suffix can be
+		// relied on.
+		if !strings.HasSuffix(service, ".service") {
+			service += ".service"
+		}
+		paths = append(paths, "/etc/systemd/system/"+service+".d")
+	}
+	return paths
+}
+
+// validateConfigPaths returns an error if any of o.ConfigPaths is relative, or
+// would be archived under the same top-level directory as one of
+// o.Directories.
+func (o *Opts) validateConfigPaths() error {
+	bases := map[string]bool{}
+	for _, directory := range o.Directories {
+		bases[filepath.Base(directory)] = true
+	}
+	for _, p := range o.ConfigPaths {
+		if !path.IsAbs(filepath.ToSlash(p)) {
+			return fmt.Errorf("%w: config path %v is not absolute", ErrBadDirectory, p)
+		}
+		top, _, _ := strings.Cut(configMember(p), "/")
+		if bases[top] {
+			return fmt.Errorf("%w: config path %v would be archived under directory %v", ErrBadDirectory, p, top)
+		}
+	}
+	return nil
+}
+
+// configMembers returns the archive member names of those of o.ConfigPaths
+// that exist.
+func (o *Opts) configMembers() []string {
+	var members []string
+	for _, p := range o.ConfigPaths {
+		if _, err := os.Lstat(p); err == nil {
+			members = append(members, configMember(p))
+		}
+	}
+	return members
+}
+
+// configMember returns the archive member name of the config path p: its path
+// relative to the root.
+func configMember(p string) string {
+	return strings.TrimPrefix(path.Clean(filepath.ToSlash(p)), "/")
+}
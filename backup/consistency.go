@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+)
+
+// plexRunning reports whether Plex is running, without changing its state, by
+// asking systemd whether o.Service is active, or if that is not possible,
+// e.g. because the service is controlled by o.StopCommand, whether it
+// responds at o.PlexURL. known is false if neither can tell.
+func (o *Opts) plexRunning(ctx context.Context) (running, known bool) {
+	if o.Service != "" && len(o.StopCommand) == 0 {
+		err := o.runner().Run(ctx, io.Discard, "systemctl", "is-active", "--quiet", o.Service)
+		if err == nil {
+			return true, true
+		}
+		// Anything other than a non-zero exit means systemctl could not be
+		// run, e.g. on a NAS without systemd.
+		if errors.As(err, new(*exec.ExitError)) {
+			return false, true
+		}
+	}
+	if o.PlexURL != "" {
+		_, err := identityVersion(ctx, o.PlexURL)
+		return err == nil, true
+	}
+	return false, false
+}
+
+// fileState is the part of a file's metadata that changes when it is written.
+type fileState struct {
+	modTime int64
+	size    int64
+}
+
+// databaseStates returns the state of each of Plex's library databases and
+// their write-ahead logs in directories, keyed by their path relative to the
+// parent of the directory, as in Result.DirectoryBytes. Missing files are
+// omitted. The -shm files are ignored, as they are not backed up, and readers
+// write to them.
+func databaseStates(directories []string) map[string]fileState {
+	states := map[string]fileState{}
+	for _, directory := range directories {
+		for _, database := range LibraryDatabases {
+			for _, name := range []string{database, database + "-wal"} {
+				rel := filepath.Join(databasesDir, name)
+				info, err := os.Stat(filepath.Join(directory, rel))
+				if err != nil {
+					continue
+				}
+				states[filepath.ToSlash(filepath.Join(filepath.Base(directory), rel))] = fileState{
+					modTime: info.ModTime().UnixNano(),
+					size:    info.Size(),
+				}
+			}
+		}
+	}
+	return states
+}
+
+// statFiles returns the state of each of paths that exists.
+func statFiles(paths ...string) map[string]fileState {
+	states := map[string]fileState{}
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			states[path] = fileState{
+				modTime: info.ModTime().UnixNano(),
+				size:    info.Size(),
+			}
+		}
+	}
+	return states
+}
+
+// changedDatabases returns the paths of the files whose state differs between
+// before and after, including those created or deleted, in order.
+func changedDatabases(before, after map[string]fileState) []string {
+	var changed []string
+	for path, state := range before {
+		if state != after[path] {
+			changed = append(changed, path)
+		}
+	}
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// consistencyCheck records whether Plex was running when a backup was started
+// with o.NoPause, and the state of its databases at the time, so they can be
+// compared once they have been archived. It is nil if the service is stopped
+// for the backup, the databases are archived from reflinks, or the
+// directories are archived remotely.
+type consistencyCheck struct {
+	running bool
+	before  map[string]fileState
+}
+
+// checkConsistency begins a consistency check if o.NoPause is set, logging
+// whether Plex is running.
+func (o *Opts) checkConsistency(ctx context.Context, logger *slog.Logger) *consistencyCheck {
+	if !o.NoPause || o.Reflink || o.RemoteDirectories {
+		return nil
+	}
+	running, known := o.plexRunning(ctx)
+	switch {
+	case !known:
+		logger.DebugContext(ctx, "cannot tell whether Plex is running")
+	case running:
+		logger.InfoContext(ctx, "Plex is running, so the backup may be inconsistent if its databases change")
+	default:
+		logger.InfoContext(ctx, "Plex is not running")
+	}
+	return &consistencyCheck{
+		running: running,
+		before:  databaseStates(o.Directories),
+	}
+}
+
+// finish compares the state of the databases in directories with that when
+// the check began, logging and returning any that changed.
+func (c *consistencyCheck) finish(ctx context.Context, logger *slog.Logger, directories []string) []string {
+	changed := changedDatabases(c.before, databaseStates(directories))
+	if len(changed) > 0 {
+		logger.WarnContext(ctx, "databases changed while archiving, so the backup may be inconsistent",
+			slog.Any("databases", changed))
+	} else {
+		logger.InfoContext(ctx, "databases unchanged while archiving",
+			slog.Int("files", len(c.before)))
+	}
+	return changed
+}
@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"sync/atomic"
+)
+
+// maxDedupBytes is the size of the largest file deduplicator compares. Each is
+// held in memory while it is hashed; larger files, such as databases, are
+// rarely duplicated, so are passed through as they are read.
+const maxDedupBytes = 16 << 20
+
+// deduplicator reads an archive from r, replacing each regular file whose
+// content is identical to one earlier in the archive with a hard link to it.
+// Plex's metadata contains many copies of the same artwork, each stored once
+// per item it is attached to; tar only recognises files that are already hard
+// links. Restoring the archive creates the links, so duplicates share one copy
+// on disk.
+type deduplicator struct {
+	r       io.Reader
+	archive *tar.Reader
+	out     bytes.Buffer
+	writer  *tar.Writer
+
+	// first maps the digest of each file compared to the name of the first
+	// with that content.
+	first map[[sha256.Size]byte]string
+
+	// body is set while the content of a file too large to compare is
+	// being copied.
+	body bool
+	done bool
+
+	// linked counts the files replaced by links, and linkedBytes their
+	// total size.
+	linked, linkedBytes atomic.Uint64
+}
+
+// newDeduplicator returns a deduplicator of the archive read from r.
+func newDeduplicator(r io.Reader) *deduplicator {
+	d := &deduplicator{
+		r:       r,
+		archive: tar.NewReader(r),
+		first:   map[[sha256.Size]byte]string{},
+	}
+	d.writer = tar.NewWriter(&d.out)
+	return d
+}
+
+func (d *deduplicator) Read(p []byte) (int, error) {
+	for d.out.Len() == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	return d.out.Read(p)
+}
+
+// next writes the next chunk of output to d.out: a block of a large file's
+// content, a whole entry, or the end of the archive.
+func (d *deduplicator) next() error {
+	if d.body {
+		_, err := io.CopyN(d.writer, d.archive, 64<<10)
+		if err == io.EOF {
+			d.body = false
+			return nil
+		}
+		return err
+	}
+	header, err := d.archive.Next()
+	if err == io.EOF {
+		d.done = true
+		// tar pads the archive after its end, and blocks until the
+		// padding is read.
+		if _, err := io.Copy(io.Discard, d.r); err != nil {
+			return err
+		}
+		return d.writer.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg || header.Size == 0 || header.Size > maxDedupBytes {
+		d.body = true
+		return d.writer.WriteHeader(header)
+	}
+	content, err := io.ReadAll(d.archive)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(content)
+	if name, ok := d.first[digest]; ok {
+		d.linked.Add(1)
+		d.linkedBytes.Add(uint64(len(content)))
+		header.Typeflag = tar.TypeLink
+		header.Linkname = name
+		header.Size = 0
+		return d.writer.WriteHeader(header)
+	}
+	d.first[digest] = header.Name
+	if err := d.writer.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = d.writer.Write(content)
+	return err
+}
@@ -0,0 +1,245 @@
+package backup
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gebn/plexbackup/internal/pkg/staging"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// DownloadOpts tunes the concurrent ranged GETs a backup is restored with. A
+// single GET is limited by the throughput of one connection, which dominates
+// the time taken to restore a large backup over a fast link.
+type DownloadOpts struct {
+
+	// Stream extracts the ranges in order as they are downloaded, rather
+	// than spooling the object to disk first, so only the extracted files
+	// need room. At most Concurrency ranges are held in memory at once,
+	// and a slow range stalls the rest.
+	Stream bool
+
+	// Concurrency is the number of ranges downloaded at once. If zero,
+	// s3manager.DefaultDownloadConcurrency is used.
+	Concurrency int
+
+	// PartSize is the size of each range in bytes. If zero,
+	// s3manager.DefaultDownloadPartSize is used.
+	PartSize int64
+
+	// SpaceMargin, if non-zero, is how many times the size of the object
+	// must be free in the directory it is spooled to, checked before it is
+	// downloaded.
+	SpaceMargin float64
+
+	// Staging records the file the object is spooled to, so it can be
+	// removed if the process is killed. If nil, it is not recorded.
+	Staging *staging.Registry
+}
+
+// downloadBackup downloads the backup at key with concurrent ranged GETs,
+// returning its compressed content as openBackup does. Unless d.Stream is set,
+// the object is written to a temporary file in spoolDir, as the ranges
+// complete out of order, so cannot be decompressed until all have been
+// downloaded; the file is removed when the returned body is closed.
+func downloadBackup(ctx context.Context, client S3API, keys KMSAPI, bucket, key, spoolDir string, d DownloadOpts, raw io.Writer) (io.ReadCloser, error) {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := unwrapDataKey(ctx, keys, head.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	var object io.ReadCloser
+	if d.Stream {
+		object = newRangeReader(ctx, client, bucket, key, head, d)
+	} else if object, err = spoolObject(ctx, client, bucket, key, spoolDir, head, d); err != nil {
+		return nil, err
+	}
+	body, err := decryptedBody(object, plaintext, raw)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{body, object}, nil
+}
+
+// spoolObject downloads the object described by head into a temporary file in
+// spoolDir, returning it open at the start. Closing it removes it.
+func spoolObject(ctx context.Context, client S3API, bucket, key, spoolDir string, head *s3.HeadObjectOutput, d DownloadOpts) (io.ReadCloser, error) {
+	if err := checkSpace(spoolDir, "downloading the backup", uint64(aws.ToInt64(head.ContentLength)), d.SpaceMargin); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(spoolDir, ".plexbackup-*.spool")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	s := spool{file, d.Staging}
+	if err := d.Staging.Register(file.Name()); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	downloader := s3manager.NewDownloader(client, func(dl *s3manager.Downloader) {
+		if d.Concurrency > 0 {
+			dl.Concurrency = d.Concurrency
+		}
+		if d.PartSize > 0 {
+			dl.PartSize = d.PartSize
+		}
+		dl.ClientOptions = append(dl.ClientOptions, skipRangeChecksum)
+	})
+	if _, err := downloader.Download(ctx, s, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		// Every range must come from the object whose data key was
+		// unwrapped, should it be overwritten meanwhile.
+		IfMatch: head.ETag,
+	}); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if _, err := s.Seek(0, io.SeekStart); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// skipRangeChecksum disables validation of the checksum returned with a
+// ranged GET. Any checksum returned is of the whole object, so cannot be
+// validated against a range of it. The object's digest is checked once it
+// has been read instead.
+func skipRangeChecksum(o *s3.Options) {
+	o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+}
+
+// spool is a temporary file holding a download, removed on Close.
+type spool struct {
+	*os.File
+	staging *staging.Registry
+}
+
+func (s spool) Close() error {
+	err := errors.Join(s.File.Close(), os.Remove(s.Name()))
+	if err == nil {
+		s.staging.Release(s.Name())
+	}
+	return err
+}
+
+// rangeReader reads an object as a series of ranges, downloaded concurrently
+// and returned in order.
+type rangeReader struct {
+	cancel context.CancelFunc
+
+	// pending holds the result of each range in order, as it is started.
+	// Its capacity bounds the number of ranges held in memory.
+	pending chan chan downloadedRange
+	buf     []byte
+	err     error
+}
+
+// downloadedRange is the content of a range, or the error downloading it.
+type downloadedRange struct {
+	content []byte
+	err     error
+}
+
+// newRangeReader returns a rangeReader of the object described by head,
+// which must be closed.
+func newRangeReader(ctx context.Context, client S3API, bucket, key string, head *s3.HeadObjectOutput, d DownloadOpts) *rangeReader {
+	concurrency := cmp.Or(d.Concurrency, s3manager.DefaultDownloadConcurrency)
+	partSize := cmp.Or(d.PartSize, s3manager.DefaultDownloadPartSize)
+	size := aws.ToInt64(head.ContentLength)
+	ctx, cancel := context.WithCancel(ctx)
+	r := &rangeReader{
+		cancel: cancel,
+		// One more range is held by Read.
+		pending: make(chan chan downloadedRange, concurrency-1),
+	}
+	go func() {
+		defer close(r.pending)
+		for offset := int64(0); offset < size; offset += partSize {
+			result := make(chan downloadedRange, 1)
+			select {
+			case r.pending <- result:
+			case <-ctx.Done():
+				return
+			}
+			input := &s3.GetObjectInput{
+				Bucket:  &bucket,
+				Key:     &key,
+				Range:   aws.String(fmt.Sprintf("bytes=%v-%v", offset, min(offset+partSize, size)-1)),
+				IfMatch: head.ETag,
+			}
+			go func() {
+				content, err := downloadRange(ctx, client, input, min(partSize, size-offset))
+				result <- downloadedRange{content, err}
+			}()
+		}
+	}()
+	return r
+}
+
+// downloadRange returns the content of the range requested by input, which is
+// length bytes long. A connection dropped while reading the body is retried,
+// as the client only retries failed requests.
+func downloadRange(ctx context.Context, client S3API, input *s3.GetObjectInput, length int64) ([]byte, error) {
+	content := make([]byte, length)
+	var err error
+	for range s3manager.DefaultPartBodyMaxRetries {
+		var output *s3.GetObjectOutput
+		output, err = client.GetObject(ctx, input, skipRangeChecksum)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(output.Body, content)
+		output.Body.Close()
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %v: %w", *input.Range, err)
+	}
+	return content, nil
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		result, ok := <-r.pending
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		downloaded := <-result
+		r.buf, r.err = downloaded.content, downloaded.err
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close stops downloading ranges.
+func (r *rangeReader) Close() error {
+	r.cancel()
+	return nil
+}
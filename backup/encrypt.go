@@ -0,0 +1,423 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Metadata keys of an encrypted backup object, which hold everything needed
+// to decrypt it besides access to a KMS key. If the data key is wrapped by
+// several KMS keys, the second and subsequent are suffixed with "-2", "-3" etc.
+const (
+	encryptionMetadata = "plexbackup-encryption"
+	dataKeyMetadata    = "plexbackup-data-key"
+	kmsKeyMetadata     = "plexbackup-kms-key"
+)
+
+// encryptionScheme identifies the format of encrypted backups: the compressed
+// stream split into segments of segmentBytes, each sealed with AES-256-GCM
+// under a data key unique to the backup.
+const encryptionScheme = "kms-aes256-gcm-v1"
+
+// segmentBytes is the amount of plaintext in each encrypted segment but the
+// last, which may be shorter.
+const segmentBytes = 64 << 10
+
+// encryptionContext is bound to every data key, so it cannot be decrypted for
+// another purpose. It does not include the backup's key, which may change,
+// e.g. with MigratePrefix.
+var encryptionContext = map[string]string{"application": "plexbackup"}
+
+// ErrEncrypted is wrapped by errors reading a backup that is encrypted, when
+// no KMS client was provided to decrypt it.
+var ErrEncrypted = errors.New("backup is encrypted; a KMS client is required")
+
+// ErrNoKey is wrapped by errors reading an encrypted backup whose data key
+// could not be decrypted with any of the KMS keys that wrapped it, e.g. as the
+// credentials in use lack kms:Decrypt on all of them.
+var ErrNoKey = errors.New("no KMS key available to decrypt the backup")
+
+// KMSAPI is the subset of *kms.Client used by the package to encrypt and
+// decrypt backups.
+type KMSAPI interface {
+	GenerateDataKey(context.Context, *kms.GenerateDataKeyInput, ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Encrypt(context.Context, *kms.EncryptInput, ...func(*kms.Options)) (*kms.EncryptOutput, error)
+	Decrypt(context.Context, *kms.DecryptInput, ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// wrappedKey is a data key encrypted by a KMS key.
+type wrappedKey struct {
+	ciphertext []byte
+
+	// kmsKey is the ARN of the KMS key, so its region is known when
+	// decrypting.
+	kmsKey string
+}
+
+// dataKey is a key generated by KMS to encrypt a single backup.
+type dataKey struct {
+	plaintext []byte
+
+	// metadata describes the wrapped keys, to be stored on the backup
+	// object.
+	metadata map[string]string
+}
+
+// generateDataKey asks KMS for a new data key under the first of keyIDs, each
+// of which may be an ID, alias or ARN, then wraps it with each of the rest, so
+// any of them can decrypt it.
+func generateDataKey(ctx context.Context, client KMSAPI, keyIDs []string) (*dataKey, error) {
+	output, err := client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             &keyIDs[0],
+		KeySpec:           kmstypes.DataKeySpecAes256,
+		EncryptionContext: encryptionContext,
+	}, regionOf(keyIDs[0]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped := []*wrappedKey{{
+		ciphertext: output.CiphertextBlob,
+		kmsKey:     *output.KeyId,
+	}}
+	rest, err := wrapDataKey(ctx, client, output.Plaintext, keyIDs[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{
+		plaintext: output.Plaintext,
+		metadata:  encryptionMetadataOf(append(wrapped, rest...)),
+	}, nil
+}
+
+// wrapDataKey encrypts plaintext with each of keyIDs.
+func wrapDataKey(ctx context.Context, client KMSAPI, plaintext []byte, keyIDs []string) ([]*wrappedKey, error) {
+	var wrapped []*wrappedKey
+	for _, keyID := range keyIDs {
+		output, err := client.Encrypt(ctx, &kms.EncryptInput{
+			KeyId:             &keyID,
+			Plaintext:         plaintext,
+			EncryptionContext: encryptionContext,
+		}, regionOf(keyID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap data key with %v: %w", keyID, err)
+		}
+		wrapped = append(wrapped, &wrappedKey{
+			ciphertext: output.CiphertextBlob,
+			kmsKey:     *output.KeyId,
+		})
+	}
+	return wrapped, nil
+}
+
+// encryptionMetadataOf returns the object metadata describing wrapped.
+func encryptionMetadataOf(wrapped []*wrappedKey) map[string]string {
+	metadata := map[string]string{
+		encryptionMetadata: encryptionScheme,
+	}
+	for i, key := range wrapped {
+		suffix := ""
+		if i > 0 {
+			suffix = fmt.Sprintf("-%d", i+1)
+		}
+		metadata[dataKeyMetadata+suffix] = base64.StdEncoding.EncodeToString(key.ciphertext)
+		metadata[kmsKeyMetadata+suffix] = key.kmsKey
+	}
+	return metadata
+}
+
+// wrappedKeys returns the wrapped data keys described by an encrypted
+// object's metadata, in order.
+func wrappedKeys(metadata map[string]string) ([]*wrappedKey, error) {
+	var wrapped []*wrappedKey
+	for i := 1; ; i++ {
+		suffix := ""
+		if i > 1 {
+			suffix = fmt.Sprintf("-%d", i)
+		}
+		encoded, ok := metadata[dataKeyMetadata+suffix]
+		if !ok {
+			break
+		}
+		ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data key: %w", err)
+		}
+		wrapped = append(wrapped, &wrappedKey{
+			ciphertext: ciphertext,
+			kmsKey:     metadata[kmsKeyMetadata+suffix],
+		})
+	}
+	if len(wrapped) == 0 {
+		return nil, errors.New("no data key")
+	}
+	return wrapped, nil
+}
+
+// isEncryptionMetadata returns whether the metadata key name describes the
+// encryption of a backup.
+func isEncryptionMetadata(name string) bool {
+	return name == encryptionMetadata || strings.HasPrefix(name, dataKeyMetadata) || strings.HasPrefix(name, kmsKeyMetadata)
+}
+
+// regionOf returns an option directing requests to the region of keyID if it
+// is an ARN, and otherwise leaving the client's region unchanged.
+func regionOf(keyID string) func(*kms.Options) {
+	return func(o *kms.Options) {
+		if parsed, err := arn.Parse(keyID); err == nil {
+			o.Region = parsed.Region
+		}
+	}
+}
+
+// unwrapDataKey asks KMS to decrypt the data key of a backup with the provided
+// object metadata, trying each KMS key that wrapped it in turn, e.g. as access
+// to an old key may have been revoked. It returns nil if the backup is not
+// encrypted. If no key can decrypt it, the error wraps ErrNoKey and names
+// them, so it is clear which access is required.
+func unwrapDataKey(ctx context.Context, client KMSAPI, metadata map[string]string) ([]byte, error) {
+	scheme, ok := metadata[encryptionMetadata]
+	if !ok {
+		return nil, nil
+	}
+	if scheme != encryptionScheme {
+		return nil, fmt.Errorf("unsupported encryption scheme %q", scheme)
+	}
+	if client == nil {
+		return nil, ErrEncrypted
+	}
+	wrapped, err := wrappedKeys(metadata)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	var kmsKeys []string
+	for _, key := range wrapped {
+		output, err := client.Decrypt(ctx, &kms.DecryptInput{
+			CiphertextBlob:    key.ciphertext,
+			KeyId:             &key.kmsKey,
+			EncryptionContext: encryptionContext,
+		}, regionOf(key.kmsKey))
+		if err == nil {
+			return output.Plaintext, nil
+		}
+		errs = append(errs, fmt.Errorf("failed to decrypt data key with %v: %w", key.kmsKey, err))
+		kmsKeys = append(kmsKeys, key.kmsKey)
+	}
+	return nil, fmt.Errorf("%w; it requires kms:Decrypt on %v: %w", ErrNoKey, strings.Join(kmsKeys, " or "), errors.Join(errs...))
+}
+
+// checkKeys returns an error if the data key of the backup at key in bucket,
+// or any of its parts, cannot be decrypted with keys, so a backup that cannot
+// be read is rejected before any of it is downloaded, rather than after the
+// first object, which may be gigabytes. Unencrypted objects pass.
+func checkKeys(ctx context.Context, client S3API, keys KMSAPI, bucket, key string, parts []string) error {
+	for _, object := range append([]string{key}, parts...) {
+		head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &object,
+		})
+		if err == nil {
+			_, err = unwrapDataKey(ctx, keys, head.Metadata)
+		}
+		if err != nil {
+			if object != key {
+				err = fmt.Errorf("%v: %w", object, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// openBackup downloads the backup at key, returning its compressed content,
+// decrypted with keys if necessary. The raw object, as uploaded, is also
+// written to raw, e.g. to check its digest. The returned body must be read to
+// EOF for raw to see the whole object, and closed.
+func openBackup(ctx context.Context, client S3API, keys KMSAPI, bucket, key string, raw io.Writer) (io.ReadCloser, error) {
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := unwrapDataKey(ctx, keys, output.Metadata)
+	if err != nil {
+		output.Body.Close()
+		return nil, err
+	}
+	body, err := decryptedBody(output.Body, plaintext, raw)
+	if err != nil {
+		output.Body.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{body, output.Body}, nil
+}
+
+// decryptedBody returns the compressed content of object, the body of a
+// backup, decrypted with plaintext, its data key, unless nil. The object is
+// also written to raw as it is read, unless nil.
+func decryptedBody(object io.Reader, plaintext []byte, raw io.Writer) (io.Reader, error) {
+	if raw != nil {
+		object = io.TeeReader(object, raw)
+	}
+	if plaintext == nil {
+		return object, nil
+	}
+	return newDecrypter(object, plaintext)
+}
+
+// newAEAD returns AES-256-GCM keyed with key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of the segment at index. As every backup has
+// its own data key, a counter is sufficient. The final byte marks the last
+// segment, so truncation at a segment boundary is detected.
+func segmentNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encrypter is an io.WriteCloser encrypting what is written to it in
+// segments. Close must be called to write the final segment.
+type encrypter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+}
+
+// newEncrypter returns an encrypter writing to w with key.
+func newEncrypter(w io.Writer, key []byte) (*encrypter, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encrypter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, segmentBytes+aead.Overhead()),
+	}, nil
+}
+
+func (e *encrypter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data arrives, so the
+		// final segment written by Close is never empty unless the whole
+		// stream is.
+		if len(e.buf) == segmentBytes {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(len(p), segmentBytes-len(e.buf))
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the final segment. It does not close the underlying writer.
+func (e *encrypter) Close() error {
+	return e.seal(true)
+}
+
+// seal encrypts and writes the buffered segment.
+func (e *encrypter) seal(last bool) error {
+	sealed := e.aead.Seal(e.buf[:0], segmentNonce(e.index, last), e.buf, nil)
+	e.index++
+	_, err := e.w.Write(sealed)
+	e.buf = e.buf[:0]
+	return err
+}
+
+// decrypter is an io.Reader decrypting the segments written by an encrypter.
+// It returns an error if the stream has been modified or truncated.
+type decrypter struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	plain []byte
+	index uint64
+	done  bool
+}
+
+// newDecrypter returns a decrypter reading from r with key.
+func newDecrypter(r io.Reader, key []byte) (*decrypter, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{
+		r:    bufio.NewReader(r),
+		aead: aead,
+		buf:  make([]byte, segmentBytes+aead.Overhead()),
+	}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next segment.
+func (d *decrypter) open() error {
+	n, err := io.ReadFull(d.r, d.buf)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		d.done = true
+	case err != nil:
+		return err
+	default:
+		// A full segment is the last if nothing follows it.
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := d.aead.Open(d.buf[:0], segmentNonce(d.index, d.done), d.buf[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt segment %v: %w", d.index, err)
+	}
+	d.index++
+	d.plain = plain
+	return nil
+}
@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// encrypt returns plaintext encrypted with key.
+func encrypt(t *testing.T, key, plaintext []byte) []byte {
+	t.Helper()
+	var ciphertext bytes.Buffer
+	e, err := newEncrypter(&ciphertext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written in uneven pieces, so segments span writes.
+	for p := plaintext; len(p) > 0; {
+		n := min(len(p), 10000)
+		if _, err := e.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext.Bytes()
+}
+
+// decrypt returns ciphertext decrypted with key.
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	d, err := newDecrypter(bytes.NewReader(ciphertext), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(d)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	for _, tc := range []struct {
+		name  string
+		bytes int
+	}{
+		{"empty", 0},
+		{"short", 1},
+		{"one segment", segmentBytes},
+		{"segment and a byte", segmentBytes + 1},
+		{"several segments", 3*segmentBytes + 12345},
+		{"whole segments", 3 * segmentBytes},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintext := make([]byte, tc.bytes)
+			rand.Read(plaintext)
+			ciphertext := encrypt(t, key, plaintext)
+			decrypted, err := decrypt(key, ciphertext)
+			if err != nil {
+				t.Fatalf("decrypt() = %v", err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("decrypted %v bytes, which differ from the %v encrypted", len(decrypted), len(plaintext))
+			}
+		})
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	plaintext := make([]byte, 3*segmentBytes+100)
+	rand.Read(plaintext)
+	ciphertext := encrypt(t, key, plaintext)
+	aead, err := newAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The size of each sealed segment but the last.
+	sealed := segmentBytes + aead.Overhead()
+
+	otherKey := make([]byte, 32)
+	rand.Read(otherKey)
+	flipped := bytes.Clone(ciphertext)
+	flipped[sealed+7] ^= 1
+	reordered := bytes.Join([][]byte{ciphertext[sealed : 2*sealed], ciphertext[:sealed], ciphertext[2*sealed:]}, nil)
+
+	for _, tc := range []struct {
+		name       string
+		key        []byte
+		ciphertext []byte
+	}{
+		{"truncated at a segment boundary", key, ciphertext[:2*sealed]},
+		{"truncated within a segment", key, ciphertext[:2*sealed+100]},
+		{"extended", key, append(bytes.Clone(ciphertext), ciphertext[:sealed]...)},
+		{"modified", key, flipped},
+		{"segments reordered", key, reordered},
+		{"wrong key", otherKey, ciphertext},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := decrypt(tc.key, tc.ciphertext); err == nil {
+				t.Error("decrypt() succeeded, want error")
+			}
+		})
+	}
+}
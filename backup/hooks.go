@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"context"
+	"time"
+)
+
+// Hooks is notified as Run progresses, allowing callers to plug in their own
+// notifications and metrics. Methods are called synchronously, so delay the
+// backup until they return, with the exception of OnUploadProgress, which is
+// called from a separate goroutine. Embed NopHooks to implement only some of
+// the methods.
+type Hooks interface {
+
+	// OnServiceStopped is called after the service has been stopped. It is
+	// not called if Opts.NoPause is set.
+	OnServiceStopped(ctx context.Context, service string)
+
+	// OnArchiveStarted is called immediately before tar is started, with the
+	// key the backup will be uploaded to.
+	OnArchiveStarted(ctx context.Context, key string)
+
+	// OnUploadProgress is called every Opts.ProgressInterval while the
+	// backup is in progress, alongside Opts.OnProgress. It should return
+	// promptly.
+	OnUploadProgress(ctx context.Context, progress Progress)
+
+	// OnServiceStarted is called after the service has been started again,
+	// with the time it was stopped for. It is not called if Opts.NoPause is
+	// set.
+	OnServiceStarted(ctx context.Context, service string, downtime time.Duration)
+
+	// OnPruned is called after an old backup has been deleted.
+	OnPruned(ctx context.Context, key string)
+}
+
+// NopHooks implements Hooks, ignoring all events.
+type NopHooks struct{}
+
+func (NopHooks) OnServiceStopped(context.Context, string)                {}
+func (NopHooks) OnArchiveStarted(context.Context, string)                {}
+func (NopHooks) OnUploadProgress(context.Context, Progress)              {}
+func (NopHooks) OnServiceStarted(context.Context, string, time.Duration) {}
+func (NopHooks) OnPruned(context.Context, string)                        {}
+
+// hooks returns o.Hooks, or NopHooks if it is nil.
+func (o *Opts) hooks() Hooks {
+	if o.Hooks == nil {
+		return NopHooks{}
+	}
+	return o.Hooks
+}
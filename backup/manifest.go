@@ -0,0 +1,225 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ManifestEntry describes a file in a backup. Directories are omitted, as
+// they are implied by the files within them.
+type ManifestEntry struct {
+
+	// Path is the path of the file within the archive, whose first element
+	// is the base name of the directory that was backed up, e.g. "Plex Media
+	// Server/Preferences.xml".
+	Path string
+
+	// Size is the size of a regular file in bytes.
+	Size int64
+
+	// SHA256 is the hex-encoded SHA-256 digest of a regular file's content.
+	SHA256 string
+
+	// Linkname is the target of a symbolic link, and empty otherwise.
+	Linkname string
+}
+
+// ReadManifest downloads the backup at key in bucket, decrypting it with keys
+// if necessary, and returns an entry for each file in the archive, in archive
+// order, followed by those in each of its parts. Nothing is written to disk.
+func ReadManifest(ctx context.Context, client S3API, keys KMSAPI, bucket, key string) ([]*ManifestEntry, error) {
+	parts, err := PartKeys(ctx, client, bucket, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list parts of %v: %w", key, err)
+	}
+	var manifest []*ManifestEntry
+	for _, object := range append([]string{key}, parts...) {
+		entries, err := readManifest(ctx, client, keys, bucket, object)
+		if err != nil {
+			return nil, err
+		}
+		manifest = append(manifest, entries...)
+	}
+	return manifest, nil
+}
+
+// readManifest returns an entry for each file in the single object at key.
+func readManifest(ctx context.Context, client S3API, keys KMSAPI, bucket, key string) ([]*ManifestEntry, error) {
+	body, err := openBackup(ctx, client, keys, bucket, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	dec, err := decompress(ctx, body, key, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	var manifest []*ManifestEntry
+	files := map[string]*ManifestEntry{}
+	archive := tar.NewReader(dec)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return manifest, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v: %w", key, err)
+		}
+		entry := &ManifestEntry{
+			Path: strings.TrimPrefix(path.Clean(header.Name), "./"),
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			hash := sha256.New()
+			if entry.Size, err = io.Copy(hash, archive); err != nil {
+				return nil, fmt.Errorf("failed to read %v: %w", key, err)
+			}
+			entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		case tar.TypeSymlink:
+			entry.Linkname = header.Linkname
+		case tar.TypeLink:
+			// A further link to a file earlier in the archive, which has
+			// the same content.
+			target, ok := files[strings.TrimPrefix(path.Clean(header.Linkname), "./")]
+			if !ok {
+				continue
+			}
+			entry.Size, entry.SHA256 = target.Size, target.SHA256
+		default:
+			continue
+		}
+		files[entry.Path] = entry
+		manifest = append(manifest, entry)
+	}
+}
+
+// Change kinds, describing how a file would change if a backup were restored.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Change is a difference between two sets of files.
+type Change struct {
+	Path string
+	Kind string
+}
+
+// DiffManifests returns how the files described by from would change to become
+// those described by to, sorted by path.
+func DiffManifests(from, to []*ManifestEntry) []*Change {
+	previous := make(map[string]*ManifestEntry, len(from))
+	for _, entry := range from {
+		previous[entry.Path] = entry
+	}
+	var changes []*Change
+	for _, entry := range to {
+		old, ok := previous[entry.Path]
+		delete(previous, entry.Path)
+		switch {
+		case !ok:
+			changes = append(changes, &Change{Path: entry.Path, Kind: ChangeAdded})
+		case *old != *entry:
+			changes = append(changes, &Change{Path: entry.Path, Kind: ChangeModified})
+		}
+	}
+	for p := range previous {
+		changes = append(changes, &Change{Path: p, Kind: ChangeRemoved})
+	}
+	slices.SortFunc(changes, func(a, b *Change) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return changes
+}
+
+// LiveManifest describes the files currently in o.Directories and
+// o.ConfigPaths that would be backed up, in the same form as ReadManifest, so
+// it can be compared with a backup. Files matching o.Excludes are omitted, as
+// they would be by tar.
+func (o *Opts) LiveManifest() ([]*ManifestEntry, error) {
+	excludes := o.excludes()
+	// Each directory is walked from its path on disk, and recorded under
+	// its member name in the archive.
+	members := map[string]string{}
+	roots := slices.Clone(o.Directories)
+	for _, directory := range o.Directories {
+		members[directory] = filepath.Base(directory)
+	}
+	for _, p := range o.ConfigPaths {
+		if _, err := os.Lstat(p); err == nil {
+			members[p] = configMember(p)
+			roots = append(roots, p)
+		}
+	}
+	var manifest []*ManifestEntry
+	for _, directory := range roots {
+		base := members[directory]
+		err := filepath.WalkDir(directory, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(directory, name)
+			if err != nil {
+				return err
+			}
+			if rel != "." && excluded(rel, excludes) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			entry := &ManifestEntry{
+				Path: path.Join(base, filepath.ToSlash(rel)),
+			}
+			switch {
+			case d.Type().IsRegular():
+				if entry.Size, entry.SHA256, err = hashFile(name); err != nil {
+					return err
+				}
+			case d.Type()&fs.ModeSymlink != 0:
+				if entry.Linkname, err = os.Readlink(name); err != nil {
+					return err
+				}
+			default:
+				return nil
+			}
+			manifest = append(manifest, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// hashFile returns the size and hex-encoded SHA-256 digest of the file at
+// name.
+func hashFile(name string) (int64, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
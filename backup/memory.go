@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"runtime"
+
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Bounds of the zstd window size chosen to fit Opts.MaxMemory. The upper bound
+// is the default window size.
+const (
+	minWindowSize = 1 << 20
+	maxWindowSize = 8 << 20
+)
+
+// encoderOptions returns the zstd options fitting the encoder within a quarter
+// of o.MaxMemory. Each concurrent block encoder holds roughly three windows'
+// worth of history and buffers, so the window is shrunk before concurrency is
+// reduced to one.
+func (o *Opts) encoderOptions() []zstd.EOption {
+	if o.MaxMemory <= 0 {
+		return nil
+	}
+	window, concurrency := o.encoderLimits()
+	return []zstd.EOption{
+		zstd.WithWindowSize(window),
+		zstd.WithEncoderConcurrency(concurrency),
+	}
+}
+
+// encoderLimits returns the zstd window size and number of concurrent block
+// encoders fitting within a quarter of o.MaxMemory, or the defaults if it is
+// not set.
+func (o *Opts) encoderLimits() (window, concurrency int) {
+	if o.MaxMemory <= 0 {
+		return maxWindowSize, runtime.GOMAXPROCS(0)
+	}
+	budget := o.MaxMemory / 4
+	w := int64(maxWindowSize)
+	for w > minWindowSize && 3*w > budget {
+		w /= 2
+	}
+	c := min(max(budget/(3*w), 1), int64(runtime.GOMAXPROCS(0)))
+	return int(w), int(c)
+}
+
+// uploaderOptions returns the options fitting the uploader's part buffers
+// within half of o.MaxMemory. The uploader holds one part per concurrent
+// upload, plus one being filled.
+func (o *Opts) uploaderOptions() []func(*s3manager.Uploader) {
+	if o.MaxMemory <= 0 {
+		return nil
+	}
+	budget := o.MaxMemory / 2
+	concurrency := min(max(budget/s3manager.DefaultUploadPartSize-1, 1), s3manager.DefaultUploadConcurrency)
+	return []func(*s3manager.Uploader){
+		func(u *s3manager.Uploader) {
+			u.Concurrency = int(concurrency)
+		},
+	}
+}
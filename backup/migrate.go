@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MigratePrefix moves the backups directly under from in bucket to the same
+// names under to, server-side, so they remain subject to retention after the
+// prefix is changed. Backups in "subdirectories" of from are left alone, so to
+// may be nested within it, e.g. plex/ to plex/newton/. Each backup is deleted
+// once copied, and its catalog entry moved to the catalog under to. The keys
+// moved are returned, even if an error occurs part way.
+func MigratePrefix(ctx context.Context, client S3API, bucket, from, to string) (moved []string, err error) {
+	ctx, span := tracer.Start(ctx, "migrate prefix", trace.WithAttributes(
+		attribute.String("from", from),
+		attribute.String("to", to)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if from == to {
+		return nil, fmt.Errorf("%w: the prefixes are the same", ErrBadPrefix)
+	}
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &from,
+	})
+	var backups []s3types.Object
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list backups: %w", err)
+		}
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(*object.Key, from)
+			if isBackupObject(name) && !strings.Contains(name, "/") {
+				backups = append(backups, object)
+			}
+		}
+	}
+
+	// Catalog updates are deferred until the end, so a failure part way
+	// leaves entries for every backup that was moved.
+	defer func() {
+		if len(moved) == 0 {
+			return
+		}
+		if catalogErr := moveCatalogEntries(ctx, client, bucket, from, to, moved); catalogErr != nil && err == nil {
+			err = fmt.Errorf("failed to update catalog: %w", catalogErr)
+		}
+	}()
+	for _, object := range backups {
+		key := to + strings.TrimPrefix(*object.Key, from)
+		if err := moveObject(ctx, client, bucket, object, key); err != nil {
+			return moved, fmt.Errorf("failed to move %v: %w", *object.Key, err)
+		}
+		moved = append(moved, key)
+	}
+	return moved, nil
+}
+
+// moveObject copies object to key in the same bucket, then deletes it.
+func moveObject(ctx context.Context, client S3API, bucket string, object s3types.Object, key string) error {
+	source := (&url.URL{Path: bucket + "/" + *object.Key}).EscapedPath()
+	size := uint64(0)
+	if object.Size != nil {
+		size = uint64(*object.Size)
+	}
+	if size <= maxCopyObjectBytes {
+		if _, err := client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     &bucket,
+			Key:        &key,
+			CopySource: &source,
+		}); err != nil {
+			return err
+		}
+	} else {
+		head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    object.Key,
+		})
+		if err != nil {
+			return err
+		}
+		if err := copyMultipart(ctx, client, source, size, bucket, key, head.Metadata); err != nil {
+			return err
+		}
+	}
+	_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    object.Key,
+	})
+	return err
+}
+
+// moveCatalogEntries moves the entries of the backups now at keys under to
+// from the catalog under from to the catalog under to.
+func moveCatalogEntries(ctx context.Context, client S3API, bucket, from, to string, keys []string) error {
+	if _, etag, err := ReadCatalog(ctx, client, bucket, from); err != nil || etag == "" {
+		// There is no catalog under the old prefix, or it is unreadable.
+		return err
+	}
+	var entries []*CatalogEntry
+	err := UpdateCatalog(ctx, client, bucket, from, func(catalog *Catalog) {
+		entries = nil
+		var kept []*CatalogEntry
+		for _, entry := range catalog.Backups {
+			name := strings.TrimPrefix(entry.Key, from)
+			if strings.HasPrefix(entry.Key, from) && slices.Contains(keys, to+name) {
+				moved := *entry
+				moved.Key = to + name
+				entries = append(entries, &moved)
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		catalog.Backups = kept
+	})
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	return UpdateCatalog(ctx, client, bucket, to, func(catalog *Catalog) {
+		for _, entry := range entries {
+			if catalog.Entry(entry.Key) == nil {
+				catalog.Backups = append(catalog.Backups, entry)
+			}
+		}
+		slices.SortFunc(catalog.Backups, func(a, b *CatalogEntry) int {
+			return a.Time.Compare(b.Time)
+		})
+	})
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// ErrBadOwnership is returned by Ownership.Validate if the expected owner or
+// ACL is invalid.
+var ErrBadOwnership = errors.New("invalid bucket ownership")
+
+// Ownership describes the account owning a bucket written to from another
+// account, so requests do not reach a bucket of the same name owned by
+// someone else, and the objects written belong to the bucket's owner.
+type Ownership struct {
+
+	// ExpectedOwner is the ID of the AWS account expected to own the
+	// bucket. Requests fail with 403 Forbidden if it does not. If empty,
+	// the owner is not checked.
+	ExpectedOwner string
+
+	// ACL is the canned ACL applied to every object written, e.g.
+	// s3types.ObjectCannedACLBucketOwnerFullControl, so the bucket's owner
+	// can read objects written by another account to a bucket that still
+	// has ACLs enabled. Buckets with the BucketOwnerEnforced object
+	// ownership setting, the default since April 2023, reject any other
+	// ACL. If empty, no ACL is sent.
+	ACL s3types.ObjectCannedACL
+}
+
+// Validate returns an error wrapping ErrBadOwnership if ExpectedOwner is not
+// a 12-digit account ID, or ACL is not a canned ACL.
+func (o Ownership) Validate() error {
+	if o.ExpectedOwner != "" {
+		if len(o.ExpectedOwner) != 12 || !isDigits(o.ExpectedOwner) {
+			return fmt.Errorf("%w: expected owner %q is not a 12-digit account ID", ErrBadOwnership, o.ExpectedOwner)
+		}
+	}
+	if o.ACL != "" && !slices.Contains(o.ACL.Values(), o.ACL) {
+		return fmt.Errorf("%w: unknown canned ACL %q", ErrBadOwnership, o.ACL)
+	}
+	return nil
+}
+
+// isDigits returns whether s consists only of ASCII digits.
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ClientOption returns an option for s3.NewFromConfig applying o to every
+// request, including those made by the functions of this package, which do
+// not take it as an argument.
+func (o Ownership) ClientOption() func(*s3.Options) {
+	return func(options *s3.Options) {
+		if o.ExpectedOwner != "" {
+			options.APIOptions = append(options.APIOptions,
+				smithyhttp.SetHeaderValue("X-Amz-Expected-Bucket-Owner", o.ExpectedOwner))
+		}
+		if o.ACL != "" {
+			options.APIOptions = append(options.APIOptions, o.addACL)
+		}
+	}
+}
+
+// addACL adds middleware setting o.ACL on each request creating an object
+// that does not already specify one.
+func (o Ownership) addACL(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("PlexbackupACL",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			switch input := in.Parameters.(type) {
+			case *s3.PutObjectInput:
+				if input.ACL == "" {
+					input.ACL = o.ACL
+				}
+			case *s3.CreateMultipartUploadInput:
+				if input.ACL == "" {
+					input.ACL = o.ACL
+				}
+			case *s3.CopyObjectInput:
+				if input.ACL == "" {
+					input.ACL = o.ACL
+				}
+			}
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+}
@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// partSuffix follows the key of a backup, then the number of the part, to
+// form the key of each of its parts, e.g. "2024-04-20T06:22:01Z.tar.zst.part1".
+// Part keys do not end in backupSuffix, so are not mistaken for backups.
+const partSuffix = ".part"
+
+// Part is an object holding one of Opts.Parts of a backup. Each is a complete
+// archive in the same format as the backup object, so can be read alone.
+type Part struct {
+
+	// Key is the key of the part within Opts.Bucket.
+	Key string
+
+	// UncompressedBytes and CompressedBytes are the sizes of the part's tar
+	// stream and object.
+	UncompressedBytes uint64
+	CompressedBytes   uint64
+
+	// SHA256 is the hex-encoded SHA-256 digest of the object.
+	SHA256 string
+
+	// metadata is that of the object, needed to copy it in parts.
+	metadata map[string]string
+}
+
+// partKey returns the key of the nth part of the backup at key, counting from
+// 1.
+func partKey(key string, n int) string {
+	return key + partSuffix + strconv.Itoa(n)
+}
+
+// partNumber returns the number of the part at key, or 0 if key is not that
+// of a part.
+func partNumber(key string) int {
+	i := strings.LastIndex(key, backupSuffix+partSuffix)
+	if i < 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(key[i+len(backupSuffix+partSuffix):])
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
+
+// isBackupObject returns whether key is that of a backup or one of its parts.
+func isBackupObject(key string) bool {
+	return isBackupKey(key) || partNumber(key) > 0
+}
+
+// PartObjects lists the parts of the backup at key, in order. A backup taken
+// without Opts.Parts has none.
+func PartObjects(ctx context.Context, client S3API, bucket, key string) ([]s3types.Object, error) {
+	prefix := key + partSuffix
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	var parts []s3types.Object
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			if partNumber(*object.Key) > 0 {
+				parts = append(parts, object)
+			}
+		}
+	}
+	// part10 sorts before part2 lexically.
+	slices.SortFunc(parts, func(a, b s3types.Object) int {
+		return partNumber(*a.Key) - partNumber(*b.Key)
+	})
+	return parts, nil
+}
+
+// PartKeys returns the keys of the parts of the backup at key, in order, which
+// are restored along with it.
+func PartKeys(ctx context.Context, client S3API, bucket, key string) ([]string, error) {
+	parts, err := PartObjects(ctx, client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(parts))
+	for i, object := range parts {
+		keys[i] = *object.Key
+	}
+	return keys, nil
+}
+
+// validateParts checks each of o.Parts is a distinct subtree of one of
+// o.Directories. Nested parts would be archived twice.
+func (o *Opts) validateParts() error {
+	for i, part := range o.Parts {
+		if part != path.Clean(part) || path.IsAbs(part) {
+			return fmt.Errorf("%w: %q must be a clean relative path", ErrBadPart, part)
+		}
+		directory := o.partDirectory(part)
+		if directory == "" {
+			return fmt.Errorf("%w: %q must be within the base name of a directory backed up, e.g. %q", ErrBadPart, part, path.Join(filepath.Base(o.Directories[0]), "Metadata"))
+		}
+		if !o.RemoteDirectories {
+			if _, err := os.Stat(filepath.Join(filepath.Dir(directory), filepath.FromSlash(part))); err != nil {
+				return fmt.Errorf("%w: %w", ErrBadPart, err)
+			}
+		}
+		for _, other := range o.Parts[:i] {
+			if other == part || strings.HasPrefix(part, other+"/") || strings.HasPrefix(other, part+"/") {
+				return fmt.Errorf("%w: %q and %q overlap", ErrBadPart, other, part)
+			}
+		}
+	}
+	return nil
+}
+
+// partDirectory returns the member of o.Directories containing part, or the
+// empty string if none does.
+func (o *Opts) partDirectory(part string) string {
+	base, _, ok := strings.Cut(part, "/")
+	if !ok {
+		return ""
+	}
+	for _, directory := range o.Directories {
+		if filepath.Base(directory) == base {
+			return directory
+		}
+	}
+	return ""
+}
+
+// partArchiveCommand returns the name and arguments of the tar command writing
+// the uncompressed archive of part to stdout. Paths within it are the same as
+// they would be in the backup object.
+func (o *Opts) partArchiveCommand(part string) (string, []string) {
+	args := []string{"-cf", "-"}
+	for _, exclude := range o.excludes() {
+		args = append(args, "--exclude", exclude)
+	}
+	args = append(args, o.reflinkArgs()...)
+	args = append(args, "-C", filepath.Dir(o.partDirectory(part)), part)
+	return o.deprioritise("tar", args)
+}
@@ -0,0 +1,38 @@
+package backup
+
+import "testing"
+
+func TestPartNumber(t *testing.T) {
+	for _, tc := range []struct {
+		key    string
+		number int
+		object bool
+	}{
+		{"plex/2024-04-20T06:22:01Z.tar.zst", 0, true},
+		{"plex/2024-04-20T06:22:01Z.tar.zst.part1", 1, true},
+		{"plex/2024-04-20T06:22:01Z-x.tar.zst.part12", 12, true},
+		{"plex/2024-04-20T06:22:01Z.tar.zst.part0", 0, false},
+		{"plex/2024-04-20T06:22:01Z.tar.zst.part-1", 0, false},
+		{"plex/2024-04-20T06:22:01Z.tar.zst.part", 0, false},
+		{"plex/2024-04-20T06:22:01Z.tar.zst.partx", 0, false},
+		{"plex/2024-04-20T06:22:01Z.tar.zst.seed1", 0, false},
+		{"plex/2024-04-20T06:22:01Z.tar.part1", 0, false},
+		{"plex/catalog.json", 0, false},
+	} {
+		if n := partNumber(tc.key); n != tc.number {
+			t.Errorf("partNumber(%q) = %v, want %v", tc.key, n, tc.number)
+		}
+		if object := isBackupObject(tc.key); object != tc.object {
+			t.Errorf("isBackupObject(%q) = %v, want %v", tc.key, object, tc.object)
+		}
+	}
+}
+
+func TestPartKey(t *testing.T) {
+	key := "plex/2024-04-20T06:22:01Z.tar.zst"
+	for n := 1; n <= 3; n++ {
+		if got := partNumber(partKey(key, n)); got != n {
+			t.Errorf("partNumber(partKey(%q, %v)) = %v", key, n, got)
+		}
+	}
+}
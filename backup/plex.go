@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultPlexURL is where Plex Media Server listens by default.
+const DefaultPlexURL = "http://127.0.0.1:32400"
+
+// plexBinary is the location of the server in the official Linux packages.
+const plexBinary = "/usr/lib/plexmediaserver/Plex Media Server"
+
+// PlexVersion returns the version of Plex Media Server, e.g.
+// "1.40.2.8395-c67dce28e". It is read from the unauthenticated /identity
+// endpoint of the server at url. If that fails, e.g. because the server is
+// stopped, r is used to ask the binary at its default location instead.
+func PlexVersion(ctx context.Context, r Runner, url string) (string, error) {
+	version, apiErr := identityVersion(ctx, url)
+	if apiErr == nil {
+		return version, nil
+	}
+	var stdout bytes.Buffer
+	if err := r.Run(ctx, &stdout, plexBinary, "--version"); err != nil {
+		return "", errors.Join(apiErr, err)
+	}
+	// The binary prefixes the version with a "v".
+	return strings.TrimPrefix(strings.TrimSpace(stdout.String()), "v"), nil
+}
+
+// identityVersion queries Plex's /identity endpoint for its version.
+func identityVersion(ctx context.Context, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(url, "/")+"/identity", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status from /identity: %v", resp.Status)
+	}
+	var identity struct {
+		Version string `xml:"version,attr"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		return "", err
+	}
+	if identity.Version == "" {
+		return "", errors.New("/identity did not include a version")
+	}
+	return identity.Version, nil
+}
+
+// plexVersion returns the version of Plex if o.PlexURL is set, or the empty
+// string if it is not or detection fails. Failure is only logged, as the
+// version is informational.
+func (o *Opts) plexVersion(ctx context.Context, logger *slog.Logger) string {
+	if o.PlexURL == "" {
+		return ""
+	}
+	version, err := PlexVersion(ctx, o.runner(), o.PlexURL)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to detect Plex version",
+			slog.String("error", err.Error()))
+		return ""
+	}
+	logger.DebugContext(ctx, "detected Plex version", slog.String("version", version))
+	return version
+}
+
+// AwaitPlex waits for Plex to respond at o.PlexURL after it has been started,
+// for up to o.StartGrace. It does nothing if either is unset.
+func (o *Opts) AwaitPlex(ctx context.Context, logger *slog.Logger) {
+	if o.StartGrace == 0 || o.PlexURL == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, o.StartGrace)
+	defer cancel()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		_, err := identityVersion(ctx, o.PlexURL)
+		if err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			logger.WarnContext(ctx, "Plex did not respond after starting",
+				slog.Duration("start_grace", o.StartGrace),
+				slog.String("error", err.Error()))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// servicePatterns match the systemd units Plex Media Server is installed as:
+// plexmediaserver.service by the official packages, and
+// snap.plexmediaserver.plexmediaserver.service by the snap.
+var servicePatterns = []string{"plexmediaserver*.service", "snap.plexmediaserver.*.service"}
+
+// DetectService returns the name of the systemd unit running Plex Media
+// Server, using r to query systemctl. An error listing the candidates is
+// returned unless exactly one is found.
+func DetectService(ctx context.Context, r Runner) (string, error) {
+	var stdout bytes.Buffer
+	args := append([]string{"list-units", "--all", "--plain", "--no-legend", "--type=service"}, servicePatterns...)
+	if err := r.Run(ctx, &stdout, "systemctl", args...); err != nil {
+		return "", fmt.Errorf("failed to list units: %w", err)
+	}
+	var units []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			units = append(units, fields[0])
+		}
+	}
+	switch len(units) {
+	case 0:
+		return "", errors.New("no Plex Media Server unit found")
+	case 1:
+		return units[0], nil
+	default:
+		return "", fmt.Errorf("found several Plex Media Server units: %v", strings.Join(units, ", "))
+	}
+}
@@ -0,0 +1,147 @@
+package backup
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Progress is a snapshot of how far through a backup we are.
+type Progress struct {
+
+	// ArchivedBytes is the number of uncompressed bytes produced by tar so
+	// far.
+	ArchivedBytes uint64
+
+	// UploadedBytes is the number of compressed bytes consumed by the
+	// uploader so far. Parts are buffered before being sent, so this slightly
+	// leads the bytes actually transferred.
+	UploadedBytes uint64
+
+	// EstimatedBytes is the expected total of ArchivedBytes, based on the size
+	// of the files to be archived. It is calculated concurrently with the
+	// backup, so is zero until the estimate is available.
+	EstimatedBytes uint64
+
+	// Elapsed is the time since archiving began.
+	Elapsed time.Duration
+}
+
+// Throughput returns the average rate at which data has been archived, in
+// bytes per second.
+func (p Progress) Throughput() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.ArchivedBytes) / p.Elapsed.Seconds()
+}
+
+// Fraction returns the proportion of the estimated size archived so far,
+// between 0 and 1, or -1 if there is no estimate.
+func (p Progress) Fraction() float64 {
+	if p.EstimatedBytes == 0 {
+		return -1
+	}
+	return min(float64(p.ArchivedBytes)/float64(p.EstimatedBytes), 1)
+}
+
+// ETA returns the estimated time remaining until archiving completes, or
+// zero if it cannot be estimated.
+func (p Progress) ETA() time.Duration {
+	throughput := p.Throughput()
+	if p.EstimatedBytes == 0 || throughput == 0 || p.ArchivedBytes >= p.EstimatedBytes {
+		return 0
+	}
+	remaining := float64(p.EstimatedBytes - p.ArchivedBytes)
+	return time.Duration(remaining / throughput * float64(time.Second))
+}
+
+// excluded returns whether path would be omitted by tar given the exclude
+// patterns. Like tar, a pattern matches if it matches any component of the
+// path.
+func excluded(path string, patterns []string) bool {
+	_, ok := excludedBy(path, patterns)
+	return ok
+}
+
+// excludedBy returns the first of patterns matching a component of path, and
+// whether there was one.
+func excludedBy(path string, patterns []string) (string, bool) {
+	for _, component := range strings.Split(filepath.ToSlash(path), "/") {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, component); ok {
+				return pattern, true
+			}
+		}
+	}
+	return "", false
+}
+
+// treeSize describes the regular files under the directories being backed up.
+type treeSize struct {
+
+	// included is the total size of the files that would not be excluded.
+	// This approximates the size of the tar stream, ignoring headers and
+	// padding.
+	included uint64
+
+	// excluded is the total size of the files omitted by each exclude
+	// pattern, including those matching none. A file matching several is
+	// attributed to the first.
+	excluded map[string]uint64
+}
+
+// measureTree returns the sizes of the regular files under directories,
+// given the exclude patterns. Unreadable entries are skipped.
+func measureTree(ctx context.Context, directories, patterns []string) *treeSize {
+	size := &treeSize{
+		excluded: map[string]uint64{},
+	}
+	for _, pattern := range patterns {
+		size.excluded[pattern] = 0
+	}
+	for _, directory := range directories {
+		filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(filepath.Dir(directory), path)
+			if pattern, ok := excludedBy(rel, patterns); ok {
+				size.excluded[pattern] += diskUsage(ctx, path)
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() {
+				if info, err := d.Info(); err == nil {
+					size.included += uint64(info.Size())
+				}
+			}
+			return nil
+		})
+	}
+	return size
+}
+
+// diskUsage returns the total size of the regular files at or under path.
+func diskUsage(ctx context.Context, path string) uint64 {
+	var total uint64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += uint64(info.Size())
+			}
+		}
+		return nil
+	})
+	return total
+}
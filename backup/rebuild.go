@@ -0,0 +1,196 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RebuildResult describes the changes made to a catalog by RebuildCatalog.
+type RebuildResult struct {
+
+	// Added are the keys of backups that had no entry.
+	Added []string
+
+	// Pruned are the keys of backups whose entry was available, but which
+	// no longer exist.
+	Pruned []string
+
+	// Incomplete are the keys of backups missing some of their parts, e.g.
+	// as a prune failed part way, which are not added.
+	Incomplete []string
+}
+
+// errIncomplete is returned by rebuildEntry if parts of the backup are
+// missing.
+var errIncomplete = errors.New("backup is incomplete")
+
+// RebuildCatalog reconstructs the catalog of the backups under prefix from the
+// objects there, so backups taken without Opts.Catalog, or before it existed,
+// can be used by the features reading it. Existing entries are kept, as they
+// record more than can be recovered. Each backup without one is added, its time
+// parsed from its key, and its size, Plex version and label read from its
+// object and parts. The uncompressed size is read from the trailer of
+// unencrypted backups that have one. Backups missing parts are skipped. The
+// SHA-256 digest cannot be recovered without downloading the backup, so is left
+// empty, and restores of these backups are not checked against it. Entries of
+// backups that no longer exist are marked pruned.
+func RebuildCatalog(ctx context.Context, client S3API, bucket, prefix string) (result *RebuildResult, err error) {
+	ctx, span := tracer.Start(ctx, "rebuild catalog", trace.WithAttributes(
+		attribute.String("prefix", prefix)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	objects, err := ListBackups(ctx, client, bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	catalog, _, err := ReadCatalog(ctx, client, bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+	// HEAD requests are only made for backups missing from the catalog read
+	// now; one added concurrently is skipped when updating.
+	var entries []*CatalogEntry
+	var incomplete []string
+	for _, object := range objects {
+		if catalog.Entry(*object.Key) != nil {
+			continue
+		}
+		entry, err := rebuildEntry(ctx, client, bucket, prefix, object)
+		if errors.Is(err, errIncomplete) {
+			incomplete = append(incomplete, *object.Key)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", *object.Key, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	result = &RebuildResult{}
+	err = UpdateCatalog(ctx, client, bucket, prefix, func(catalog *Catalog) {
+		*result = RebuildResult{
+			Incomplete: incomplete,
+		}
+		for _, entry := range entries {
+			if catalog.Entry(entry.Key) == nil {
+				catalog.Backups = append(catalog.Backups, entry)
+				result.Added = append(result.Added, entry.Key)
+			}
+		}
+		for _, entry := range catalog.Backups {
+			if entry.Status != CatalogAvailable {
+				continue
+			}
+			if !slices.ContainsFunc(objects, func(object s3types.Object) bool {
+				return *object.Key == entry.Key
+			}) {
+				entry.Status = CatalogPruned
+				result.Pruned = append(result.Pruned, entry.Key)
+			}
+		}
+		slices.SortStableFunc(catalog.Backups, func(a, b *CatalogEntry) int {
+			return a.Time.Compare(b.Time)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update catalog: %w", err)
+	}
+	return result, nil
+}
+
+// rebuildEntry returns the catalog entry of the backup object under prefix,
+// reconstructed from its key, metadata and parts.
+func rebuildEntry(ctx context.Context, client S3API, bucket, prefix string, object s3types.Object) (*CatalogEntry, error) {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    object.Key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry := &CatalogEntry{
+		Key:             *object.Key,
+		CompressedBytes: uint64(aws.ToInt64(head.ContentLength)),
+		PlexVersion:     head.Metadata["plex-version"],
+		Label:           KeyLabel(prefix, *object.Key),
+		Status:          CatalogAvailable,
+	}
+	t, ok := keyTime(prefix, *object.Key)
+	if !ok {
+		t = aws.ToTime(object.LastModified)
+	}
+	entry.Time = t.UTC()
+	encrypted := head.Metadata[encryptionMetadata] != ""
+	if !encrypted && entry.CompressedBytes > 0 {
+		entry.UncompressedBytes, err = trailerBytes(ctx, client, bucket, *object.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	parts, err := PartObjects(ctx, client, bucket, *object.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list parts: %w", err)
+	}
+	if n, err := strconv.Atoi(head.Metadata["parts"]); err == nil && n != len(parts) {
+		return nil, fmt.Errorf("%w: %v of its %v parts exist", errIncomplete, len(parts), n)
+	}
+	entry.Parts = len(parts)
+	for _, part := range parts {
+		entry.CompressedBytes += uint64(aws.ToInt64(part.Size))
+		if entry.UncompressedBytes == 0 || encrypted {
+			continue
+		}
+		// All or nothing, so the size is never understated.
+		uncompressed, err := trailerBytes(ctx, client, bucket, *part.Key)
+		if err != nil {
+			return nil, err
+		}
+		if uncompressed == 0 {
+			entry.UncompressedBytes = 0
+			continue
+		}
+		entry.UncompressedBytes += uncompressed
+	}
+	return entry, nil
+}
+
+// trailerBytes returns the uncompressed size recorded in the trailer of the
+// unencrypted object at key, or 0 if it has none, reading only the end of the
+// object.
+func trailerBytes(ctx context.Context, client S3API, bucket, key string) (uint64, error) {
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Range:  aws.String("bytes=-" + strconv.Itoa(maxTrailerBytes)),
+	}, func(o *s3.Options) {
+		// Any checksum returned is of the whole object, so cannot be
+		// validated against part of it.
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read trailer: %w", err)
+	}
+	defer output.Body.Close()
+	tail, err := io.ReadAll(output.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read trailer: %w", err)
+	}
+	tr, _ := (&tailReader{tail: tail}).trailer()
+	if tr == nil {
+		return 0, nil
+	}
+	return tr.UncompressedBytes, nil
+}
@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+)
+
+// reflinkSuffix is appended to the name of each clone made by Opts.Reflink,
+// and removed from its name in the archive by tar.
+const reflinkSuffix = ".plexbackup-reflink"
+
+// reflinkAttempts is how many times the databases are cloned before giving up
+// if Plex keeps writing to them while they are.
+const reflinkAttempts = 5
+
+// reflinkArgs returns the tar arguments archiving the clones made by
+// reflinkDatabases in place of the live databases and write-ahead logs, or
+// nil if o.Reflink is not set. They must precede the directories.
+func (o *Opts) reflinkArgs() []string {
+	if !o.Reflink {
+		return nil
+	}
+	var args []string
+	for _, database := range LibraryDatabases {
+		args = append(args, "--exclude", database, "--exclude", database+"-wal")
+	}
+	return append(args, `--transform=s,\`+reflinkSuffix+`$,,`)
+}
+
+// reflinkDatabases clones each library database in o.Directories and its
+// write-ahead log alongside them, to be archived in their place. The log is
+// cloned first, so a checkpoint between the two only writes pages to the
+// database that the cloned log also holds. If either changes while they are
+// being cloned, they are cloned again. The returned function removes the
+// clones, and must be called once they have been archived. The error wraps
+// ErrArchive, and errors.ErrUnsupported if the filesystem does not support
+// reflinks.
+func (o *Opts) reflinkDatabases(ctx context.Context, logger *slog.Logger) (func(), error) {
+	var clones []string
+	remove := func() {
+		for _, clone := range clones {
+			if err := os.Remove(clone); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.WarnContext(ctx, "failed to remove database clone",
+					slog.String("path", clone),
+					slog.String("error", err.Error()))
+				continue
+			}
+			o.Staging.Release(clone)
+		}
+	}
+	for _, directory := range o.Directories {
+		for _, database := range LibraryDatabases {
+			path := filepath.Join(directory, databasesDir, database)
+			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			for _, clone := range []string{path + "-wal" + reflinkSuffix, path + reflinkSuffix} {
+				// A clone left behind would be archived by a backup
+				// without Reflink.
+				if err := o.Staging.Register(clone); err != nil {
+					remove()
+					return nil, fmt.Errorf("%w: %w", ErrArchive, err)
+				}
+				clones = append(clones, clone)
+			}
+			if err := cloneDatabase(ctx, logger, path); err != nil {
+				remove()
+				return nil, fmt.Errorf("%w: failed to reflink %v: %w", ErrArchive, path, err)
+			}
+		}
+	}
+	return remove, nil
+}
+
+// cloneDatabase clones the database at path, and its write-ahead log if it
+// has one, until neither changes while they are cloned.
+func cloneDatabase(ctx context.Context, logger *slog.Logger, path string) error {
+	wal := path + "-wal"
+	for attempt := 1; ; attempt++ {
+		before := statFiles(path, wal)
+		err := reflink(wal, wal+reflinkSuffix)
+		if errors.Is(err, os.ErrNotExist) {
+			// The log was checkpointed and removed, so the database
+			// alone is complete. A clone left by an earlier run must not
+			// be archived with it.
+			err = os.Remove(wal + reflinkSuffix)
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		}
+		if err == nil {
+			err = reflink(path, path+reflinkSuffix)
+		}
+		if err != nil {
+			return err
+		}
+		if maps.Equal(before, statFiles(path, wal)) {
+			logger.DebugContext(ctx, "cloned database",
+				slog.String("database", path),
+				slog.Int("attempt", attempt))
+			return nil
+		}
+		if attempt == reflinkAttempts {
+			return fmt.Errorf("changed while cloning %v times in a row", attempt)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,47 @@
+//go:build linux
+
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes dst a copy of src sharing its blocks, replacing any existing
+// file, with the same mode, owner and modification time. The error wraps
+// errors.ErrUnsupported if the filesystem does not support reflinks.
+func reflink(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	switch {
+	case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.EXDEV),
+		errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOTTY):
+		err = fmt.Errorf("%w: filesystem does not support reflinks: %w", errors.ErrUnsupported, err)
+	case err == nil:
+		if stat, ok := info.Sys().(*unix.Stat_t); ok {
+			// Only possible as root, otherwise the clone is owned by us.
+			os.Chown(dst, int(stat.Uid), int(stat.Gid))
+		}
+		err = os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	if err = errors.Join(err, out.Close()); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package backup
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink returns an error wrapping errors.ErrUnsupported, as reflinks are
+// only supported on Linux.
+func reflink(src, dst string) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RekeyResult describes the outcome of Rekey for a single backup.
+type RekeyResult struct {
+	Key string
+
+	// Encrypted is false if the backup is not encrypted, so was left alone.
+	// Only the data key is replaced, so an unencrypted backup cannot be
+	// encrypted this way.
+	Encrypted bool
+}
+
+// Rekey replaces the wrapped data keys of the encrypted backups under prefix
+// in bucket, so they can be decrypted with each of keyIDs, and only those,
+// e.g. after rotating to a new KMS key. The content of each backup, encrypted
+// by its data key, is unchanged, so is not downloaded; the data key is
+// decrypted with any KMS key that wrapped it, then wrapped again with each of
+// keyIDs, and the object copied over itself with the new metadata. Each part of
+// a backup has its own data key, so is rekeyed in the same way. The backups
+// processed are returned, even if an error occurs part way.
+func Rekey(ctx context.Context, client S3API, keys KMSAPI, bucket, prefix string, keyIDs []string) (results []*RekeyResult, err error) {
+	ctx, span := tracer.Start(ctx, "rekey", trace.WithAttributes(
+		attribute.String("prefix", prefix)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	backups, err := ListBackups(ctx, client, bucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	for _, object := range backups {
+		parts, err := PartObjects(ctx, client, bucket, *object.Key)
+		if err != nil {
+			return results, fmt.Errorf("failed to list parts of %v: %w", *object.Key, err)
+		}
+		for _, part := range parts {
+			if _, err := rekeyObject(ctx, client, keys, bucket, part, keyIDs); err != nil {
+				return results, fmt.Errorf("failed to rekey %v: %w", *part.Key, err)
+			}
+		}
+		encrypted, err := rekeyObject(ctx, client, keys, bucket, object, keyIDs)
+		if err != nil {
+			return results, fmt.Errorf("failed to rekey %v: %w", *object.Key, err)
+		}
+		results = append(results, &RekeyResult{
+			Key:       *object.Key,
+			Encrypted: encrypted,
+		})
+	}
+	return results, nil
+}
+
+// rekeyObject replaces the wrapped data keys of object, returning false if it
+// is not encrypted.
+func rekeyObject(ctx context.Context, client S3API, keys KMSAPI, bucket string, object s3types.Object, keyIDs []string) (bool, error) {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    object.Key,
+	})
+	if err != nil {
+		return false, err
+	}
+	plaintext, err := unwrapDataKey(ctx, keys, head.Metadata)
+	if err != nil || plaintext == nil {
+		return false, err
+	}
+	wrapped, err := wrapDataKey(ctx, keys, plaintext, keyIDs)
+	if err != nil {
+		return true, err
+	}
+
+	metadata := encryptionMetadataOf(wrapped)
+	for name, value := range head.Metadata {
+		if !isEncryptionMetadata(strings.ToLower(name)) {
+			metadata[name] = value
+		}
+	}
+	source := (&url.URL{Path: bucket + "/" + *object.Key}).EscapedPath()
+	size := uint64(0)
+	if object.Size != nil {
+		size = uint64(*object.Size)
+	}
+	if size > maxCopyObjectBytes {
+		return true, copyMultipart(ctx, client, source, size, bucket, *object.Key, metadata)
+	}
+	_, err = client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            &bucket,
+		Key:               object.Key,
+		CopySource:        &source,
+		Metadata:          metadata,
+		MetadataDirective: s3types.MetadataDirectiveReplace,
+		ContentType:       head.ContentType,
+		StorageClass:      s3types.StorageClass(head.StorageClass),
+	})
+	return true, err
+}
@@ -0,0 +1,245 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// databasesDir is the directory within the 'Plex Media Server' directory
+// containing Plex's SQLite databases.
+const databasesDir = "Plug-in Support/Databases"
+
+// LibraryDatabases are the names of the databases replaced by
+// RepairDatabases, which hold the library. Each may be accompanied by -wal and
+// -shm files.
+var LibraryDatabases = []string{
+	"com.plexapp.plugins.library.db",
+	"com.plexapp.plugins.library.blobs.db",
+}
+
+// sqliteSidecars are the suffixes of the files SQLite keeps alongside a
+// database in WAL mode. Their content only makes sense with the database they
+// were written with.
+var sqliteSidecars = []string{"-wal", "-shm"}
+
+// sidecars returns the names of the files SQLite may keep alongside database.
+func sidecars(database string) []string {
+	var names []string
+	for _, suffix := range sqliteSidecars {
+		names = append(names, database+suffix)
+	}
+	return names
+}
+
+// databaseBytes returns the total size of the library databases and their
+// sidecars in directories, or 0 if none contains them.
+func databaseBytes(directories []string) uint64 {
+	var total uint64
+	for _, directory := range directories {
+		for _, database := range LibraryDatabases {
+			for _, name := range append([]string{database}, sidecars(database)...) {
+				if info, err := os.Stat(filepath.Join(directory, databasesDir, name)); err == nil {
+					total += uint64(info.Size())
+				}
+			}
+		}
+	}
+	return total
+}
+
+// ErrRepair is wrapped by errors returned by RepairDatabases.
+var ErrRepair = errors.New("failed to repair databases")
+
+// RepairDatabases replaces Plex's library databases with those in the backup
+// at key, the most common recovery from database corruption, leaving the rest
+// of the data directory alone. The databases are downloaded alongside the live
+// ones while Plex is still running, and checked against digest if non-empty,
+// so the service is only stopped to swap them in. The live databases and any
+// -wal and -shm files are renamed with a ".corrupt-<time>" suffix rather than
+// deleted, as a -wal file left behind would be applied to the restored
+// database. The service is started again even if swapping fails. The paths of
+// the restored files are returned. The error wraps ErrRepair, or ErrStop or
+// ErrStart.
+func (o *Opts) RepairDatabases(ctx context.Context, logger *slog.Logger, client S3API, key, digest string) ([]string, error) {
+	if o.NoPause {
+		return nil, fmt.Errorf("%w: Plex must be stopped to replace its databases", ErrRepair)
+	}
+	dir := ""
+	for _, directory := range o.Directories {
+		if info, err := os.Stat(filepath.Join(directory, databasesDir)); err == nil && info.IsDir() {
+			dir = directory
+			break
+		}
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("%w: no directory contains %v", ErrRepair, databasesDir)
+	}
+	databases := filepath.Join(dir, databasesDir)
+
+	logger.InfoContext(ctx, "downloading databases", slog.String("key", key))
+	staged, err := o.stageDatabases(ctx, client, key, digest, filepath.Base(dir), databases)
+	registered := slices.Collect(maps.Values(staged))
+	defer func() {
+		// Only those not moved into place remain.
+		for _, name := range staged {
+			os.Remove(name)
+		}
+		for _, name := range registered {
+			if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+				o.Staging.Release(name)
+			}
+		}
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRepair, err)
+	}
+
+	logger.InfoContext(ctx, "stopping service", slog.String("service", o.Service))
+	if err := o.ControlService(ctx, "stop"); err != nil {
+		return nil, err
+	}
+	restored, swapErr := swapDatabases(databases, staged, time.Now())
+	if swapErr != nil {
+		swapErr = fmt.Errorf("%w: %w", ErrRepair, swapErr)
+	}
+	logger.InfoContext(ctx, "starting service", slog.String("service", o.Service))
+	startCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), startTimeout)
+	defer cancel()
+	if err := o.ControlService(startCtx, "start"); err != nil {
+		return restored, errors.Join(swapErr, err)
+	}
+	o.AwaitPlex(startCtx, logger)
+	return restored, swapErr
+}
+
+// stageDatabases extracts the library databases and their sidecars from the
+// backup at key into temporary files in databases, owned like the live files
+// they will replace, returning a map from the live name to the temporary
+// path. base is the name of the directory within the archive.
+func (o *Opts) stageDatabases(ctx context.Context, client S3API, key, digest, base, databases string) (map[string]string, error) {
+	wanted := map[string]bool{}
+	for _, name := range LibraryDatabases {
+		wanted[name] = true
+		for _, sidecar := range sidecars(name) {
+			wanted[sidecar] = true
+		}
+	}
+
+	hash := sha256.New()
+	body, err := openBackup(ctx, client, o.KMS, o.Bucket, key, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	dec, err := decompress(ctx, body, key, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	staged := map[string]string{}
+	archive := tar.NewReader(dec)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return staged, err
+		}
+		dir, name := path.Split(path.Clean(header.Name))
+		if header.Typeflag != tar.TypeReg || path.Clean(dir) != path.Join(base, databasesDir) || !wanted[name] {
+			continue
+		}
+		if err := checkSpace(databases, "staging "+name, uint64(header.Size), o.SpaceMargin); err != nil {
+			return staged, err
+		}
+		temp := filepath.Join(databases, ".plexbackup-"+name)
+		if err := o.Staging.Register(temp); err != nil {
+			return staged, err
+		}
+		staged[name] = temp
+		if err := writeFile(temp, archive, header.FileInfo().Mode().Perm()); err != nil {
+			return staged, err
+		}
+		live := filepath.Join(databases, name)
+		if _, err := os.Stat(live); err == nil {
+			if err := o.runner().Run(ctx, nil, "chown", "--reference="+live, temp); err != nil {
+				return staged, fmt.Errorf("failed to change owner of %v: %w", temp, err)
+			}
+		}
+	}
+	if _, err := io.Copy(io.Discard, dec); err != nil {
+		return staged, err
+	}
+	if digest != "" {
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != digest {
+			return staged, fmt.Errorf("SHA-256 of %v is %v, expected %v", key, actual, digest)
+		}
+	}
+	for _, name := range LibraryDatabases {
+		if _, ok := staged[name]; !ok {
+			return staged, fmt.Errorf("%v does not contain %v", key, name)
+		}
+	}
+	return staged, nil
+}
+
+// writeFile writes the content of r to a new file at name with mode perm.
+func writeFile(name string, r io.Reader, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	// The databases must be durable before the originals are moved aside.
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// swapDatabases moves the live library databases and their sidecars in
+// databases aside with a suffix derived from now, then renames the staged
+// files into place, removing each from staged. The paths of the restored files
+// are returned.
+func swapDatabases(databases string, staged map[string]string, now time.Time) ([]string, error) {
+	suffix := ".corrupt-" + now.UTC().Format("20060102T150405Z")
+	for _, database := range LibraryDatabases {
+		for _, name := range append([]string{database}, sidecars(database)...) {
+			live := filepath.Join(databases, name)
+			if err := os.Rename(live, live+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	var restored []string
+	for name, temp := range staged {
+		live := filepath.Join(databases, name)
+		if err := os.Rename(temp, live); err != nil {
+			return restored, err
+		}
+		delete(staged, name)
+		restored = append(restored, live)
+	}
+	slices.Sort(restored)
+	return restored, nil
+}
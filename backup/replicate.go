@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxCopyObjectBytes is the largest object CopyObject can copy in a single
+// request. Larger objects are copied in parts.
+const maxCopyObjectBytes = 5 << 30
+
+// copyPartBytes is the size of each part of a multipart copy. 10,000 parts
+// allow objects up to S3's limit of 5 TiB.
+const copyPartBytes = 512 << 20
+
+// Replicate copies the backup described by result, and its parts, from bucket
+// to the same keys in replicaBucket, server-side, so it is not uploaded twice.
+// client must be for replicaBucket's region, which may differ from bucket's.
+// The parts are copied first, so the backup only appears in replicaBucket
+// once complete. The error wraps ErrReplicate.
+func Replicate(ctx context.Context, client S3API, bucket, replicaBucket string, result *Result) (err error) {
+	ctx, span := tracer.Start(ctx, "replicate", trace.WithAttributes(
+		attribute.String("key", result.Key),
+		attribute.String("replica_bucket", replicaBucket)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	for _, part := range result.Parts {
+		if err := replicateObject(ctx, client, bucket, replicaBucket, part.Key, part.CompressedBytes, part.metadata); err != nil {
+			return err
+		}
+	}
+	return replicateObject(ctx, client, bucket, replicaBucket, result.Key, result.objectBytes, result.metadata)
+}
+
+// replicateObject copies the object at key of size bytes from bucket to
+// replicaBucket. The error wraps ErrReplicate.
+func replicateObject(ctx context.Context, client S3API, bucket, replicaBucket, key string, size uint64, metadata map[string]string) error {
+	source := (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+	var err error
+	if size <= maxCopyObjectBytes {
+		_, err = client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     &replicaBucket,
+			Key:        &key,
+			CopySource: &source,
+		})
+	} else {
+		err = copyMultipart(ctx, client, source, size, replicaBucket, key, metadata)
+	}
+	if err != nil {
+		return fmt.Errorf("%w %v to %v: %w", ErrReplicate, key, replicaBucket, err)
+	}
+	return nil
+}
+
+// copyMultipart copies size bytes of source to key in bucket with
+// UploadPartCopy, for objects too large for CopyObject. Unlike CopyObject,
+// this does not copy the source's metadata. The upload is aborted on failure.
+func copyMultipart(ctx context.Context, client S3API, source string, size uint64, bucket, key string, metadata map[string]string) error {
+	upload, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   &bucket,
+		Key:      &key,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return err
+	}
+	var parts []s3types.CompletedPart
+	for offset, number := uint64(0), int32(1); offset < size; offset, number = offset+copyPartBytes, number+1 {
+		last := min(offset+copyPartBytes, size) - 1
+		part, err := client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          &bucket,
+			Key:             &key,
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int32(number),
+			CopySource:      &source,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, last)),
+		})
+		if err != nil {
+			abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+			defer cancel()
+			client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+				Bucket:   &bucket,
+				Key:      &key,
+				UploadId: upload.UploadId,
+			})
+			return err
+		}
+		parts = append(parts, s3types.CompletedPart{
+			ETag:       part.CopyPartResult.ETag,
+			PartNumber: aws.Int32(number),
+		})
+	}
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &bucket,
+		Key:             &key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
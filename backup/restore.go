@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrRestore is wrapped by errors returned by Restore.
+var ErrRestore = errors.New("failed to restore")
+
+// Restore downloads the backup at key in bucket and extracts it with tar into
+// dir, which is created if it does not exist, and must otherwise be empty, so
+// nothing is overwritten. Each directory that was backed up becomes a
+// subdirectory of dir. Any parts of the backup are then extracted into the same
+// place, reassembling the directories. tar preserves ownership if run as root.
+// Each object is downloaded with concurrent ranged GETs tuned by d, into a
+// temporary file in the parent of dir unless d.Stream is set, in which case
+// that need not have room for the largest object as well as the extracted
+// files. If digest is non-empty, the backup object is checked against it, as is
+// each object against its trailer, if it has one; as files are extracted before
+// the checks complete, they should not be used if either fails. An encrypted
+// backup is decrypted with keys, which must be able to decrypt the data key of
+// every object before any is downloaded, otherwise the error also wraps
+// ErrNoKey. The error wraps ErrRestore.
+func Restore(ctx context.Context, client S3API, keys KMSAPI, bucket, key, digest, dir string, d DownloadOpts) (err error) {
+	ctx, span := tracer.Start(ctx, "restore", trace.WithAttributes(
+		attribute.String("key", key),
+		attribute.String("dir", dir)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if err := restore(ctx, client, keys, bucket, key, digest, dir, d); err != nil {
+		return fmt.Errorf("%w %v: %w", ErrRestore, key, err)
+	}
+	return nil
+}
+
+// restore implements Restore, returning unwrapped errors.
+func restore(ctx context.Context, client S3API, keys KMSAPI, bucket, key, digest, dir string, d DownloadOpts) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%v is not empty", dir)
+	}
+	parts, err := PartKeys(ctx, client, bucket, key)
+	if err != nil {
+		return fmt.Errorf("failed to list parts: %w", err)
+	}
+	if err := checkKeys(ctx, client, keys, bucket, key, parts); err != nil {
+		return err
+	}
+	if err := extract(ctx, client, keys, bucket, key, digest, dir, d); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if err := extract(ctx, client, keys, bucket, part, "", dir, d); err != nil {
+			return fmt.Errorf("%v: %w", part, err)
+		}
+	}
+	return nil
+}
+
+// extract downloads the object at key and extracts it into dir, checking it
+// against digest if non-empty.
+func extract(ctx context.Context, client S3API, keys KMSAPI, bucket, key, digest, dir string, d DownloadOpts) error {
+	hash := sha256.New()
+	body, err := downloadBackup(ctx, client, keys, bucket, key, filepath.Dir(filepath.Clean(dir)), d, hash)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	tail := &tailReader{r: body}
+	dec, err := decompress(ctx, tail, key)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	archived := newSummingReader(dec)
+
+	cmd := exec.CommandContext(ctx, "tar", "-xf", "-", "-C", dir)
+	cmd.Stdin = archived
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return cancelled(ctx, fmt.Errorf("tar failed: %w", err))
+	}
+	// tar stops reading at the end of the archive, but the digests cover
+	// the whole object.
+	if _, err := io.Copy(io.Discard, archived); err != nil {
+		return err
+	}
+	if digest != "" {
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != digest {
+			return fmt.Errorf("SHA-256 is %v, expected %v", actual, digest)
+		}
+	}
+	// tar does not report the number of entries extracted.
+	return tail.check(archived, -1)
+}
+
+// ServiceOwner returns the user and group the named systemd unit runs as, in
+// the "user:group" form accepted by chown, using r to query systemctl. If the
+// unit does not specify a group, the user's login group is implied. An error
+// is returned if the unit runs as root, as its files' ownership cannot then
+// be inferred.
+func ServiceOwner(ctx context.Context, r Runner, service string) (string, error) {
+	var stdout bytes.Buffer
+	if err := r.Run(ctx, &stdout, "systemctl", "show", "--property=User", "--property=Group", service); err != nil {
+		return "", fmt.Errorf("failed to query %v: %w", service, err)
+	}
+	var user, group string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, "User="); ok {
+			user = value
+		} else if value, ok := strings.CutPrefix(line, "Group="); ok {
+			group = value
+		}
+	}
+	if user == "" || user == "root" {
+		return "", fmt.Errorf("%v does not run as a dedicated user", service)
+	}
+	return user + ":" + group, nil
+}
+
+// FixOwnership uses r to recursively change the owner of dir to owner, in the
+// "user:group" form accepted by chown, so files restored by root are
+// accessible to Plex. If SELinux is enabled, the default security contexts
+// for their location are also restored, as tar does not apply them.
+func FixOwnership(ctx context.Context, r Runner, dir, owner string) error {
+	if err := r.Run(ctx, nil, "chown", "-R", owner, dir); err != nil {
+		return fmt.Errorf("failed to change owner of %v: %w", dir, err)
+	}
+	// Exits non-zero if SELinux is disabled, or not installed at all.
+	if r.Run(ctx, nil, "selinuxenabled") != nil {
+		return nil
+	}
+	if err := r.Run(ctx, nil, "restorecon", "-R", dir); err != nil {
+		return fmt.Errorf("failed to restore SELinux contexts of %v: %w", dir, err)
+	}
+	return nil
+}
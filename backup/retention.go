@@ -0,0 +1,267 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// RetentionRule describes the retention policy applied by Run, which deletes
+// the oldest backup under the prefix after each successful one, so only the
+// newest is kept. Labelled backups are exempt.
+const RetentionRule = "keep only the newest backup, and every labelled one"
+
+// maxLabelLen is the maximum length of Opts.Label.
+const maxLabelLen = 64
+
+// ValidLabel returns an error wrapping ErrBadLabel if label cannot be used as
+// Opts.Label. Labels are at most 64 letters, digits, dots, underscores and
+// hyphens, starting with a letter or digit, so they are safe in keys and
+// metadata. The empty label is valid, and means the backup is not labelled.
+func ValidLabel(label string) error {
+	if len(label) > maxLabelLen {
+		return fmt.Errorf("%w: longer than %v bytes", ErrBadLabel, maxLabelLen)
+	}
+	for i, r := range label {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case i > 0 && (r == '.' || r == '_' || r == '-'):
+		default:
+			return fmt.Errorf("%w: %q must contain only letters, digits, '.', '_' and '-', and start with a letter or digit", ErrBadLabel, label)
+		}
+	}
+	return nil
+}
+
+// backupKey returns the key of a backup taken at t.
+func backupKey(prefix string, t time.Time, label string) string {
+	key := prefix + t.Format(time.RFC3339)
+	if label != "" {
+		key += "-" + label
+	}
+	return key + backupSuffix
+}
+
+// KeyLabel returns the label of the backup at key under prefix, or the empty
+// string if it is not labelled.
+func KeyLabel(prefix, key string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(key, prefix), backupSuffix)
+	// Keys are always formatted in UTC, so the date has a fixed length.
+	date := len("2006-01-02T15:04:05Z")
+	if len(name) <= date+1 || name[date] != '-' {
+		return ""
+	}
+	if _, err := time.Parse(time.RFC3339, name[:date]); err != nil {
+		return ""
+	}
+	return name[date+1:]
+}
+
+// keyTime returns the time the backup at key under prefix was taken, parsed
+// from its key, and whether it could be.
+func keyTime(prefix, key string) (time.Time, bool) {
+	name := strings.TrimPrefix(key, prefix)
+	date := len("2006-01-02T15:04:05Z")
+	if len(name) < date {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, name[:date])
+	return t, err == nil
+}
+
+// Retention is a grandfather-father-son policy, keeping the newest backup of
+// each of the most recent Daily days, Weekly weeks and Monthly months that
+// have one, in addition to the newest backup overall. Periods are in UTC, and
+// weeks start on Monday. The zero value keeps only the newest, as described
+// by RetentionRule. Labelled backups are exempt from every policy.
+type Retention struct {
+	Daily, Weekly, Monthly int
+}
+
+// IsZero returns whether r is the default policy.
+func (r Retention) IsZero() bool {
+	return r == Retention{}
+}
+
+// Validate returns an error wrapping ErrBadRetention if any count is
+// negative.
+func (r Retention) Validate() error {
+	if r.Daily < 0 || r.Weekly < 0 || r.Monthly < 0 {
+		return fmt.Errorf("%w: counts must not be negative", ErrBadRetention)
+	}
+	return nil
+}
+
+// String describes the policy, e.g. "keep the newest backup, the newest of
+// each of the last 7 days and 4 weeks, and every labelled one".
+func (r Retention) String() string {
+	if r.IsZero() {
+		return RetentionRule
+	}
+	var periods []string
+	for _, period := range []struct {
+		n    int
+		unit string
+	}{{r.Daily, "day"}, {r.Weekly, "week"}, {r.Monthly, "month"}} {
+		switch {
+		case period.n == 1:
+			periods = append(periods, period.unit)
+		case period.n > 1:
+			periods = append(periods, fmt.Sprintf("%v %vs", period.n, period.unit))
+		}
+	}
+	last := periods[len(periods)-1]
+	if len(periods) > 1 {
+		last = strings.Join(periods[:len(periods)-1], ", ") + " and " + last
+	}
+	return "keep the newest backup, the newest of each of the last " + last + ", and every labelled one"
+}
+
+// RetainedBackup is an unlabelled backup considered by Retention.Apply.
+type RetainedBackup struct {
+	Key   string
+	Time  time.Time
+	Bytes uint64
+
+	// LastModified is that of the object, which is later than Time if it
+	// has been copied since, e.g. by Rekey.
+	LastModified time.Time
+
+	// Keep is set by Apply if the policy keeps the backup, and Reason to
+	// why it is kept or deleted.
+	Keep   bool
+	Reason string
+}
+
+// RetainedBackups returns the unlabelled backups among objects under prefix,
+// as listed by ListBackups, for Retention.Apply. The time of each is parsed
+// from its key, falling back to its LastModified.
+func RetainedBackups(prefix string, objects []s3types.Object) []*RetainedBackup {
+	var backups []*RetainedBackup
+	for _, object := range objects {
+		if !isBackupKey(*object.Key) || KeyLabel(prefix, *object.Key) != "" {
+			continue
+		}
+		backup := &RetainedBackup{
+			Key:          *object.Key,
+			LastModified: aws.ToTime(object.LastModified),
+			Bytes:        uint64(aws.ToInt64(object.Size)),
+		}
+		backup.Time = backup.LastModified
+		if t, ok := keyTime(prefix, backup.Key); ok {
+			backup.Time = t
+		}
+		backups = append(backups, backup)
+	}
+	return backups
+}
+
+// Apply decides which of backups the policy keeps, setting the Keep and
+// Reason of each.
+func (r Retention) Apply(backups []*RetainedBackup) {
+	if len(backups) == 0 {
+		return
+	}
+	newestFirst := slices.Clone(backups)
+	slices.SortStableFunc(newestFirst, func(a, b *RetainedBackup) int {
+		return b.Time.Compare(a.Time)
+	})
+	newest := newestFirst[0]
+	for _, backup := range newestFirst {
+		backup.Keep, backup.Reason = false, ""
+	}
+	newest.Keep, newest.Reason = true, "newest"
+
+	for _, period := range []struct {
+		n      int
+		name   string
+		period func(time.Time) string
+	}{
+		{r.Daily, "daily", func(t time.Time) string {
+			return t.Format(time.DateOnly)
+		}},
+		{r.Weekly, "weekly", func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%v-W%02d", year, week)
+		}},
+		{r.Monthly, "monthly", func(t time.Time) string {
+			return t.Format("2006-01")
+		}},
+	} {
+		seen, last := 0, ""
+		for _, backup := range newestFirst {
+			current := period.period(backup.Time.UTC())
+			if current == last {
+				continue
+			}
+			last = current
+			if seen++; seen > period.n {
+				break
+			}
+			backup.Keep = true
+			backup.Reason = strings.TrimPrefix(backup.Reason+", "+period.name, ", ")
+		}
+	}
+
+	for _, backup := range newestFirst {
+		if backup.Keep {
+			continue
+		}
+		if r.IsZero() {
+			backup.Reason = "superseded by " + newest.Key
+		} else {
+			backup.Reason = "not the newest of any day, week or month retained"
+		}
+	}
+}
+
+// PruneCandidate is a backup the retention policy would delete.
+type PruneCandidate struct {
+	Key          string
+	LastModified time.Time
+	Bytes        uint64
+
+	// Index is the position of the backup counting back from the newest
+	// unlabelled one, which has index 0 and is never a candidate.
+	Index int
+
+	// Reason explains why the backup would be deleted under the policy.
+	Reason string
+}
+
+// PrunePlan lists the backups under prefix, returning those the retention
+// policy would delete, oldest first. Backups accumulate beyond the default
+// policy if pruning fails, or the new backup fails verification. Labelled
+// backups are never candidates, and do not count as the newest. Nothing is
+// deleted.
+func PrunePlan(ctx context.Context, client S3API, bucket, prefix string, r Retention) ([]*PruneCandidate, error) {
+	objects, err := ListBackups(ctx, client, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	backups := RetainedBackups(prefix, objects)
+	r.Apply(backups)
+	// Newest first, so the index is the position in the slice.
+	slices.SortStableFunc(backups, func(a, b *RetainedBackup) int {
+		return b.Time.Compare(a.Time)
+	})
+	var candidates []*PruneCandidate
+	for i, backup := range slices.Backward(backups) {
+		if backup.Keep {
+			continue
+		}
+		candidates = append(candidates, &PruneCandidate{
+			Key:          backup.Key,
+			LastModified: backup.LastModified,
+			Bytes:        backup.Bytes,
+			Index:        i,
+			Reason:       backup.Reason,
+		})
+	}
+	return candidates, nil
+}
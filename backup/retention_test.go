@@ -0,0 +1,162 @@
+package backup
+
+import (
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionApply(t *testing.T) {
+	// Daily backups from Monday 2024-01-01 to Sunday 2024-03-31, with an
+	// extra one on the last day.
+	var days []time.Time
+	for day := time.Date(2024, 1, 1, 3, 30, 0, 0, time.UTC); day.Month() < 4; day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	days = append(days, time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC))
+
+	for _, tc := range []struct {
+		name      string
+		retention Retention
+		times     []time.Time
+		keep      map[string]string
+	}{
+		{
+			name:  "none",
+			times: nil,
+			keep:  map[string]string{},
+		},
+		{
+			name:  "default keeps only the newest",
+			times: days,
+			keep: map[string]string{
+				"2024-03-31T12:00:00Z": "newest",
+			},
+		},
+		{
+			name:      "daily",
+			retention: Retention{Daily: 3},
+			times:     days,
+			keep: map[string]string{
+				"2024-03-31T12:00:00Z": "newest, daily",
+				"2024-03-30T03:30:00Z": "daily",
+				"2024-03-29T03:30:00Z": "daily",
+			},
+		},
+		{
+			name:      "weekly starts on monday",
+			retention: Retention{Weekly: 2},
+			times:     days,
+			keep: map[string]string{
+				"2024-03-31T12:00:00Z": "newest, weekly",
+				"2024-03-24T03:30:00Z": "weekly",
+			},
+		},
+		{
+			name:      "monthly",
+			retention: Retention{Monthly: 12},
+			times:     days,
+			keep: map[string]string{
+				"2024-03-31T12:00:00Z": "newest, monthly",
+				"2024-02-29T03:30:00Z": "monthly",
+				"2024-01-31T03:30:00Z": "monthly",
+			},
+		},
+		{
+			name:      "combined",
+			retention: Retention{Daily: 2, Weekly: 2, Monthly: 2},
+			times:     days,
+			keep: map[string]string{
+				"2024-03-31T12:00:00Z": "newest, daily, weekly, monthly",
+				"2024-03-30T03:30:00Z": "daily",
+				"2024-03-24T03:30:00Z": "weekly",
+				"2024-02-29T03:30:00Z": "monthly",
+			},
+		},
+		{
+			name:      "periods without a backup do not count",
+			retention: Retention{Daily: 2},
+			times: []time.Time{
+				time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 20, 0, 0, 0, 0, time.UTC),
+			},
+			keep: map[string]string{
+				"2024-03-20T00:00:00Z": "newest, daily",
+				"2024-03-10T00:00:00Z": "daily",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var backups []*RetainedBackup
+			for _, tm := range tc.times {
+				backups = append(backups, &RetainedBackup{
+					Key:  tm.Format(time.RFC3339),
+					Time: tm,
+				})
+			}
+			tc.retention.Apply(backups)
+			keep := map[string]string{}
+			for _, backup := range backups {
+				if backup.Keep {
+					keep[backup.Key] = backup.Reason
+				} else if backup.Reason == "" {
+					t.Errorf("%v deleted without a reason", backup.Key)
+				}
+			}
+			if !maps.Equal(keep, tc.keep) {
+				t.Errorf("kept %v, want %v", keep, tc.keep)
+			}
+		})
+	}
+}
+
+func TestRetentionString(t *testing.T) {
+	for _, tc := range []struct {
+		retention Retention
+		want      string
+	}{
+		{Retention{}, RetentionRule},
+		{Retention{Daily: 1}, "keep the newest backup, the newest of each of the last day, and every labelled one"},
+		{Retention{Daily: 7, Weekly: 4}, "keep the newest backup, the newest of each of the last 7 days and 4 weeks, and every labelled one"},
+		{Retention{Daily: 7, Weekly: 4, Monthly: 12}, "keep the newest backup, the newest of each of the last 7 days, 4 weeks and 12 months, and every labelled one"},
+	} {
+		if got := tc.retention.String(); got != tc.want {
+			t.Errorf("%+v.String() = %q, want %q", tc.retention, got, tc.want)
+		}
+	}
+}
+
+func TestKeyLabel(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, key, label string
+	}{
+		{"plex/", "plex/2024-04-20T06:22:01Z.tar.zst", ""},
+		{"plex/", "plex/2024-04-20T06:22:01Z-pre-upgrade-1.40.tar.zst", "pre-upgrade-1.40"},
+		{"plex/newton-", "plex/newton-2024-04-20T06:22:01Z-x.tar.zst", "x"},
+		{"", "2024-04-20T06:22:01Z-x.tar.zst", "x"},
+		{"plex/", "plex/2024-04-20T06:22:01Z-.tar.zst", ""},
+		{"plex/", "plex/2024-04-20T06:22:01Zx.tar.zst", ""},
+		{"plex/", "plex/not-a-date-at-all-x.tar.zst", ""},
+		{"plex/", "plex/2024.tar.zst", ""},
+	} {
+		if label := KeyLabel(tc.prefix, tc.key); label != tc.label {
+			t.Errorf("KeyLabel(%q, %q) = %q, want %q", tc.prefix, tc.key, label, tc.label)
+		}
+	}
+}
+
+func TestValidLabel(t *testing.T) {
+	for _, label := range []string{"", "a", "pre-upgrade-1.40", "A_b.c-D", strings.Repeat("a", maxLabelLen)} {
+		if err := ValidLabel(label); err != nil {
+			t.Errorf("ValidLabel(%q) = %v", label, err)
+		}
+	}
+	for _, label := range []string{"-a", ".a", "a/b", "a b", "ü", strings.Repeat("a", maxLabelLen+1)} {
+		if err := ValidLabel(label); !errors.Is(err, ErrBadLabel) {
+			t.Errorf("ValidLabel(%q) = %v, want %v", label, err, ErrBadLabel)
+		}
+	}
+}
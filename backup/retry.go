@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// Bounds of the delay before a run is retried, which doubles after each
+// attempt from runRetryBaseDelay.
+const (
+	runRetryBaseDelay    = time.Minute
+	DefaultRunMaxBackoff = 15 * time.Minute
+)
+
+// RunRetryErrors are the errors a failed run may be retried on, in
+// RetryPolicy.Errors. A failure to start the service is never retried, as
+// that would stop it again.
+var RunRetryErrors = []error{ErrStop, ErrArchive, ErrUpload}
+
+// RetryPolicy decides whether, and after how long, Run retries a failed run
+// from the start, stopping the service again, so a backup interrupted by a
+// transient fault, e.g. a home connection dropping, is still taken. Each
+// attempt is a new backup with its own key, other than a seed, whose upload
+// resumes. The zero value does not retry.
+type RetryPolicy struct {
+
+	// MaxAttempts is the maximum number of runs, including the first. Values
+	// below 2 disable retries.
+	MaxAttempts int
+
+	// MaxBackoff caps the delay before each retry, which starts at a minute
+	// and doubles after each attempt, with jitter. If zero,
+	// DefaultRunMaxBackoff is used.
+	MaxBackoff time.Duration
+
+	// Errors are those a failed run must wrap to be retried, a subset of
+	// RunRetryErrors. If empty, only ErrUpload is retried, being the most
+	// likely to be transient.
+	Errors []error
+}
+
+// Validate returns an error wrapping ErrBadRetry if the policy is invalid.
+func (p RetryPolicy) Validate() error {
+	if p.MaxBackoff < 0 {
+		return fmt.Errorf("%w: negative maximum backoff", ErrBadRetry)
+	}
+	for _, err := range p.Errors {
+		if !slices.Contains(RunRetryErrors, err) {
+			return fmt.Errorf("%w: cannot retry on %v", ErrBadRetry, err)
+		}
+	}
+	return nil
+}
+
+// retryable returns whether a run that failed with err should be retried.
+func (p RetryPolicy) retryable(err error) bool {
+	if errors.Is(err, ErrStart) {
+		return false
+	}
+	retried := p.Errors
+	if len(retried) == 0 {
+		retried = []error{ErrUpload}
+	}
+	for _, target := range retried {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the attempt following attempt, counting
+// from 1: a random duration between half and all of the exponential delay.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	limit := p.MaxBackoff
+	if limit == 0 {
+		limit = DefaultRunMaxBackoff
+	}
+	delay := runRetryBaseDelay
+	for range attempt - 1 {
+		if delay >= limit {
+			break
+		}
+		delay *= 2
+	}
+	delay = min(delay, limit)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retry calls run until it succeeds, fails with an error the policy does not
+// retry, or the attempts are exhausted, waiting between attempts. It returns
+// the result and error of the last attempt, or ctx's error if cancelled while
+// waiting.
+func (p RetryPolicy) retry(ctx context.Context, logger *slog.Logger, run func() (*Result, error)) (*Result, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := run()
+		if err == nil || attempt >= p.MaxAttempts || ctx.Err() != nil || !p.retryable(err) {
+			return result, err
+		}
+		delay := p.backoff(attempt)
+		logger.WarnContext(ctx, "backup failed, retrying",
+			slog.Int("attempt", attempt),
+			slog.Int("max_attempts", p.MaxAttempts),
+			slog.Duration("delay", delay),
+			slog.String("error", err.Error()))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result, cancelled(ctx, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+)
+
+// Runner runs the external commands the backup depends on: sudo systemctl to
+// stop and start the service, and tar to create the archive. Replacing it
+// allows commands to be simulated in tests, or the service to be controlled
+// by something other than systemd.
+type Runner interface {
+
+	// Run runs the named command to completion. If stdout is non-nil, the
+	// command's standard output is written to it. The command must be
+	// stopped if ctx is cancelled.
+	Run(ctx context.Context, stdout io.Writer, name string, args ...string) error
+}
+
+// ExecRunner is the default Runner, which runs commands as child processes.
+// Their standard error is inherited.
+type ExecRunner struct{}
+
+// Run implements Runner.
+func (ExecRunner) Run(ctx context.Context, stdout io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// ArchiveCommand returns the name and arguments of the tar command writing the
+// uncompressed archive of o.Directories and any of o.ConfigPaths that exist to
+// stdout, run at the priority requested by o.Nice and o.IdleIO. o.Parts are
+// excluded, as they are archived separately. If o.Reflink is set, the clones
+// of the databases are archived in place of the live files.
+func (o *Opts) ArchiveCommand() (string, []string) {
+	args := []string{"-cf", "-"}
+	for _, exclude := range append(slices.Clone(o.Parts), o.excludes()...) {
+		args = append(args, "--exclude", exclude)
+	}
+	args = append(args, o.reflinkArgs()...)
+	for _, directory := range o.Directories {
+		args = append(args, "-C", filepath.Dir(directory), filepath.Base(directory))
+	}
+	if members := o.configMembers(); len(members) > 0 {
+		args = append(append(args, "-C", "/"), members...)
+	}
+	return o.deprioritise("tar", args)
+}
+
+// excludes returns o.Excludes, or PlexExcludes if it is nil.
+func (o *Opts) excludes() []string {
+	if o.Excludes == nil {
+		return PlexExcludes
+	}
+	return o.Excludes
+}
+
+// deprioritise returns the command to run name with args at the priority
+// requested by o.Nice and o.IdleIO.
+func (o *Opts) deprioritise(name string, args []string) (string, []string) {
+	if o.IdleIO {
+		name, args = "ionice", append([]string{"-c", "3", name}, args...)
+	}
+	if o.Nice != 0 {
+		name, args = "nice", append([]string{"-n", strconv.Itoa(o.Nice), name}, args...)
+	}
+	return name, args
+}
+
+// runner returns o.Runner, or ExecRunner if it is nil.
+func (o *Opts) runner() Runner {
+	if o.Runner == nil {
+		return ExecRunner{}
+	}
+	return o.Runner
+}
@@ -0,0 +1,207 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRunner is a Runner recording the commands it is asked to run, without
+// running them.
+type fakeRunner struct {
+	mu       sync.Mutex
+	commands []string
+
+	// run, if set, simulates the command, e.g. writing its output to
+	// stdout or failing. Otherwise commands succeed without output.
+	run func(stdout io.Writer, command string) error
+}
+
+// Run implements Runner.
+func (f *fakeRunner) Run(_ context.Context, stdout io.Writer, name string, args ...string) error {
+	command := strings.Join(append([]string{name}, args...), " ")
+	f.mu.Lock()
+	f.commands = append(f.commands, command)
+	f.mu.Unlock()
+	if f.run == nil {
+		return nil
+	}
+	return f.run(stdout, command)
+}
+
+// failing returns a run func failing the commands in fail.
+func failing(fail ...string) func(io.Writer, string) error {
+	return func(_ io.Writer, command string) error {
+		if slices.Contains(fail, command) {
+			return errors.New("exit status 1")
+		}
+		return nil
+	}
+}
+
+func TestControlService(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     Opts
+		action   string
+		fail     []string
+		commands []string
+		err      error
+	}{
+		{
+			name:   "stop",
+			opts:   Opts{Service: "plexmediaserver.service"},
+			action: "stop",
+			commands: []string{
+				"sudo systemctl stop plexmediaserver.service",
+			},
+		},
+		{
+			name:   "start",
+			opts:   Opts{Service: "plexmediaserver.service"},
+			action: "start",
+			commands: []string{
+				"sudo systemctl start plexmediaserver.service",
+			},
+		},
+		{
+			name:   "extra services started in reverse",
+			opts:   Opts{Service: "plex", ExtraServices: []string{"tautulli", "sonarr"}},
+			action: "start",
+			commands: []string{
+				"sudo systemctl start sonarr",
+				"sudo systemctl start tautulli",
+				"sudo systemctl start plex",
+			},
+		},
+		{
+			name: "custom commands only for service",
+			opts: Opts{
+				Service:       "plex",
+				ExtraServices: []string{"tautulli"},
+				StopCommand:   []string{"docker", "stop", "plex"},
+				StartCommand:  []string{"docker", "start", "plex"},
+			},
+			action: "stop",
+			commands: []string{
+				"docker stop plex",
+				"sudo systemctl stop tautulli",
+			},
+		},
+		{
+			name:   "failure to stop starts services again",
+			opts:   Opts{Service: "plex", ExtraServices: []string{"tautulli", "sonarr"}},
+			action: "stop",
+			fail:   []string{"sudo systemctl stop tautulli"},
+			commands: []string{
+				"sudo systemctl stop plex",
+				"sudo systemctl stop tautulli",
+				"sudo systemctl start tautulli",
+				"sudo systemctl start plex",
+			},
+			err: ErrStop,
+		},
+		{
+			name:   "failure to start continues",
+			opts:   Opts{Service: "plex", ExtraServices: []string{"tautulli"}},
+			action: "start",
+			fail:   []string{"sudo systemctl start tautulli"},
+			commands: []string{
+				"sudo systemctl start tautulli",
+				"sudo systemctl start plex",
+			},
+			err: ErrStart,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &fakeRunner{run: failing(tc.fail...)}
+			tc.opts.Runner = runner
+			err := tc.opts.ControlService(context.Background(), tc.action)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("ControlService() = %v, want %v", err, tc.err)
+			}
+			if !slices.Equal(runner.commands, tc.commands) {
+				t.Errorf("ran %q, want %q", runner.commands, tc.commands)
+			}
+		})
+	}
+}
+
+func TestDetectService(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		output  string
+		service string
+		wantErr bool
+	}{
+		{
+			name:    "package",
+			output:  "plexmediaserver.service loaded active running Plex Media Server\n",
+			service: "plexmediaserver.service",
+		},
+		{
+			name:    "snap",
+			output:  "snap.plexmediaserver.plexmediaserver.service loaded active running Service for snap application plexmediaserver.plexmediaserver\n",
+			service: "snap.plexmediaserver.plexmediaserver.service",
+		},
+		{
+			name:    "none",
+			output:  "",
+			wantErr: true,
+		},
+		{
+			name:    "several",
+			output:  "plexmediaserver.service loaded active running\nsnap.plexmediaserver.plexmediaserver.service loaded inactive dead\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := &fakeRunner{run: func(stdout io.Writer, _ string) error {
+				_, err := io.WriteString(stdout, tc.output)
+				return err
+			}}
+			service, err := DetectService(context.Background(), runner)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("DetectService() error = %v, want error %v", err, tc.wantErr)
+			}
+			if service != tc.service {
+				t.Errorf("DetectService() = %q, want %q", service, tc.service)
+			}
+		})
+	}
+}
+
+func TestArchiveCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Opts
+		want string
+	}{
+		{
+			name: "default",
+			opts: Opts{Directories: []string{"/var/lib/plex/Plex Media Server"}, Excludes: []string{}},
+			want: "tar -cf - -C /var/lib/plex Plex Media Server",
+		},
+		{
+			name: "excludes",
+			opts: Opts{Directories: []string{"/srv/plex"}, Excludes: []string{"plex/Cache"}},
+			want: "tar -cf - --exclude plex/Cache -C /srv plex",
+		},
+		{
+			name: "deprioritised",
+			opts: Opts{Directories: []string{"/srv/plex"}, Excludes: []string{}, Nice: 10, IdleIO: true},
+			want: "nice -n 10 ionice -c 3 tar -cf - -C /srv plex",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name, args := tc.opts.ArchiveCommand()
+			if got := strings.Join(append([]string{name}, args...), " "); got != tc.want {
+				t.Errorf("ArchiveCommand() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
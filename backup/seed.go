@@ -0,0 +1,446 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SeedSuffix follows the key of a seeded backup, then the number of the chunk,
+// to form the key of each chunk object uploaded before the backup is
+// assembled, e.g. "2024-04-20T06:22:01Z.tar.zst.seed1". Like part keys, chunk
+// keys do not end in backupSuffix, so are not mistaken for backups.
+const SeedSuffix = ".seed"
+
+// Names of the files in Opts.SeedDir while a seed is in progress.
+const (
+	seedStateName   = "seed.json"
+	seedArchiveName = "seed.tar.zst"
+)
+
+// seedMetadata is the metadata of a seeded backup holding the SHA-256 of the
+// staged archive, so a run can recognise a backup it assembled but did not
+// record, e.g. having been killed after completing the upload.
+const seedMetadata = "plexbackup-seed-sha256"
+
+// Bounds of Opts.SeedChunkBytes. Chunks are assembled by UploadPartCopy, whose
+// parts other than the last must be at least 5 MiB, and at most 5 GiB, and of
+// which there may be at most 10,000.
+const (
+	MinSeedChunkBytes int64 = 5 << 20
+	MaxSeedChunkBytes int64 = 5 << 30
+	maxSeedChunks           = 10000
+)
+
+// seedState records the progress of a seed in Opts.SeedDir, so an interrupted
+// upload can be resumed by running again with the same options.
+type seedState struct {
+	Bucket            string            `json:"bucket"`
+	Key               string            `json:"key"`
+	Time              time.Time         `json:"time"`
+	PlexVersion       string            `json:"plex_version,omitempty"`
+	Label             string            `json:"label,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	UncompressedBytes uint64            `json:"uncompressed_bytes"`
+	CompressedBytes   uint64            `json:"compressed_bytes"`
+	DatabaseBytes     uint64            `json:"database_bytes"`
+	SHA256            string            `json:"sha256"`
+	DirectoryBytes    map[string]uint64 `json:"directory_bytes,omitempty"`
+	ExcludedBytes     map[string]uint64 `json:"excluded_bytes,omitempty"`
+	ArchiveSeconds    float64           `json:"archive_seconds"`
+	PlexRunning       bool              `json:"plex_running,omitempty"`
+	ChangedDatabases  []string          `json:"changed_databases,omitempty"`
+	Chunks            []*seedChunk      `json:"chunks"`
+
+	// Assembled is set once the chunks have been copied into the backup
+	// object, so only their deletion remains.
+	Assembled bool `json:"assembled"`
+
+	// Invalid is set if the backup object assembled from the chunks failed
+	// its check, or an object not assembled from them exists at the key, so
+	// it is deleted before they are assembled, which would otherwise fail
+	// rather than replace it.
+	Invalid bool `json:"invalid,omitempty"`
+}
+
+// seedChunk is a range of the staged archive uploaded as its own object.
+type seedChunk struct {
+	Key      string `json:"key"`
+	Offset   int64  `json:"offset"`
+	Bytes    int64  `json:"bytes"`
+	Uploaded bool   `json:"uploaded"`
+}
+
+// seedChunkKey returns the key of the nth chunk of the seed of the backup at
+// key, counting from 1.
+func seedChunkKey(key string, n int) string {
+	return key + SeedSuffix + strconv.Itoa(n)
+}
+
+// validateSeed checks the seed options, returning an error wrapping ErrBadSeed
+// if they are invalid.
+func (o *Opts) validateSeed() error {
+	if o.SeedDir == "" {
+		return nil
+	}
+	if len(o.Parts) > 0 {
+		return fmt.Errorf("%w: a backup with parts cannot be seeded", ErrBadSeed)
+	}
+	if o.SeedChunkBytes < MinSeedChunkBytes || o.SeedChunkBytes > MaxSeedChunkBytes {
+		return fmt.Errorf("%w: chunks must be between %v and %v bytes", ErrBadSeed, MinSeedChunkBytes, MaxSeedChunkBytes)
+	}
+	info, err := os.Stat(o.SeedDir)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadSeed, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%w: %v is not a directory", ErrBadSeed, o.SeedDir)
+	}
+	return nil
+}
+
+// loadSeed returns the state of the seed in progress in o.SeedDir, or nil if
+// there is none.
+func (o *Opts) loadSeed() (*seedState, error) {
+	data, err := os.ReadFile(filepath.Join(o.SeedDir, seedStateName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seed: %w", err)
+	}
+	state := &seedState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to read seed: %w", err)
+	}
+	if state.Bucket != o.Bucket || !strings.HasPrefix(state.Key, o.Prefix) {
+		return nil, fmt.Errorf("%w: %v holds a seed of s3://%v/%v", ErrBadSeed, o.SeedDir, state.Bucket, state.Key)
+	}
+	return state, nil
+}
+
+// saveSeed atomically replaces the state in o.SeedDir with state.
+func (o *Opts) saveSeed(state *seedState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(o.SeedDir, seedStateName)
+	temp, err := os.CreateTemp(o.SeedDir, ".seed-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to save seed: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	err = errors.Join(err, temp.Sync(), temp.Close())
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save seed: %w", err)
+	}
+	return nil
+}
+
+// newSeed records the archive staged by backup, described by result, dividing
+// it into chunks of o.SeedChunkBytes, or larger if there would otherwise be
+// too many.
+func (o *Opts) newSeed(result *Result) (*seedState, error) {
+	state := &seedState{
+		Bucket:            o.Bucket,
+		Key:               result.Key,
+		Time:              result.Time,
+		PlexVersion:       result.PlexVersion,
+		Label:             result.Label,
+		Metadata:          result.metadata,
+		UncompressedBytes: result.UncompressedBytes,
+		CompressedBytes:   result.CompressedBytes,
+		DatabaseBytes:     result.DatabaseBytes,
+		SHA256:            result.SHA256,
+		DirectoryBytes:    result.DirectoryBytes,
+		ExcludedBytes:     result.ExcludedBytes,
+		ArchiveSeconds:    result.ArchiveElapsed.Seconds(),
+		PlexRunning:       result.PlexRunning,
+		ChangedDatabases:  result.ChangedDatabases,
+	}
+	size := int64(result.CompressedBytes)
+	chunkBytes := max(o.SeedChunkBytes, (size+maxSeedChunks-1)/maxSeedChunks)
+	for offset := int64(0); offset < size || offset == 0; offset += chunkBytes {
+		state.Chunks = append(state.Chunks, &seedChunk{
+			Key:    seedChunkKey(result.Key, len(state.Chunks)+1),
+			Offset: offset,
+			Bytes:  min(chunkBytes, size-offset),
+		})
+	}
+	if err := o.saveSeed(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// result returns the Result of the backup once the seed is complete.
+func (s *seedState) result() *Result {
+	return &Result{
+		Key:               s.Key,
+		Time:              s.Time,
+		UncompressedBytes: s.UncompressedBytes,
+		CompressedBytes:   s.CompressedBytes,
+		DatabaseBytes:     s.DatabaseBytes,
+		DirectoryBytes:    s.DirectoryBytes,
+		ExcludedBytes:     s.ExcludedBytes,
+		PlexRunning:       s.PlexRunning,
+		ChangedDatabases:  s.ChangedDatabases,
+		// A seed may span several runs, so it took as long as it has
+		// been since it was staged.
+		Elapsed:        time.Since(s.Time),
+		ArchiveElapsed: time.Duration(s.ArchiveSeconds * float64(time.Second)),
+		PlexVersion:    s.PlexVersion,
+		Label:          s.Label,
+		SHA256:         s.SHA256,
+		metadata:       s.Metadata,
+		objectBytes:    s.CompressedBytes,
+	}
+}
+
+// uploadSeed uploads each chunk of the archive staged in o.SeedDir not yet
+// uploaded, subject to o.UploadWindow, then assembles them into the backup
+// object server-side and checks its size. Once complete, the chunk objects
+// and the seed directory's contents are deleted. If interrupted, calling this
+// again with the state loaded by loadSeed resumes from the first chunk not
+// uploaded. The error wraps ErrUpload.
+func (o *Opts) uploadSeed(ctx context.Context, logger *slog.Logger, client S3API, state *seedState) (result *Result, err error) {
+	ctx, span := tracer.Start(ctx, "upload seed", trace.WithAttributes(
+		attribute.String("key", state.Key),
+		attribute.Int("chunks", len(state.Chunks))))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if !state.Assembled {
+		if err := o.findAssembledSeed(ctx, client, state); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUpload, err)
+		}
+	}
+	if !state.Assembled {
+		if err := o.uploadSeedChunks(ctx, logger, client, state); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUpload, err)
+		}
+		if state.Invalid {
+			if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: &o.Bucket,
+				Key:    &state.Key,
+			}); err != nil {
+				return nil, fmt.Errorf("%w: failed to delete invalid %v: %w", ErrUpload, state.Key, err)
+			}
+			state.Invalid = false
+			if err := o.saveSeed(state); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrUpload, err)
+			}
+		}
+		if err := o.assembleSeed(ctx, client, state); err != nil {
+			return nil, fmt.Errorf("%w: failed to assemble %v: %w", ErrUpload, state.Key, err)
+		}
+		if err := o.checkUploaded(ctx, client, state.Key, state.CompressedBytes); err != nil {
+			// The chunks are intact, so the next run assembles them
+			// again, deleting the object first if checkUploaded could
+			// not.
+			state.Invalid = true
+			return nil, fmt.Errorf("%w: %w", ErrUpload, errors.Join(err, o.saveSeed(state)))
+		}
+		state.Assembled = true
+		if err := o.saveSeed(state); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUpload, err)
+		}
+		logger.InfoContext(ctx, "assembled seed",
+			slog.String("key", state.Key),
+			slog.Int("chunks", len(state.Chunks)))
+	}
+
+	// The backup is complete, so failure to clean up is only logged.
+	for _, chunk := range state.Chunks {
+		if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &o.Bucket,
+			Key:    &chunk.Key,
+		}); err != nil {
+			logger.WarnContext(ctx, "failed to delete seed chunk",
+				slog.String("key", chunk.Key),
+				slog.String("error", err.Error()))
+		}
+	}
+	for _, name := range []string{seedArchiveName, seedStateName} {
+		if err := os.Remove(filepath.Join(o.SeedDir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.WarnContext(ctx, "failed to remove seed file",
+				slog.String("error", err.Error()))
+		}
+	}
+	return state.result(), nil
+}
+
+// findAssembledSeed marks the seed assembled if the backup object at state.Key
+// was assembled from it by a run that ended before recording so. If an object
+// exists that was not, the seed is marked invalid, so the next run deletes it
+// and assembles the chunks again, and an error is returned.
+func (o *Opts) findAssembledSeed(ctx context.Context, client S3API, state *seedState) error {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &o.Bucket,
+		Key:    &state.Key,
+	})
+	if errors.As(err, new(*s3types.NotFound)) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check %v: %w", state.Key, err)
+	}
+	if uint64(aws.ToInt64(head.ContentLength)) == state.CompressedBytes &&
+		maps.Equal(head.Metadata, seedObjectMetadata(state)) {
+		state.Assembled = true
+		return o.saveSeed(state)
+	}
+	if state.Invalid {
+		return nil
+	}
+	state.Invalid = true
+	err = fmt.Errorf("%v exists but was not assembled from %v; it is replaced by the next run", state.Key, o.SeedDir)
+	return errors.Join(err, o.saveSeed(state))
+}
+
+// seedObjectMetadata returns the metadata of the backup object assembled from
+// the seed.
+func seedObjectMetadata(state *seedState) map[string]string {
+	metadata := maps.Clone(state.Metadata)
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadata[seedMetadata] = state.SHA256
+	return metadata
+}
+
+// uploadSeedChunks uploads each chunk not yet uploaded, recording each in the
+// state as it completes. Chunks recorded as uploaded by an earlier run are
+// checked to still exist, and uploaded again if not.
+func (o *Opts) uploadSeedChunks(ctx context.Context, logger *slog.Logger, client S3API, state *seedState) error {
+	archive, err := os.Open(filepath.Join(o.SeedDir, seedArchiveName))
+	if err != nil {
+		return fmt.Errorf("failed to open staged archive: %w", err)
+	}
+	defer archive.Close()
+	info, err := archive.Stat()
+	if err != nil {
+		return err
+	}
+	if uint64(info.Size()) != state.CompressedBytes {
+		return fmt.Errorf("staged archive is %v bytes, expected %v; empty %v to start again", info.Size(), state.CompressedBytes, o.SeedDir)
+	}
+
+	for i, chunk := range state.Chunks {
+		if chunk.Uploaded {
+			head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: &o.Bucket,
+				Key:    &chunk.Key,
+			})
+			if err == nil && aws.ToInt64(head.ContentLength) == chunk.Bytes {
+				continue
+			}
+			if err != nil && !errors.As(err, new(*s3types.NotFound)) {
+				return fmt.Errorf("failed to check %v: %w", chunk.Key, err)
+			}
+			logger.WarnContext(ctx, "seed chunk missing, uploading it again",
+				slog.String("key", chunk.Key))
+		}
+		input := &s3.PutObjectInput{
+			Bucket: &o.Bucket,
+			Key:    &chunk.Key,
+			Body:   o.newWindowReader(ctx, logger, chunk.Key, io.NewSectionReader(archive, chunk.Offset, chunk.Bytes)),
+		}
+		if _, err := s3manager.NewUploader(abortingClient{client}, o.uploaderOptions()...).Upload(ctx, input); err != nil {
+			return fmt.Errorf("failed to upload %v: %w", chunk.Key, err)
+		}
+		if err := o.checkUploaded(ctx, client, chunk.Key, uint64(chunk.Bytes)); err != nil {
+			return err
+		}
+		chunk.Uploaded = true
+		if err := o.saveSeed(state); err != nil {
+			return err
+		}
+		// Logged at info level, as a seed may take days.
+		logger.InfoContext(ctx, "uploaded seed chunk",
+			slog.String("key", chunk.Key),
+			slog.Int("chunk", i+1),
+			slog.Int("chunks", len(state.Chunks)))
+	}
+	return nil
+}
+
+// assembleSeed copies the chunks, in order, into the backup object with
+// UploadPartCopy, with the metadata of the staged archive and its SHA-256. Like
+// any other backup, an existing object at the key is not replaced. The upload
+// is aborted on failure.
+func (o *Opts) assembleSeed(ctx context.Context, client S3API, state *seedState) (err error) {
+	upload, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   &o.Bucket,
+		Key:      &state.Key,
+		Metadata: seedObjectMetadata(state),
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+		defer cancel()
+		client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+			Bucket:   &o.Bucket,
+			Key:      &state.Key,
+			UploadId: upload.UploadId,
+		})
+	}()
+	var parts []s3types.CompletedPart
+	for i, chunk := range state.Chunks {
+		source := (&url.URL{Path: o.Bucket + "/" + chunk.Key}).EscapedPath()
+		part, err := client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:     &o.Bucket,
+			Key:        &state.Key,
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(int32(i + 1)),
+			CopySource: &source,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy %v: %w", chunk.Key, err)
+		}
+		parts = append(parts, s3types.CompletedPart{
+			ETag:       part.CopyPartResult.ETag,
+			PartNumber: aws.Int32(int32(i + 1)),
+		})
+	}
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &o.Bucket,
+		Key:             &state.Key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+		IfNoneMatch:     aws.String("*"),
+	})
+	if isConflict(err) {
+		err = fmt.Errorf("%v already exists: %w", state.Key, err)
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestFindAssembledSeed(t *testing.T) {
+	state := seedState{
+		Bucket:          "bucket",
+		Key:             "plex/2024-04-20T06:22:01Z.tar.zst",
+		CompressedBytes: 10,
+		SHA256:          "e3b0c442",
+		Metadata:        map[string]string{"plex-version": "1.40.0"},
+	}
+	for _, tc := range []struct {
+		name      string
+		object    string
+		metadata  map[string]string
+		invalid   bool
+		assembled bool
+		wantErr   bool
+	}{
+		{
+			name: "not assembled",
+		},
+		{
+			name:      "assembled but not recorded",
+			object:    strings.Repeat("x", 10),
+			metadata:  map[string]string{"plex-version": "1.40.0", seedMetadata: "e3b0c442"},
+			assembled: true,
+		},
+		{
+			name:     "other object",
+			object:   strings.Repeat("x", 10),
+			metadata: map[string]string{"plex-version": "1.40.0"},
+			invalid:  true,
+			wantErr:  true,
+		},
+		{
+			name:     "other size",
+			object:   strings.Repeat("x", 11),
+			metadata: map[string]string{"plex-version": "1.40.0", seedMetadata: "e3b0c442"},
+			invalid:  true,
+			wantErr:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeS3()
+			if tc.object != "" {
+				client.objects[state.Key] = []byte(tc.object)
+				client.metadata[state.Key] = tc.metadata
+			}
+			o := &Opts{Bucket: "bucket", Prefix: "plex/", SeedDir: t.TempDir()}
+			state := state
+			err := o.findAssembledSeed(context.Background(), client, &state)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("findAssembledSeed() = %v, want error %v", err, tc.wantErr)
+			}
+			if state.Assembled != tc.assembled || state.Invalid != tc.invalid {
+				t.Errorf("assembled %v, invalid %v, want %v, %v", state.Assembled, state.Invalid, tc.assembled, tc.invalid)
+			}
+			if tc.object != "" {
+				saved, err := o.loadSeed()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if saved.Assembled != tc.assembled || saved.Invalid != tc.invalid {
+					t.Errorf("saved assembled %v, invalid %v", saved.Assembled, saved.Invalid)
+				}
+			}
+
+			// Once marked invalid, the object is left for the caller to
+			// delete.
+			if tc.invalid {
+				if err := o.findAssembledSeed(context.Background(), client, &state); err != nil || !state.Invalid {
+					t.Errorf("findAssembledSeed() of invalid seed = %v, invalid %v", err, state.Invalid)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+)
+
+// ErrNoSpace is wrapped by errors returned when a filesystem does not have
+// room for the files about to be written to it.
+var ErrNoSpace = errors.New("insufficient free space")
+
+// checkSpace returns an error wrapping ErrNoSpace if the filesystem containing
+// dir has less than margin times bytes free, for what, e.g. "staging the
+// seed". It returns nil if margin is zero, or free space cannot be determined
+// on this platform.
+func checkSpace(dir, what string, bytes uint64, margin float64) error {
+	if margin == 0 {
+		return nil
+	}
+	free, err := freeSpace(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check free space in %v: %w", dir, err)
+	}
+	if needed := uint64(float64(bytes) * margin); free < needed {
+		return fmt.Errorf("%w: %v needs %v MB in %v, %v times the estimated %v MB, but %v MB is free",
+			ErrNoSpace, what, megabytes(needed), dir, margin, megabytes(bytes), megabytes(free))
+	}
+	return nil
+}
+
+// megabytes returns n in MB, rounded up.
+func megabytes(n uint64) uint64 {
+	return (n + 1e6 - 1) / 1e6
+}
+
+// ensureSpace checks there is room for the files Run writes locally before it
+// stops the service, with o.SpaceMargin to spare: the archive staged in
+// o.SeedDir, estimated from the newest backup or the size of the
+// directories, the copies of the databases VACUUM writes, and the clones made
+// by o.Reflink, which diverge from the originals as Plex writes to them. The
+// error wraps ErrArchive and ErrNoSpace.
+func (o *Opts) ensureSpace(ctx context.Context, logger *slog.Logger, client S3API) error {
+	if o.SpaceMargin == 0 {
+		return nil
+	}
+	if o.Vacuum || o.Reflink {
+		what := "vacuuming the databases"
+		if o.Reflink {
+			what = "cloning the databases"
+		}
+		for _, directory := range o.Directories {
+			dir := filepath.Join(directory, databasesDir)
+			if err := checkSpace(dir, what, databaseBytes([]string{directory}), o.SpaceMargin); err != nil {
+				return fmt.Errorf("%w: %w", ErrArchive, err)
+			}
+		}
+	}
+	if o.SeedDir != "" {
+		estimate, err := o.seedEstimate(ctx, client)
+		if err != nil {
+			return fmt.Errorf("%w: failed to estimate the size of the seed: %w", ErrArchive, err)
+		}
+		logger.DebugContext(ctx, "estimated size of seed", slog.Uint64("bytes", estimate))
+		if err := checkSpace(o.SeedDir, "staging the seed", estimate, o.SpaceMargin); err != nil {
+			return fmt.Errorf("%w: %w", ErrArchive, err)
+		}
+	}
+	return nil
+}
+
+// seedEstimate returns the expected size of the archive staged in o.SeedDir:
+// the size of the newest backup, or if there is none, of the files to be
+// archived before compression.
+func (o *Opts) seedEstimate(ctx context.Context, client S3API) (uint64, error) {
+	newest, err := NewestObject(ctx, client, o.Bucket, o.Prefix)
+	if err != nil {
+		return 0, err
+	}
+	if newest != nil && newest.Size != nil {
+		return uint64(*newest.Size), nil
+	}
+	if o.RemoteDirectories {
+		return 0, nil
+	}
+	return measureTree(ctx, o.Directories, o.excludes()).included, nil
+}
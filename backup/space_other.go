@@ -0,0 +1,10 @@
+//go:build !linux
+
+package backup
+
+import "errors"
+
+// freeSpace is not implemented outside Linux, so free space is not checked.
+func freeSpace(string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,234 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// sqliteMagic begins every SQLite database file.
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+// Magic numbers of a write-ahead log, whose last bit gives the byte order of
+// its checksums.
+const (
+	walMagicLittleEndian = 0x377f0682
+	walMagicBigEndian    = 0x377f0683
+)
+
+// Sizes of the headers of a database, a write-ahead log and each of its
+// frames.
+const (
+	sqliteHeaderBytes = 100
+	walHeaderBytes    = 32
+	walFrameBytes     = 24
+)
+
+// sqliteDatabase describes a database read from an archive.
+type sqliteDatabase struct {
+	bytes    int64
+	pageSize int64
+	walMode  bool
+
+	// headerPages is the size of the database in pages recorded in its
+	// header, or 0 if not recorded, as by versions before 3.7.0.
+	headerPages int64
+}
+
+// sqliteWAL describes a write-ahead log read from an archive.
+type sqliteWAL struct {
+	bytes    int64
+	pageSize int64
+
+	// valid is whether the header's magic number and checksum are correct,
+	// and committed the number of valid frames up to the last commit,
+	// which SQLite would apply to the database.
+	valid     bool
+	committed int
+}
+
+// databaseChecker finds the SQLite databases and write-ahead logs in an
+// archive as it is read, so each pair can be checked to be consistent. Their
+// content only makes sense together, so a backup taken without stopping Plex
+// may capture one mid-write, or one before and the other after a checkpoint.
+type databaseChecker struct {
+	databases map[string]*sqliteDatabase
+	wals      map[string]*sqliteWAL
+
+	// logs are the names of the write-ahead logs, in archive order.
+	logs []string
+}
+
+func newDatabaseChecker() *databaseChecker {
+	return &databaseChecker{
+		databases: map[string]*sqliteDatabase{},
+		wals:      map[string]*sqliteWAL{},
+	}
+}
+
+// read consumes r, the content of the regular file name in the archive,
+// recording it if it is a database or write-ahead log.
+func (c *databaseChecker) read(name string, r io.Reader) error {
+	buffered := bufio.NewReaderSize(r, 64<<10)
+	if strings.HasSuffix(name, "-wal") {
+		c.logs = append(c.logs, name)
+		wal, err := readWAL(buffered)
+		if err != nil {
+			return err
+		}
+		c.wals[name] = wal
+		return nil
+	}
+	header, _ := buffered.Peek(sqliteHeaderBytes)
+	if len(header) == sqliteHeaderBytes && bytes.HasPrefix(header, sqliteMagic) {
+		database := &sqliteDatabase{
+			pageSize: int64(binary.BigEndian.Uint16(header[16:18])),
+			// The file format write and read versions.
+			walMode: header[18] == 2 && header[19] == 2,
+		}
+		if database.pageSize == 1 {
+			database.pageSize = 1 << 16
+		}
+		// The in-header size is only valid if written by the version
+		// that last changed the file.
+		if binary.BigEndian.Uint32(header[92:96]) == binary.BigEndian.Uint32(header[24:28]) {
+			database.headerPages = int64(binary.BigEndian.Uint32(header[28:32]))
+		}
+		c.databases[name] = database
+		var err error
+		database.bytes, err = io.Copy(io.Discard, buffered)
+		return err
+	}
+	_, err := io.Copy(io.Discard, buffered)
+	return err
+}
+
+// link records name, a hard link to target, as a copy of it.
+func (c *databaseChecker) link(name, target string) {
+	if database, ok := c.databases[target]; ok {
+		c.databases[name] = database
+	}
+	if wal, ok := c.wals[target]; ok {
+		c.wals[name] = wal
+		c.logs = append(c.logs, name)
+	}
+}
+
+// readWAL reads a write-ahead log from r, validating its frames as SQLite does
+// when recovering it.
+func readWAL(r io.Reader) (*sqliteWAL, error) {
+	wal := &sqliteWAL{}
+	header := make([]byte, walHeaderBytes)
+	n, err := io.ReadFull(r, header)
+	wal.bytes = int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return wal, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch binary.BigEndian.Uint32(header) {
+	case walMagicLittleEndian:
+		order = binary.LittleEndian
+	case walMagicBigEndian:
+		order = binary.BigEndian
+	}
+	wal.pageSize = int64(binary.BigEndian.Uint32(header[8:12]))
+	var s0, s1 uint32
+	if order != nil {
+		s0, s1 = walChecksum(order, header[:24], 0, 0)
+		wal.valid = s0 == binary.BigEndian.Uint32(header[24:28]) && s1 == binary.BigEndian.Uint32(header[28:32])
+	}
+	// Frames are only read while they remain valid; anything after the
+	// first invalid frame is ignored by SQLite too.
+	var frame []byte
+	if wal.valid && wal.pageSize >= 512 && wal.pageSize <= 1<<16 {
+		frame = make([]byte, walFrameBytes+wal.pageSize)
+	}
+	for frames := 0; frame != nil; frames++ {
+		n, err := io.ReadFull(r, frame)
+		wal.bytes += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(frame[8:16], header[16:24]) {
+			break
+		}
+		s0, s1 = walChecksum(order, frame[:8], s0, s1)
+		s0, s1 = walChecksum(order, frame[walFrameBytes:], s0, s1)
+		if s0 != binary.BigEndian.Uint32(frame[16:20]) || s1 != binary.BigEndian.Uint32(frame[20:24]) {
+			break
+		}
+		if binary.BigEndian.Uint32(frame[4:8]) != 0 {
+			wal.committed = frames + 1
+		}
+	}
+	rest, err := io.Copy(io.Discard, r)
+	wal.bytes += rest
+	return wal, err
+}
+
+// walChecksum continues the checksum s0, s1 over data, a multiple of 8 bytes,
+// whose 32-bit words are in order.
+func walChecksum(order binary.ByteOrder, data []byte, s0, s1 uint32) (uint32, uint32) {
+	for i := 0; i+8 <= len(data); i += 8 {
+		s0 += order.Uint32(data[i:]) + s1
+		s1 += order.Uint32(data[i+4:]) + s0
+	}
+	return s0, s1
+}
+
+// check returns an error describing each database inconsistent with its
+// write-ahead log, or whose size does not match its header, and each non-empty
+// write-ahead log without its database.
+func (c *databaseChecker) check() error {
+	var errs []error
+	for _, log := range c.logs {
+		if _, ok := c.databases[strings.TrimSuffix(log, "-wal")]; !ok && c.wals[log].bytes > 0 {
+			errs = append(errs, fmt.Errorf("%v is present without its database", log))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.databases)) {
+		if err := c.databases[name].check(c.wals[name+"-wal"]); err != nil {
+			errs = append(errs, fmt.Errorf("database %v: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// check returns an error if the database is inconsistent with wal, which is
+// nil if it has none.
+func (d *sqliteDatabase) check(wal *sqliteWAL) error {
+	if wal != nil && wal.bytes > 0 {
+		if !wal.valid {
+			return errors.New("write-ahead log has an invalid header")
+		}
+		if wal.pageSize != d.pageSize {
+			return fmt.Errorf("write-ahead log has %v byte pages, the database %v", wal.pageSize, d.pageSize)
+		}
+		if wal.committed > 0 {
+			if !d.walMode {
+				return fmt.Errorf("write-ahead log has %v committed frames, but the database is not in WAL mode", wal.committed)
+			}
+			// The database's size is given by the log.
+			return nil
+		}
+	}
+	if d.pageSize == 0 || d.bytes%d.pageSize != 0 {
+		return fmt.Errorf("%v bytes is not a whole number of %v byte pages", d.bytes, d.pageSize)
+	}
+	if d.headerPages != 0 && d.headerPages*d.pageSize != d.bytes {
+		return fmt.Errorf("%v pages long, but its header records %v", d.bytes/d.pageSize, d.headerPages)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// trailerID identifies the skippable zstd frame holding the trailer, in case
+// others are ever appended.
+const trailerID = 0xb
+
+// maxTrailerBytes bounds the size of the trailer frame, including its header,
+// so only the end of the object need be retained to find it.
+const maxTrailerBytes = 1 << 10
+
+// trailer is appended to every object as a skippable zstd frame, which
+// decoders, including those of older versions, ignore. It describes the
+// archive within, so a backup can be checked for completeness from its
+// content alone, without relying on the digest recorded in the catalog or
+// the result of the run that took it. Backups taken before trailers were
+// added have none, so are not checked.
+type trailer struct {
+
+	// SHA256 is the hex-encoded SHA-256 digest of the uncompressed
+	// archive.
+	SHA256 string `json:"sha256"`
+
+	// Entries is the number of entries in the archive.
+	Entries int `json:"entries"`
+
+	// UncompressedBytes is the size of the archive, and CompressedBytes the
+	// size of the zstd frames preceding the trailer.
+	UncompressedBytes uint64 `json:"uncompressed_bytes"`
+	CompressedBytes   uint64 `json:"compressed_bytes"`
+}
+
+// appendTrailer writes t to w as a skippable frame.
+func appendTrailer(w io.Writer, t *trailer) error {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	header := zstd.Header{
+		Skippable:     true,
+		SkippableID:   trailerID,
+		SkippableSize: uint32(len(payload)),
+	}
+	frame, err := header.AppendTo(nil)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(frame, payload...))
+	return err
+}
+
+// archiveSummer computes the trailer of an archive as it is written to it,
+// counting its entries with a tar reader running in its own goroutine.
+type archiveSummer struct {
+	digest  hash.Hash
+	bytes   uint64
+	pipe    *io.PipeWriter
+	entries chan int
+
+	// directoryBytes is the total size of the regular files within each
+	// top-level directory of the archive, keyed by topLevelDirectory. It
+	// must not be read until Close returns.
+	directoryBytes map[string]uint64
+}
+
+// newArchiveSummer returns an archiveSummer that must be closed once the
+// archive has been written.
+func newArchiveSummer() *archiveSummer {
+	r, w := io.Pipe()
+	s := &archiveSummer{
+		digest:         sha256.New(),
+		pipe:           w,
+		entries:        make(chan int, 1),
+		directoryBytes: map[string]uint64{},
+	}
+	go func() {
+		entries := 0
+		archive := tar.NewReader(r)
+		for {
+			header, err := archive.Next()
+			if err != nil {
+				break
+			}
+			entries++
+			if header.Typeflag == tar.TypeReg {
+				s.directoryBytes[topLevelDirectory(header.Name)] += uint64(header.Size)
+			}
+		}
+		// Anything after the end of the archive, or a malformed one,
+		// must still be consumed so writes do not block.
+		io.Copy(io.Discard, r)
+		s.entries <- entries
+	}()
+	return s
+}
+
+func (s *archiveSummer) Write(p []byte) (int, error) {
+	s.digest.Write(p)
+	s.bytes += uint64(len(p))
+	return s.pipe.Write(p)
+}
+
+// Close returns the trailer of everything written, given the number of bytes
+// it was compressed to.
+func (s *archiveSummer) Close(compressedBytes uint64) *trailer {
+	s.pipe.Close()
+	return &trailer{
+		SHA256:            hex.EncodeToString(s.digest.Sum(nil)),
+		Entries:           <-s.entries,
+		UncompressedBytes: s.bytes,
+		CompressedBytes:   compressedBytes,
+	}
+}
+
+// topLevelDirectory returns the directory within a backed up directory that
+// the archive member name is in, e.g. "Plex Media Server/Metadata", or the
+// backed up directory itself for files directly within it.
+func topLevelDirectory(name string) string {
+	components := strings.SplitN(strings.TrimPrefix(name, "./"), "/", 3)
+	if len(components) < 3 {
+		return components[0]
+	}
+	return components[0] + "/" + components[1]
+}
+
+// tailReader reads from r, counting the bytes read and retaining the last
+// maxTrailerBytes of them, so the trailer can be found once the object has
+// been read.
+type tailReader struct {
+	r     io.Reader
+	bytes uint64
+	tail  []byte
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.bytes += uint64(n)
+	t.tail = append(t.tail, p[:n]...)
+	if excess := len(t.tail) - maxTrailerBytes; excess > 0 {
+		t.tail = append(t.tail[:0], t.tail[excess:]...)
+	}
+	return n, err
+}
+
+// trailer returns the trailer at the end of everything read, or nil if there
+// is none, along with the size of its frame.
+func (t *tailReader) trailer() (*trailer, int) {
+	magic := []byte{0x50 | trailerID, 0x2a, 0x4d, 0x18}
+	for i := bytes.LastIndex(t.tail, magic); i >= 0; i = bytes.LastIndex(t.tail[:i], magic) {
+		var header zstd.Header
+		payload, err := header.DecodeAndStrip(t.tail[i:])
+		if err != nil || int(header.SkippableSize) != len(payload) {
+			continue
+		}
+		tr := &trailer{}
+		if err := json.Unmarshal(payload, tr); err != nil {
+			return nil, 0
+		}
+		return tr, len(t.tail) - i
+	}
+	return nil, 0
+}
+
+// summingReader reads an archive from r, computing its digest and size to
+// check against the trailer.
+type summingReader struct {
+	r      io.Reader
+	digest hash.Hash
+	bytes  uint64
+}
+
+func newSummingReader(r io.Reader) *summingReader {
+	return &summingReader{
+		r:      r,
+		digest: sha256.New(),
+	}
+}
+
+func (s *summingReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.digest.Write(p[:n])
+	s.bytes += uint64(n)
+	return n, err
+}
+
+// check returns an error if the archive read by archive does not match the
+// trailer at the end of the object, if any. entries is the number of entries
+// read, or negative if unknown.
+func (t *tailReader) check(archive *summingReader, entries int) error {
+	tr, size := t.trailer()
+	if tr == nil {
+		return nil
+	}
+	if compressed := t.bytes - uint64(size); compressed != tr.CompressedBytes {
+		return fmt.Errorf("object is truncated or extended: %v compressed bytes precede the trailer, which records %v", compressed, tr.CompressedBytes)
+	}
+	if archive.bytes != tr.UncompressedBytes {
+		return fmt.Errorf("archive is %v bytes, trailer records %v", archive.bytes, tr.UncompressedBytes)
+	}
+	if entries >= 0 && entries != tr.Entries {
+		return fmt.Errorf("archive has %v entries, trailer records %v", entries, tr.Entries)
+	}
+	if actual := hex.EncodeToString(archive.digest.Sum(nil)); actual != tr.SHA256 {
+		return fmt.Errorf("archive SHA-256 is %v, trailer records %v", actual, tr.SHA256)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w     io.Writer
+	bytes uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.bytes += uint64(n)
+	return n, err
+}
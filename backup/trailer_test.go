@@ -0,0 +1,149 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveObject returns an object holding a compressed archive of files of
+// the given sizes, and its trailer if withTrailer is set.
+func archiveObject(t *testing.T, sizes []int, withTrailer bool) ([]byte, *trailer) {
+	t.Helper()
+	var object bytes.Buffer
+	compressed := &countingWriter{w: &object}
+	encoder, err := zstd.NewWriter(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summer := newArchiveSummer()
+	archive := tar.NewWriter(io.MultiWriter(encoder, summer))
+	for i, size := range sizes {
+		if err := archive.WriteHeader(&tar.Header{
+			Name:     "Plex Media Server/" + string(rune('a'+i)),
+			Mode:     0644,
+			Size:     int64(size),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.CopyN(archive, rand.Reader, int64(size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr := summer.Close(compressed.bytes)
+	if !withTrailer {
+		return object.Bytes(), nil
+	}
+	if err := appendTrailer(&object, tr); err != nil {
+		t.Fatal(err)
+	}
+	return object.Bytes(), tr
+}
+
+// readObject decompresses object through a tailReader, as verify and restore
+// do, returning the result of checking it against its trailer.
+func readObject(t *testing.T, object []byte) (*tailReader, error) {
+	t.Helper()
+	// Small reads, so the tail is retained across many.
+	tail := &tailReader{r: iotest.HalfReader(bytes.NewReader(object))}
+	decoder, err := zstd.NewReader(tail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	archive := newSummingReader(decoder)
+	entries := 0
+	reader := tar.NewReader(archive)
+	for {
+		if _, err := reader.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entries++
+	}
+	// The end of the archive, and anything after it.
+	if _, err := io.Copy(io.Discard, archive); err != nil {
+		return nil, err
+	}
+	return tail, tail.check(archive, entries)
+}
+
+func TestTrailer(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		sizes []int
+	}{
+		{"empty", nil},
+		{"small", []int{10, 0, 100}},
+		{"larger than the tail", []int{maxTrailerBytes * 100, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			object, want := archiveObject(t, tc.sizes, true)
+			if want.Entries != len(tc.sizes) {
+				t.Errorf("trailer records %v entries, want %v", want.Entries, len(tc.sizes))
+			}
+			tail, err := readObject(t, object)
+			if err != nil {
+				t.Fatalf("check() = %v", err)
+			}
+			got, size := tail.trailer()
+			if got == nil {
+				t.Fatal("trailer() found no trailer")
+			}
+			if *got != *want {
+				t.Errorf("trailer() = %+v, want %+v", got, want)
+			}
+			if uint64(len(object)-size) != want.CompressedBytes {
+				t.Errorf("trailer frame is %v bytes of %v, but %v precede it", size, len(object), want.CompressedBytes)
+			}
+		})
+	}
+}
+
+func TestTrailerAbsent(t *testing.T) {
+	object, _ := archiveObject(t, []int{100}, false)
+	tail, err := readObject(t, object)
+	if err != nil {
+		t.Fatalf("check() = %v, want nil without a trailer", err)
+	}
+	if tr, _ := tail.trailer(); tr != nil {
+		t.Errorf("trailer() = %+v, want nil", tr)
+	}
+}
+
+func TestTrailerMismatch(t *testing.T) {
+	object, want := archiveObject(t, []int{1000, 1000}, true)
+	for _, tc := range []struct {
+		name    string
+		trailer trailer
+	}{
+		{"compressed bytes", trailer{want.SHA256, want.Entries, want.UncompressedBytes, want.CompressedBytes + 1}},
+		{"uncompressed bytes", trailer{want.SHA256, want.Entries, want.UncompressedBytes - 1, want.CompressedBytes}},
+		{"entries", trailer{want.SHA256, want.Entries + 1, want.UncompressedBytes, want.CompressedBytes}},
+		{"digest", trailer{want.SHA256[1:] + want.SHA256[:1], want.Entries, want.UncompressedBytes, want.CompressedBytes}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The object with its trailer replaced.
+			modified := bytes.NewBuffer(bytes.Clone(object[:want.CompressedBytes]))
+			if err := appendTrailer(modified, &tc.trailer); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readObject(t, modified.Bytes()); err == nil {
+				t.Error("check() succeeded, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultPlexSQLite is where Plex's Linux packages install their build of
+// SQLite, which supports the tokenizers and collations the library databases
+// are created with, so must be used to modify them.
+const DefaultPlexSQLite = "/usr/lib/plexmediaserver/Plex SQLite"
+
+// vacuumSQL checkpoints the write-ahead log into the database and truncates
+// it, then rebuilds the database without its free pages, and checkpoints the
+// log VACUUM wrote through.
+const vacuumSQL = "PRAGMA wal_checkpoint(TRUNCATE); VACUUM; PRAGMA wal_checkpoint(TRUNCATE);"
+
+// vacuum compacts each of the library databases in o.Directories with
+// o.PlexSQLite, while the service is stopped. Failure is only logged, as the
+// databases are left as they were, and can still be backed up.
+func (o *Opts) vacuum(ctx context.Context, logger *slog.Logger) {
+	for _, directory := range o.Directories {
+		for _, database := range LibraryDatabases {
+			name := filepath.Join(directory, databasesDir, database)
+			before, err := os.Stat(name)
+			if err != nil {
+				continue
+			}
+			start := time.Now()
+			if err := o.runner().Run(ctx, nil, o.plexSQLite(), name, vacuumSQL); err != nil {
+				logger.WarnContext(ctx, "failed to vacuum database",
+					slog.String("database", name),
+					slog.String("error", err.Error()))
+				continue
+			}
+			after, err := os.Stat(name)
+			if err != nil {
+				continue
+			}
+			logger.InfoContext(ctx, "vacuumed database",
+				slog.String("database", name),
+				slog.Duration("elapsed", time.Since(start)),
+				slog.Int64("bytes_before", before.Size()),
+				slog.Int64("bytes_after", after.Size()))
+		}
+	}
+}
+
+// plexSQLite returns o.PlexSQLite, or DefaultPlexSQLite if it is empty.
+func (o *Opts) plexSQLite() string {
+	if o.PlexSQLite == "" {
+		return DefaultPlexSQLite
+	}
+	return o.PlexSQLite
+}
@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Verify downloads the backup at key in bucket and reads every entry of the
+// archive, proving it can be restored. If digest is non-empty, the object must
+// also have that hex-encoded SHA-256 digest, as recorded in Result.SHA256. An
+// encrypted backup is decrypted with keys, failing with an error wrapping
+// ErrNoKey before anything is downloaded if they cannot decrypt every object.
+// The parts of the backup are also read, though have no digest to check. Each
+// object is also checked against its trailer, if it has one, so truncation and
+// corruption are detected without a digest. SQLite databases in the archive
+// must be consistent with their write-ahead logs, as they may not be if Plex
+// was not stopped. The number of entries is returned. The error wraps
+// ErrVerify.
+func Verify(ctx context.Context, client S3API, keys KMSAPI, bucket, key, digest string) (entries int, err error) {
+	ctx, span := tracer.Start(ctx, "verify", trace.WithAttributes(
+		attribute.String("key", key)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	parts, err := PartKeys(ctx, client, bucket, key)
+	if err != nil {
+		return 0, fmt.Errorf("%w %v: failed to list parts: %w", ErrVerify, key, err)
+	}
+	if err := checkKeys(ctx, client, keys, bucket, key, parts); err != nil {
+		return 0, fmt.Errorf("%w %v: %w", ErrVerify, key, err)
+	}
+	return verifyObjects(ctx, client, keys, bucket, append([]string{key}, parts...), []string{digest})
+}
+
+// verifyResult verifies the backup described by result, checking the digest
+// of each of its parts as well as the backup object. The error wraps
+// ErrVerify.
+func (o *Opts) verifyResult(ctx context.Context, client S3API, result *Result) (entries int, err error) {
+	ctx, span := tracer.Start(ctx, "verify", trace.WithAttributes(
+		attribute.String("key", result.Key)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	keys, digests := []string{result.Key}, []string{result.SHA256}
+	for _, part := range result.Parts {
+		keys = append(keys, part.Key)
+		digests = append(digests, part.SHA256)
+	}
+	return verifyObjects(ctx, client, o.KMS, o.Bucket, keys, digests)
+}
+
+// verifyObjects verifies each object in objects in turn, against the digest at
+// the same index, if any, returning the total number of entries.
+func verifyObjects(ctx context.Context, client S3API, keys KMSAPI, bucket string, objects, digests []string) (int, error) {
+	total := 0
+	for i, key := range objects {
+		digest := ""
+		if i < len(digests) {
+			digest = digests[i]
+		}
+		entries, err := verify(ctx, client, keys, bucket, key, digest)
+		total += entries
+		if err != nil {
+			return total, fmt.Errorf("%w %v: %w", ErrVerify, key, err)
+		}
+	}
+	return total, nil
+}
+
+// verify implements Verify, returning unwrapped errors.
+func verify(ctx context.Context, client S3API, keys KMSAPI, bucket, key, digest string) (int, error) {
+	hash := sha256.New()
+	body, err := openBackup(ctx, client, keys, bucket, key, hash)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	// The decoder is only as fast as the download, so concurrency would
+	// just use memory.
+	tail := &tailReader{r: body}
+	dec, err := decompress(ctx, tail, key, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return 0, err
+	}
+	defer dec.Close()
+	archived := newSummingReader(dec)
+
+	entries := 0
+	databases := newDatabaseChecker()
+	archive := tar.NewReader(archived)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, fmt.Errorf("failed to read entry %v: %w", entries+1, err)
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			err = databases.read(header.Name, archive)
+		case tar.TypeLink:
+			databases.link(header.Name, header.Linkname)
+		default:
+			_, err = io.Copy(io.Discard, archive)
+		}
+		if err != nil {
+			return entries, fmt.Errorf("failed to read entry %v: %w", entries+1, err)
+		}
+		entries++
+	}
+	// Include anything after the end of the archive in the digests.
+	if _, err := io.Copy(io.Discard, archived); err != nil {
+		return entries, err
+	}
+	if digest != "" {
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != digest {
+			return entries, fmt.Errorf("SHA-256 is %v, expected %v", actual, digest)
+		}
+	}
+	if err := tail.check(archived, entries); err != nil {
+		return entries, err
+	}
+	if err := databases.check(); err != nil {
+		return entries, fmt.Errorf("inconsistent SQLite databases: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// objectVersion identifies a single version of an object in a versioned
+// bucket.
+type objectVersion struct {
+	key, versionID string
+}
+
+// PurgeVersions permanently deletes the noncurrent versions and delete markers
+// of backups and their parts under prefix. In a bucket with versioning enabled,
+// Prune only adds a delete marker, so old backups continue to be billed until
+// this is called. Current versions, and objects other than backups, such as the
+// catalog, are untouched. The number of versions deleted is returned; the error
+// wraps ErrPrune.
+func PurgeVersions(ctx context.Context, client S3API, bucket, prefix string) (purged int, err error) {
+	ctx, span := tracer.Start(ctx, "purge_versions", trace.WithAttributes(
+		attribute.String("prefix", prefix)))
+	defer func() {
+		span.SetAttributes(attribute.Int("purged", purged))
+		endSpan(span, err)
+	}()
+
+	var versions, markers []objectVersion
+	paginator := s3.NewListObjectVersionsPaginator(client, &s3.ListObjectVersionsInput{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("%w: failed to list versions: %w", ErrPrune, err)
+		}
+		for _, version := range page.Versions {
+			if !aws.ToBool(version.IsLatest) && isBackupObject(aws.ToString(version.Key)) {
+				versions = append(versions, objectVersion{
+					key:       aws.ToString(version.Key),
+					versionID: aws.ToString(version.VersionId),
+				})
+			}
+		}
+		for _, marker := range page.DeleteMarkers {
+			if isBackupObject(aws.ToString(marker.Key)) {
+				markers = append(markers, objectVersion{
+					key:       aws.ToString(marker.Key),
+					versionID: aws.ToString(marker.VersionId),
+				})
+			}
+		}
+	}
+
+	// Delete markers go last, so a failure part way through cannot make a
+	// pruned backup current again.
+	for _, v := range append(versions, markers...) {
+		if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket:    &bucket,
+			Key:       &v.key,
+			VersionId: &v.versionID,
+		}); err != nil {
+			return purged, fmt.Errorf("%w %v version %v: %w", ErrPrune, v.key, v.versionID, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/gebn/plexbackup/internal/pkg/ratelimit"
+	"github.com/gebn/plexbackup/internal/pkg/schedule"
+)
+
+// windowReader passes reads through to r while window is open. While it is
+// closed, reads are limited to rate bytes per second, or block until it opens
+// if rate is zero.
+type windowReader struct {
+	ctx    context.Context
+	logger *slog.Logger
+	key    string
+	r      io.Reader
+	window schedule.Window
+	rate   int64
+
+	// limited reads from r while the window is closed, and is nil while it
+	// is open, so the rate is measured from when it last closed.
+	limited io.Reader
+}
+
+func (o *Opts) newWindowReader(ctx context.Context, logger *slog.Logger, key string, r io.Reader) io.Reader {
+	if o.UploadWindow.IsZero() {
+		return r
+	}
+	return &windowReader{
+		ctx:    ctx,
+		logger: logger,
+		key:    key,
+		r:      r,
+		window: o.UploadWindow,
+		rate:   o.OutsideWindowRate,
+	}
+}
+
+func (w *windowReader) Read(p []byte) (int, error) {
+	now := time.Now()
+	if w.window.Contains(now) {
+		if w.limited != nil {
+			w.logger.InfoContext(w.ctx, "upload window opened",
+				slog.String("key", w.key))
+			w.limited = nil
+		}
+		return w.r.Read(p)
+	}
+	if w.limited == nil {
+		w.logger.InfoContext(w.ctx, "upload window closed",
+			slog.String("key", w.key),
+			slog.String("window", w.window.String()),
+			slog.Int64("bytes_per_second", w.rate),
+			slog.Time("opens", w.window.Opens(now)))
+		w.limited = w.r
+		if w.rate > 0 {
+			w.limited = ratelimit.New(w.ctx, w.r, w.rate)
+		}
+	}
+	if w.rate > 0 {
+		return w.limited.Read(p)
+	}
+	timer := time.NewTimer(time.Until(w.window.Opens(now)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return w.Read(p)
+	case <-w.ctx.Done():
+		return 0, w.ctx.Err()
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gebn/plexbackup/internal/pkg/schedule"
+)
+
+// breaker suspends the scheduled backups of a job after consecutive failures,
+// so a backup that will never succeed, e.g. because credentials have expired,
+// does not stop Plex every night. Once threshold runs have failed in a row,
+// the next scheduled run is skipped, then the next two after another failure,
+// doubling up to maxSkip. A successful run closes it. It is not safe for
+// concurrent use.
+type breaker struct {
+	sched     schedule.Schedule
+	threshold int
+	maxSkip   int
+
+	// failures is the number of consecutive failed runs.
+	failures int
+
+	// skip is the number of scheduled runs remaining to be skipped.
+	skip int
+
+	// resumes is the scheduled time, before jitter, of the next run that
+	// will be attempted while the breaker is open, otherwise zero.
+	resumes time.Time
+}
+
+func newBreaker(sched schedule.Schedule, threshold, maxSkip int) *breaker {
+	return &breaker{
+		sched:     sched,
+		threshold: threshold,
+		maxSkip:   maxSkip,
+	}
+}
+
+// allow returns whether a scheduled run should go ahead. If not, the run is
+// counted as skipped.
+func (b *breaker) allow() bool {
+	if b.skip == 0 {
+		return true
+	}
+	b.skip--
+	return false
+}
+
+// record updates the breaker with the outcome of a run finishing at now.
+func (b *breaker) record(err error, now time.Time) {
+	b.resumes = time.Time{}
+	if err == nil {
+		b.failures = 0
+		b.skip = 0
+		return
+	}
+	b.failures++
+	if b.failures < b.threshold {
+		return
+	}
+	b.skip = min(1<<min(b.failures-b.threshold, 30), b.maxSkip)
+	b.resumes = now
+	for range b.skip + 1 {
+		if b.resumes = b.sched.Next(b.resumes); b.resumes.IsZero() {
+			break
+		}
+	}
+}
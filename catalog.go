@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// catalogRebuild reconstructs the catalog of each job from the backups under
+// its prefix, writing the changes made to w.
+func catalogRebuild(ctx context.Context, w io.Writer, configs []*jobConfig, names []string) error {
+	var errs []error
+	for i, c := range configs {
+		if err := catalogRebuildJob(ctx, w, c); err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// catalogRebuildJob reconstructs the catalog of a single job.
+func catalogRebuildJob(ctx context.Context, w io.Writer, c *jobConfig) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := backup.RebuildCatalog(ctx, c.s3Client(cfg), c.bucket, c.prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range result.Added {
+		fmt.Fprintf(w, "added s3://%v/%v\n", c.bucket, key)
+	}
+	for _, key := range result.Pruned {
+		fmt.Fprintf(w, "marked s3://%v/%v pruned: no longer exists\n", c.bucket, key)
+	}
+	for _, key := range result.Incomplete {
+		fmt.Fprintf(w, "skipped s3://%v/%v: parts are missing\n", c.bucket, key)
+	}
+	fmt.Fprintf(w, "rebuilt s3://%v/%v%v: %v added, %v marked pruned\n", c.bucket, c.prefix, backup.CatalogName, len(result.Added), len(result.Pruned))
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// Exit codes of the check command, following the Nagios plugin convention
+// rather than those of a backup.
+const (
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+// ErrStale is returned by check if a job's newest backup is older than
+// -max-age, or there are no backups.
+var ErrStale = errors.New("backup is stale")
+
+// checkError carries the exit code of the check command.
+type checkError struct {
+	error
+	code int
+}
+
+func (e checkError) Unwrap() error {
+	return e.error
+}
+
+// check writes a line to w describing the age of the newest backup of each
+// job. It returns a checkError if any is older than -max-age, or could not be
+// determined.
+func check(ctx context.Context, w io.Writer, configs []*jobConfig, names []string) error {
+	var errs []error
+	code := 0
+	for i, c := range configs {
+		label := "s3://" + c.bucket + "/" + c.prefix
+		if names[i] != "" {
+			label = names[i] + " (" + label + ")"
+		}
+		status, err := checkJob(ctx, c)
+		switch {
+		case errors.Is(err, ErrStale):
+			fmt.Fprintf(w, "CRITICAL: %v: %v\n", label, status)
+			code = max(code, checkCritical)
+		case err != nil:
+			fmt.Fprintf(w, "UNKNOWN: %v: %v\n", label, err)
+			code = max(code, checkUnknown)
+		default:
+			fmt.Fprintf(w, "OK: %v: %v\n", label, status)
+		}
+		if err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	if code == 0 {
+		return nil
+	}
+	return checkError{errors.Join(errs...), code}
+}
+
+// checkJob describes the newest backup of c, returning ErrStale if it is older
+// than -max-age.
+func checkJob(ctx context.Context, c *jobConfig) (string, error) {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	newest, err := backup.NewestObject(ctx, c.s3Client(cfg), c.bucket, c.prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to list backups: %w", err)
+	}
+	if newest == nil {
+		return "no backups found", ErrStale
+	}
+	age := time.Since(*newest.LastModified).Round(time.Minute)
+	status := fmt.Sprintf("newest backup %v is %v old", *newest.Key, age)
+	if age > maxAge {
+		return status + ", more than " + maxAge.String(), ErrStale
+	}
+	return status, nil
+}
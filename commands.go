@@ -0,0 +1,631 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Global flags, accepted by every command.
+var (
+	showVersion bool
+	configFile  string
+	jobNames    stringsFlag
+	isDebug     bool
+	logLevel    string
+	logFormat   string
+	isQuiet     bool
+	stagingFile string
+
+	// defaultJob holds the job flags provided on the command line. It is used
+	// directly unless the -config file defines named jobs, in which case it
+	// provides defaults for each.
+	defaultJob = &jobConfig{}
+)
+
+// Flags of particular commands, registered by their flags function.
+var (
+	jsonOutput       bool
+	progressInterval time.Duration
+	backupLabel      string
+	maxProcs         int
+	maxMemory        int
+	tracing          bool
+
+	preUpgradeApt        bool
+	preUpgradeWatchtower bool
+
+	seedDir       string
+	seedChunkSize int
+
+	scheduleSpec string
+	jitter       time.Duration
+	livenessFile string
+	runToken     string
+	listenAddr   string
+
+	agentTLSCert      string
+	agentTLSKey       string
+	agentRestartAfter time.Duration
+
+	breakerFailures int
+	breakerMaxSkip  int
+
+	historyFile string
+	historySize int
+
+	maxAge time.Duration
+
+	dryRun bool
+
+	restoreKey         string
+	restoreDir         string
+	restoreDiff        bool
+	restoreInteractive bool
+	fixOwnership       bool
+	restoreOwner       string
+
+	downloadConcurrency int
+	downloadPartSize    int
+	downloadStream      bool
+
+	retentionDays int
+
+	migrateFrom string
+	migrateTo   string
+
+	lifecycleTransitionDays  int
+	lifecycleTransitionClass string
+	lifecycleExpireDays      int
+
+	iamRestore bool
+	iamSeed    bool
+
+	unitName       string
+	unitUser       string
+	unitOnCalendar string
+	unitDelay      time.Duration
+	unitInstall    bool
+)
+
+// command is a subcommand of the CLI, e.g. "restore". Each has its own flag
+// set, containing the global flags, the job flags and its own.
+type command struct {
+	name string
+
+	// usage follows the name in the synopsis.
+	usage string
+
+	// summary is a one-line description, starting lower case.
+	summary string
+
+	// examples are the arguments of example invocations, shown by help.
+	examples []string
+
+	// flags registers the command's own flags, and may be nil.
+	flags func(*flag.FlagSet)
+
+	// noJobs indicates the command does not act on jobs, so does not accept
+	// the job flags.
+	noJobs bool
+
+	// fs holds every flag the command accepts, and own only those
+	// registered by flags, for help.
+	fs, own *flag.FlagSet
+}
+
+// commands are the commands of the CLI, in the order they are listed by
+// -help.
+var commands = []*command{
+	{
+		name:    "init",
+		usage:   "[flags]",
+		summary: "detect how Plex is installed, test access to the bucket, and write a -config file and optionally a systemd timer",
+		examples: []string{
+			"-config /etc/plexbackup.yaml -bucket my-backups -region eu-west-2",
+		},
+		flags: unitFlags,
+	},
+	{
+		name:    "backup",
+		usage:   "[flags]",
+		summary: "perform a single backup of each -job; the default if no command is given",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton-",
+			"-config /etc/plexbackup.yaml -job plex",
+			"-config /etc/plexbackup.yaml -label pre-upgrade-1.40",
+		},
+		flags: func(fs *flag.FlagSet) {
+			backupFlags(fs)
+			fs.StringVar(&backupLabel, "label", "", `label the backup, e.g. "pre-upgrade-1.40", so it is never pruned; it does not replace the newest unlabelled backup, which is kept`)
+		},
+	},
+	{
+		name:    "restore",
+		usage:   "[flags]",
+		summary: "extract the newest or -key backup of a -job into -restore-dir",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton- -restore-dir /var/tmp/plex-restore -fix-ownership",
+			"-bucket my-backups -prefix plex/newton- -key plex/newton-2024-04-20T06:22:01Z.tar.zst -diff",
+			"-config /etc/plexbackup.yaml -job plex -interactive",
+		},
+		flags: restoreFlags,
+	},
+	{
+		name:    "pre-upgrade",
+		usage:   "[flags]",
+		summary: "take a labelled backup of each -job before Plex is upgraded, failing so the upgrade is blocked if it cannot",
+		examples: []string{
+			"-config /etc/plexbackup.yaml -apt",
+			"-config /etc/plexbackup.yaml -watchtower",
+		},
+		flags: preUpgradeFlags,
+	},
+	{
+		name:    "seed",
+		usage:   "[flags]",
+		summary: "take the first backup of a -job over as many runs as it takes, staging it in -seed-dir and uploading it in resumable chunks",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton- -seed-dir /srv/plexbackup-seed -upload-window 01:00-07:00",
+		},
+		flags: seedFlags,
+	},
+	{
+		name:    "list",
+		usage:   "[flags]",
+		summary: "list the backups of each -job, oldest first",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton-",
+		},
+	},
+	{
+		name:    "prune",
+		usage:   "[flags]",
+		summary: "delete the backups of each -job the retention policy would, e.g. after a failed prune",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton- -dry-run",
+		},
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&dryRun, "dry-run", false, "list the backups that would be deleted, and why, without deleting them")
+		},
+	},
+	{
+		name:    "verify",
+		usage:   "[flags]",
+		summary: "download the newest or -key backup of each -job and read every file in it",
+		examples: []string{
+			"-config /etc/plexbackup.yaml",
+		},
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&restoreKey, "key", "", "key of the backup to verify (default the newest under -prefix)")
+		},
+	},
+	{
+		name:    "daemon",
+		usage:   "[flags]",
+		summary: "perform backups of each -job on a -schedule",
+		examples: []string{
+			"-bucket my-backups -schedule 03:30 -jitter 10m -listen-addr :9812",
+		},
+		flags: daemonFlags,
+	},
+	{
+		name:    "history",
+		usage:   "[flags]",
+		summary: "show the most recent runs of the daemon, newest first, including failures and skipped backups",
+		examples: []string{
+			"-history-file /var/cache/plexbackup/history.json",
+		},
+		flags: func(fs *flag.FlagSet) {
+			historyFlags(fs)
+			fs.BoolVar(&jsonOutput, "json", false, "write the runs as a JSON array")
+		},
+		noJobs: true,
+	},
+	{
+		name:    "version",
+		usage:   "[flags]",
+		summary: "display software version",
+		examples: []string{
+			"-json",
+		},
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&jsonOutput, "json", false, "write the version as a JSON document")
+		},
+		noJobs: true,
+	},
+	{
+		name:    "install-unit",
+		usage:   "[flags]",
+		summary: "generate systemd units running a backup with the provided flags",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton- -unit-install",
+		},
+		flags: installUnitFlags,
+	},
+	{
+		name:    "retention",
+		usage:   "simulate [flags]",
+		summary: "show which backups of each -job its -keep-daily, -keep-weekly and -keep-monthly policy would keep or delete over the next -days",
+		examples: []string{
+			"simulate -bucket my-backups -prefix plex/newton- -keep-daily 7 -keep-weekly 4 -days 60",
+		},
+		flags: retentionFlags,
+	},
+	{
+		name:    "check",
+		usage:   "[flags]",
+		summary: "exit 2 if the newest backup of any -job is older than -max-age, for monitoring",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton- -max-age 26h",
+		},
+		flags: func(fs *flag.FlagSet) {
+			fs.DurationVar(&maxAge, "max-age", 26*time.Hour, "age beyond which the newest backup is considered stale")
+		},
+	},
+	{
+		name:    "cost",
+		usage:   "[flags]",
+		summary: "estimate the monthly cost of storing the backups of each -job",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton-",
+		},
+	},
+	{
+		name:    "stats",
+		usage:   "[flags]",
+		summary: "show how the backups and library databases of each -job have grown, from the catalog",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton-",
+		},
+	},
+	{
+		name:    "rekey",
+		usage:   "[flags]",
+		summary: "rewrap the data keys of each -job's encrypted backups with its -kms-key-id values, e.g. after rotating keys",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton- -kms-key-id alias/plexbackup-2025",
+		},
+	},
+	{
+		name:    "catalog",
+		usage:   "rebuild [flags]",
+		summary: "reconstruct the catalog of each -job from the backups under its -prefix, e.g. after enabling -catalog on existing backups",
+		examples: []string{
+			"rebuild -bucket my-backups -prefix plex/newton-",
+		},
+	},
+	{
+		name:    "diff",
+		usage:   "[flags] <key> <key>",
+		summary: "list the files added, removed and modified between two backups of a -job, given as keys or names under -prefix",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton- 2024-01-01T03:30:00Z.tar.zst 2024-01-02T03:30:00Z.tar.zst",
+		},
+	},
+	{
+		name:    "repair-db",
+		usage:   "[flags]",
+		summary: "replace Plex's library databases with those in the newest or -key backup of a -job",
+		examples: []string{
+			"-bucket my-backups -prefix plex/newton-",
+		},
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&restoreKey, "key", "", "key of the backup to take the databases from (default the newest under -prefix)")
+		},
+	},
+	{
+		name:    "migrate-prefix",
+		usage:   "[flags]",
+		summary: "move the backups of a -job from the -from prefix to the -to prefix, along with their catalog entries",
+		examples: []string{
+			"-bucket my-backups -from plex/ -prefix plex/newton/",
+		},
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&migrateFrom, "from", "", "prefix the backups are currently under")
+			fs.StringVar(&migrateTo, "to", "", "prefix to move the backups to (default -prefix)")
+		},
+	},
+	{
+		name:    "agent",
+		usage:   "[flags]",
+		summary: "serve requests to stop, start and archive Plex from a coordinator with -agent-url",
+		examples: []string{
+			"-listen-addr :9813 -agent-token ssm:/plexbackup/agent-token",
+			"-listen-addr :9813 -agent-token ssm:/plexbackup/agent-token -agent-tls-cert /etc/plexbackup/agent.crt -agent-tls-key /etc/plexbackup/agent.key",
+		},
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&listenAddr, "listen-addr", "", `address to serve agent requests on, e.g. ":9813"`)
+			fs.StringVar(&agentTLSCert, "agent-tls-cert", "", "path of a PEM certificate to serve agent requests over HTTPS with, so the -agent-token and archive are encrypted; requires -agent-tls-key")
+			fs.StringVar(&agentTLSKey, "agent-tls-key", "", "path of the PEM private key of the -agent-tls-cert")
+			fs.DurationVar(&agentRestartAfter, "restart-after", 15*time.Minute, "how long after stopping Plex, or finishing an archive, to start it again if the coordinator has not, e.g. as it crashed; 0 to wait forever")
+			runtimeFlags(fs)
+		},
+	},
+	{
+		name:    "lifecycle",
+		usage:   "apply [flags]",
+		summary: "create or update an S3 lifecycle rule transitioning and expiring the backups of each -job",
+		examples: []string{
+			"apply -bucket my-backups -prefix plex/newton- -lifecycle-transition-days 30 -lifecycle-expire-days 365",
+		},
+		flags: lifecycleFlags,
+	},
+	{
+		name:    "iam-policy",
+		usage:   "[flags]",
+		summary: "print the least-privilege IAM policy allowing the backups of each -job, given the features their flags enable",
+		examples: []string{
+			"-config /etc/plexbackup.yaml",
+			"-bucket my-backups -prefix plex/newton- -prune=false -restore",
+		},
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&iamRestore, "restore", false, "also allow restoring, verifying and repairing from the backups, which additionally requires kms:Decrypt with -kms-key-id")
+			fs.BoolVar(&iamSeed, "seed", false, "also allow the seed command, which deletes its chunks once assembled, so additionally requires s3:DeleteObject on them with -prune=false")
+		},
+	},
+	{
+		name:    "completion",
+		usage:   "bash|zsh|fish",
+		summary: "print a script completing commands, flags and backup keys in the given shell",
+		examples: []string{
+			"bash > /etc/bash_completion.d/plexbackup",
+			"zsh > \"${fpath[1]}/_plexbackup\"",
+			"fish > ~/.config/fish/completions/plexbackup.fish",
+		},
+		noJobs: true,
+	},
+}
+
+// subcommands maps the commands that take a subcommand to the only one they
+// currently accept.
+var subcommands = map[string]string{
+	"lifecycle": "apply",
+	"catalog":   "rebuild",
+	"retention": "simulate",
+}
+
+// commandAliases maps alternative names to the command they refer to.
+var commandAliases = map[string]string{
+	"":    "backup",
+	"run": "backup",
+}
+
+// lookupCommand returns the command with the given name or alias, or nil if
+// there is none.
+func lookupCommand(name string) *command {
+	if alias, ok := commandAliases[name]; ok {
+		name = alias
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// isCommandFlag returns whether name is a flag of any command, so may appear
+// in a -config file shared by several.
+func isCommandFlag(name string) bool {
+	for _, cmd := range commands {
+		if cmd.fs.Lookup(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// globalFlagSet holds the global flags alone, for help.
+var globalFlagSet = flag.NewFlagSet("global", flag.ContinueOnError)
+
+// jobFlagGroups are the job flags divided by concern, for help.
+var jobFlagGroups = []*struct {
+	title    string
+	register func(*jobConfig, *flag.FlagSet)
+	fs       *flag.FlagSet
+}{
+	{title: "Storage", register: (*jobConfig).registerStorage},
+	{title: "Plex", register: (*jobConfig).registerPlex},
+	{title: "Hook", register: (*jobConfig).registerHooks},
+	{title: "Notification", register: (*jobConfig).registerNotifications},
+}
+
+func init() {
+	// Every flag set is built before any is parsed, as registering a flag
+	// resets its variable to the default.
+	globalFlags(globalFlagSet)
+	for _, group := range jobFlagGroups {
+		group.fs = flag.NewFlagSet(group.title, flag.ContinueOnError)
+		group.register(defaultJob, group.fs)
+	}
+	for _, cmd := range commands {
+		cmd.own = flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		if cmd.flags != nil {
+			cmd.flags(cmd.own)
+		}
+		cmd.fs = flag.NewFlagSet(cmd.name, flag.ExitOnError)
+		globalFlags(cmd.fs)
+		if !cmd.noJobs {
+			defaultJob.register(cmd.fs)
+		}
+		if cmd.flags != nil {
+			cmd.flags(cmd.fs)
+		}
+		cmd.fs.Usage = cmd.printUsage
+	}
+}
+
+// globalFlags registers the flags accepted by every command on fs.
+func globalFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&showVersion, "version", false, "display software version and exit, like the version command")
+	fs.StringVar(&configFile, "config", "", "path of a YAML file mapping flag names to values; flags on the command line take precedence")
+	fs.Var(&jobNames, "job", "name of a job in the -config file to run, may be repeated; defaults to all jobs")
+	fs.BoolVar(&isDebug, "debug", false, "enable debug logging in a human-readable format; shorthand for -log-level debug -log-format text")
+	fs.StringVar(&logLevel, "log-level", "", "minimum level of log messages: debug, info, warn or error (default info)")
+	fs.StringVar(&logFormat, "log-format", "", "format of log messages: json, text or journal (default journal if stderr is connected to the systemd journal, otherwise json)")
+	fs.BoolVar(&isQuiet, "quiet", false, "only log errors; shorthand for -log-level error")
+	fs.StringVar(&stagingFile, "staging-file", defaultStagingFile(), "path of a file recording the temporary files created while running, so those left by a crashed run are removed by the next; empty to not record them")
+}
+
+// runtimeFlags registers the flags controlling the resources used and
+// telemetry emitted by commands that archive Plex.
+func runtimeFlags(fs *flag.FlagSet) {
+	fs.IntVar(&maxProcs, "max-procs", 0, "maximum number of CPUs to compress with, e.g. 1 to leave the others free for Plex; 0 to use all")
+	fs.IntVar(&maxMemory, "max-memory", 0, "approximate memory limit in MB, e.g. 200 in a 256 MB container; reduces compression and upload buffering to fit, 0 for no limit")
+	fs.BoolVar(&tracing, "tracing", false, "export OpenTelemetry traces via OTLP/HTTP, configured by the standard OTEL_EXPORTER_OTLP_* environment variables")
+}
+
+// backupFlags registers the flags of the backup command, which the daemon and
+// install-unit commands also accept.
+func backupFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&jsonOutput, "json", false, "write a JSON document describing the result of each run to stdout")
+	fs.DurationVar(&progressInterval, "progress-interval", time.Minute, "how often to log progress while a backup is running, 0 to disable; a progress bar is shown instead if stdout is a terminal")
+	runtimeFlags(fs)
+}
+
+func preUpgradeFlags(fs *flag.FlagSet) {
+	backupFlags(fs)
+	fs.StringVar(&backupLabel, "label", "", `label of the backup (default "pre-upgrade-" followed by the running Plex version, or "pre-upgrade" if it cannot be detected)`)
+	fs.BoolVar(&preUpgradeApt, "apt", false, "read the packages about to be installed from stdin, as given to apt's DPkg::Pre-Install-Pkgs hook, and do nothing unless Plex is among them")
+	fs.BoolVar(&preUpgradeWatchtower, "watchtower", false, "exit with 75 on any failure, which Watchtower's pre-update lifecycle hook requires to skip the update")
+}
+
+func seedFlags(fs *flag.FlagSet) {
+	backupFlags(fs)
+	fs.StringVar(&seedDir, "seed-dir", "", "directory to stage the backup in, with space for the compressed backup; created if it does not exist, and kept between runs until the seed completes")
+	fs.IntVar(&seedChunkSize, "chunk-size", 256, "size in MB of each chunk of the backup uploaded as its own object, at least 6; an interrupted chunk is uploaded again from its start")
+}
+
+func daemonFlags(fs *flag.FlagSet) {
+	backupFlags(fs)
+	fs.StringVar(&scheduleSpec, "schedule", "", `local time of day to back up at, e.g. "03:30", or a 5-field cron expression; a time repeated as clocks go back backs up once, and one skipped as they go forward when they change`)
+	fs.DurationVar(&jitter, "jitter", 0, "maximum random delay added to each scheduled backup")
+	fs.StringVar(&livenessFile, "liveness-file", "", "path of a file whose modification time is updated every 30s while the daemon is alive")
+	fs.StringVar(&runToken, "run-token", "", "secret required to request a backup with POST /run on the -listen-addr, as a bearer token or basic auth password; /run is disabled if empty")
+	fs.StringVar(&listenAddr, "listen-addr", "", `address to serve /healthz, /metrics and /status on, e.g. ":9812"`)
+	fs.IntVar(&breakerFailures, "breaker-failures", 3, "consecutive failures of a job after which its next scheduled backup is skipped, then twice as many after each further failure, until one succeeds; 0 to always attempt it")
+	fs.IntVar(&breakerMaxSkip, "breaker-max-skip", 7, "maximum number of scheduled backups of a failing job skipped in a row, e.g. 7 to still attempt a nightly backup weekly")
+	historyFlags(fs)
+	fs.IntVar(&historySize, "history-size", 100, "number of runs to keep in the history served on /status and shown by the history command; 0 to keep none")
+}
+
+func restoreFlags(fs *flag.FlagSet) {
+	fs.StringVar(&restoreKey, "key", "", "key of the backup to restore (default the newest under -prefix)")
+	fs.StringVar(&restoreDir, "restore-dir", "", "empty or nonexistent directory to extract the backup into")
+	fs.BoolVar(&restoreDiff, "diff", false, "list the files restoring the backup over the -directory would add, remove and modify, without restoring it")
+	fs.BoolVar(&restoreInteractive, "interactive", false, "choose the backup from a list, prompt for -restore-dir if not set, and show the live files it would overwrite before asking for its name to be typed to confirm; requires a terminal")
+	fs.BoolVar(&fixOwnership, "fix-ownership", false, "change the owner of the restored files to -restore-owner, and restore SELinux contexts if enabled, so Plex can access them after a restore as root")
+	fs.StringVar(&restoreOwner, "restore-owner", "", `"user:group" to give the restored files with -fix-ownership (default that of the -service unit)`)
+	fs.IntVar(&downloadConcurrency, "download-concurrency", 8, "number of ranges of the backup to download at once")
+	fs.IntVar(&downloadPartSize, "download-part-size", 16, "size of each range of the backup downloaded, in MB")
+	fs.BoolVar(&downloadStream, "stream", false, "extract the backup as it downloads rather than saving it to the parent of -restore-dir first, holding up to -download-concurrency ranges in memory instead, for when there is not room for both")
+}
+
+func retentionFlags(fs *flag.FlagSet) {
+	fs.IntVar(&retentionDays, "days", 30, "number of days to simulate, assuming a backup is taken each day")
+}
+
+func lifecycleFlags(fs *flag.FlagSet) {
+	fs.IntVar(&lifecycleTransitionDays, "lifecycle-transition-days", 0, "days after which backups are transitioned to -lifecycle-transition-class, 0 to disable")
+	fs.StringVar(&lifecycleTransitionClass, "lifecycle-transition-class", string(s3types.TransitionStorageClassGlacierIr), "storage class backups are transitioned to, e.g. STANDARD_IA, GLACIER_IR, GLACIER or DEEP_ARCHIVE")
+	fs.IntVar(&lifecycleExpireDays, "lifecycle-expire-days", 0, "days after which backups are deleted, 0 to disable")
+}
+
+func installUnitFlags(fs *flag.FlagSet) {
+	backupFlags(fs)
+	unitFlags(fs)
+	fs.BoolVar(&unitInstall, "unit-install", false, "write the units and sudoers rule, then enable the timer, rather than printing them; requires root")
+}
+
+// unitFlags registers the flags describing the generated systemd units.
+func unitFlags(fs *flag.FlagSet) {
+	fs.StringVar(&unitName, "unit-name", "plexbackup", "name of the generated service and timer units")
+	fs.StringVar(&unitUser, "unit-user", "plex", "user to run the backup as")
+	fs.StringVar(&unitOnCalendar, "unit-on-calendar", "*-*-* 06:00:00", "systemd OnCalendar= expression of when to back up")
+	fs.DurationVar(&unitDelay, "unit-randomized-delay", 30*time.Minute, "maximum random delay added to each -unit-on-calendar activation")
+}
+
+// printUsage describes the command, with examples, and its own flags on
+// stderr. The global and job flags are left to -help.
+func (c *command) printUsage() {
+	out := os.Stderr
+	fmt.Fprintf(out, "Usage: %v %v %v\n\n", os.Args[0], c.name, c.usage)
+	fmt.Fprintf(out, "%v.\n", upperFirst(c.summary))
+	if len(c.examples) > 0 {
+		fmt.Fprintln(out, "\nExamples:")
+		for _, example := range c.examples {
+			fmt.Fprintf(out, "  %v %v %v\n", os.Args[0], c.name, example)
+		}
+	}
+	if hasFlags(c.own) {
+		fmt.Fprintln(out, "\nFlags:")
+		c.own.SetOutput(out)
+		c.own.PrintDefaults()
+	}
+	if c.noJobs {
+		fmt.Fprintf(out, "\nThe global flags are also accepted; run %v -help to list them.\n", os.Args[0])
+	} else {
+		fmt.Fprintf(out, "\nThe global and job flags are also accepted; run %v -help to list them.\n", os.Args[0])
+	}
+}
+
+// printUsage lists the commands, the global and job flags, and the exit codes
+// on stderr.
+func printUsage() {
+	out := os.Stderr
+	fmt.Fprintf(out, "Usage: %v <command> [flags]\n\nCommands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %v\t%v\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(out, "\nRun %v help <command> for the examples and flags of a command. Flags follow the command.\n", os.Args[0])
+	fmt.Fprintln(out, "\nGlobal flags, accepted by every command:")
+	globalFlagSet.SetOutput(out)
+	globalFlagSet.PrintDefaults()
+	fmt.Fprintln(out, "\nJob flags, accepted by every command but version and completion, and settable per job in the -config file.")
+	for _, group := range jobFlagGroups {
+		fmt.Fprintf(out, "\n%v flags:\n", group.title)
+		group.fs.SetOutput(out)
+		group.fs.PrintDefaults()
+	}
+	fmt.Fprint(out, `
+Exit codes:
+  1  any other failure
+  2  invalid flags or config
+  3  failed to stop the service, so no backup was taken
+  4  failed to archive or compress the backup
+  5  failed to upload the backup
+  6  the backup finished, but the service failed to start
+  7  the backup succeeded, but an old backup could not be deleted
+  8  the backup succeeded, but could not be copied to the -replica-bucket
+  9  Plex remained in use for -busy-wait, so the backup was skipped
+  10 the backup was uploaded, but could not be read back by -verify or the verify command
+  75 pre-upgrade -watchtower failed, so Watchtower skips the update
+The check command instead follows the Nagios plugin convention: 0 if the
+newest backups are fresh, 2 if any is stale, and 3 if any cannot be listed.
+`)
+}
+
+// hasFlags returns whether any flag is defined on fs.
+func hasFlags(fs *flag.FlagSet) bool {
+	found := false
+	fs.VisitAll(func(*flag.Flag) {
+		found = true
+	})
+	return found
+}
+
+// upperFirst returns s with its first letter capitalised.
+func upperFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// completeCommand is the hidden command the completion scripts run to find
+// the candidates for the word being completed.
+const completeCommand = "__complete"
+
+// completionTimeout bounds how long listing backup keys may delay the shell.
+const completionTimeout = 5 * time.Second
+
+// completionScripts are the completion scripts for each shell. They are
+// executed with the name of the binary, and delegate to completeCommand, so
+// need not be regenerated when commands or flags change.
+var completionScripts = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Parse(`# bash completion for {{.}}, generated by {{.}} completion bash.
+_{{.}}() {
+	local line=${COMP_LINE:0:COMP_POINT}
+	local -a words
+	read -ra words <<< "$line"
+	if [[ $line == *[[:space:]] ]]; then
+		words+=("")
+	fi
+	# Readline only replaces the text after the last ":" or "=", which
+	# appear in backup keys.
+	local token=${words[${#words[@]}-1]}
+	local strip=${token%"${token##*[:=]}"}
+	local candidate IFS=$'\n'
+	COMPREPLY=()
+	for candidate in $("${words[0]}" __complete "${words[@]:1}" 2>/dev/null); do
+		COMPREPLY+=("${candidate#"$strip"}")
+	done
+}
+complete -o default -F _{{.}} {{.}}
+`)),
+	"zsh": template.Must(template.New("zsh").Parse(`#compdef {{.}}
+# zsh completion for {{.}}, generated by {{.}} completion zsh.
+compdef _{{.}} {{.}}
+
+_{{.}}() {
+	local -a candidates
+	candidates=("${(@f)$(${words[1]} __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	candidates=(${candidates:#})
+	if (( ${#candidates} )); then
+		compadd -- "${candidates[@]}"
+	else
+		_files
+	fi
+}
+
+if [[ $funcstack[1] == _{{.}} ]]; then
+	_{{.}} "$@"
+fi
+`)),
+	"fish": template.Must(template.New("fish").Parse(`# fish completion for {{.}}, generated by {{.}} completion fish.
+function __{{.}}_complete
+	set -l tokens (commandline -opc)
+	set -l program $tokens[1]
+	set -e tokens[1]
+	set -l current (commandline -ct)
+	$program __complete $tokens "$current" 2>/dev/null
+end
+
+complete -c {{.}} -f -a '(__{{.}}_complete)'
+`)),
+}
+
+// writeCompletion writes the completion script for shell to w.
+func writeCompletion(w io.Writer, shell string) error {
+	tmpl, ok := completionScripts[shell]
+	if !ok {
+		return configError{fmt.Errorf("unsupported shell %q, must be bash, zsh or fish", shell)}
+	}
+	return tmpl.Execute(w, filepath.Base(os.Args[0]))
+}
+
+// complete writes the candidates for the last of words, the arguments up to
+// the cursor, to w, one per line: commands, the flags of the command, and the
+// keys of backups for -key and diff, found by listing the bucket of each job
+// the preceding flags describe. Nothing is written if there are none, so the
+// shell falls back to completing paths.
+func complete(ctx context.Context, w io.Writer, words []string) {
+	if len(words) == 0 {
+		return
+	}
+	current, words := words[len(words)-1], words[:len(words)-1]
+	if len(words) == 0 && !strings.HasPrefix(current, "-") {
+		for _, cmd := range commands {
+			writeCandidate(w, cmd.name, current)
+		}
+		return
+	}
+
+	name := ""
+	if len(words) > 0 && !strings.HasPrefix(words[0], "-") {
+		name, words = words[0], words[1:]
+	}
+	cmd := lookupCommand(name)
+	if cmd == nil {
+		return
+	}
+	switch cmd.name {
+	case "completion":
+		if len(words) == 0 {
+			for _, shell := range []string{"bash", "fish", "zsh"} {
+				writeCandidate(w, shell, current)
+			}
+		}
+		return
+	case "lifecycle", "catalog", "retention":
+		if len(words) == 0 {
+			writeCandidate(w, subcommands[cmd.name], current)
+			return
+		}
+		words = words[1:]
+	}
+
+	if strings.HasPrefix(current, "-") {
+		cmd.fs.VisitAll(func(f *flag.Flag) {
+			writeCandidate(w, "-"+f.Name, current)
+		})
+		return
+	}
+	if len(words) > 0 {
+		if f := cmd.fs.Lookup(strings.TrimLeft(words[len(words)-1], "-")); f != nil && !isBoolFlag(f) {
+			if f.Name == "key" {
+				completeKeys(ctx, w, cmd.fs, words[:len(words)-1], current)
+			}
+			return
+		}
+	}
+	if cmd.name == "diff" {
+		completeKeys(ctx, w, cmd.fs, words, current)
+	}
+}
+
+// completeKeys writes the keys of the backups of each job described by the
+// flags in args that start with current to w. Errors are ignored, as there is
+// nowhere to report them.
+func completeKeys(ctx context.Context, w io.Writer, fs *flag.FlagSet, args []string, current string) {
+	fs.Init(fs.Name(), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return
+	}
+	configs, _, err := resolveJobs(fs, explicitFlags(fs))
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, completionTimeout)
+	defer cancel()
+	for _, c := range configs {
+		if c.bucket == "" {
+			continue
+		}
+		cfg, err := c.awsConfig(ctx)
+		if err != nil {
+			return
+		}
+		backups, err := backup.ListBackups(ctx, c.s3Client(cfg), c.bucket, c.prefix)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return
+			}
+			continue
+		}
+		for _, object := range backups {
+			writeCandidate(w, *object.Key, current)
+		}
+	}
+}
+
+// writeCandidate writes candidate to w if it starts with current.
+func writeCandidate(w io.Writer, candidate, current string) {
+	if strings.HasPrefix(candidate, current) {
+		fmt.Fprintln(w, candidate)
+	}
+}
+
+// isBoolFlag returns whether f can be given without a value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the parsed contents of a -config file. Keys are flag names
+// without the leading hyphen, e.g. "bucket" or "no-pause". Flags that may be
+// repeated, such as "webhook-url", accept a list. The optional "jobs" key maps
+// job names to further sets of flags, which override the top-level values for
+// that job only:
+//
+//	bucket: my-backups
+//	jobs:
+//	  plex:
+//	    prefix: plex/
+//	  tautulli:
+//	    prefix: tautulli/
+//	    service: tautulli.service
+//	    directory: /opt/Tautulli
+type fileConfig struct {
+	values map[string]any
+	jobs   map[string]map[string]any
+}
+
+// loadConfig reads the YAML file at path.
+func loadConfig(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Jobs   map[string]map[string]any `yaml:"jobs"`
+		Values map[string]any            `yaml:",inline"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %w", path, err)
+	}
+	return &fileConfig{
+		values: doc.Values,
+		jobs:   doc.Jobs,
+	}, nil
+}
+
+// jobNames returns the names of the jobs in the file in sorted order.
+func (c *fileConfig) jobNames() []string {
+	names := make([]string, 0, len(c.jobs))
+	for name := range c.jobs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// resolveJob returns the config for the named job. Values are taken from the
+// job's section of the file, falling back to those on fs, which has already
+// had the file's top-level values applied. Flags named in cmdline were
+// provided on the command line, and take precedence over everything.
+func (c *fileConfig) resolveJob(fs *flag.FlagSet, name string, cmdline map[string]bool) (*jobConfig, error) {
+	values, ok := c.jobs[name]
+	if !ok {
+		return nil, fmt.Errorf("no job named %q in -config", name)
+	}
+	jobFlags := flag.NewFlagSet(name, flag.ContinueOnError)
+	job := &jobConfig{}
+	job.register(jobFlags)
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil && jobFlags.Lookup(f.Name) != nil {
+			err = copyFlag(jobFlags, f)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := setFlags(jobFlags, values, cmdline); err != nil {
+		return nil, fmt.Errorf("job %v: %w", name, err)
+	}
+	return job, nil
+}
+
+// copyFlag sets the flag in fs with the same name as f to f's value.
+func copyFlag(fs *flag.FlagSet, f *flag.Flag) error {
+	if values, ok := f.Value.(*stringsFlag); ok {
+		dest := fs.Lookup(f.Name).Value.(*stringsFlag)
+		*dest = slices.Clone(*values)
+		return nil
+	}
+	return fs.Set(f.Name, f.Value.String())
+}
+
+// setFlags sets each flag in values that is not in skip. A list replaces any
+// existing values of a repeatable flag.
+func setFlags(fs *flag.FlagSet, values map[string]any, skip map[string]bool) error {
+	for name, value := range values {
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if skip[name] {
+			continue
+		}
+		if existing, ok := f.Value.(*stringsFlag); ok {
+			*existing = nil
+		}
+		list, ok := value.([]any)
+		if !ok {
+			list = []any{value}
+		}
+		for _, element := range list {
+			if err := fs.Set(name, fmt.Sprint(element)); err != nil {
+				return fmt.Errorf("invalid value for %v: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// explicitFlags returns the names of flags in fs that have been set.
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// storagePrices are the monthly storage prices of each S3 storage class in USD
+// per GiB, from the us-east-1 price list. Other regions are similar, and
+// request and retrieval charges are ignored, so estimates are approximate.
+var storagePrices = map[s3types.ObjectStorageClass]float64{
+	s3types.ObjectStorageClassStandard:           0.023,
+	s3types.ObjectStorageClassReducedRedundancy:  0.024,
+	s3types.ObjectStorageClassIntelligentTiering: 0.023,
+	s3types.ObjectStorageClassStandardIa:         0.0125,
+	s3types.ObjectStorageClassOnezoneIa:          0.01,
+	s3types.ObjectStorageClassGlacierIr:          0.004,
+	s3types.ObjectStorageClassGlacier:            0.0036,
+	s3types.ObjectStorageClassDeepArchive:        0.00099,
+}
+
+// classUsage is the amount of data stored in a storage class.
+type classUsage struct {
+	objects int
+	bytes   uint64
+}
+
+// cost writes the storage used under each job's prefix to w, broken down by
+// storage class, along with the estimated monthly cost, and what it would cost
+// in other storage classes.
+func cost(ctx context.Context, w io.Writer, configs []*jobConfig, names []string) error {
+	for i, c := range configs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		label := "s3://" + c.bucket + "/" + c.prefix
+		if names[i] != "" {
+			label = names[i] + " (" + label + ")"
+		}
+		fmt.Fprintln(w, label)
+
+		usage, err := storageUsage(ctx, c)
+		if err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			return err
+		}
+		var total uint64
+		var monthly float64
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "class\tobjects\tsize\tUSD/month\t")
+		for _, class := range slices.Sorted(maps.Keys(usage)) {
+			u := usage[class]
+			total += u.bytes
+			price, ok := storagePrices[class]
+			if !ok {
+				fmt.Fprintf(tw, "%v\t%v\t%v\t?\t\n", class, u.objects, formatBytes(u.bytes))
+				continue
+			}
+			monthly += gibibytes(u.bytes) * price
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%.2f\t\n", class, u.objects, formatBytes(u.bytes), gibibytes(u.bytes)*price)
+		}
+		fmt.Fprintf(tw, "total\t\t%v\t%.2f\t\n", formatBytes(total), monthly)
+		tw.Flush()
+
+		fmt.Fprintln(w, "If everything were stored in one class:")
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, class := range slices.Sorted(maps.Keys(storagePrices)) {
+			fmt.Fprintf(tw, "%v\t%.2f\t\n", class, gibibytes(total)*storagePrices[class])
+		}
+		tw.Flush()
+	}
+	return nil
+}
+
+// storageUsage lists every object under the job's prefix, including the
+// catalog, totalling them by storage class.
+func storageUsage(ctx context.Context, c *jobConfig) (map[s3types.ObjectStorageClass]*classUsage, error) {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	paginator := s3.NewListObjectsV2Paginator(c.s3Client(cfg), &s3.ListObjectsV2Input{
+		Bucket: &c.bucket,
+		Prefix: &c.prefix,
+	})
+	usage := map[s3types.ObjectStorageClass]*classUsage{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list backups: %w", err)
+		}
+		for _, object := range page.Contents {
+			class := object.StorageClass
+			if class == "" {
+				class = s3types.ObjectStorageClassStandard
+			}
+			if usage[class] == nil {
+				usage[class] = &classUsage{}
+			}
+			usage[class].objects++
+			if object.Size != nil {
+				usage[class].bytes += uint64(*object.Size)
+			}
+		}
+	}
+	return usage, nil
+}
+
+func gibibytes(n uint64) float64 {
+	return float64(n) / (1 << 30)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"time"
+
+	"github.com/gebn/plexbackup/internal/pkg/schedule"
+)
+
+// daemon runs each job in turn according to sched until ctx is cancelled.
+// Failed backups are logged, and do not stop the daemon, though after
+// -breaker-failures in a row, a job's scheduled runs are skipped with
+// increasing backoff until one succeeds. Runs requested via /run are always
+// attempted.
+func daemon(ctx context.Context, logger *slog.Logger, jobs []*job, sched schedule.Schedule) error {
+	if livenessFile != "" {
+		go touchLoop(ctx, logger, livenessFile)
+	}
+	h, err := loadHistory(historyFile, historySize)
+	if err != nil {
+		return err
+	}
+	state := newStatus(h)
+	if listenAddr != "" {
+		go serveStatus(ctx, logger, listenAddr, state, jobs)
+	}
+	if breakerFailures > 0 {
+		for _, j := range jobs {
+			j.breaker = newBreaker(sched, breakerFailures, breakerMaxSkip)
+		}
+	}
+
+	for {
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			return ErrScheduleExhausted
+		}
+		if jitter > 0 {
+			next = next.Add(rand.N(jitter))
+		}
+		logger.InfoContext(ctx, "next backup scheduled", slog.Time("at", next))
+		state.scheduled(next)
+
+		timer := time.NewTimer(time.Until(next))
+		requested := false
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logger.InfoContext(ctx, "shutting down")
+			return nil
+		case <-timer.C:
+		case <-state.runNow:
+			timer.Stop()
+			requested = true
+		}
+
+		state.setRunning(true)
+		for _, j := range jobs {
+			if !requested && j.breaker != nil && !j.breaker.allow() {
+				j.logger.WarnContext(ctx, "skipping backup after repeated failures",
+					slog.Int("consecutive_failures", j.breaker.failures),
+					slog.Time("resumes", j.breaker.resumes))
+				if err := state.skipped(j.name, j.breaker); err != nil {
+					j.logger.WarnContext(ctx, "failed to record run",
+						slog.String("error", err.Error()))
+				}
+				continue
+			}
+			start := time.Now()
+			result, err := j.run(ctx)
+			if err != nil {
+				j.logger.ErrorContext(ctx, "backup failed",
+					slog.String("error", err.Error()))
+			}
+			if err := state.completed(j.name, start, result, err, j.breaker); err != nil {
+				j.logger.WarnContext(ctx, "failed to record run",
+					slog.String("error", err.Error()))
+			}
+			if j.breaker != nil && !j.breaker.resumes.IsZero() {
+				j.logger.ErrorContext(ctx, "suspending scheduled backups after repeated failures",
+					slog.Int("consecutive_failures", j.breaker.failures),
+					slog.Time("resumes", j.breaker.resumes))
+			}
+		}
+		state.setRunning(false)
+	}
+}
+
+// touchLoop updates the modification time of path every 30 seconds until ctx
+// is cancelled, creating it if necessary. This allows external supervisors,
+// e.g. a container health check, to verify the daemon is alive without the
+// daemon needing to listen on a port.
+func touchLoop(ctx context.Context, logger *slog.Logger, path string) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := touch(path); err != nil {
+			logger.WarnContext(ctx, "failed to update liveness file",
+				slog.String("path", path),
+				slog.String("error", err.Error()))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// touch sets the access and modification times of path to now, creating it if
+// it does not exist.
+func touch(path string) error {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"strings"
+)
+
+// stringsFlag is a flag.Value that may be specified multiple times,
+// accumulating each value in order.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultHistoryFile returns the default -history-file, in the user's cache
+// directory, or the empty string if it cannot be determined.
+func defaultHistoryFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "plexbackup", "history.json")
+}
+
+// historyFlags defines the flags locating the run history, shared by the
+// daemon and history commands.
+func historyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&historyFile, "history-file", defaultHistoryFile(), "path of a file recording the most recent runs of the daemon, so they survive restarts; empty to keep them only in memory")
+}
+
+// history is the most recent runs of every job, oldest first, persisted to a
+// file if path is non-empty. It is not safe for concurrent use.
+type history struct {
+	path string
+	size int
+	runs []*runRecord
+}
+
+// loadHistory reads the runs recorded in path, keeping at most size of them.
+// A missing file is treated as empty.
+func loadHistory(path string, size int) (*history, error) {
+	h := &history{
+		path: path,
+		size: size,
+	}
+	if path == "" {
+		return h, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	if err := json.Unmarshal(data, &h.runs); err != nil {
+		return nil, fmt.Errorf("failed to parse history %v: %w", path, err)
+	}
+	h.trim()
+	return h, nil
+}
+
+// trim discards the oldest runs beyond h.size.
+func (h *history) trim() {
+	if excess := len(h.runs) - h.size; excess > 0 {
+		h.runs = slices.Clone(h.runs[excess:])
+	}
+}
+
+// add records a run, saving the history if it is persisted. The run is
+// remembered even if it cannot be saved.
+func (h *history) add(record *runRecord) error {
+	if h.size == 0 {
+		return nil
+	}
+	h.runs = append(h.runs, record)
+	h.trim()
+	if h.path == "" {
+		return nil
+	}
+	return h.save()
+}
+
+// save atomically replaces the history file with the current runs.
+func (h *history) save() error {
+	data, err := json.MarshalIndent(h.runs, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(h.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	temp, err := os.CreateTemp(dir, ".history-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	err = errors.Join(err, temp.Sync(), temp.Close())
+	if err == nil {
+		err = os.Rename(temp.Name(), h.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	return nil
+}
+
+// printHistory writes the runs recorded in path, newest first, as a table, or
+// a JSON array if asJSON is set.
+func printHistory(w io.Writer, path string, asJSON bool) error {
+	if path == "" {
+		return errors.New("no -history-file to read")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+	h, err := loadHistory(path, math.MaxInt)
+	if err != nil {
+		return err
+	}
+	slices.Reverse(h.runs)
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(h.runs)
+	}
+	if len(h.runs) == 0 {
+		fmt.Fprintln(w, "no runs")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "start\tduration\tjob\tresult\tsize\terror\t")
+	for _, run := range h.runs {
+		job := run.Job
+		if job == "" {
+			job = "-"
+		}
+		size := "-"
+		if run.CompressedBytes > 0 {
+			size = formatBytes(run.CompressedBytes)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t\n",
+			run.Start.Local().Format(time.DateTime),
+			run.End.Sub(run.Start).Round(time.Second),
+			job,
+			run.Result,
+			size,
+			run.Error)
+	}
+	return tw.Flush()
+}
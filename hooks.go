@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/gebn/plexbackup/internal/pkg/notify"
+)
+
+// hooks are shell commands run around each backup, e.g. to quiesce related
+// services or kick off downstream jobs. Empty commands are skipped.
+type hooks struct {
+	pre     string
+	post    string
+	failure string
+}
+
+// runPre runs the pre-hook, if any. The backup should not proceed if it fails.
+func (h hooks) runPre(ctx context.Context, job, bucket string) error {
+	if h.pre == "" {
+		return nil
+	}
+	env := hookEnv(&notify.Summary{
+		Job:    job,
+		Bucket: bucket,
+	})
+	if err := runHook(ctx, h.pre, env); err != nil {
+		return fmt.Errorf("-pre-hook failed: %w", err)
+	}
+	return nil
+}
+
+// runPost runs the post-hook or on-failure hook, depending on the status of
+// summary, if configured.
+func (h hooks) runPost(ctx context.Context, summary *notify.Summary) error {
+	command, name := h.post, "-post-hook"
+	if summary.Status != notify.StatusSuccess {
+		command, name = h.failure, "-on-failure-hook"
+	}
+	if command == "" {
+		return nil
+	}
+	if err := runHook(ctx, command, hookEnv(summary)); err != nil {
+		return fmt.Errorf("%v failed: %w", name, err)
+	}
+	return nil
+}
+
+// runHook runs command with sh, adding env to the environment. Its output is
+// sent to stderr, as stdout is reserved for -json.
+func runHook(ctx context.Context, command string, env []string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// hookEnv describes a run as PLEXBACKUP_* environment variables. Fields
+// without a value are omitted.
+func hookEnv(summary *notify.Summary) []string {
+	var env []string
+	add := func(name, value string) {
+		if value != "" {
+			env = append(env, "PLEXBACKUP_"+name+"="+value)
+		}
+	}
+	add("JOB", summary.Job)
+	add("STATUS", string(summary.Status))
+	add("BUCKET", summary.Bucket)
+	add("KEY", summary.Key)
+	if summary.CompressedBytes > 0 {
+		add("UNCOMPRESSED_BYTES", strconv.FormatUint(summary.UncompressedBytes, 10))
+		add("COMPRESSED_BYTES", strconv.FormatUint(summary.CompressedBytes, 10))
+	}
+	add("SHA256", summary.SHA256)
+	add("PLEX_VERSION", summary.PlexVersion)
+	add("LABEL", summary.Label)
+	if summary.Status != "" {
+		add("DURATION_SECONDS", strconv.FormatFloat(summary.DurationSeconds, 'f', -1, 64))
+	}
+	if summary.DowntimeSeconds > 0 {
+		add("DOWNTIME_SECONDS", strconv.FormatFloat(summary.DowntimeSeconds, 'f', -1, 64))
+	}
+	add("ERROR", summary.Error)
+	return env
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/gebn/plexbackup/backup"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// iamPolicy is an IAM policy document.
+type iamPolicy struct {
+	Version   string          `json:"Version"`
+	Statement []*iamStatement `json:"Statement"`
+}
+
+// iamStatement allows Action on each of Resource, subject to Condition.
+type iamStatement struct {
+	Effect    string       `json:"Effect"`
+	Action    []string     `json:"Action"`
+	Resource  []string     `json:"Resource"`
+	Condition iamCondition `json:"Condition,omitempty"`
+}
+
+// iamCondition maps condition operators to the values each key must have.
+type iamCondition map[string]map[string][]string
+
+// printIAMPolicy writes the IAM policy allowing the backups of every job, as
+// configured, to w.
+func printIAMPolicy(w io.Writer, configs []*jobConfig) error {
+	policy := &iamPolicy{
+		Version: "2012-10-17",
+	}
+	for _, c := range configs {
+		policy.addJob(c)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(policy)
+}
+
+// allow grants actions on resource, subject to condition if non-nil, adding
+// the resource to an existing statement granting the same actions under the
+// same condition if there is one.
+func (p *iamPolicy) allow(actions []string, resource string, condition iamCondition) {
+	for _, s := range p.Statement {
+		if slices.Equal(s.Action, actions) && reflect.DeepEqual(s.Condition, condition) {
+			if !slices.Contains(s.Resource, resource) {
+				s.Resource = append(s.Resource, resource)
+			}
+			return
+		}
+	}
+	p.Statement = append(p.Statement, &iamStatement{
+		Effect:    "Allow",
+		Action:    actions,
+		Resource:  []string{resource},
+		Condition: condition,
+	})
+}
+
+// addJob grants the permissions the backups of c need with its flags, with
+// -restore, those needed to restore them, and with -seed, those needed to
+// seed them.
+func (p *iamPolicy) addJob(c *jobConfig) {
+	partition := awsPartition(c.region)
+	bucketARN := "arn:" + partition + ":s3:::"
+
+	// Listing is not limited to the prefix, as without s3:ListBucket on the
+	// whole bucket, S3 reports missing objects, e.g. the catalog before it is
+	// first written, as 403 Forbidden rather than 404 Not Found. The replica
+	// is also listed for the parts of each backup pruned from it.
+	list := []string{"s3:ListBucket"}
+	if c.purgeVersions {
+		list = append(list, "s3:ListBucketVersions")
+	}
+	p.allow(list, bucketARN+c.bucket, nil)
+	if c.replicaBucket != "" {
+		p.allow([]string{"s3:ListBucket"}, bucketARN+c.replicaBucket, nil)
+	}
+
+	// HeadObject checks each upload, and the catalog is read before it is
+	// updated.
+	objects := []string{"s3:GetObject", "s3:PutObject", "s3:AbortMultipartUpload"}
+	if c.prune {
+		objects = append(objects, "s3:DeleteObject")
+	}
+	if c.acl != "" {
+		objects = append(objects, "s3:PutObjectAcl")
+	}
+	primary := objects
+	if c.purgeVersions {
+		primary = append(slices.Clip(objects), "s3:DeleteObjectVersion")
+	}
+	p.allow(primary, bucketARN+c.bucket+"/"+c.prefix+"*", nil)
+	if c.replicaBucket != "" {
+		p.allow(objects, bucketARN+c.replicaBucket+"/"+c.prefix+"*", nil)
+	}
+	if iamSeed && !c.prune {
+		// A seed deletes its chunks once assembled into the backup, which
+		// is left alone.
+		p.allow([]string{"s3:DeleteObject"}, bucketARN+c.bucket+"/"+c.prefix+"*"+backup.SeedSuffix+"*", nil)
+	}
+
+	for i, keyID := range c.kmsKeyIDs {
+		// The data key is generated by the first key, and wrapped by the
+		// rest.
+		actions := []string{"kms:Encrypt"}
+		if i == 0 {
+			actions = []string{"kms:GenerateDataKey"}
+		}
+		if c.verify || iamRestore {
+			actions = append(actions, "kms:Decrypt")
+		}
+		resource, condition := kmsKeyResource(keyID, partition, c.region)
+		p.allow(actions, resource, condition)
+	}
+
+	if c.snsTopicARN != "" {
+		p.allow([]string{"sns:Publish"}, c.snsTopicARN, nil)
+	}
+
+	if c.dynamoDBTable != "" {
+		actions := []string{"dynamodb:PutItem"}
+		if c.prune {
+			actions = append(actions, "dynamodb:UpdateItem")
+		}
+		p.allow(actions, tableARN(c.dynamoDBTable, partition, c.region), nil)
+	}
+
+	flags := c.secretFlags()
+	for _, name := range slices.Sorted(maps.Keys(flags)) {
+		value := *flags[name]
+		if id, ok := strings.CutPrefix(value, secretsManagerPrefix); ok {
+			id, _, _ = strings.Cut(id, "#")
+			p.allow([]string{"secretsmanager:GetSecretValue"}, secretARN(id, partition, c.region), nil)
+		} else if parameter, ok := strings.CutPrefix(value, ssmPrefix); ok {
+			p.allow([]string{"ssm:GetParameter"}, parameterARN(parameter, partition, c.region), nil)
+		}
+	}
+}
+
+// awsPartition returns the partition of region, e.g. "aws-cn" for cn-north-1.
+func awsPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return "aws-cn"
+	case strings.HasPrefix(region, "us-gov-"):
+		return "aws-us-gov"
+	default:
+		return "aws"
+	}
+}
+
+// kmsKeyResource returns the resource and condition identifying the KMS key
+// with keyID, an ID, alias or ARN, in region unless given by ARN. Permissions
+// are granted on keys rather than aliases, so an alias is matched by the
+// aliases of the key used instead. The account is not known unless keyID is
+// an ARN, so any is allowed.
+func kmsKeyResource(keyID, partition, region string) (string, iamCondition) {
+	account := "*"
+	if parsed, err := arn.Parse(keyID); err == nil {
+		if !strings.HasPrefix(parsed.Resource, "alias/") {
+			return keyID, nil
+		}
+		partition, region, account, keyID = parsed.Partition, parsed.Region, parsed.AccountID, parsed.Resource
+	}
+	prefix := "arn:" + partition + ":kms:" + region + ":" + account + ":key/"
+	if strings.HasPrefix(keyID, "alias/") {
+		return prefix + "*", iamCondition{"ForAnyValue:StringEquals": {"kms:ResourceAliases": {keyID}}}
+	}
+	return prefix + keyID, nil
+}
+
+// secretARN returns the ARN of the Secrets Manager secret with id, a name or
+// ARN, in region unless given by ARN. The ARN of a secret ends with 6 random
+// characters not in its name.
+func secretARN(id, partition, region string) string {
+	if arn.IsARN(id) {
+		return id
+	}
+	return "arn:" + partition + ":secretsmanager:" + region + ":*:secret:" + id + "-??????"
+}
+
+// tableARN returns the ARN of the DynamoDB table with name, a name or ARN, in
+// region unless given by ARN.
+func tableARN(name, partition, region string) string {
+	if arn.IsARN(name) {
+		return name
+	}
+	return "arn:" + partition + ":dynamodb:" + region + ":*:table/" + name
+}
+
+// parameterARN returns the ARN of the SSM parameter with name, a name or ARN,
+// in region unless given by ARN.
+func parameterARN(name, partition, region string) string {
+	if arn.IsARN(name) {
+		return name
+	}
+	return "arn:" + partition + ":ssm:" + region + ":*:parameter/" + strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+var serviceTemplate = template.Must(template.New("service").Parse(`[Unit]
+Description=Back up Plex Media Server to S3
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+User={{.User}}
+ExecStart={{.ExecStart}}
+
+# Hardening. Most sandboxing options imply NoNewPrivileges=yes for non-root
+# users, which prevents sudo stopping and starting Plex, so they only apply if
+# -no-pause is used.
+ProtectSystem=full
+ProtectHome=read-only
+PrivateTmp=yes
+{{- if .NoPause}}
+NoNewPrivileges=yes
+CapabilityBoundingSet=
+PrivateDevices=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectKernelLogs=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+ProtectHostname=yes
+RestrictNamespaces=yes
+RestrictRealtime=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK
+{{- end}}
+`))
+
+var timerTemplate = template.Must(template.New("timer").Parse(`[Unit]
+Description=Back up Plex Media Server to S3 on a schedule
+
+[Timer]
+OnCalendar={{.OnCalendar}}
+RandomizedDelaySec={{.RandomizedDelaySec}}
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`))
+
+var sudoersTemplate = template.Must(template.New("sudoers").Parse(`# Allows the backup to stop and start Plex without a password.
+{{- range .Services}}
+{{$.User}} ALL=NOPASSWD: {{$.Systemctl}} stop {{.}}
+{{$.User}} ALL=NOPASSWD: {{$.Systemctl}} start {{.}}
+{{- end}}
+`))
+
+type unitParams struct {
+	User               string
+	ExecStart          string
+	NoPause            bool
+	OnCalendar         string
+	RandomizedDelaySec int64
+	Systemctl          string
+	Services           []string
+}
+
+// unitFile is a generated file and where it belongs.
+type unitFile struct {
+	Path    string
+	Content []byte
+}
+
+// installUnit generates a systemd service and timer running a backup with the
+// flags of fs provided on the command line, named in cmdline, along with the
+// sudoers rule needed to stop and start the service of each of configs. The
+// files are written to w unless -unit-install is set, in which case they are
+// installed and the timer enabled. If a -config file is used, the service
+// references it rather than copying its values.
+func installUnit(w io.Writer, fs *flag.FlagSet, cmdline map[string]bool, configs []*jobConfig) error {
+	files, err := buildUnitFiles(fs, cmdline, configs)
+	if err != nil {
+		return err
+	}
+
+	if !unitInstall {
+		for i, file := range files {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "# %v\n", file.Path)
+			w.Write(file.Content)
+		}
+		return nil
+	}
+
+	for _, file := range files {
+		if err := os.WriteFile(file.Path, file.Content, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "wrote %v\n", file.Path)
+	}
+	if len(files) == 3 {
+		sudoers := files[2].Path
+		// sudo refuses to run at all if any sudoers file is invalid, so
+		// remove it rather than risk locking out the administrator.
+		if out, err := exec.Command("visudo", "-cf", sudoers).CombinedOutput(); err != nil {
+			os.Remove(sudoers)
+			return fmt.Errorf("generated sudoers rule is invalid, removed it: %w: %s", err, out)
+		}
+		if err := os.Chmod(sudoers, 0440); err != nil {
+			return err
+		}
+	}
+	for _, args := range [][]string{
+		{"daemon-reload"},
+		{"enable", "--now", unitName + ".timer"},
+	} {
+		if out, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("systemctl %v failed: %w: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	fmt.Fprintf(w, "enabled %v.timer\n", unitName)
+	return nil
+}
+
+func buildUnitFiles(fs *flag.FlagSet, cmdline map[string]bool, configs []*jobConfig) ([]unitFile, error) {
+	for _, c := range configs {
+		if c.platform != "" {
+			return nil, fmt.Errorf("install-unit is not supported on -platform %v, which does not use systemd; use its scheduler instead", c.platform)
+		}
+		// PrivateTmp= gives the unit its own /tmp and /var/tmp, so a lock
+		// there would not be seen by other runs.
+		for _, tmp := range []string{"/tmp", "/var/tmp"} {
+			if rel, err := filepath.Rel(tmp, c.lockFile); err == nil && filepath.IsLocal(rel) {
+				return nil, fmt.Errorf("-lock-file %v would be private to the unit, so would not stop other runs overlapping its own; use a path outside %v, e.g. in %v", c.lockFile, tmp, lockDir)
+			}
+		}
+	}
+	binary, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if binary, err = filepath.EvalSymlinks(binary); err != nil {
+		return nil, err
+	}
+	systemctl, err := exec.LookPath("systemctl")
+	if err != nil {
+		systemctl = "/usr/bin/systemctl"
+	}
+
+	// Besides its own, install-unit has the flags of the backup command.
+	args := []string{binary, "backup"}
+	fs.Visit(func(f *flag.Flag) {
+		if !cmdline[f.Name] || f.Name == "version" || strings.HasPrefix(f.Name, "unit-") {
+			return
+		}
+		if values, ok := f.Value.(*stringsFlag); ok {
+			for _, value := range *values {
+				args = append(args, "-"+f.Name+"="+value)
+			}
+			return
+		}
+		value := f.Value.String()
+		if f.Name == "config" {
+			// The unit's working directory is unrelated to ours.
+			if abs, err := filepath.Abs(value); err == nil {
+				value = abs
+			}
+		}
+		args = append(args, "-"+f.Name+"="+value)
+	})
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteSystemd(arg)
+	}
+
+	params := &unitParams{
+		User:               unitUser,
+		ExecStart:          strings.Join(quoted, " "),
+		NoPause:            true,
+		OnCalendar:         unitOnCalendar,
+		RandomizedDelaySec: int64(unitDelay.Seconds()),
+		Systemctl:          systemctl,
+	}
+	for _, c := range configs {
+		if !c.noPause && !c.reflink {
+			params.NoPause = false
+			for _, service := range c.services {
+				if !slices.Contains(params.Services, service) {
+					params.Services = append(params.Services, service)
+				}
+			}
+		}
+	}
+	var files []unitFile
+	for _, spec := range []struct {
+		path string
+		tmpl *template.Template
+	}{
+		{"/etc/systemd/system/" + unitName + ".service", serviceTemplate},
+		{"/etc/systemd/system/" + unitName + ".timer", timerTemplate},
+		{"/etc/sudoers.d/10-" + unitName, sudoersTemplate},
+	} {
+		if spec.tmpl == sudoersTemplate && params.NoPause {
+			// No service is ever stopped, so no rule is needed.
+			continue
+		}
+		var b bytes.Buffer
+		if err := spec.tmpl.Execute(&b, params); err != nil {
+			return nil, err
+		}
+		files = append(files, unitFile{spec.path, b.Bytes()})
+	}
+	return files, nil
+}
+
+// quoteSystemd quotes an argument for use in an Exec*= directive. Specifiers
+// and variable expansion are escaped, so the argument is passed verbatim.
+func quoteSystemd(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	arg = strings.ReplaceAll(arg, "$", "$$")
+	if !strings.ContainsAny(arg, " \t\"';\\") {
+		return arg
+	}
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	arg = strings.ReplaceAll(arg, `"`, `\"`)
+	return `"` + arg + `"`
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	ErrNotTerminal  = errors.New("-interactive requires a terminal")
+	ErrNotConfirmed = errors.New("confirmation did not match, nothing was restored")
+)
+
+// maxPreviewChanges is how many overwritten and removed files are listed
+// before confirming a restore.
+const maxPreviewChanges = 20
+
+// prompter asks questions on a terminal.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask writes question to the terminal and returns the trimmed answer.
+func (p *prompter) ask(question string) (string, error) {
+	fmt.Fprint(p.out, question)
+	answer, err := p.in.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			return "", errors.New("no answer given")
+		}
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+// chooseBackup lists the job's backups, newest first, and asks which to
+// restore, unless -key is set. It then asks for -restore-dir if not set,
+// shows what moving the backup into place would overwrite, and asks for the
+// backup's name to be typed to confirm it. -key and -restore-dir are set to
+// the answers.
+func chooseBackup(ctx context.Context, p *prompter, client *s3.Client, keys backup.KMSAPI, c *jobConfig) error {
+	if restoreKey == "" {
+		key, err := pickBackup(ctx, p, client, c)
+		if err != nil {
+			return err
+		}
+		restoreKey = key
+	}
+	if restoreDir == "" && !restoreDiff {
+		dir, err := p.ask("Directory to extract the backup into (must be empty or not exist): ")
+		if err != nil {
+			return err
+		}
+		if dir == "" {
+			return ErrNoRestoreDir
+		}
+		restoreDir = dir
+	}
+	if restoreDiff {
+		// Nothing is changed, so there is nothing to confirm.
+		return nil
+	}
+
+	if err := previewOverwrites(ctx, p.out, client, keys, c, restoreKey); err != nil {
+		return err
+	}
+	name := backupName(c, restoreKey)
+	answer, err := p.ask(fmt.Sprintf("Type %v to restore s3://%v/%v into %v: ", name, c.bucket, restoreKey, restoreDir))
+	if err != nil {
+		return err
+	}
+	if answer != name {
+		return ErrNotConfirmed
+	}
+	return nil
+}
+
+// pickBackup lists the job's backups, newest first, and returns the key of
+// the one chosen.
+func pickBackup(ctx context.Context, p *prompter, client *s3.Client, c *jobConfig) (string, error) {
+	backups, err := backup.ListBackups(ctx, client, c.bucket, c.prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to list backups: %w", err)
+	}
+	if len(backups) == 0 {
+		return "", fmt.Errorf("no backups found under s3://%v/%v", c.bucket, c.prefix)
+	}
+	slices.Reverse(backups)
+	catalog := &backup.Catalog{}
+	if c.catalog {
+		if catalog, _, err = backup.ReadCatalog(ctx, client, c.bucket, c.prefix); err != nil {
+			return "", fmt.Errorf("failed to read catalog: %w", err)
+		}
+	}
+
+	fmt.Fprintf(p.out, "Backups under s3://%v/%v, newest first:\n", c.bucket, c.prefix)
+	tw := tabwriter.NewWriter(p.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\ttime\tage\tsize\tplex\tname\t")
+	for i, object := range backups {
+		size := uint64(0)
+		if object.Size != nil {
+			size = uint64(*object.Size)
+		}
+		plex := "?"
+		if entry := catalog.Entry(*object.Key); entry != nil && entry.PlexVersion != "" {
+			plex = entry.PlexVersion
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t\n",
+			i+1,
+			object.LastModified.Local().Format(time.DateTime),
+			formatDays(time.Since(*object.LastModified)),
+			formatBytes(size),
+			plex,
+			backupName(c, *object.Key))
+	}
+	tw.Flush()
+
+	answer, err := p.ask(fmt.Sprintf("Backup to restore [1-%v]: ", len(backups)))
+	if err != nil {
+		return "", err
+	}
+	choice, err := strconv.Atoi(answer)
+	if err != nil || choice < 1 || choice > len(backups) {
+		return "", fmt.Errorf("invalid choice %q", answer)
+	}
+	return *backups[choice-1].Key, nil
+}
+
+// previewOverwrites writes the files that moving the backup at key into
+// place would overwrite or remove to w, if the job's directories are present
+// on this host. The -restore-dir itself must be empty, so nothing there is
+// overwritten.
+func previewOverwrites(ctx context.Context, w io.Writer, client *s3.Client, keys backup.KMSAPI, c *jobConfig, key string) error {
+	o := c.opts()
+	for _, dir := range o.Directories {
+		if _, err := os.Stat(dir); err != nil {
+			fmt.Fprintf(w, "%v is not present here, so cannot be compared with the backup.\n", dir)
+			return nil
+		}
+	}
+	fmt.Fprintf(w, "Reading the backup to compare it with %v...\n", strings.Join(o.Directories, ", "))
+	backupManifest, err := backup.ReadManifest(ctx, client, keys, c.bucket, key)
+	if err != nil {
+		return err
+	}
+	liveManifest, err := o.LiveManifest()
+	if err != nil {
+		return fmt.Errorf("failed to read live files: %w", err)
+	}
+	var lost []*backup.Change
+	added := 0
+	for _, change := range backup.DiffManifests(liveManifest, backupManifest) {
+		if change.Kind == backup.ChangeAdded {
+			added++
+			continue
+		}
+		lost = append(lost, change)
+	}
+	if len(lost) == 0 {
+		fmt.Fprintf(w, "Moving it into place would overwrite nothing, and add %v files.\n", added)
+		return nil
+	}
+	fmt.Fprintf(w, "Moving it into place would overwrite or remove %v files, and add %v:\n", len(lost), added)
+	for i, change := range lost {
+		if i == maxPreviewChanges {
+			fmt.Fprintf(w, "  ... and %v more\n", len(lost)-i)
+			break
+		}
+		fmt.Fprintf(w, "  %v %v\n", strings.ToUpper(change.Kind[:1]), change.Path)
+	}
+	return nil
+}
+
+// backupName returns the part of key identifying the backup within the job's
+// prefix, e.g. "2024-04-20T06:22:01Z".
+func backupName(c *jobConfig, key string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(key, c.prefix), ".tar.zst")
+}
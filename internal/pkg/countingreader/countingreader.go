@@ -4,13 +4,15 @@ package countingreader
 
 import (
 	"io"
+	"sync/atomic"
 )
 
 // Reader wraps an io.Reader, counting the total number of bytes read. It will
 // wrap around after reading 16 exbibytes, which is assumed to be sufficient.
+// The count may be read concurrently with reads.
 type Reader struct {
 	reader    io.Reader
-	ReadBytes uint64
+	ReadBytes atomic.Uint64
 }
 
 func New(r io.Reader) *Reader {
@@ -21,6 +23,6 @@ func New(r io.Reader) *Reader {
 
 func (r *Reader) Read(p []byte) (n int, err error) {
 	n, err = r.reader.Read(p)
-	r.ReadBytes += uint64(n)
+	r.ReadBytes.Add(uint64(n))
 	return n, err
 }
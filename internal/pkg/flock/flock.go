@@ -0,0 +1,38 @@
+// Package flock provides advisory, non-blocking exclusive locks on files,
+// used to prevent concurrent runs from interfering with each other. Locks are
+// released automatically by the OS if the process exits, so a crashed run
+// never leaves a stale lock behind.
+package flock
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrLocked is returned by Acquire if another process holds the lock.
+var ErrLocked = errors.New("lock is held by another process")
+
+// Lock is an exclusive lock held on a file.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire attempts to take an exclusive lock on the file at path, creating it
+// if necessary. It returns ErrLocked immediately if the lock is already held.
+func Acquire(path string) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Lock{file: file}, nil
+}
+
+// Release drops the lock. The file is deliberately not deleted, as doing so
+// would allow two processes to hold locks on different inodes at once.
+func (l *Lock) Release() error {
+	return l.file.Close()
+}
@@ -0,0 +1,66 @@
+// Package healthcheck pings a healthchecks.io-compatible dead man's switch,
+// allowing missed or failed runs to be detected externally.
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Check identifies a single check. The start and fail endpoints are derived by
+// appending "/start" and "/fail" respectively to the URL.
+type Check struct {
+	url    string
+	client *http.Client
+}
+
+// New creates a Check for the provided ping URL, e.g.
+// https://hc-ping.com/<uuid>.
+func New(url string) *Check {
+	return &Check{
+		url: strings.TrimSuffix(url, "/"),
+		client: &http.Client{
+			// A slow monitoring service should not hold up the backup.
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// Start signals that a run has begun. This allows the service to measure run
+// durations, and to detect runs that never finish.
+func (c *Check) Start(ctx context.Context) error {
+	return c.ping(ctx, c.url+"/start", "")
+}
+
+// Success signals that a run completed successfully.
+func (c *Check) Success(ctx context.Context) error {
+	return c.ping(ctx, c.url, "")
+}
+
+// Fail signals that a run failed. The error is sent as the request body, so it
+// appears in the service's event log.
+func (c *Check) Fail(ctx context.Context, cause error) error {
+	return c.ping(ctx, c.url+"/fail", cause.Error())
+}
+
+func (c *Check) ping(ctx context.Context, url, body string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("ping returned %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Package journald implements a slog.Handler writing to the systemd journal
+// via its native protocol, so entries retain their level and attributes are
+// stored as separate, queryable fields, e.g. `journalctl -u plexbackup KEY=...`.
+package journald
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+)
+
+// socket is where journald listens for native protocol datagrams.
+const socket = "/run/systemd/journal/socket"
+
+// Handler is a slog.Handler sending each record to the journal as a single
+// datagram. Attribute keys are converted to journal field names by
+// upper-casing them and replacing invalid characters with underscores; groups
+// are joined with underscores.
+type Handler struct {
+	conn   *conn
+	opts   slog.HandlerOptions
+	prefix string
+	fields []byte
+}
+
+// conn is shared between a Handler and those derived from it.
+type conn struct {
+	mu sync.Mutex
+	c  net.Conn
+}
+
+// NewHandler connects to the journal. opts may be nil, in which case records
+// at info level and above are written.
+func NewHandler(opts *slog.HandlerOptions) (*Handler, error) {
+	c, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, err
+	}
+	h := &Handler{
+		conn: &conn{c: c},
+	}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h, nil
+}
+
+// Enabled implements slog.Handler.
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	minimum := slog.LevelInfo
+	if h.opts.Level != nil {
+		minimum = h.opts.Level.Level()
+	}
+	return level >= minimum
+}
+
+// Handle implements slog.Handler.
+func (h *Handler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	appendField(&b, "MESSAGE", r.Message)
+	appendField(&b, "PRIORITY", priority(r.Level))
+	appendField(&b, "SYSLOG_IDENTIFIER", "plexbackup")
+	b.Write(h.fields)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, h.prefix, a)
+		return true
+	})
+
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	_, err := h.conn.c.Write(b.Bytes())
+	return err
+}
+
+// WithAttrs implements slog.Handler.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b bytes.Buffer
+	b.Write(h.fields)
+	for _, a := range attrs {
+		appendAttr(&b, h.prefix, a)
+	}
+	h2 := *h
+	h2.fields = b.Bytes()
+	return &h2
+}
+
+// WithGroup implements slog.Handler.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "_"
+	return &h2
+}
+
+// priority maps a slog level to a syslog priority.
+func priority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "3"
+	case level >= slog.LevelWarn:
+		return "4"
+	case level >= slog.LevelInfo:
+		return "6"
+	default:
+		return "7"
+	}
+}
+
+// appendAttr appends a for the journal, flattening groups.
+func appendAttr(b *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "_"
+		}
+		for _, attr := range a.Value.Group() {
+			appendAttr(b, prefix, attr)
+		}
+		return
+	}
+	if name := fieldName(prefix + a.Key); name != "" {
+		appendField(b, name, a.Value.String())
+	}
+}
+
+// fieldName converts key to a valid journal field name, or returns the empty
+// string if this is not possible. Names may only contain upper-case letters,
+// digits and underscores, and may not start with an underscore, which denotes
+// fields set by journald itself.
+func fieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// appendField encodes a field in the native protocol. Values containing
+// newlines are length-prefixed rather than newline-terminated.
+func appendField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
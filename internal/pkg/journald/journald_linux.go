@@ -0,0 +1,25 @@
+//go:build linux
+
+package journald
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Connected returns whether stderr is connected to the journal, i.e. the
+// process was started by systemd with StandardError=journal, which is the
+// default. systemd sets $JOURNAL_STREAM to the device and inode of the stream
+// it connects, so this is not fooled by the output being redirected.
+func Connected() bool {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" {
+		return false
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &stat); err != nil {
+		return false
+	}
+	return stream == fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+}
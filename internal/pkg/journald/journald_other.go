@@ -0,0 +1,8 @@
+//go:build !linux
+
+package journald
+
+// Connected always returns false, as the journal only exists on Linux.
+func Connected() bool {
+	return false
+}
@@ -0,0 +1,138 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Email sends the summary as a plain text email via SMTP. STARTTLS is used if
+// the server supports it, and is required if credentials are provided.
+type Email struct {
+
+	// Addr is the host:port of the SMTP server, e.g. smtp.example.com:587.
+	Addr string
+
+	// Username and Password are used for PLAIN authentication if Username is
+	// non-empty.
+	Username, Password string
+
+	// From is the envelope and header sender address.
+	From string
+
+	// To is the list of recipient addresses.
+	To []string
+
+	// Always sends a report for successful runs as well as failures. By
+	// default, only failures are reported, on the basis that an email every
+	// night quickly gets ignored.
+	Always bool
+}
+
+func (e *Email) Notify(ctx context.Context, s *Summary) error {
+	if s.Status == StatusSuccess && !e.Always {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(e.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP address: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", e.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if e.Username != "" {
+		// PlainAuth refuses to send credentials over an unencrypted
+		// connection to anything other than localhost.
+		if err := client.Auth(smtp.PlainAuth("", e.Username, e.Password, host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(e.From); err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(e.message(s)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// message renders the summary as an RFC 5322 message.
+func (e *Email) message(s *Summary) []byte {
+	subject := "Plex backup succeeded"
+	if s.Status != StatusSuccess {
+		subject = s.FailureSubject()
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %v\r\n", e.From)
+	fmt.Fprintf(&b, "To: %v\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&b, "Subject: %v\r\n", subject)
+	fmt.Fprintf(&b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "%v\r\n\r\n", s.Text())
+	fmt.Fprintf(&b, "Status:             %v\r\n", s.Status)
+	fmt.Fprintf(&b, "Bucket:             %v\r\n", s.Bucket)
+	if s.Key != "" {
+		fmt.Fprintf(&b, "Key:                %v\r\n", s.Key)
+		fmt.Fprintf(&b, "Uncompressed bytes: %v\r\n", s.UncompressedBytes)
+		fmt.Fprintf(&b, "Compressed bytes:   %v\r\n", s.CompressedBytes)
+	}
+	fmt.Fprintf(&b, "Duration:           %.1fs\r\n", s.DurationSeconds)
+	if s.DowntimeSeconds > 0 {
+		fmt.Fprintf(&b, "Plex downtime:      %.1fs\r\n", s.DowntimeSeconds)
+	}
+	if len(s.ChangedDatabases) > 0 {
+		fmt.Fprintf(&b, "Changed databases:  %v\r\n", strings.Join(s.ChangedDatabases, ", "))
+	}
+	if s.Error != "" {
+		fmt.Fprintf(&b, "Error:              %v\r\n", s.Error)
+	}
+	if s.ConsecutiveFailures > 1 {
+		fmt.Fprintf(&b, "Failures in a row:  %v\r\n", s.ConsecutiveFailures)
+	}
+	if !s.ResumesAt.IsZero() {
+		fmt.Fprintf(&b, "Suspended until:    %v\r\n", s.ResumesAt.Format(time.RFC1123Z))
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,89 @@
+// Package notify delivers a summary of each backup run to external services.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Status is the outcome of a run.
+type Status string
+
+const (
+	StatusSuccess Status = "success"
+	StatusFailure Status = "failure"
+)
+
+// Summary describes a completed run. Fields relating to the backup object are
+// only populated if the run succeeded.
+type Summary struct {
+	Job               string            `json:"job,omitempty"`
+	Status            Status            `json:"status"`
+	Bucket            string            `json:"bucket"`
+	Key               string            `json:"key,omitempty"`
+	UncompressedBytes uint64            `json:"uncompressed_bytes,omitempty"`
+	CompressedBytes   uint64            `json:"compressed_bytes,omitempty"`
+	SHA256            string            `json:"sha256,omitempty"`
+	PlexVersion       string            `json:"plex_version,omitempty"`
+	Label             string            `json:"label,omitempty"`
+	DurationSeconds   float64           `json:"duration_seconds"`
+	DowntimeSeconds   float64           `json:"downtime_seconds,omitempty"`
+	DirectoryBytes    map[string]uint64 `json:"directory_bytes,omitempty"`
+	ExcludedBytes     map[string]uint64 `json:"excluded_bytes,omitempty"`
+	PrunedKeys        []string          `json:"pruned_keys,omitempty"`
+	ChangedDatabases  []string          `json:"changed_databases,omitempty"`
+	Error             string            `json:"error,omitempty"`
+
+	// ConsecutiveFailures is the number of runs of the job in a row that have
+	// failed, including this one, if counted by the daemon.
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+
+	// ResumesAt is set if the daemon has suspended the job's scheduled runs
+	// after repeated failures, to the time of the next it will attempt.
+	ResumesAt time.Time `json:"resumes_at,omitzero"`
+}
+
+// Text renders the summary as a single human-readable line.
+func (s *Summary) Text() string {
+	duration := time.Duration(s.DurationSeconds * float64(time.Second)).Round(time.Second)
+	if s.Status == StatusSuccess {
+		text := fmt.Sprintf("Plex backup succeeded in %v: uploaded s3://%v/%v (%v bytes, %v uncompressed)",
+			duration, s.Bucket, s.Key, s.CompressedBytes, s.UncompressedBytes)
+		if s.DowntimeSeconds > 0 {
+			downtime := time.Duration(s.DowntimeSeconds * float64(time.Second)).Round(time.Second)
+			text += fmt.Sprintf(", Plex was down for %v", downtime)
+		}
+		if len(s.ChangedDatabases) > 0 {
+			text += fmt.Sprintf(", but it may be inconsistent, as Plex changed %v database files while it was taken", len(s.ChangedDatabases))
+		}
+		return text
+	}
+	text := fmt.Sprintf("Plex backup failed after %v: %v", duration, s.Error)
+	if s.ConsecutiveFailures > 1 {
+		text += fmt.Sprintf(" (%v failures in a row", s.ConsecutiveFailures)
+		if !s.ResumesAt.IsZero() {
+			text += fmt.Sprintf(", backups suspended until %v", s.ResumesAt.Format("Mon 2 Jan 15:04"))
+		}
+		text += ")"
+	}
+	return text
+}
+
+// FailureSubject returns a short description of a failed run for the subject
+// of a message, escalating once the job has failed repeatedly.
+func (s *Summary) FailureSubject() string {
+	switch {
+	case !s.ResumesAt.IsZero():
+		return fmt.Sprintf("Plex backup FAILED %v times in a row, backups suspended", s.ConsecutiveFailures)
+	case s.ConsecutiveFailures > 1:
+		return fmt.Sprintf("Plex backup FAILED %v times in a row", s.ConsecutiveFailures)
+	default:
+		return "Plex backup FAILED"
+	}
+}
+
+// Notifier sends a summary to a destination.
+type Notifier interface {
+	Notify(context.Context, *Summary) error
+}
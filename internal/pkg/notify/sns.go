@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// SNS publishes the summary as a JSON message to an SNS topic. The status is
+// also set as a message attribute, allowing subscriptions to filter on it, as
+// is the number of consecutive failures, e.g. to page only on repeated ones.
+type SNS struct {
+	client   *sns.Client
+	topicARN string
+}
+
+// NewSNS creates a Notifier publishing to the topic with the provided ARN.
+func NewSNS(client *sns.Client, topicARN string) *SNS {
+	return &SNS{
+		client:   client,
+		topicARN: topicARN,
+	}
+}
+
+func (n *SNS) Notify(ctx context.Context, s *Summary) error {
+	message, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	subject := "Plex backup succeeded"
+	if s.Status != StatusSuccess {
+		subject = s.FailureSubject()
+	}
+	_, err = n.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: &n.topicARN,
+		Subject:  &subject,
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"status": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(string(s.Status)),
+			},
+			"consecutive_failures": {
+				DataType:    aws.String("Number"),
+				StringValue: aws.String(strconv.Itoa(s.ConsecutiveFailures)),
+			},
+		},
+	})
+	return err
+}
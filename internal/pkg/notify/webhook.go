@@ -0,0 +1,64 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// webhookPayload is the JSON document POSTed to webhooks. In addition to the
+// summary's fields, it contains a human-readable rendering under the keys
+// understood by Slack ("text") and Discord ("content"), so those services work
+// without an intermediary.
+type webhookPayload struct {
+	*Summary
+	Text    string `json:"text"`
+	Content string `json:"content"`
+}
+
+// Webhook POSTs the summary as JSON to a URL.
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhook creates a Notifier that POSTs to the provided URL.
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		url: url,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (w *Webhook) Notify(ctx context.Context, s *Summary) error {
+	text := s.Text()
+	body, err := json.Marshal(&webhookPayload{
+		Summary: s,
+		Text:    text,
+		Content: text,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
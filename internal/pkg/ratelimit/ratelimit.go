@@ -0,0 +1,53 @@
+// Package ratelimit implements an io.Reader that limits the rate at which
+// bytes are read.
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Reader wraps an io.Reader, sleeping as necessary so the mean rate of reads
+// since the first does not exceed a fixed number of bytes per second. Reads
+// are split so the reader is never blocked for much more than a tenth of a
+// second at a time, smoothing the rate seen by whatever is writing to it.
+type Reader struct {
+	ctx         context.Context
+	reader      io.Reader
+	bytesPerSec int64
+	start       time.Time
+	read        int64
+}
+
+// New limits reads from r to bytesPerSec. Sleeps are interrupted, and reads
+// fail with ctx's error, once ctx is cancelled.
+func New(ctx context.Context, r io.Reader, bytesPerSec int64) *Reader {
+	return &Reader{
+		ctx:         ctx,
+		reader:      r,
+		bytesPerSec: bytesPerSec,
+	}
+}
+
+func (r *Reader) Read(p []byte) (n int, err error) {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	if chunk := max(r.bytesPerSec/10, 1); int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	n, err = r.reader.Read(p)
+	r.read += int64(n)
+	due := r.start.Add(time.Duration(float64(r.read) / float64(r.bytesPerSec) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,135 @@
+// Package registry records backups in a DynamoDB table, so the state of the
+// backups of a fleet of hosts can be queried in one place, without listing
+// their buckets.
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gebn/plexbackup/internal/pkg/notify"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Statuses of a backup, matching those of the catalog.
+const (
+	StatusAvailable = "available"
+	StatusPruned    = "pruned"
+)
+
+// Table is a DynamoDB table with a string partition key named "bucket", and a
+// string sort key named "key", holding an item for each backup.
+type Table struct {
+	client      *dynamodb.Client
+	name        string
+	host        string
+	toolVersion string
+}
+
+// New creates a Table recording backups in the table with the provided name.
+// The host name of the machine and toolVersion are recorded with each backup.
+func New(client *dynamodb.Client, name, toolVersion string) *Table {
+	// An empty host is omitted, rather than failing every backup.
+	host, _ := os.Hostname()
+	return &Table{
+		client:      client,
+		name:        name,
+		host:        host,
+		toolVersion: toolVersion,
+	}
+}
+
+// Record adds the backup uploaded by the run s describes, if any, and marks
+// any backups it pruned as such. If the run failed after uploading, e.g.
+// verification, the backup is recorded along with the error.
+func (t *Table) Record(ctx context.Context, s *notify.Summary) error {
+	if s.Key != "" {
+		item := map[string]types.AttributeValue{
+			"bucket":             str(s.Bucket),
+			"key":                str(s.Key),
+			"status":             str(StatusAvailable),
+			"time":               str(time.Now().UTC().Format(time.RFC3339)),
+			"sha256":             str(s.SHA256),
+			"uncompressed_bytes": num(s.UncompressedBytes),
+			"compressed_bytes":   num(s.CompressedBytes),
+			"duration_seconds":   &types.AttributeValueMemberN{Value: strconv.FormatFloat(s.DurationSeconds, 'f', 3, 64)},
+		}
+		optional := map[string]string{
+			"job":          s.Job,
+			"host":         t.host,
+			"plex_version": s.PlexVersion,
+			"label":        s.Label,
+			"tool_version": t.toolVersion,
+			"error":        s.Error,
+		}
+		for name, value := range optional {
+			if value != "" {
+				item[name] = str(value)
+			}
+		}
+		_, err := t.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: &t.name,
+			Item:      item,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record %v: %w", s.Key, err)
+		}
+	}
+	return t.Pruned(ctx, s.Bucket, s.PrunedKeys)
+}
+
+// Pruned marks the backups in bucket with the provided keys as deleted. Keys
+// without an item, e.g. backups taken before the table was configured, are
+// ignored.
+func (t *Table) Pruned(ctx context.Context, bucket string, keys []string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	var errs []error
+	for _, key := range keys {
+		values := map[string]types.AttributeValue{
+			":status": str(StatusPruned),
+			":time":   str(now),
+		}
+		update := "SET #status = :status, pruned_time = :time"
+		if t.host != "" {
+			values[":host"] = str(t.host)
+			update += ", pruned_host = :host"
+		}
+		_, err := t.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: &t.name,
+			Key: map[string]types.AttributeValue{
+				"bucket": str(bucket),
+				"key":    str(key),
+			},
+			UpdateExpression:    &update,
+			ConditionExpression: aws.String("attribute_exists(#key)"),
+			// Both are reserved words.
+			ExpressionAttributeNames: map[string]string{
+				"#status": "status",
+				"#key":    "key",
+			},
+			ExpressionAttributeValues: values,
+		})
+		var missing *types.ConditionalCheckFailedException
+		if err != nil && !errors.As(err, &missing) {
+			errs = append(errs, fmt.Errorf("failed to mark %v pruned: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// str returns a string attribute value.
+func str(s string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: s}
+}
+
+// num returns a number attribute value.
+func num(n uint64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatUint(n, 10)}
+}
@@ -0,0 +1,235 @@
+// Package schedule determines when recurring jobs should next run, and the
+// windows of each day they may use resources in. Schedules are either a time
+// of day, e.g. "03:30", or a standard 5-field cron expression, e.g.
+// "30 3 * * 1-5". All times are interpreted in the location of the time passed
+// to Next.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule yields successive activation times.
+type Schedule interface {
+
+	// Next returns the first activation time strictly after t, or the zero
+	// time if there is none within the next five years.
+	Next(t time.Time) time.Time
+}
+
+// Parse interprets spec as either a time of day in 24-hour HH:MM format, in
+// which case the schedule activates once a day at that time, or as a cron
+// expression with minute, hour, day of month, month and day of week fields.
+// Cron fields support "*", single values, ranges ("1-5"), lists ("1,3") and
+// steps ("*/15", "0-30/10").
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if t, err := time.Parse("15:04", spec); err == nil {
+		return &cron{
+			minute: 1 << uint(t.Minute()),
+			hour:   1 << uint(t.Hour()),
+			dom:    all(1, 31),
+			month:  all(1, 12),
+			dow:    all(0, 6),
+			domAny: true,
+			dowAny: true,
+		}, nil
+	}
+	return parseCron(spec)
+}
+
+// cron is a Schedule where each field is represented by a bitset of the
+// permitted values.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+
+	// domAny and dowAny record whether the respective field was "*". If both
+	// day fields are restricted, a day matches if either matches, per
+	// traditional cron semantics.
+	domAny, dowAny bool
+}
+
+func parseCron(spec string) (*cron, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected HH:MM or 5 cron fields, got %q", spec)
+	}
+	c := &cron{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	var err error
+	if c.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if c.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// 7 is an alias for Sunday.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseField parses a comma-separated list of cron terms into a bitset.
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, term := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(term, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			loPart, hiPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(loPart); err != nil {
+				return 0, fmt.Errorf("invalid value %q", loPart)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiPart); err != nil {
+					return 0, fmt.Errorf("invalid value %q", hiPart)
+				}
+			} else if hasStep {
+				// "5/15" means starting at 5, every 15.
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %v-%v", term, min, max)
+		}
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// all returns a bitset with every value from min to max inclusive set.
+func all(min, max int) uint64 {
+	var bits uint64
+	for i := min; i <= max; i++ {
+		bits |= 1 << uint(i)
+	}
+	return bits
+}
+
+// Next walks forward in wall-clock time. When clocks go back, a time of day
+// that occurs twice only activates the first time, and when they go forward,
+// the first instant after the gap activates if any skipped time would have.
+func (c *cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.skipped(t) {
+			return t
+		}
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = forward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc))
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 || repeat(t) > 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// forward returns next, a later wall-clock time than t built by time.Date,
+// corrected for how that normalises times around a change of the clocks: one
+// occurring twice as they go back becomes its first occurrence after t, and one
+// skipped as they go forward, which may be normalised to before t, becomes the
+// end of the gap.
+func forward(t, next time.Time) time.Time {
+	if d := repeat(next); d > 0 && next.Add(-d).After(t) {
+		return next.Add(-d)
+	}
+	if next.After(t) {
+		return next
+	}
+	if _, end := t.ZoneBounds(); end.After(t) {
+		return end
+	}
+	return t.Add(time.Minute)
+}
+
+// matches returns whether the wall-clock time of t is an activation time.
+func (c *cron) matches(t time.Time) bool {
+	return c.month&(1<<uint(t.Month())) != 0 &&
+		c.dayMatches(t) &&
+		c.hour&(1<<uint(t.Hour())) != 0 &&
+		c.minute&(1<<uint(t.Minute())) != 0
+}
+
+// skipped returns whether t is when clocks went forward, skipping a wall-clock
+// time that is an activation time.
+func (c *cron) skipped(t time.Time) bool {
+	start, _ := t.ZoneBounds()
+	if !t.Equal(start) {
+		return false
+	}
+	_, before := start.Add(-time.Nanosecond).Zone()
+	_, after := start.Zone()
+	// Wall-clock times are compared in UTC, where all of them exist.
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	for w := wall.Add(time.Duration(before-after) * time.Second); w.Before(wall); w = w.Add(time.Minute) {
+		if c.matches(w) {
+			return true
+		}
+	}
+	return false
+}
+
+// repeat returns how long ago the wall-clock time of t last occurred, as
+// clocks went back, or 0 if it did not.
+func repeat(t time.Time) time.Duration {
+	start, _ := t.ZoneBounds()
+	if start.IsZero() {
+		return 0
+	}
+	_, before := start.Add(-time.Nanosecond).Zone()
+	_, after := start.Zone()
+	if d := time.Duration(before-after) * time.Second; t.Sub(start) < d {
+		return d
+	}
+	return 0
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
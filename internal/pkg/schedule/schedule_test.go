@@ -0,0 +1,178 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{
+		"03:30",
+		" 23:59 ",
+		"30 3 * * *",
+		"*/15 * * * 1-5",
+		"0 0-12/3 1,15 * 7",
+	} {
+		if _, err := Parse(spec); err != nil {
+			t.Errorf("Parse(%q) = %v", spec, err)
+		}
+	}
+	for _, spec := range []string{
+		"",
+		"3:3",
+		"24:00",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		spec string
+		from time.Time
+		want []time.Time
+	}{
+		{
+			name: "time of day",
+			spec: "03:30",
+			from: time.Date(2024, 4, 20, 3, 30, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2024, 4, 21, 3, 30, 0, 0, time.UTC),
+				time.Date(2024, 4, 22, 3, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "later today",
+			spec: "03:30",
+			from: time.Date(2024, 4, 20, 3, 29, 59, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2024, 4, 20, 3, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "weekdays",
+			spec: "30 3 * * 1-5",
+			// A Friday.
+			from: time.Date(2024, 4, 19, 12, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2024, 4, 22, 3, 30, 0, 0, time.UTC),
+				time.Date(2024, 4, 23, 3, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "steps",
+			spec: "*/20 3 * * *",
+			from: time.Date(2024, 4, 20, 3, 30, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2024, 4, 20, 3, 40, 0, 0, time.UTC),
+				time.Date(2024, 4, 21, 3, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "either day field",
+			spec: "0 0 1 * 0",
+			// A Saturday.
+			from: time.Date(2024, 6, 29, 12, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2024, 7, 7, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "leap day",
+			spec: "0 0 29 2 *",
+			from: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			want: []time.Time{
+				time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "never",
+			spec: "0 0 31 2 *",
+			from: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			want: []time.Time{{}},
+		},
+		{
+			name: "repeated hour activates once",
+			spec: "30 1 * * *",
+			from: time.Date(2024, 10, 26, 12, 0, 0, 0, london),
+			want: []time.Time{
+				// 01:30 BST.
+				time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC),
+				time.Date(2024, 10, 28, 1, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "repeated hour activates each minute once",
+			spec: "*/20 1 * * *",
+			from: time.Date(2024, 11, 3, 0, 30, 0, 0, newYork),
+			want: []time.Time{
+				// 01:00 to 01:40 EDT, but not again in EST.
+				time.Date(2024, 11, 3, 5, 0, 0, 0, time.UTC),
+				time.Date(2024, 11, 3, 5, 20, 0, 0, time.UTC),
+				time.Date(2024, 11, 3, 5, 40, 0, 0, time.UTC),
+				time.Date(2024, 11, 4, 6, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "skipped hour activates after the gap",
+			spec: "30 2 * * *",
+			from: time.Date(2024, 3, 9, 12, 0, 0, 0, newYork),
+			want: []time.Time{
+				// 03:00 EDT.
+				time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 11, 6, 30, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "skipped minutes activate once",
+			spec: "*/20 1-2 * * *",
+			from: time.Date(2024, 3, 31, 0, 50, 0, 0, london),
+			want: []time.Time{
+				// 01:00 to 01:59 GMT is skipped, so 02:00 BST
+				// activates once.
+				time.Date(2024, 3, 31, 1, 0, 0, 0, time.UTC),
+				time.Date(2024, 3, 31, 1, 20, 0, 0, time.UTC),
+				time.Date(2024, 3, 31, 1, 40, 0, 0, time.UTC),
+				time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := Parse(tc.spec)
+			if err != nil {
+				t.Fatalf("Parse(%q) = %v", tc.spec, err)
+			}
+			from := tc.from
+			for _, want := range tc.want {
+				got := s.Next(from)
+				if !got.Equal(want) {
+					t.Fatalf("Next(%v) = %v, want %v", from, got, want.In(from.Location()))
+				}
+				from = got
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a period of each day between two times of day, e.g. 01:00-07:00.
+// It spans midnight if it ends before it starts, e.g. 23:00-06:00. The zero
+// Window is always open.
+type Window struct {
+	// start and end are offsets from midnight. The window is open from start
+	// inclusive until end exclusive.
+	start, end time.Duration
+}
+
+// ParseWindow interprets spec as two times of day in 24-hour HH:MM format
+// separated by a hyphen, e.g. "01:00-07:00".
+func ParseWindow(spec string) (Window, error) {
+	startPart, endPart, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return Window{}, fmt.Errorf("expected HH:MM-HH:MM, got %q", spec)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(startPart))
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid start %q", startPart)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(endPart))
+	if err != nil {
+		return Window{}, fmt.Errorf("invalid end %q", endPart)
+	}
+	w := Window{
+		start: sinceMidnight(start),
+		end:   sinceMidnight(end),
+	}
+	if w.start == w.end {
+		return Window{}, fmt.Errorf("%q starts and ends at the same time", spec)
+	}
+	return w, nil
+}
+
+// IsZero returns whether w is the zero Window, which is always open.
+func (w Window) IsZero() bool {
+	return w == Window{}
+}
+
+// Contains returns whether the window is open at t, in t's location.
+func (w Window) Contains(t time.Time) bool {
+	if w.IsZero() {
+		return true
+	}
+	offset := sinceMidnight(t)
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// Opens returns t if the window is open at t, otherwise the time it next
+// opens, in t's location.
+func (w Window) Opens(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	y, m, d := t.Date()
+	hour, minute := int(w.start.Hours()), int(w.start.Minutes())%60
+	start := time.Date(y, m, d, hour, minute, 0, 0, t.Location())
+	if start.Before(t) {
+		start = time.Date(y, m, d+1, hour, minute, 0, 0, t.Location())
+	}
+	return start
+}
+
+func (w Window) String() string {
+	if w.IsZero() {
+		return ""
+	}
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return format(w.start) + "-" + format(w.end)
+}
+
+// sinceMidnight returns the time of day of t as an offset from midnight, as
+// shown on the clock, so it is unaffected by daylight saving transitions.
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second +
+		time.Duration(t.Nanosecond())
+}
@@ -0,0 +1,271 @@
+// Package staging records the temporary files a process creates outside the
+// system's temporary directory in a state file shared between processes, so
+// those left behind by a process that crashed or was killed can be removed by
+// the next, rather than slowly filling the disk.
+//
+// Each process holds a lock on a file of its own while it has files
+// registered, which the OS releases when it exits, so a file is known to be
+// stale once the lock on its owner's file can be taken.
+package staging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gebn/plexbackup/internal/pkg/flock"
+)
+
+// stateLockTimeout bounds how long to wait for another process to finish
+// updating the state file.
+const stateLockTimeout = 10 * time.Second
+
+// entry is a file registered in the state file.
+type entry struct {
+	Path    string    `json:"path"`
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+}
+
+// Registry records staging files in the state file at path. A nil Registry
+// records nothing. It is safe for concurrent use.
+type Registry struct {
+	path string
+
+	mu sync.Mutex
+
+	// owner is the lock held by this process while it has files
+	// registered, created on first use.
+	owner *flock.Lock
+
+	// ownerPath is the path of the file locked by owner.
+	ownerPath string
+}
+
+// New returns a Registry recording files in the state file at path, whose
+// directory is created if necessary. The locks of each process are held in
+// files alongside it.
+func New(path string) *Registry {
+	return &Registry{
+		path: path,
+	}
+}
+
+// Register records that this process has created, or is about to create, the
+// file or directory at path. Release must be called once it has been removed,
+// or moved out of the staging area, so it is not removed after this process
+// exits.
+func (r *Registry) Register(path string) error {
+	if r == nil {
+		return nil
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.owner == nil {
+		if err := r.lockOwner(); err != nil {
+			return fmt.Errorf("failed to register staging file: %w", err)
+		}
+	}
+	err = r.update(func(entries []*entry) []*entry {
+		return append(entries, &entry{
+			Path:    path,
+			Owner:   r.ownerPath,
+			Created: time.Now(),
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register staging file: %w", err)
+	}
+	return nil
+}
+
+// Release forgets the file or directory at path registered by this process.
+// Failure is ignored, as it only means the next call to Clean will try to
+// remove it.
+func (r *Registry) Release(path string) {
+	if r == nil {
+		return
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.update(func(entries []*entry) []*entry {
+		return slices.DeleteFunc(entries, func(e *entry) bool {
+			return e.Path == path && e.Owner == r.ownerPath
+		})
+	})
+}
+
+// lockOwner creates and locks the file identifying this process as the owner
+// of the files it registers. The caller must hold mu.
+func (r *Registry) lockOwner() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o700); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(r.path), "staging-*.lock")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	if r.owner, err = flock.Acquire(file.Name()); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	r.ownerPath = file.Name()
+	return nil
+}
+
+// Clean removes the files and directories registered by processes that have
+// exited, returning their paths.
+func (r *Registry) Clean() ([]string, error) {
+	if r == nil {
+		return nil, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var removed []string
+	var errs []error
+	err := r.update(func(entries []*entry) []*entry {
+		// The liveness of each owner is only checked once.
+		stale := map[string]bool{}
+		kept := entries[:0]
+		for _, e := range entries {
+			dead, checked := stale[e.Owner]
+			if !checked {
+				dead = e.Owner != r.ownerPath && exited(e.Owner)
+				stale[e.Owner] = dead
+			}
+			if !dead {
+				kept = append(kept, e)
+				continue
+			}
+			if err := os.RemoveAll(e.Path); err != nil {
+				errs = append(errs, err)
+				kept = append(kept, e)
+				continue
+			}
+			removed = append(removed, e.Path)
+		}
+		for owner, dead := range stale {
+			if dead && !slices.ContainsFunc(kept, func(e *entry) bool {
+				return e.Owner == owner
+			}) {
+				os.Remove(owner)
+			}
+		}
+		return kept
+	})
+	return removed, errors.Join(append(errs, err)...)
+}
+
+// Close releases this process's lock, and removes its file unless files are
+// still registered to it, which the next call to Clean by any process then
+// removes.
+func (r *Registry) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.owner == nil {
+		return nil
+	}
+	err := r.owner.Release()
+	r.owner = nil
+	// The file is only needed while files are registered to it.
+	r.update(func(entries []*entry) []*entry {
+		if !slices.ContainsFunc(entries, func(e *entry) bool {
+			return e.Owner == r.ownerPath
+		}) {
+			os.Remove(r.ownerPath)
+		}
+		return entries
+	})
+	return err
+}
+
+// exited returns whether the process that locked the file at owner has
+// exited, as its lock can be taken, or the file is missing.
+func exited(owner string) bool {
+	if _, err := os.Stat(owner); errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	lock, err := flock.Acquire(owner)
+	if err != nil {
+		return false
+	}
+	lock.Release()
+	return true
+}
+
+// update replaces the entries in the state file with those returned by fn,
+// holding a lock on the state file's lock file meanwhile, waiting up to
+// stateLockTimeout for it. The caller must hold mu.
+func (r *Registry) update(fn func([]*entry) []*entry) error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o700); err != nil {
+		return err
+	}
+	lock, err := r.lockState()
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	var entries []*entry
+	data, err := os.ReadFile(r.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("failed to parse %v: %w", r.path, err)
+		}
+	}
+	entries = fn(entries)
+	if len(entries) == 0 {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if data, err = json.MarshalIndent(entries, "", "  "); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(r.path), ".staging-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if err = errors.Join(err, temp.Sync(), temp.Close()); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), r.path)
+}
+
+// lockState takes the lock guarding the state file, waiting up to
+// stateLockTimeout if another process holds it.
+func (r *Registry) lockState() (*flock.Lock, error) {
+	deadline := time.Now().Add(stateLockTimeout)
+	for {
+		lock, err := flock.Acquire(r.path + ".lock")
+		if !errors.Is(err, flock.ErrLocked) || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,112 @@
+// Package tautulli queries a Tautulli instance for what Plex is doing, so a
+// backup can avoid interrupting viewers without needing a Plex token.
+package tautulli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the Tautulli API.
+type Client struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+// New creates a Client for the Tautulli instance at baseURL, e.g.
+// http://localhost:8181, authenticating with apiKey, found under Settings, Web
+// Interface.
+func New(baseURL, apiKey string) *Client {
+	return &Client{
+		url:    strings.TrimSuffix(baseURL, "/") + "/api/v2",
+		apiKey: apiKey,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// Activity summarises what Plex is currently doing.
+type Activity struct {
+
+	// Streams is the number of active sessions, including paused ones.
+	Streams int
+
+	// LastAdded is when the most recently added item was added to a library,
+	// or the zero time if there are none. A recent time suggests a library
+	// scan is in progress.
+	LastAdded time.Time
+}
+
+// Activity retrieves the current activity.
+func (c *Client) Activity(ctx context.Context) (*Activity, error) {
+	var activity struct {
+		Sessions []json.RawMessage `json:"sessions"`
+	}
+	if err := c.call(ctx, "get_activity", nil, &activity); err != nil {
+		return nil, err
+	}
+	var added struct {
+		RecentlyAdded []struct {
+			AddedAt string `json:"added_at"`
+		} `json:"recently_added"`
+	}
+	if err := c.call(ctx, "get_recently_added", url.Values{"count": {"1"}}, &added); err != nil {
+		return nil, err
+	}
+	a := &Activity{
+		Streams: len(activity.Sessions),
+	}
+	if len(added.RecentlyAdded) > 0 {
+		seconds, err := strconv.ParseInt(added.RecentlyAdded[0].AddedAt, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid added_at: %w", err)
+		}
+		a.LastAdded = time.Unix(seconds, 0)
+	}
+	return a, nil
+}
+
+// call invokes cmd with params, decoding the response's data into v.
+func (c *Client) call(ctx context.Context, cmd string, params url.Values, v any) error {
+	query := url.Values{
+		"apikey": {c.apiKey},
+		"cmd":    {cmd},
+	}
+	for k, vs := range params {
+		query[k] = vs
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v returned %v", cmd, resp.Status)
+	}
+	var body struct {
+		Response struct {
+			Result  string          `json:"result"`
+			Message string          `json:"message"`
+			Data    json.RawMessage `json:"data"`
+		} `json:"response"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to parse %v response: %w", cmd, err)
+	}
+	if body.Response.Result != "success" {
+		return fmt.Errorf("%v failed: %v", cmd, body.Response.Message)
+	}
+	return json.Unmarshal(body.Response.Data, v)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+	"github.com/gebn/plexbackup/internal/pkg/flock"
+	"github.com/gebn/plexbackup/internal/pkg/healthcheck"
+	"github.com/gebn/plexbackup/internal/pkg/notify"
+	"github.com/gebn/plexbackup/internal/pkg/registry"
+	"github.com/gebn/plexbackup/internal/pkg/tautulli"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// job is a fully-configured backup, which may be run any number of times.
+type job struct {
+	name     string
+	logger   *slog.Logger
+	client   *s3.Client
+	opts     *backup.Opts
+	lockFile string
+
+	// lockMu serialises acquiring lockFile, so the daemon checking for a run
+	// outside it is not mistaken for one by run.
+	lockMu sync.Mutex
+
+	hooks     hooks
+	bar       *progressBar
+	output    io.Writer
+	check     *healthcheck.Check
+	tautulli  *tautulli.Client
+	busyWait  time.Duration
+	notifiers []notify.Notifier
+
+	// registry, if set, records the backup taken by each run.
+	registry *registry.Table
+
+	// strictPrune reports failure to delete an old backup as failure of the
+	// run, rather than only in the exit code.
+	strictPrune bool
+
+	// breaker counts consecutive failures when run by the daemon, and is
+	// otherwise nil.
+	breaker *breaker
+}
+
+// locked returns whether another run holds the lock file, e.g. one started by
+// cron while the daemon is idle.
+func (j *job) locked() bool {
+	if j.lockFile == "" {
+		return false
+	}
+	j.lockMu.Lock()
+	defer j.lockMu.Unlock()
+	lock, err := flock.Acquire(j.lockFile)
+	if err != nil {
+		return errors.Is(err, flock.ErrLocked)
+	}
+	lock.Release()
+	return false
+}
+
+// run performs a single backup, reporting its outcome to any configured
+// monitoring and notification services and registry. Failure to report is
+// logged rather than returned, as it is not a failure of the backup itself. If
+// another run holds the lock file, an error wrapping flock.ErrLocked is
+// returned immediately, without reporting anything, as the other run will do
+// so.
+func (j *job) run(ctx context.Context) (*backup.Result, error) {
+	if j.lockFile != "" {
+		j.lockMu.Lock()
+		lock, err := flock.Acquire(j.lockFile)
+		j.lockMu.Unlock()
+		if errors.Is(err, flock.ErrLocked) {
+			return nil, fmt.Errorf("another backup is already running (%v): %w", j.lockFile, err)
+		}
+		if errors.Is(err, fs.ErrPermission) {
+			return nil, fmt.Errorf("failed to acquire lock: %w; set -lock-file to a path writable by every user running backups", err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire lock: %w", err)
+		}
+		defer lock.Release()
+	}
+
+	if j.check != nil {
+		if err := j.check.Start(ctx); err != nil {
+			j.logger.WarnContext(ctx, "failed to ping healthcheck start",
+				slog.String("error", err.Error()))
+		}
+	}
+
+	start := time.Now()
+	var result *backup.Result
+	runErr := j.waitIdle(ctx)
+	if runErr == nil {
+		runErr = j.hooks.runPre(ctx, j.name, j.opts.Bucket)
+	}
+	if runErr == nil {
+		result, runErr = backup.Run(ctx, j.logger, j.client, j.opts)
+		if j.bar != nil {
+			j.bar.finish()
+		}
+		if runErr == nil {
+			// A backup that cannot be read back is no backup at all.
+			runErr = result.VerifyErr
+		}
+		if runErr == nil && j.strictPrune {
+			runErr = result.PruneErr
+		}
+	}
+
+	// The outcome should be reported even if the run was interrupted.
+	ctx = context.WithoutCancel(ctx)
+
+	if j.breaker != nil {
+		j.breaker.record(runErr, time.Now())
+	}
+
+	if j.check != nil {
+		// The monitoring service will alert on the missing ping anyway.
+		var err error
+		if runErr == nil {
+			err = j.check.Success(ctx)
+		} else {
+			err = j.check.Fail(ctx, runErr)
+		}
+		if err != nil {
+			j.logger.WarnContext(ctx, "failed to ping healthcheck",
+				slog.String("error", err.Error()))
+		}
+	}
+
+	summary := &notify.Summary{
+		Job:             j.name,
+		Bucket:          j.opts.Bucket,
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if runErr == nil {
+		summary.Status = notify.StatusSuccess
+	} else {
+		summary.Status = notify.StatusFailure
+		summary.Error = runErr.Error()
+		if j.breaker != nil {
+			summary.ConsecutiveFailures = j.breaker.failures
+			summary.ResumesAt = j.breaker.resumes
+		}
+	}
+	if result != nil {
+		// Present on failure if the backup was uploaded, but Plex failed to
+		// start again, or it failed verification or pruning.
+		summary.Key = result.Key
+		summary.UncompressedBytes = result.UncompressedBytes
+		summary.CompressedBytes = result.CompressedBytes
+		summary.DirectoryBytes = result.DirectoryBytes
+		summary.ExcludedBytes = result.ExcludedBytes
+		summary.SHA256 = result.SHA256
+		summary.PlexVersion = result.PlexVersion
+		summary.Label = result.Label
+		summary.DowntimeSeconds = result.Downtime.Seconds()
+		summary.PrunedKeys = result.PrunedKeys
+		summary.ChangedDatabases = result.ChangedDatabases
+	}
+	if j.output != nil {
+		if err := json.NewEncoder(j.output).Encode(summary); err != nil {
+			j.logger.WarnContext(ctx, "failed to write result",
+				slog.String("error", err.Error()))
+		}
+	}
+	if err := j.hooks.runPost(ctx, summary); err != nil {
+		j.logger.WarnContext(ctx, "hook failed",
+			slog.String("error", err.Error()))
+	}
+	for _, notifier := range j.notifiers {
+		if err := notifier.Notify(ctx, summary); err != nil {
+			j.logger.WarnContext(ctx, "failed to send notification",
+				slog.String("error", err.Error()))
+		}
+	}
+	if j.registry != nil {
+		if err := j.registry.Record(ctx, summary); err != nil {
+			j.logger.WarnContext(ctx, "failed to update registry",
+				slog.String("error", err.Error()))
+		}
+	}
+	return result, runErr
+}
+
+// ErrBusy is returned by a run skipped because Plex remained in use for
+// longer than -busy-wait.
+var ErrBusy = errors.New("Plex is in use")
+
+// scanWindow is how recently an item must have been added to a library for a
+// scan to be considered in progress.
+const scanWindow = 10 * time.Minute
+
+// waitIdle waits up to j.busyWait for Plex to be idle according to Tautulli,
+// returning an error wrapping ErrBusy if it is not. Plex is not stopped if
+// j.opts.NoPause or j.opts.Reflink is set, so viewers are not interrupted
+// regardless. If Tautulli cannot be queried, the backup goes ahead.
+func (j *job) waitIdle(ctx context.Context) error {
+	if j.tautulli == nil || j.opts.NoPause || j.opts.Reflink {
+		return nil
+	}
+	deadline := time.Now().Add(j.busyWait)
+	for {
+		activity, err := j.tautulli.Activity(ctx)
+		if err != nil {
+			j.logger.WarnContext(ctx, "failed to query Tautulli, assuming Plex is idle",
+				slog.String("error", err.Error()))
+			return nil
+		}
+		var reason string
+		switch {
+		case activity.Streams > 0:
+			reason = fmt.Sprintf("%d active streams", activity.Streams)
+		case time.Since(activity.LastAdded) < scanWindow:
+			reason = "library scan in progress"
+		default:
+			return nil
+		}
+		wait := min(time.Until(deadline), time.Minute)
+		if wait <= 0 {
+			return fmt.Errorf("%w: %v", ErrBusy, reason)
+		}
+		j.logger.InfoContext(ctx, "waiting for Plex to be idle",
+			slog.String("reason", reason))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
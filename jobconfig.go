@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+	"github.com/gebn/plexbackup/internal/pkg/healthcheck"
+	"github.com/gebn/plexbackup/internal/pkg/notify"
+	"github.com/gebn/plexbackup/internal/pkg/registry"
+	"github.com/gebn/plexbackup/internal/pkg/schedule"
+	"github.com/gebn/plexbackup/internal/pkg/tautulli"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// defaultDirectory is the location of the 'Plex Media Server' directory in a
+// standard Linux installation.
+const defaultDirectory = "/var/lib/plexmediaserver/Library/Application Support/Plex Media Server"
+
+var (
+	ErrNoBucket        = errors.New("bucket name must be specified with -bucket")
+	ErrIncompleteEmail = errors.New("-email-from and -email-to must be specified with -smtp-addr")
+)
+
+// jobConfig holds the flags describing a single backup job. The instance
+// registered on the command line also provides defaults for each named job in
+// the -config file.
+type jobConfig struct {
+	bucket        string
+	region        string
+	accelerate    bool
+	expectedOwner string
+	acl           string
+	prefix        string
+	catalog       bool
+	purgeVersions bool
+	prune         bool
+	keepDaily     int
+	keepWeekly    int
+	keepMonthly   int
+	verify        bool
+	strictPrune   bool
+	replicaBucket string
+	replicaRegion string
+	kmsKeyIDs     stringsFlag
+
+	uploadWindow      string
+	outsideWindowRate float64
+
+	awsMaxAttempts int
+	awsMaxBackoff  time.Duration
+	awsRetryErrors stringsFlag
+	runAttempts    int
+	runMaxBackoff  time.Duration
+	runRetryErrors stringsFlag
+
+	platform    string
+	noPause     bool
+	reflink     bool
+	services    stringsFlag
+	stopTimeout time.Duration
+	startGrace  time.Duration
+	directories stringsFlag
+	excludes    stringsFlag
+	defExcludes bool
+	parts       stringsFlag
+	sysConfig   bool
+	lockFile    string
+	plexURL     string
+	nice        int
+	idleIO      bool
+	maxReadRate float64
+	adaptive    bool
+	dedup       bool
+	vacuum      bool
+	plexSQLite  string
+	spaceMargin float64
+	agentURL    string
+	agentToken  string
+	agentCACert string
+
+	// agentCAs are the certificates in agentCACert, loaded by validate.
+	agentCAs *x509.CertPool
+
+	tautulliURL    string
+	tautulliAPIKey string
+	busyWait       time.Duration
+
+	preHook     string
+	postHook    string
+	failureHook string
+
+	healthcheckURL string
+	webhookURLs    stringsFlag
+	snsTopicARN    string
+	dynamoDBTable  string
+
+	smtpAddr     string
+	smtpUsername string
+	smtpPassword string
+	emailFrom    string
+	emailTo      stringsFlag
+	emailAlways  bool
+}
+
+// register defines the job's flags on fs.
+func (c *jobConfig) register(fs *flag.FlagSet) {
+	c.registerStorage(fs)
+	c.registerPlex(fs)
+	c.registerHooks(fs)
+	c.registerNotifications(fs)
+	c.registerRetries(fs)
+}
+
+// registerStorage defines the flags controlling where and how backups are
+// stored.
+func (c *jobConfig) registerStorage(fs *flag.FlagSet) {
+	fs.StringVar(&c.bucket, "bucket", "", "name of the S3 bucket to upload the backup to")
+	fs.StringVar(&c.region, "region", "us-east-1", "region of the -bucket")
+	fs.StringVar(&c.expectedOwner, "expected-bucket-owner", "", "ID of the AWS account expected to own the -bucket, e.g. a separate backup account; requests fail rather than reach a bucket of the same name owned by anyone else")
+	fs.StringVar(&c.acl, "acl", "", "canned ACL to give each object written, e.g. bucket-owner-full-control so the owner of a -bucket in another account with ACLs enabled can read backups; buckets with ACLs disabled only accept that one")
+	fs.BoolVar(&c.accelerate, "accelerate", false, "transfer to and from the -bucket via its S3 Transfer Acceleration endpoint, which must be enabled on the bucket, to speed up uploads from far outside its -region; charged per GB transferred")
+	fs.StringVar(&c.prefix, "prefix", "plex/", `suffixed with "<RFC3339 date>.tar.zst" to form the upload key`)
+	fs.StringVar(&c.replicaBucket, "replica-bucket", "", "name of a second S3 bucket, usually in another -replica-region, to copy each backup to server-side after upload; old backups are pruned from it too")
+	fs.StringVar(&c.replicaRegion, "replica-region", "", "region of the -replica-bucket (default -region)")
+	fs.StringVar(&c.uploadWindow, "upload-window", "", "local time of day the upload may use all available bandwidth, e.g. 01:00-07:00; outside it, the upload is limited to -outside-window-rate, so large backups can finish over several nights")
+	fs.Float64Var(&c.outsideWindowRate, "outside-window-rate", 0, "maximum rate to upload at outside the -upload-window, in MB/s; 0 pauses the upload until the window opens")
+	fs.IntVar(&c.keepDaily, "keep-daily", 0, "keep the newest backup of each of this many most recent days, rather than only the newest backup overall; see retention simulate")
+	fs.IntVar(&c.keepWeekly, "keep-weekly", 0, "keep the newest backup of each of this many most recent weeks, starting on Monday")
+	fs.IntVar(&c.keepMonthly, "keep-monthly", 0, "keep the newest backup of each of this many most recent months")
+	fs.BoolVar(&c.prune, "prune", true, "delete old backups after each successful one, as the -keep-* flags allow; false to leave them to a lifecycle rule, e.g. with Object Lock retention, so the credentials need no delete permissions")
+	fs.BoolVar(&c.purgeVersions, "purge-versions", false, "permanently delete noncurrent versions and delete markers of backups under the -prefix after pruning, for buckets with versioning enabled; requires s3:ListBucketVersions and s3:DeleteObjectVersion")
+	fs.BoolVar(&c.verify, "verify", false, "download the backup after uploading it and read every file in the archive, only deleting old backups if this succeeds; doubles the data transferred")
+	fs.BoolVar(&c.strictPrune, "strict-prune", false, "report failure to delete old backups as a failed run to -healthcheck-url and notifications, rather than only in the exit code")
+	fs.Var(&c.kmsKeyIDs, "kms-key-id", "ID, alias or ARN of a KMS key to encrypt backups with client-side, using a new data key for each backup stored wrapped in its metadata; requires kms:GenerateDataKey, and kms:Decrypt to restore. May be repeated to also wrap the data key with further keys, any of which can decrypt it, requiring kms:Encrypt")
+	fs.BoolVar(&c.catalog, "catalog", true, `maintain an index of backups under the -prefix, suffixed with "`+backup.CatalogName+`", recording their checksum and Plex version`)
+}
+
+// lockDir is the directory for lock files shared between processes on Linux.
+// Unlike /tmp, it is not made private by the PrivateTmp= option of the unit
+// written by install-unit.
+const lockDir = "/run/lock"
+
+// defaultLockFile returns the default -lock-file, in lockDir if it exists, so
+// manual runs, the systemd timer's and pre-upgrade hooks all see the same one,
+// otherwise in the temporary directory.
+func defaultLockFile() string {
+	dir := os.TempDir()
+	if runtime.GOOS == "linux" {
+		if info, err := os.Stat(lockDir); err == nil && info.IsDir() {
+			dir = lockDir
+		}
+	}
+	return filepath.Join(dir, "plexbackup.lock")
+}
+
+// registerPlex defines the flags describing the service backed up and how it
+// is stopped and read.
+func (c *jobConfig) registerPlex(fs *flag.FlagSet) {
+	fs.StringVar(&c.platform, "platform", "", "NAS platform Plex is installed on, unraid or qnap; defaults -directory, -service and -exclude accordingly, and stops Plex without systemd")
+	fs.BoolVar(&c.noPause, "no-pause", false, "suppresses stopping Plex while the backup is performed, risks an inconsistent backup; databases changed while archiving are logged and recorded in the catalog")
+	fs.BoolVar(&c.reflink, "reflink", false, "instead of stopping Plex, back up instant reflink copies of its databases, made alongside them, for a consistent backup without downtime; requires a filesystem supporting reflinks, e.g. XFS or Btrfs, and write access to the databases' directory")
+	fs.Var(&c.services, "service", "name of the systemd unit to stop, redundant if -no-pause or -reflink used; may be repeated to also stop companion units, which are stopped in order after Plex and started in reverse order (default detected from the units matching plexmediaserver or snap.plexmediaserver.*)")
+	fs.DurationVar(&c.stopTimeout, "stop-timeout", 5*time.Minute, "how long to wait for the -service to stop before abandoning the backup; raise for large databases that take a while to checkpoint, 0 for no limit")
+	fs.DurationVar(&c.startGrace, "start-grace", time.Minute, "how long to wait for Plex to respond at the -plex-url after starting it, so it is not reported started while still booting; 0 to not wait")
+	fs.Var(&c.directories, "directory", "path of a directory to back up, may be repeated to capture several in one archive (default \""+defaultDirectory+"\")")
+	fs.Var(&c.excludes, "exclude", "tar --exclude pattern of paths within -directory to omit in addition to the defaults, may be repeated")
+	fs.BoolVar(&c.defExcludes, "default-excludes", true, "omit regenerable and re-downloadable content: "+strings.Join(backup.PlexExcludes, ", ")+", and Codecs with -platform; false to back up everything not matched by -exclude")
+	fs.BoolVar(&c.sysConfig, "system-config", true, "also back up /etc/default/plexmediaserver and the systemd drop-ins of each -service, if they exist, under etc/ in the archive; Linux only")
+	fs.Var(&c.parts, "part", `path of a large subtree within the archive to archive, compress and upload concurrently with the rest, as a separate object restored along with it, e.g. "Plex Media Server/Metadata"; may be repeated`)
+	fs.StringVar(&c.plexURL, "plex-url", backup.DefaultPlexURL, "address of Plex, queried for its version to record with the backup; empty to disable, e.g. if -service is not Plex")
+	fs.IntVar(&c.nice, "nice", 0, "niceness to run tar with, e.g. 19 to only use CPU otherwise idle; 0 to leave unchanged")
+	fs.BoolVar(&c.idleIO, "idle-io", false, "run tar in the idle I/O scheduling class, so it only reads from disk when nothing else is; Linux only")
+	fs.Float64Var(&c.maxReadRate, "max-read-rate", 0, "maximum rate to read -directory at, in MB/s, to leave disk bandwidth for Plex; 0 for no limit")
+	fs.BoolVar(&c.vacuum, "vacuum", false, "checkpoint and VACUUM the library databases with -plex-sqlite once Plex has stopped, shrinking the backup at the cost of longer downtime")
+	fs.StringVar(&c.plexSQLite, "plex-sqlite", backup.DefaultPlexSQLite, "path of Plex's SQLite shell, used by -vacuum")
+	fs.Float64Var(&c.spaceMargin, "space-margin", 1.5, "before stopping Plex, check the filesystems written to by -seed-dir, -vacuum and -reflink, and by restore and repair-db, have this many times the estimated size of the files free, aborting otherwise; 0 to not check")
+	fs.BoolVar(&c.dedup, "dedup", false, "store files of up to 16 MiB with identical content, e.g. artwork shared between items, once, as hard links to the first; they are restored as hard links")
+	fs.BoolVar(&c.adaptive, "adaptive-compression", false, "sample each window of the archive, storing those that barely compress, e.g. of JPEG artwork, at the fastest level rather than spending CPU on them")
+	fs.StringVar(&c.agentURL, "agent-url", "", "URL of a plexbackup agent on the Plex host to stop, start and archive Plex via, e.g. https://nas:9813; the service and directories are then configured on the agent")
+	fs.StringVar(&c.agentToken, "agent-token", "", "secret shared with the agent, required by agent mode and with -agent-url")
+	fs.StringVar(&c.agentCACert, "agent-ca-cert", "", "path of a PEM certificate to trust for an https -agent-url, e.g. the agent's self-signed -agent-tls-cert, instead of the system's certificate authorities")
+	fs.StringVar(&c.tautulliURL, "tautulli-url", "", "URL of Tautulli, e.g. http://localhost:8181, queried for active streams and library scans before stopping Plex")
+	fs.StringVar(&c.tautulliAPIKey, "tautulli-api-key", "", "API key of the -tautulli-url")
+	fs.DurationVar(&c.busyWait, "busy-wait", 0, "how long to wait for Plex to become idle according to -tautulli-url before skipping the backup")
+	fs.StringVar(&c.lockFile, "lock-file", defaultLockFile(), "path of a file locked for the duration of each backup to prevent overlapping runs, empty to disable; must be writable by every user running backups")
+}
+
+// registerHooks defines the flags of shell commands run around each backup.
+func (c *jobConfig) registerHooks(fs *flag.FlagSet) {
+	fs.StringVar(&c.preHook, "pre-hook", "", "shell command to run before the backup, which is aborted if it fails")
+	fs.StringVar(&c.postHook, "post-hook", "", "shell command to run after a successful backup, with details in PLEXBACKUP_* environment variables")
+	fs.StringVar(&c.failureHook, "on-failure-hook", "", "shell command to run after a failed backup, with details in PLEXBACKUP_* environment variables")
+}
+
+// registerNotifications defines the flags of where the outcome of each backup
+// is reported.
+func (c *jobConfig) registerNotifications(fs *flag.FlagSet) {
+	fs.StringVar(&c.healthcheckURL, "healthcheck-url", "", "healthchecks.io-compatible URL to ping when the backup starts (/start suffix), succeeds and fails (/fail suffix)")
+	fs.Var(&c.webhookURLs, "webhook-url", "URL to POST a JSON summary of the run to on completion, may be repeated")
+	fs.StringVar(&c.snsTopicARN, "sns-topic-arn", "", "ARN of an SNS topic to publish a JSON summary of the run to on completion")
+	fs.StringVar(&c.dynamoDBTable, "dynamodb-table", "", `name or ARN of a DynamoDB table, keyed by "bucket" and "key" strings, to record each backup in, with its checksum, sizes, host and status, so those of many hosts can be queried without listing buckets; requires dynamodb:PutItem, and dynamodb:UpdateItem to mark pruned backups`)
+
+	fs.StringVar(&c.smtpAddr, "smtp-addr", "", "host:port of the SMTP server used to send email reports, enables reports if set")
+	fs.StringVar(&c.smtpUsername, "smtp-username", "", "username to authenticate to the -smtp-addr with, if required")
+	fs.StringVar(&c.smtpPassword, "smtp-password", "", "password to authenticate to the -smtp-addr with, if required")
+	fs.StringVar(&c.emailFrom, "email-from", "", "sender address of email reports")
+	fs.Var(&c.emailTo, "email-to", "recipient address of email reports, may be repeated")
+	fs.BoolVar(&c.emailAlways, "email-always", false, "send an email report for successful runs, not only failures")
+}
+
+// detectService sets the service to the Plex unit if it was not specified and
+// is needed.
+func (c *jobConfig) detectService(ctx context.Context) error {
+	if c.noPause || c.reflink || len(c.services) > 0 || c.platform != "" || c.agentURL != "" {
+		return nil
+	}
+	service, err := backup.DetectService(ctx, backup.ExecRunner{})
+	if err != nil {
+		return fmt.Errorf("%w; specify the unit to stop with -service", err)
+	}
+	c.services = stringsFlag{service}
+	return nil
+}
+
+// validate checks the config is complete and consistent.
+func (c *jobConfig) validate() error {
+	if c.bucket == "" {
+		return ErrNoBucket
+	}
+
+	if c.smtpAddr != "" && (c.emailFrom == "" || len(c.emailTo) == 0) {
+		return ErrIncompleteEmail
+	}
+	if c.agentURL != "" && c.agentToken == "" {
+		return ErrNoAgentToken
+	}
+	if c.tautulliURL != "" && c.tautulliAPIKey == "" {
+		return errors.New("-tautulli-api-key must be specified with -tautulli-url")
+	}
+	if _, ok := platforms[c.platform]; c.platform != "" && !ok {
+		return fmt.Errorf("unknown -platform %q, must be unraid or qnap", c.platform)
+	}
+	if c.agentCACert != "" {
+		if !strings.HasPrefix(c.agentURL, "https://") {
+			return errors.New("-agent-ca-cert requires an https -agent-url")
+		}
+		pem, err := os.ReadFile(c.agentCACert)
+		if err != nil {
+			return fmt.Errorf("failed to read -agent-ca-cert: %w", err)
+		}
+		c.agentCAs = x509.NewCertPool()
+		if !c.agentCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in -agent-ca-cert %v", c.agentCACert)
+		}
+	}
+	if c.agentURL != "" && len(c.parts) > 0 {
+		return errors.New("-part cannot be used with -agent-url, as the agent archives everything in one stream")
+	}
+	if c.uploadWindow != "" {
+		if _, err := schedule.ParseWindow(c.uploadWindow); err != nil {
+			return fmt.Errorf("invalid -upload-window: %w", err)
+		}
+	}
+	if c.outsideWindowRate < 0 {
+		return errors.New("-outside-window-rate must not be negative")
+	}
+	if err := c.ownership().Validate(); err != nil {
+		return err
+	}
+	if c.accelerate && strings.Contains(c.bucket, ".") {
+		return errors.New("-accelerate cannot be used with a -bucket whose name contains dots")
+	}
+	if err := c.validateRetries(); err != nil {
+		return err
+	}
+	return c.opts().Validate()
+}
+
+// validateAgent checks the config is complete and consistent for agent mode.
+// The agent does not upload, so needs no bucket, or to notify.
+func (c *jobConfig) validateAgent() error {
+	if c.agentToken == "" {
+		return ErrNoAgentToken
+	}
+	if c.agentURL != "" {
+		return errors.New("-agent-url cannot be specified in agent mode")
+	}
+	if _, ok := platforms[c.platform]; c.platform != "" && !ok {
+		return fmt.Errorf("unknown -platform %q, must be unraid or qnap", c.platform)
+	}
+	o := c.opts()
+	o.Bucket = "agent" // checked by Validate
+	return o.Validate()
+}
+
+// retention returns the job's retention policy.
+func (c *jobConfig) retention() backup.Retention {
+	return backup.Retention{
+		Daily:   c.keepDaily,
+		Weekly:  c.keepWeekly,
+		Monthly: c.keepMonthly,
+	}
+}
+
+// opts returns the options to pass to the backup package, excluding those
+// controlling progress reporting.
+func (c *jobConfig) opts() *backup.Opts {
+	o := &backup.Opts{
+		NoPause:             c.noPause,
+		Reflink:             c.reflink,
+		Directories:         c.directories,
+		Parts:               c.parts,
+		StopTimeout:         c.stopTimeout,
+		StartGrace:          c.startGrace,
+		Bucket:              c.bucket,
+		Prefix:              c.prefix,
+		PlexURL:             c.plexURL,
+		Nice:                c.nice,
+		IdleIO:              c.idleIO,
+		MaxReadRate:         int64(c.maxReadRate * 1e6),
+		OutsideWindowRate:   int64(c.outsideWindowRate * 1e6),
+		AdaptiveCompression: c.adaptive,
+		Deduplicate:         c.dedup,
+		Vacuum:              c.vacuum,
+		SpaceMargin:         c.spaceMargin,
+		Staging:             stagingRegistry,
+		PlexSQLite:          c.plexSQLite,
+		Catalog:             c.catalog,
+		PurgeVersions:       c.purgeVersions,
+		NoPrune:             !c.prune,
+		Retention:           c.retention(),
+		Retry:               c.runRetry(),
+		Verify:              c.verify,
+		ReplicaBucket:       c.replicaBucket,
+		KMSKeyIDs:           c.kmsKeyIDs,
+		ToolVersion:         build.Version,
+		Label:               backupLabel,
+		SeedDir:             seedDir,
+		SeedChunkBytes:      int64(seedChunkSize) * 1e6,
+	}
+	// Checked by validate.
+	o.UploadWindow, _ = schedule.ParseWindow(c.uploadWindow)
+	if len(c.services) > 0 {
+		o.Service = c.services[0]
+		o.ExtraServices = c.services[1:]
+	}
+	defaultExcludes := backup.PlexExcludes
+	if p, ok := platforms[c.platform]; ok {
+		if len(o.Directories) == 0 {
+			o.Directories = []string{p.directory}
+		}
+		if o.Service == "" {
+			o.Service = p.service
+		}
+		defaultExcludes = p.excludes
+		o.StopCommand = p.stop(o.Service)
+		o.StartCommand = p.start(o.Service)
+	}
+	if len(o.Directories) == 0 {
+		o.Directories = []string{defaultDirectory}
+	}
+	// Never nil, so an empty list backs up everything.
+	o.Excludes = slices.Clone(c.excludes)
+	if c.defExcludes {
+		o.Excludes = append(slices.Clone(defaultExcludes), c.excludes...)
+	}
+	if c.sysConfig && runtime.GOOS == "linux" {
+		o.ConfigPaths = backup.LinuxConfigPaths(c.services...)
+	}
+	if c.agentURL != "" {
+		// The agent runs the commands with its own config, so these only
+		// need to be valid.
+		if o.Service == "" {
+			o.Service = c.agentURL
+		}
+		o.ExtraServices = nil
+		o.StopTimeout = 0
+		o.StartGrace = 0 // the agent waits for Plex before responding
+		o.StopCommand = []string{agentCommand, "stop"}
+		o.StartCommand = []string{agentCommand, "start"}
+		o.Nice = 0
+		o.IdleIO = false
+		o.RemoteDirectories = true
+		client := http.DefaultClient
+		if c.agentCAs != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{RootCAs: c.agentCAs}
+			client = &http.Client{Transport: transport}
+		}
+		o.Runner = &agentClient{
+			url:    c.agentURL,
+			token:  c.agentToken,
+			client: client,
+		}
+	}
+	return o
+}
+
+// awsConfig loads the AWS SDK config for the job's -region.
+func (c *jobConfig) awsConfig(ctx context.Context) (aws.Config, error) {
+	if err := c.validateRetries(); err != nil {
+		return aws.Config{}, err
+	}
+	if err := c.ownership().Validate(); err != nil {
+		return aws.Config{}, err
+	}
+	options := []func(*config.LoadOptions) error{
+		config.WithRegion(c.region),
+		config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled),
+	}
+	if retryer := c.awsRetryer(); retryer != nil {
+		options = append(options, config.WithRetryer(retryer))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to initialise AWS SDK: %w", err)
+	}
+	return cfg, nil
+}
+
+// s3Client returns a client for the job's -bucket in cfg's region, using the
+// bucket's Transfer Acceleration endpoint if -accelerate is set. Operations
+// not supported by the endpoint, e.g. CreateBucket, use the regular one.
+func (c *jobConfig) s3Client(cfg aws.Config) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UseAccelerate = c.accelerate
+	}, c.ownership().ClientOption())
+}
+
+// replicaS3Client returns a client for the job's -replica-bucket, in
+// -replica-region if set. The -expected-bucket-owner is that of the -bucket,
+// so is not checked, but objects copied to the replica are given the -acl.
+func (c *jobConfig) replicaS3Client(cfg aws.Config) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if c.replicaRegion != "" {
+			o.Region = c.replicaRegion
+		}
+	}, backup.Ownership{ACL: c.ownership().ACL}.ClientOption())
+}
+
+// ownership returns the expected owner of the -bucket and the ACL of objects
+// written to it.
+func (c *jobConfig) ownership() backup.Ownership {
+	return backup.Ownership{
+		ExpectedOwner: c.expectedOwner,
+		ACL:           s3types.ObjectCannedACL(c.acl),
+	}
+}
+
+// kmsClient returns a client for KMS in cfg's region, used to encrypt and
+// decrypt backups. KMS does not offer dual-stack endpoints in every region.
+func kmsClient(cfg aws.Config) *kms.Client {
+	return kms.NewFromConfig(cfg, func(o *kms.Options) {
+		o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateDisabled
+	})
+}
+
+// registry returns the -dynamodb-table to record backups in, or nil if there
+// is none. A table given by ARN need not be in the same region as the bucket.
+// DynamoDB does not offer dual-stack endpoints in every region.
+func (c *jobConfig) registry(cfg aws.Config) (*registry.Table, error) {
+	if c.dynamoDBTable == "" {
+		return nil, nil
+	}
+	region := cfg.Region
+	if arn.IsARN(c.dynamoDBTable) {
+		table, err := arn.Parse(c.dynamoDBTable)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -dynamodb-table: %w", err)
+		}
+		region = table.Region
+	}
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		o.Region = region
+		o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateDisabled
+	})
+	return registry.New(client, c.dynamoDBTable, build.Version), nil
+}
+
+// build creates a runnable job from the config. name is used to identify the
+// job in logs, and may be empty if it is the only one.
+func (c *jobConfig) build(ctx context.Context, logger *slog.Logger, name string) (*job, error) {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if name != "" {
+		logger = logger.With(slog.String("job", name))
+	}
+	j := &job{
+		name:     name,
+		logger:   logger,
+		client:   c.s3Client(cfg),
+		lockFile: c.lockFile,
+		hooks: hooks{
+			pre:     c.preHook,
+			post:    c.postHook,
+			failure: c.failureHook,
+		},
+		opts: c.opts(),
+	}
+	j.opts.KMS = kmsClient(cfg)
+	if c.replicaBucket != "" {
+		j.opts.ReplicaClient = c.replicaS3Client(cfg)
+	}
+	if maxMemory > 0 {
+		j.opts.MaxMemory = int64(maxMemory) * 1e6
+	}
+	// With -json, stdout is reserved for the result, so the progress bar is
+	// drawn on stderr instead.
+	barOutput := os.Stdout
+	if jsonOutput {
+		j.output = os.Stdout
+		barOutput = os.Stderr
+	}
+	if isTerminal(barOutput) {
+		j.bar = &progressBar{w: barOutput}
+		j.opts.OnProgress = j.bar.render
+		j.opts.ProgressInterval = time.Second
+	} else if progressInterval > 0 {
+		j.opts.OnProgress = logProgress(ctx, logger)
+		j.opts.ProgressInterval = progressInterval
+	}
+	j.strictPrune = c.strictPrune
+	if c.healthcheckURL != "" {
+		j.check = healthcheck.New(c.healthcheckURL)
+	}
+	if c.tautulliURL != "" {
+		j.tautulli = tautulli.New(c.tautulliURL, c.tautulliAPIKey)
+		j.busyWait = c.busyWait
+	}
+	for _, url := range c.webhookURLs {
+		j.notifiers = append(j.notifiers, notify.NewWebhook(url))
+	}
+	if c.snsTopicARN != "" {
+		topic, err := arn.Parse(c.snsTopicARN)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -sns-topic-arn: %w", err)
+		}
+		// The topic need not be in the same region as the bucket.
+		client := sns.NewFromConfig(cfg, func(o *sns.Options) {
+			o.Region = topic.Region
+		})
+		j.notifiers = append(j.notifiers, notify.NewSNS(client, c.snsTopicARN))
+	}
+	if j.registry, err = c.registry(cfg); err != nil {
+		return nil, err
+	}
+	if c.smtpAddr != "" {
+		j.notifiers = append(j.notifiers, &notify.Email{
+			Addr:     c.smtpAddr,
+			Username: c.smtpUsername,
+			Password: c.smtpPassword,
+			From:     c.emailFrom,
+			To:       c.emailTo,
+			Always:   c.emailAlways,
+		})
+	}
+	return j, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// ErrNoLifecycle is returned by lifecycle apply if the rule would do nothing.
+var ErrNoLifecycle = errors.New("lifecycle apply requires -lifecycle-transition-days or -lifecycle-expire-days")
+
+// lifecycleApply creates or updates a lifecycle rule on the bucket of each job
+// transitioning and expiring objects under its prefix, as an alternative to
+// in-tool retention. Other rules on the bucket are preserved.
+func lifecycleApply(ctx context.Context, w io.Writer, configs []*jobConfig) error {
+	if lifecycleTransitionDays == 0 && lifecycleExpireDays == 0 {
+		return configError{ErrNoLifecycle}
+	}
+	for _, c := range configs {
+		cfg, err := c.awsConfig(ctx)
+		if err != nil {
+			return err
+		}
+		client := c.s3Client(cfg)
+		rules, err := lifecycleRules(ctx, client, c.bucket)
+		if err != nil {
+			return fmt.Errorf("failed to get lifecycle configuration of %v: %w", c.bucket, err)
+		}
+		rule := lifecycleRule(c.prefix)
+		if i := slices.IndexFunc(rules, func(r s3types.LifecycleRule) bool {
+			return aws.ToString(r.ID) == aws.ToString(rule.ID)
+		}); i >= 0 {
+			rules[i] = rule
+		} else {
+			rules = append(rules, rule)
+		}
+		if _, err := client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+			Bucket: &c.bucket,
+			LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{
+				Rules: rules,
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to put lifecycle configuration of %v: %w", c.bucket, err)
+		}
+		fmt.Fprintf(w, "applied lifecycle rule %v to s3://%v/%v\n", *rule.ID, c.bucket, c.prefix)
+	}
+	return nil
+}
+
+// lifecycleRules returns the existing lifecycle rules of bucket, which may be
+// empty.
+func lifecycleRules(ctx context.Context, client *s3.Client, bucket string) ([]s3types.LifecycleRule, error) {
+	output, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: &bucket,
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchLifecycleConfiguration" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return output.Rules, nil
+}
+
+// lifecycleRule builds the rule for prefix from the -lifecycle-* flags. Its ID
+// is derived from the prefix, so applying it again replaces it.
+func lifecycleRule(prefix string) s3types.LifecycleRule {
+	rule := s3types.LifecycleRule{
+		ID:     aws.String("plexbackup " + prefix),
+		Status: s3types.ExpirationStatusEnabled,
+		Filter: &s3types.LifecycleRuleFilter{
+			Prefix: &prefix,
+		},
+		// Parts of failed uploads are otherwise invisible, but billed.
+		AbortIncompleteMultipartUpload: &s3types.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int32(7),
+		},
+	}
+	if lifecycleTransitionDays > 0 {
+		rule.Transitions = []s3types.Transition{{
+			Days:         aws.Int32(int32(lifecycleTransitionDays)),
+			StorageClass: s3types.TransitionStorageClass(lifecycleTransitionClass),
+		}}
+	}
+	if lifecycleExpireDays > 0 {
+		rule.Expiration = &s3types.LifecycleExpiration{
+			Days: aws.Int32(int32(lifecycleExpireDays)),
+		}
+	}
+	return rule
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// list writes the backups of each job to w, oldest first, along with their size
+// including any parts, storage class, label and, if the catalog is enabled, the
+// version of Plex they were taken of.
+func list(ctx context.Context, w io.Writer, configs []*jobConfig, names []string) error {
+	var errs []error
+	for i, c := range configs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		label := "s3://" + c.bucket + "/" + c.prefix
+		if names[i] != "" {
+			label = names[i] + " (" + label + ")"
+		}
+		fmt.Fprintln(w, label)
+		if err := listJob(ctx, w, c); err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// listJob writes the backups of a single job.
+func listJob(ctx context.Context, w io.Writer, c *jobConfig) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := c.s3Client(cfg)
+	backups, err := backup.ListBackups(ctx, client, c.bucket, c.prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+	if len(backups) == 0 {
+		fmt.Fprintln(w, "no backups")
+		return nil
+	}
+	catalog := &backup.Catalog{}
+	if c.catalog {
+		if catalog, _, err = backup.ReadCatalog(ctx, client, c.bucket, c.prefix); err != nil {
+			return fmt.Errorf("failed to read catalog: %w", err)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "key\ttime\tsize\tclass\tplex\tlabel\t")
+	for _, object := range backups {
+		parts, err := backup.PartObjects(ctx, client, c.bucket, *object.Key)
+		if err != nil {
+			return fmt.Errorf("failed to list parts: %w", err)
+		}
+		size := uint64(0)
+		for _, o := range append(parts, object) {
+			if o.Size != nil {
+				size += uint64(*o.Size)
+			}
+		}
+		class := object.StorageClass
+		if class == "" {
+			class = s3types.ObjectStorageClassStandard
+		}
+		plex := "?"
+		if entry := catalog.Entry(*object.Key); entry != nil && entry.PlexVersion != "" {
+			plex = entry.PlexVersion
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t\n",
+			*object.Key,
+			object.LastModified.Local().Format(time.DateTime),
+			formatBytes(size),
+			class,
+			plex,
+			backup.KeyLabel(c.prefix, *object.Key))
+	}
+	return tw.Flush()
+}
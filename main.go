@@ -3,83 +3,585 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"syscall"
 
 	"github.com/gebn/plexbackup/backup"
+	"github.com/gebn/plexbackup/internal/pkg/journald"
+	"github.com/gebn/plexbackup/internal/pkg/schedule"
+	"github.com/gebn/plexbackup/internal/pkg/staging"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/gebn/go-stamp/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 var (
-	ErrNoBucket = errors.New("bucket name must be specified with -bucket")
+	ErrNoSchedule        = errors.New("daemon mode requires a -schedule")
+	ErrScheduleExhausted = errors.New("-schedule has no future occurrences")
+	ErrNoJobs            = errors.New("-job requires jobs to be defined in the -config file")
+)
 
-	version = flag.Bool("version", false, "display software version and exit")
-	isDebug = flag.Bool("debug", false, "enable debug logging in a human-readable format")
+// stagingRegistry records the temporary files created by this process, or is
+// nil if -staging-file is empty.
+var stagingRegistry *staging.Registry
 
-	bucket = flag.String("bucket", "", "name of the S3 bucket to upload the backup to")
-	region = flag.String("region", "us-east-1", "region of the -bucket")
-	prefix = flag.String("prefix", "plex/", `suffixed with "<RFC3339 date>.tar.zst" to form the upload key`)
+// Exit codes, allowing wrappers to distinguish failures needing attention, in
+// particular the service being left stopped. If several jobs fail, the code
+// of the most severe failure is used.
+const (
+	exitFailure   = 1  // any other failure
+	exitConfig    = 2  // invalid flags or config
+	exitStop      = 3  // failed to stop the service, so no backup was taken
+	exitArchive   = 4  // failed to archive or compress the backup
+	exitUpload    = 5  // failed to upload the backup
+	exitStart     = 6  // the backup finished, but the service failed to start
+	exitPrune     = 7  // the backup succeeded, but an old one was not deleted
+	exitReplicate = 8  // the backup succeeded, but was not copied to the replica bucket
+	exitBusy      = 9  // Plex was in use, so the backup was skipped
+	exitVerify    = 10 // the backup was uploaded, but could not be read back
 
-	noPause   = flag.Bool("no-pause", false, "suppresses stopping Plex while the backup is performed, risks an inconsistent backup")
-	service   = flag.String("service", "plexmediaserver.service", "name of the Plex systemd unit to stop, redundant if -no-pause used")
-	directory = flag.String("directory", "/var/lib/plexmediaserver/Library/Application Support/Plex Media Server", "path of the 'Plex Media Server' directory to back up")
+	// exitSkipUpdate replaces any other code if pre-upgrade -watchtower
+	// fails. Watchtower only skips the update if its pre-update hook exits
+	// with 75 (EX_TEMPFAIL); other failures are logged and the update goes
+	// ahead.
+	exitSkipUpdate = 75
 )
 
+// configError indicates the flags or config file are invalid.
+type configError struct {
+	error
+}
+
+func (e configError) Unwrap() error {
+	return e.error
+}
+
+// exitCode returns the process exit code for an error returned by app.
+func exitCode(err error) int {
+	if errors.As(err, new(configError)) {
+		return exitConfig
+	}
+	var checkErr checkError
+	if errors.As(err, &checkErr) {
+		return checkErr.code
+	}
+	// Ordered by severity, as a joined error may match several.
+	switch {
+	case errors.Is(err, backup.ErrStart):
+		return exitStart
+	case errors.Is(err, backup.ErrStop):
+		return exitStop
+	case errors.Is(err, backup.ErrUpload):
+		return exitUpload
+	case errors.Is(err, backup.ErrArchive):
+		return exitArchive
+	case errors.Is(err, backup.ErrVerify):
+		return exitVerify
+	case errors.Is(err, backup.ErrReplicate):
+		return exitReplicate
+	case errors.Is(err, backup.ErrPrune):
+		return exitPrune
+	case errors.Is(err, ErrBusy):
+		return exitBusy
+	default:
+		return exitFailure
+	}
+}
+
 func main() {
 	if err := app(context.Background()); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		if preUpgradeWatchtower {
+			os.Exit(exitSkipUpdate)
+		}
+		os.Exit(exitCode(err))
 	}
 }
 
 func app(ctx context.Context) error {
-	flag.Parse()
+	name, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == completeCommand {
+		complete(ctx, os.Stdout, args)
+		return nil
+	}
+	if name == "help" && len(args) > 0 {
+		if cmd := lookupCommand(args[0]); cmd != nil {
+			cmd.printUsage()
+			return nil
+		}
+	}
+	// Without a command, -help describes them all rather than backup.
+	if name == "help" || name == "" && len(args) > 0 && slices.Contains([]string{"-h", "-help", "--help"}, args[0]) {
+		printUsage()
+		return nil
+	}
+	cmd := lookupCommand(name)
+	if cmd == nil {
+		return configError{fmt.Errorf("unknown command %q; run %v -help for a list", name, os.Args[0])}
+	}
+	command := cmd.name
+	if subcommand, ok := subcommands[command]; ok {
+		if len(args) == 0 || args[0] != subcommand {
+			return configError{fmt.Errorf("%v requires the %q subcommand", command, subcommand)}
+		}
+		args = args[1:]
+	}
+	fs := cmd.fs
+	fs.Parse(args)
+	isDaemon := command == "daemon"
 
-	if *version {
-		fmt.Println(stamp.Summary())
+	if showVersion || command == "version" {
+		if jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(build)
+		}
+		fmt.Println(build)
 		return nil
 	}
+	if command == "history" {
+		return printHistory(os.Stdout, historyFile, jsonOutput)
+	}
+	if command == "completion" {
+		if fs.NArg() != 1 {
+			return configError{errors.New("completion requires the shell: bash, zsh or fish")}
+		}
+		return writeCompletion(os.Stdout, fs.Arg(0))
+	}
+	if command == "init" {
+		// -config is the file to write, rather than read.
+		return setup(ctx, os.Stdout, fs, explicitFlags(fs))
+	}
+
+	if command == "pre-upgrade" && preUpgradeApt {
+		// The hook runs before every install, so must not fail, or even
+		// load the config, unless Plex is being upgraded.
+		queued, err := plexQueued(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read packages from stdin: %w", err)
+		}
+		if !queued {
+			return nil
+		}
+	}
+
+	cmdline := explicitFlags(fs)
+	configs, names, err := resolveJobs(fs, cmdline)
+	if err != nil {
+		return configError{err}
+	}
+	if command == "seed" {
+		if len(configs) != 1 {
+			return configError{errors.New("seed takes the backup of a single job; select one with -job")}
+		}
+		if seedDir == "" {
+			return configError{errors.New("-seed-dir must be specified")}
+		}
+		if err := os.MkdirAll(seedDir, 0o700); err != nil {
+			return configError{fmt.Errorf("failed to create -seed-dir: %w", err)}
+		}
+	}
+	for i, c := range configs {
+		var err error
+		switch command {
+		case "check", "cost", "stats", "list", "prune", "migrate-prefix", "rekey", "restore", "verify", "diff", "lifecycle", "catalog", "retention", "iam-policy":
+			// May run elsewhere, without the data or service.
+			if c.bucket == "" {
+				err = ErrNoBucket
+			} else if command == "rekey" && len(c.kmsKeyIDs) == 0 {
+				err = ErrNoKMSKey
+			} else if command == "prune" && !c.prune {
+				err = errors.New("backups are not pruned with -prune=false")
+			} else {
+				err = c.retention().Validate()
+			}
+		default:
+			if err = c.detectService(ctx); err == nil {
+				if command == "agent" {
+					err = c.validateAgent()
+				} else {
+					err = c.validate()
+				}
+			}
+		}
+		if err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			return configError{err}
+		}
+	}
+	if command == "restore" {
+		if len(configs) != 1 {
+			return configError{errors.New("restore restores the backup of a single job; select one with -job")}
+		}
+		if restoreInteractive && !isTerminal(os.Stdin) {
+			return configError{ErrNotTerminal}
+		}
+		if restoreDir == "" && !restoreDiff && !restoreInteractive {
+			return configError{ErrNoRestoreDir}
+		}
+		if downloadConcurrency < 1 || downloadPartSize < 1 {
+			return configError{errors.New("-download-concurrency and -download-part-size must be positive")}
+		}
+	}
+	if command == "diff" {
+		if len(configs) != 1 {
+			return configError{errors.New("diff compares the backups of a single job; select one with -job")}
+		}
+		if fs.NArg() != 2 {
+			return configError{errors.New("diff requires the keys of two backups")}
+		}
+	}
+	if command == "repair-db" && len(configs) != 1 {
+		return configError{errors.New("repair-db repairs the databases of a single job; select one with -job")}
+	}
+	if command == "migrate-prefix" {
+		if len(configs) != 1 {
+			return configError{errors.New("migrate-prefix moves the backups of a single job; select one with -job")}
+		}
+		if !cmdline["from"] {
+			return configError{ErrNoMigrateFrom}
+		}
+	}
+	if command == "verify" && restoreKey != "" && len(configs) != 1 {
+		return configError{errors.New("-key identifies the backup of a single job; select one with -job")}
+	}
+	if command == "agent" {
+		if len(configs) != 1 {
+			return configError{errors.New("agent mode serves a single job; select one with -job")}
+		}
+		if listenAddr == "" {
+			return configError{ErrNoAgentAddr}
+		}
+		if configs[0].reflink {
+			return configError{errors.New("-reflink is not supported in agent mode")}
+		}
+		if (agentTLSCert == "") != (agentTLSKey == "") {
+			return configError{errors.New("-agent-tls-cert and -agent-tls-key must be specified together")}
+		}
+	}
+	var sched schedule.Schedule
+	if isDaemon {
+		if scheduleSpec == "" {
+			return configError{ErrNoSchedule}
+		}
+		if sched, err = schedule.Parse(scheduleSpec); err != nil {
+			return configError{fmt.Errorf("invalid -schedule: %w", err)}
+		}
+		if breakerFailures < 0 || breakerMaxSkip < 1 {
+			return configError{errors.New("-breaker-failures must not be negative, and -breaker-max-skip must be at least 1")}
+		}
+		if historySize < 0 {
+			return configError{errors.New("-history-size must not be negative")}
+		}
+	}
+
+	logger, err := buildLogger()
+	if err != nil {
+		return configError{err}
+	}
+
+	if stagingFile != "" {
+		stagingRegistry = staging.New(stagingFile)
+		defer stagingRegistry.Close()
+		cleanStaging(ctx, logger)
+	}
+
+	if command == "install-unit" {
+		return installUnit(os.Stdout, fs, cmdline, configs)
+	}
+	if command == "check" {
+		return check(ctx, os.Stdout, configs, names)
+	}
+	if command == "cost" {
+		return cost(ctx, os.Stdout, configs, names)
+	}
+	if command == "stats" {
+		return stats(ctx, os.Stdout, configs, names)
+	}
+	if command == "list" {
+		return list(ctx, os.Stdout, configs, names)
+	}
+	if command == "prune" {
+		return prune(ctx, os.Stdout, configs, names)
+	}
+	if command == "rekey" {
+		return rekey(ctx, os.Stdout, configs, names)
+	}
+	if command == "migrate-prefix" {
+		return migratePrefix(ctx, os.Stdout, configs[0])
+	}
+	if command == "restore" {
+		return restoreBackup(ctx, logger, os.Stdout, configs[0])
+	}
+	if command == "verify" {
+		return verifyBackups(ctx, logger, os.Stdout, configs, names)
+	}
+	if command == "diff" {
+		return diffBackups(ctx, os.Stdout, configs[0], fs.Arg(0), fs.Arg(1))
+	}
+	if command == "repair-db" {
+		return repairDatabases(ctx, logger, os.Stdout, configs[0])
+	}
+	if command == "lifecycle" {
+		return lifecycleApply(ctx, os.Stdout, configs)
+	}
+	if command == "catalog" {
+		return catalogRebuild(ctx, os.Stdout, configs, names)
+	}
+	if command == "retention" {
+		return retentionSimulate(ctx, os.Stdout, configs, names)
+	}
+	if command == "iam-policy" {
+		return printIAMPolicy(os.Stdout, configs)
+	}
+
+	logger.DebugContext(ctx, "launching", slog.String("version", build.Version))
+
+	if maxProcs > 0 {
+		// zstd uses one goroutine per CPU by default.
+		runtime.GOMAXPROCS(maxProcs)
+	}
+	if maxMemory > 0 {
+		// Makes the GC more aggressive as the limit is approached, rather
+		// than letting the heap double.
+		debug.SetMemoryLimit(int64(maxMemory) * 1e6)
+	}
+
+	if tracing {
+		shutdown, err := setupTracing(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to initialise tracing: %w", err)
+		}
+		defer func() {
+			// Spans are exported in batches, so we must flush before exiting.
+			if shutdownErr := shutdown(context.Background()); shutdownErr != nil {
+				logger.WarnContext(ctx, "failed to flush traces",
+					slog.String("error", shutdownErr.Error()))
+			}
+		}()
+	}
+
+	s, err := newSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	for i, c := range configs {
+		if err := c.resolveSecrets(ctx, s); err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			return err
+		}
+	}
+	if runToken, err = s.resolve(ctx, runToken, configs[0].region); err != nil {
+		return fmt.Errorf("failed to fetch -run-token: %w", err)
+	}
+
+	// Cancelling the context aborts the backup, and Run starts Plex again
+	// before returning, so we must not exit immediately on these signals.
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if command == "agent" {
+		return serveAgent(ctx, logger, listenAddr, configs[0])
+	}
+
+	jobs := make([]*job, len(configs))
+	for i, c := range configs {
+		if jobs[i], err = c.build(ctx, logger, names[i]); err != nil {
+			return configError{err}
+		}
+	}
+	if isDaemon {
+		return daemon(ctx, logger, jobs, sched)
+	}
+	if command == "pre-upgrade" {
+		for _, j := range jobs {
+			j.opts.Label = preUpgradeLabel(ctx, j.logger, j.opts)
+		}
+	}
+	return runJobs(ctx, jobs)
+}
+
+// resolveJobs applies the -config file, if any, to the command's flags in fs,
+// and returns the config of each job to run along with its name. If the file
+// does not define named jobs, the command line flags form a single job with an
+// empty name.
+func resolveJobs(fs *flag.FlagSet, cmdline map[string]bool) ([]*jobConfig, []string, error) {
+	if configFile == "" {
+		if len(jobNames) > 0 {
+			return nil, nil, ErrNoJobs
+		}
+		return []*jobConfig{defaultJob}, []string{""}, nil
+	}
+
+	file, err := loadConfig(configFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load -config: %w", err)
+	}
+	// The file may be shared by several commands, so may set flags this one
+	// does not have.
+	values := map[string]any{}
+	for name, value := range file.values {
+		if fs.Lookup(name) != nil || !isCommandFlag(name) {
+			values[name] = value
+		}
+	}
+	if err := setFlags(fs, values, cmdline); err != nil {
+		return nil, nil, fmt.Errorf("failed to load -config: %w", err)
+	}
+	if len(file.jobs) == 0 {
+		if len(jobNames) > 0 {
+			return nil, nil, ErrNoJobs
+		}
+		return []*jobConfig{defaultJob}, []string{""}, nil
+	}
 
-	if *bucket == "" {
-		return ErrNoBucket
+	names := []string(jobNames)
+	if len(names) == 0 {
+		names = file.jobNames()
+	}
+	configs := make([]*jobConfig, len(names))
+	for i, name := range names {
+		if configs[i], err = file.resolveJob(fs, name, cmdline); err != nil {
+			return nil, nil, err
+		}
 	}
+	return configs, names, nil
+}
 
-	logger := buildLogger(*isDebug)
-	logger.DebugContext(ctx, "launching", slog.String("version", stamp.Version))
+// runJobs runs each job once in turn. A failed job does not prevent later jobs
+// from running. Failure to replicate the backup or delete an old one is
+// returned alongside errors, so it is reflected in the exit code.
+func runJobs(ctx context.Context, jobs []*job) error {
+	var errs []error
+	for _, j := range jobs {
+		if ctx.Err() != nil {
+			// Interrupted; leave later jobs for next time.
+			break
+		}
+		result, err := j.run(ctx)
+		if err == nil {
+			err = errors.Join(result.ReplicaErr, result.PruneErr)
+		}
+		if err != nil {
+			if j.name != "" {
+				err = fmt.Errorf("job %v: %w", j.name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithRegion(*region),
-		config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+// defaultStagingFile returns the default -staging-file, in the user's cache
+// directory, or the empty string if it cannot be determined.
+func defaultStagingFile() string {
+	dir, err := os.UserCacheDir()
 	if err != nil {
-		return fmt.Errorf("failed to initialise AWS SDK: %w", err)
+		return ""
 	}
+	return filepath.Join(dir, "plexbackup", "staging.json")
+}
 
-	s3client := s3.NewFromConfig(cfg)
-	return backup.Run(ctx, logger, s3client, &backup.Opts{
-		NoPause:   *noPause,
-		Service:   *service,
-		Directory: *directory,
-		Bucket:    *bucket,
-		Prefix:    *prefix,
-	})
+// cleanStaging removes the temporary files left by runs that crashed or were
+// killed. Failure is not fatal, as the files are only taking up space.
+func cleanStaging(ctx context.Context, logger *slog.Logger) {
+	removed, err := stagingRegistry.Clean()
+	for _, path := range removed {
+		logger.InfoContext(ctx, "removed stale staging file",
+			slog.String("path", path))
+	}
+	if err != nil {
+		logger.WarnContext(ctx, "failed to remove stale staging files",
+			slog.String("error", err.Error()))
+	}
 }
 
-// buildLogger creates a suitable logger for the provided mode. If debugging is
-// disabled, which is the usual case, the logger is configured for production:
-// JSON format at info level. If debugging is enabled, we optimise for
-// human-readable logs, using logfmt at debug level.
-func buildLogger(isDebug bool) *slog.Logger {
+// buildLogger creates a logger as configured by the logging flags. By default,
+// the logger is configured for production: JSON format at info level, or the
+// journal's native protocol if running under systemd. -debug
+// optimises for human-readable logs, using logfmt at debug level, and -quiet
+// suppresses everything but errors, e.g. so cron only sends mail on failure.
+// -log-level and -log-format take precedence over both.
+func buildLogger() (*slog.Logger, error) {
+	level, format := slog.LevelInfo, "json"
+	if journald.Connected() {
+		format = "journal"
+	}
 	if isDebug {
-		return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-			Level: slog.LevelDebug,
-		}))
+		level, format = slog.LevelDebug, "text"
+	}
+	if isQuiet {
+		level = slog.LevelError
+	}
+	if logLevel != "" {
+		if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+			return nil, fmt.Errorf("invalid -log-level: %w", err)
+		}
+	}
+	if logFormat != "" {
+		format = logFormat
+	}
+
+	opts := &slog.HandlerOptions{
+		Level: level,
+	}
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "journal":
+		handler, err := journald.NewHandler(opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to journal: %w", err)
+		}
+		return slog.New(handler), nil
+	default:
+		return nil, fmt.Errorf("invalid -log-format %q, must be json, text or journal", format)
+	}
+}
+
+// setupTracing registers a global TracerProvider that exports spans via
+// OTLP/HTTP. The exporter's endpoint, headers etc. are taken from the standard
+// OTEL_EXPORTER_OTLP_* environment variables. The returned function must be
+// called before the program exits to flush any buffered spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			semconv.ServiceName("plexbackup"),
+			semconv.ServiceVersion(build.Version)))
+	if err != nil {
+		return nil, err
 	}
-	return slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+var ErrNoMigrateFrom = errors.New("migrate-prefix requires -from")
+
+// migratePrefix moves the backups of the job described by c from -from to -to,
+// which defaults to the job's -prefix, in its bucket and any replica bucket,
+// writing each new key to w.
+func migratePrefix(ctx context.Context, w io.Writer, c *jobConfig) error {
+	to := migrateTo
+	if to == "" {
+		to = c.prefix
+	}
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := c.s3Client(cfg)
+	moved, err := backup.MigratePrefix(ctx, client, c.bucket, migrateFrom, to)
+	for _, key := range moved {
+		fmt.Fprintf(w, "moved s3://%v/%v\n", c.bucket, key)
+	}
+	if err != nil || c.replicaBucket == "" {
+		return err
+	}
+
+	replicaClient := c.replicaS3Client(cfg)
+	moved, err = backup.MigratePrefix(ctx, replicaClient, c.replicaBucket, migrateFrom, to)
+	for _, key := range moved {
+		fmt.Fprintf(w, "moved s3://%v/%v\n", c.replicaBucket, key)
+	}
+	if err != nil {
+		return fmt.Errorf("replica: %w", err)
+	}
+	return nil
+}
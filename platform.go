@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"slices"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// platform describes how Plex is installed on a NAS operating system, where
+// it is not managed by systemd.
+type platform struct {
+
+	// directory is the default -directory.
+	directory string
+
+	// service is the default -service, passed to stop and start.
+	service string
+
+	// stop and start return the commands to stop and start the service.
+	stop, start func(service string) []string
+
+	// excludes are the default -exclude patterns.
+	excludes []string
+
+	// marker is a file only present on the platform, used to detect it.
+	marker string
+}
+
+// platforms are the values accepted by -platform.
+var platforms = map[string]platform{
+	// Plex runs in a Docker container, usually the linuxserver.io image, with
+	// its /config volume in appdata. User scripts run as root.
+	"unraid": {
+		directory: "/mnt/user/appdata/plex/Library/Application Support/Plex Media Server",
+		service:   "plex",
+		stop: func(service string) []string {
+			return []string{"docker", "stop", service}
+		},
+		start: func(service string) []string {
+			return []string{"docker", "start", service}
+		},
+		// Codecs are downloaded again on demand.
+		excludes: append(slices.Clone(backup.PlexExcludes), "Codecs"),
+		marker:   "/etc/unraid-version",
+	},
+	// Plex is installed as a QPKG on the first storage pool.
+	"qnap": {
+		directory: "/share/CACHEDEV1_DATA/.qpkg/PlexMediaServer/Library/Plex Media Server",
+		service:   "PlexMediaServer",
+		stop: func(service string) []string {
+			return []string{"/sbin/qpkg_service", "stop", service}
+		},
+		start: func(service string) []string {
+			return []string{"/sbin/qpkg_service", "start", service}
+		},
+		excludes: append(slices.Clone(backup.PlexExcludes), "Codecs"),
+		marker:   "/etc/config/qpkg.conf",
+	},
+}
+
+// detectPlatform returns the name of the platform this host runs, or the empty
+// string if it is none of them, e.g. a Linux distribution using systemd.
+func detectPlatform() string {
+	for name, p := range platforms {
+		if _, err := os.Stat(p.marker); err == nil {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// plexPackage is the name of the Plex Media Server package, in both the deb
+// and rpm repositories.
+const plexPackage = "plexmediaserver"
+
+// plexQueued returns whether the Plex package is among those listed in r, one
+// per line, as provided by apt's DPkg::Pre-Install-Pkgs hook: usually the path
+// of each .deb, e.g.
+// /var/cache/apt/archives/plexmediaserver_1.40.2.8395-c67dce28e_amd64.deb.
+func plexQueued(r io.Reader) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name := filepath.Base(strings.TrimSpace(scanner.Text()))
+		if name == plexPackage || strings.HasPrefix(name, plexPackage+"_") {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// preUpgradeLabel returns the label of a backup taken before upgrading Plex:
+// -label if set, otherwise "pre-upgrade-" followed by the version of Plex
+// being replaced, if it can be detected, so the restore point for each
+// version is obvious from the key.
+func preUpgradeLabel(ctx context.Context, logger *slog.Logger, o *backup.Opts) string {
+	if backupLabel != "" {
+		return backupLabel
+	}
+	label := "pre-upgrade"
+	if o.PlexURL == "" {
+		return label
+	}
+	var runner backup.Runner = backup.ExecRunner{}
+	if o.Runner != nil {
+		runner = o.Runner
+	}
+	version, err := backup.PlexVersion(ctx, runner, o.PlexURL)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to detect Plex version for the label",
+			slog.String("error", err.Error()))
+		return label
+	}
+	// Versions are of the form 1.40.2.8395-c67dce28e, but are replaced
+	// rather than trusted.
+	label += "-" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' {
+			return r
+		}
+		return '-'
+	}, version)
+	if err := backup.ValidLabel(label); err != nil {
+		return "pre-upgrade"
+	}
+	return label
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// isTerminal returns whether f is a character device, e.g. an interactive
+// terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// logProgress returns a progress callback that logs each snapshot at info
+// level.
+func logProgress(ctx context.Context, logger *slog.Logger) func(backup.Progress) {
+	return func(p backup.Progress) {
+		attrs := []slog.Attr{
+			slog.Uint64("archived_bytes", p.ArchivedBytes),
+			slog.Uint64("uploaded_bytes", p.UploadedBytes),
+			slog.Float64("throughput_bytes_per_second", p.Throughput()),
+			slog.Duration("elapsed", p.Elapsed),
+		}
+		if p.EstimatedBytes > 0 {
+			attrs = append(attrs,
+				slog.Uint64("estimated_bytes", p.EstimatedBytes),
+				slog.Duration("eta", p.ETA()))
+		}
+		logger.LogAttrs(ctx, slog.LevelInfo, "backup in progress", attrs...)
+	}
+}
+
+// progressBar renders progress snapshots as a single continuously-updated
+// line on a terminal.
+type progressBar struct {
+	mu    sync.Mutex
+	w     io.Writer
+	drawn bool
+}
+
+const progressBarWidth = 30
+
+// render redraws the bar to reflect p.
+func (b *progressBar) render(p backup.Progress) {
+	var bar, percent string
+	if fraction := p.Fraction(); fraction >= 0 {
+		filled := int(fraction * progressBarWidth)
+		bar = strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+		percent = fmt.Sprintf("%3.0f%%", fraction*100)
+	} else {
+		// No estimate yet; show an indeterminate bar.
+		bar = strings.Repeat("?", progressBarWidth)
+		percent = "  ?%"
+	}
+	line := fmt.Sprintf("[%v] %v  %v archived  %v uploaded  %v/s",
+		bar, percent,
+		formatBytes(p.ArchivedBytes),
+		formatBytes(p.UploadedBytes),
+		formatBytes(uint64(p.Throughput())))
+	if eta := p.ETA(); eta > 0 {
+		line += "  ETA " + eta.Round(time.Second).String()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Clear to the end of the line in case the previous render was longer.
+	fmt.Fprintf(b.w, "\r%v\033[K", line)
+	b.drawn = true
+}
+
+// finish moves the cursor past the bar, so subsequent output starts on a new
+// line.
+func (b *progressBar) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.drawn {
+		fmt.Fprintln(b.w)
+		b.drawn = false
+	}
+}
+
+// formatBytes renders n using binary prefixes, e.g. "1.5 GiB".
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// prune deletes the backups of each job that the retention policy would, e.g.
+// after a run failed to delete the oldest, writing each key to w. With
+// -dry-run, the backups are listed along with why they would be deleted, but
+// are left in place.
+func prune(ctx context.Context, w io.Writer, configs []*jobConfig, names []string) error {
+	var errs []error
+	for i, c := range configs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		label := "s3://" + c.bucket + "/" + c.prefix
+		if names[i] != "" {
+			label = names[i] + " (" + label + ")"
+		}
+		fmt.Fprintf(w, "%v: %v\n", label, c.retention())
+		if err := pruneJob(ctx, w, c); err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pruneJob prunes the backups of a single job.
+func pruneJob(ctx context.Context, w io.Writer, c *jobConfig) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := c.s3Client(cfg)
+	candidates, err := backup.PrunePlan(ctx, client, c.bucket, c.prefix, c.retention())
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+	if len(candidates) == 0 {
+		fmt.Fprintln(w, "nothing to prune")
+		return nil
+	}
+
+	if dryRun {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "key\tindex\tage\tsize\treason\t")
+		for _, candidate := range candidates {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t\n", candidate.Key, candidate.Index,
+				time.Since(candidate.LastModified).Round(time.Minute),
+				formatBytes(candidate.Bytes), candidate.Reason)
+		}
+		return tw.Flush()
+	}
+
+	replicaClient := c.replicaS3Client(cfg)
+	var errs []error
+	var pruned []string
+	for _, candidate := range candidates {
+		if err := backup.Prune(ctx, client, c.bucket, candidate.Key); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Fprintf(w, "deleted %v (%v)\n", candidate.Key, candidate.Reason)
+		pruned = append(pruned, candidate.Key)
+		if c.replicaBucket != "" {
+			if err := backup.Prune(ctx, replicaClient, c.replicaBucket, candidate.Key); err != nil {
+				errs = append(errs, fmt.Errorf("replica: %w", err))
+			}
+		}
+	}
+	if c.catalog && len(pruned) > 0 {
+		err := backup.UpdateCatalog(ctx, client, c.bucket, c.prefix, func(catalog *backup.Catalog) {
+			for _, key := range pruned {
+				if entry := catalog.Entry(key); entry != nil {
+					entry.Status = backup.CatalogPruned
+				}
+			}
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update catalog: %w", err))
+		}
+	}
+	if len(pruned) > 0 {
+		table, err := c.registry(cfg)
+		if err == nil && table != nil {
+			err = table.Pruned(ctx, c.bucket, pruned)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update registry: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+var ErrNoKMSKey = errors.New("rekey requires -kms-key-id")
+
+// rekey rewraps the data keys of each job's encrypted backups with its
+// -kms-key-id values, in its bucket and any replica bucket, writing each key to
+// w.
+func rekey(ctx context.Context, w io.Writer, configs []*jobConfig, names []string) error {
+	var errs []error
+	for i, c := range configs {
+		if err := rekeyJob(ctx, w, c); err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rekeyJob rewraps the data keys of a single job's backups.
+func rekeyJob(ctx context.Context, w io.Writer, c *jobConfig) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := c.s3Client(cfg)
+	keyClient := kmsClient(cfg)
+	results, err := backup.Rekey(ctx, client, keyClient, c.bucket, c.prefix, c.kmsKeyIDs)
+	writeRekeyed(w, c.bucket, results)
+	if err != nil || c.replicaBucket == "" {
+		return err
+	}
+
+	replicaClient := c.replicaS3Client(cfg)
+	results, err = backup.Rekey(ctx, replicaClient, keyClient, c.replicaBucket, c.prefix, c.kmsKeyIDs)
+	writeRekeyed(w, c.replicaBucket, results)
+	if err != nil {
+		return fmt.Errorf("replica: %w", err)
+	}
+	return nil
+}
+
+// writeRekeyed writes a line for each backup in bucket processed by Rekey to w.
+func writeRekeyed(w io.Writer, bucket string, results []*backup.RekeyResult) {
+	for _, result := range results {
+		if result.Encrypted {
+			fmt.Fprintf(w, "rekeyed s3://%v/%v\n", bucket, result.Key)
+		} else {
+			fmt.Fprintf(w, "skipped s3://%v/%v: not encrypted\n", bucket, result.Key)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gebn/plexbackup/backup"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/sync/errgroup"
+)
+
+var ErrNoRestoreDir = errors.New("restore requires -restore-dir")
+
+// restoreBackup extracts the backup of the job described by c at -key, or the
+// newest, into -restore-dir, then changes its ownership if -fix-ownership is
+// set. With -diff, the changes restoring it in place would make are written to
+// w instead. With -interactive, the backup and directory are chosen and
+// confirmed on the terminal first.
+func restoreBackup(ctx context.Context, logger *slog.Logger, w io.Writer, c *jobConfig) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := c.s3Client(cfg)
+	if restoreInteractive {
+		p := &prompter{
+			in:  bufio.NewReader(os.Stdin),
+			out: w,
+		}
+		if err := chooseBackup(ctx, p, client, kmsClient(cfg), c); err != nil {
+			return err
+		}
+	}
+	key, digest, err := resolveKey(ctx, client, c)
+	if err != nil {
+		return err
+	}
+	if restoreDiff {
+		return diffLive(ctx, w, client, kmsClient(cfg), c, key)
+	}
+
+	// Resolved first, so a misconfiguration is found before downloading.
+	owner := restoreOwner
+	if fixOwnership && owner == "" {
+		if err := c.detectService(ctx); err != nil {
+			return fmt.Errorf("%w, or specify -restore-owner", err)
+		}
+		if len(c.services) == 0 {
+			return errors.New("no -service to detect the owner from; specify -restore-owner")
+		}
+		if owner, err = backup.ServiceOwner(ctx, backup.ExecRunner{}, c.services[0]); err != nil {
+			return fmt.Errorf("%w; specify -restore-owner", err)
+		}
+	}
+
+	logger.InfoContext(ctx, "restoring backup",
+		slog.String("key", key),
+		slog.String("dir", restoreDir))
+	download := backup.DownloadOpts{
+		Concurrency: downloadConcurrency,
+		PartSize:    int64(downloadPartSize) * 1e6,
+		Stream:      downloadStream,
+		SpaceMargin: c.spaceMargin,
+		Staging:     stagingRegistry,
+	}
+	if err := backup.Restore(ctx, client, kmsClient(cfg), c.bucket, key, digest, restoreDir, download); err != nil {
+		if errors.Is(err, backup.ErrNoSpace) {
+			return fmt.Errorf("%w; -stream extracts the backup without saving it first", err)
+		}
+		return err
+	}
+	if fixOwnership {
+		logger.InfoContext(ctx, "changing owner", slog.String("owner", owner))
+		if err := backup.FixOwnership(ctx, backup.ExecRunner{}, restoreDir, owner); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "restored s3://%v/%v to %v\n", c.bucket, key, restoreDir)
+	return nil
+}
+
+// resolveKey returns -key, or the key of the job's newest backup if it is not
+// set, along with its SHA-256 digest if recorded in the catalog.
+func resolveKey(ctx context.Context, client *s3.Client, c *jobConfig) (string, string, error) {
+	key := restoreKey
+	if key == "" {
+		newest, err := backup.NewestObject(ctx, client, c.bucket, c.prefix)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to list backups: %w", err)
+		}
+		if newest == nil {
+			return "", "", fmt.Errorf("no backups found under s3://%v/%v", c.bucket, c.prefix)
+		}
+		key = *newest.Key
+	}
+	if !c.catalog {
+		return key, "", nil
+	}
+	catalog, _, err := backup.ReadCatalog(ctx, client, c.bucket, c.prefix)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read catalog: %w", err)
+	}
+	if entry := catalog.Entry(key); entry != nil {
+		return key, entry.SHA256, nil
+	}
+	return key, "", nil
+}
+
+// diffLive writes the changes restoring the backup at key over the job's
+// directories would make to w, followed by a count of each kind.
+func diffLive(ctx context.Context, w io.Writer, client *s3.Client, keys backup.KMSAPI, c *jobConfig, key string) error {
+	backupManifest, err := backup.ReadManifest(ctx, client, keys, c.bucket, key)
+	if err != nil {
+		return err
+	}
+	liveManifest, err := c.opts().LiveManifest()
+	if err != nil {
+		return fmt.Errorf("failed to read live files: %w", err)
+	}
+	fmt.Fprintf(w, "restoring s3://%v/%v would change:\n", c.bucket, key)
+	writeChanges(w, backup.DiffManifests(liveManifest, backupManifest))
+	return nil
+}
+
+// diffBackups writes the files added, removed and modified between the job's
+// backups at from and to, which may be bare names under the job's prefix, to w,
+// followed by a count of each kind. The backups are downloaded concurrently.
+func diffBackups(ctx context.Context, w io.Writer, c *jobConfig, from, to string) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := c.s3Client(cfg)
+	keyClient := kmsClient(cfg)
+	keys := []string{from, to}
+	manifests := make([][]*backup.ManifestEntry, len(keys))
+	group, groupCtx := errgroup.WithContext(ctx)
+	for i := range keys {
+		// A bare name, e.g. "2024-01-02T03:30:00Z.tar.zst".
+		if !strings.HasPrefix(keys[i], c.prefix) && !strings.Contains(keys[i], "/") {
+			keys[i] = c.prefix + keys[i]
+		}
+		group.Go(func() error {
+			manifest, err := backup.ReadManifest(groupCtx, client, keyClient, c.bucket, keys[i])
+			if err != nil {
+				return fmt.Errorf("failed to read %v: %w", keys[i], err)
+			}
+			manifests[i] = manifest
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "from s3://%v/%v to s3://%v/%v:\n", c.bucket, keys[0], c.bucket, keys[1])
+	writeChanges(w, backup.DiffManifests(manifests[0], manifests[1]))
+	return nil
+}
+
+// writeChanges writes a line for each change to w, prefixed by a letter
+// indicating its kind, followed by a count of each kind.
+func writeChanges(w io.Writer, changes []*backup.Change) {
+	counts := map[string]int{}
+	for _, change := range changes {
+		counts[change.Kind]++
+		fmt.Fprintf(w, "%v %v\n", strings.ToUpper(change.Kind[:1]), change.Path)
+	}
+	fmt.Fprintf(w, "%v added, %v removed, %v modified\n",
+		counts[backup.ChangeAdded], counts[backup.ChangeRemoved], counts[backup.ChangeModified])
+}
+
+// repairDatabases replaces the library databases of the job described by c with
+// those in the backup at -key, or the newest, writing each restored file to w.
+func repairDatabases(ctx context.Context, logger *slog.Logger, w io.Writer, c *jobConfig) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := c.s3Client(cfg)
+	key, digest, err := resolveKey(ctx, client, c)
+	if err != nil {
+		return err
+	}
+	o := c.opts()
+	o.KMS = kmsClient(cfg)
+	restored, err := o.RepairDatabases(ctx, logger, client, key, digest)
+	for _, name := range restored {
+		fmt.Fprintf(w, "restored %v from s3://%v/%v\n", name, c.bucket, key)
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// retentionSimulate writes the fate of each job's backups over the next
+// -days under its retention policy to w, assuming a backup is taken each day,
+// so a policy can be tried before it deletes anything.
+func retentionSimulate(ctx context.Context, w io.Writer, configs []*jobConfig, names []string) error {
+	if retentionDays < 1 {
+		return configError{errors.New("-days must be at least 1")}
+	}
+	var errs []error
+	for i, c := range configs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		label := "s3://" + c.bucket + "/" + c.prefix
+		if names[i] != "" {
+			label = names[i] + " (" + label + ")"
+		}
+		fmt.Fprintf(w, "%v: %v\n", label, c.retention())
+		if err := retentionSimulateJob(ctx, w, c); err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// retentionSimulateJob simulates the retention policy of a single job.
+func retentionSimulateJob(ctx context.Context, w io.Writer, c *jobConfig) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	objects, err := backup.ListBackups(ctx, c.s3Client(cfg), c.bucket, c.prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+	existing := backup.RetainedBackups(c.prefix, objects)
+	slices.SortFunc(existing, func(a, b *backup.RetainedBackup) int {
+		return a.Time.Compare(b.Time)
+	})
+
+	// Each simulated backup is the size of the newest, taken at the same
+	// time each day as now.
+	var size uint64
+	if len(existing) > 0 {
+		size = existing[len(existing)-1].Bytes
+	}
+	policy := c.retention()
+	now := time.Now().UTC().Truncate(time.Second)
+	backups := slices.Clone(existing)
+	pruned := map[*backup.RetainedBackup]time.Time{}
+	for day := 1; day <= retentionDays; day++ {
+		t := now.AddDate(0, 0, day)
+		// As in a run, the default policy only deletes the backup that
+		// was oldest before the new one was taken.
+		var oldest *backup.RetainedBackup
+		if policy.IsZero() && len(backups) > 0 {
+			oldest = backups[0]
+		}
+		backups = append(backups, &backup.RetainedBackup{
+			Key:   c.prefix + t.Format(time.RFC3339) + ".tar.zst",
+			Time:  t,
+			Bytes: size,
+		})
+		policy.Apply(backups)
+		backups = slices.DeleteFunc(backups, func(b *backup.RetainedBackup) bool {
+			deleted := !b.Keep && (oldest == nil || b == oldest)
+			if deleted {
+				pruned[b] = t
+			}
+			return deleted
+		})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "key\ttime\tsize\tfate\t")
+	for _, b := range existing {
+		fate := "kept: " + b.Reason
+		if !b.Keep {
+			fate = "kept: awaiting deletion, one backup per run"
+		}
+		if t, ok := pruned[b]; ok {
+			fate = fmt.Sprintf("deleted by the backup on %v: %v", t.Local().Format(time.DateOnly), b.Reason)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t\n", b.Key, b.Time.Local().Format(time.DateTime), formatBytes(b.Bytes), fate)
+	}
+	labelled := 0
+	for _, object := range objects {
+		if backup.KeyLabel(c.prefix, *object.Key) != "" {
+			labelled++
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t\n", *object.Key, object.LastModified.Local().Format(time.DateTime), formatBytes(uint64(*object.Size)), "kept: labelled")
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	var total uint64
+	for _, b := range backups {
+		total += b.Bytes
+	}
+	remaining := 0
+	for _, b := range existing {
+		if _, ok := pruned[b]; !ok {
+			remaining++
+		}
+	}
+	fmt.Fprintf(w, "After %v days of daily backups, %v unlabelled backup(s) would remain, %v of them existing now, totalling about %v, plus %v labelled.\n",
+		retentionDays, len(backups), remaining, formatBytes(total), labelled)
+	return nil
+}
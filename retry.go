@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/gebn/plexbackup/backup"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+// awsRetryClass is a class of error AWS requests may be retried on.
+type awsRetryClass struct {
+	name  string
+	check retry.IsErrorRetryable
+}
+
+// awsRetryClasses are the classes of error accepted by -aws-retry-error, in
+// the order they are checked, as the first to decide an error wins.
+var awsRetryClasses = []awsRetryClass{
+	{"throttle", retry.IsErrorRetryables{
+		retry.RetryableErrorCode{Codes: retry.DefaultThrottleErrorCodes},
+		retry.RetryableHTTPStatusCode{Codes: map[int]struct{}{429: {}}},
+	}},
+	{"server", retry.IsErrorRetryables{
+		retry.RetryableHTTPStatusCode{Codes: retry.DefaultRetryableHTTPStatusCodes},
+		retry.RetryableErrorCode{Codes: retry.DefaultRetryableErrorCodes},
+	}},
+	// Checked before connection, which declines to retry a host that does
+	// not resolve, as a home router may report while reconnecting.
+	{"dns", retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+		if errors.As(err, new(*net.DNSError)) {
+			return aws.TrueTernary
+		}
+		return aws.UnknownTernary
+	})},
+	{"connection", retry.RetryableConnectionError{}},
+}
+
+// runRetryErrors maps the names accepted by -run-retry-error to the errors
+// they retry.
+var runRetryErrors = map[string]error{
+	"stop":    backup.ErrStop,
+	"archive": backup.ErrArchive,
+	"upload":  backup.ErrUpload,
+}
+
+// registerRetries defines the flags controlling how failed requests and runs
+// are retried.
+func (c *jobConfig) registerRetries(fs *flag.FlagSet) {
+	fs.IntVar(&c.awsMaxAttempts, "aws-max-attempts", 0, "maximum attempts of each AWS request, including the first; 0 for the SDK's default of 3, or AWS_MAX_ATTEMPTS")
+	fs.DurationVar(&c.awsMaxBackoff, "aws-max-backoff", 0, "maximum delay between attempts of an AWS request; 0 for the SDK's default of 20s")
+	fs.Var(&c.awsRetryErrors, "aws-retry-error", "class of error to retry AWS requests on: throttle, server (5xx), connection or dns, the last also retrying hosts that fail to resolve, e.g. while a router reconnects; may be repeated (default throttle, server and connection)")
+	fs.IntVar(&c.runAttempts, "run-attempts", 1, "maximum attempts of each backup, including the first, each stopping Plex and archiving again; a seed resumes its upload instead")
+	fs.DurationVar(&c.runMaxBackoff, "run-max-backoff", backup.DefaultRunMaxBackoff, "maximum delay between attempts of a backup, which starts at a minute and doubles after each")
+	fs.Var(&c.runRetryErrors, "run-retry-error", "phase whose failure causes a backup to be attempted again: stop, archive or upload; may be repeated (default upload)")
+}
+
+// validateRetries checks the retry flags name known classes of error, and are
+// not negative.
+func (c *jobConfig) validateRetries() error {
+	if c.awsMaxAttempts < 0 || c.awsMaxBackoff < 0 || c.runMaxBackoff < 0 {
+		return errors.New("-aws-max-attempts, -aws-max-backoff and -run-max-backoff must not be negative")
+	}
+	for _, name := range c.awsRetryErrors {
+		if !slices.ContainsFunc(awsRetryClasses, func(class awsRetryClass) bool {
+			return class.name == name
+		}) {
+			return fmt.Errorf("unknown -aws-retry-error %q, must be throttle, server, connection or dns", name)
+		}
+	}
+	for _, name := range c.runRetryErrors {
+		if _, ok := runRetryErrors[name]; !ok {
+			return fmt.Errorf("unknown -run-retry-error %q, must be stop, archive or upload", name)
+		}
+	}
+	return nil
+}
+
+// awsRetryer returns the retryer of AWS requests configured by the flags, or
+// nil to leave the SDK's default, which also honours AWS_MAX_ATTEMPTS and
+// AWS_RETRY_MODE.
+func (c *jobConfig) awsRetryer() func() aws.Retryer {
+	if c.awsMaxAttempts == 0 && c.awsMaxBackoff == 0 && len(c.awsRetryErrors) == 0 {
+		return nil
+	}
+	return func() aws.Retryer {
+		return retry.NewStandard(func(o *retry.StandardOptions) {
+			if c.awsMaxAttempts > 0 {
+				o.MaxAttempts = c.awsMaxAttempts
+			}
+			if c.awsMaxBackoff > 0 {
+				o.MaxBackoff = c.awsMaxBackoff
+			}
+			if len(c.awsRetryErrors) > 0 {
+				o.Retryables = []retry.IsErrorRetryable{
+					retry.NoRetryCanceledError{},
+					retry.RetryableError{},
+				}
+				for _, class := range awsRetryClasses {
+					if slices.Contains(c.awsRetryErrors, class.name) {
+						o.Retryables = append(o.Retryables, class.check)
+					}
+				}
+			}
+		})
+	}
+}
+
+// runRetry returns the policy for retrying failed backups.
+func (c *jobConfig) runRetry() backup.RetryPolicy {
+	policy := backup.RetryPolicy{
+		MaxAttempts: c.runAttempts,
+		MaxBackoff:  c.runMaxBackoff,
+	}
+	for _, name := range c.runRetryErrors {
+		policy.Errors = append(policy.Errors, runRetryErrors[name])
+	}
+	return policy
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Prefixes of flag values referring to a secret to fetch at runtime, rather
+// than the secret itself, so it need not appear in unit files or the -config
+// file. A Secrets Manager reference may end with "#<field>" to select a field
+// of a secret stored as JSON.
+const (
+	secretsManagerPrefix = "secretsmanager:"
+	ssmPrefix            = "ssm:"
+)
+
+// secrets resolves references to secrets in AWS Secrets Manager and SSM
+// Parameter Store, fetching each once even if shared by several jobs.
+type secrets struct {
+	cfg    aws.Config
+	values map[string]string
+}
+
+// newSecrets loads the AWS SDK config used to fetch secrets. Nothing is
+// fetched until a reference is resolved.
+func newSecrets(ctx context.Context) (*secrets, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise AWS SDK: %w", err)
+	}
+	return &secrets{
+		cfg:    cfg,
+		values: map[string]string{},
+	}, nil
+}
+
+// isSecretRef returns whether value refers to a secret to fetch.
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretsManagerPrefix) || strings.HasPrefix(value, ssmPrefix)
+}
+
+// resolve returns the secret value refers to, or value itself if it is not a
+// reference. Secrets are fetched from region unless identified by an ARN.
+func (s *secrets) resolve(ctx context.Context, value, region string) (string, error) {
+	if !isSecretRef(value) {
+		return value, nil
+	}
+	if secret, ok := s.values[value]; ok {
+		return secret, nil
+	}
+	var secret string
+	var err error
+	if id, ok := strings.CutPrefix(value, secretsManagerPrefix); ok {
+		secret, err = s.secretsManager(ctx, id, region)
+	} else {
+		secret, err = s.parameter(ctx, strings.TrimPrefix(value, ssmPrefix), region)
+	}
+	if err != nil {
+		return "", err
+	}
+	s.values[value] = secret
+	return secret, nil
+}
+
+// secretsManager fetches the secret identified by id from Secrets Manager,
+// optionally followed by "#<field>".
+func (s *secrets) secretsManager(ctx context.Context, id, region string) (string, error) {
+	id, field, hasField := strings.Cut(id, "#")
+	if parsed, err := arn.Parse(id); err == nil {
+		region = parsed.Region
+	}
+	client := secretsmanager.NewFromConfig(s.cfg, func(o *secretsmanager.Options) {
+		o.Region = region
+	})
+	output, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: &id,
+	})
+	if err != nil {
+		return "", err
+	}
+	if output.SecretString == nil {
+		return "", fmt.Errorf("%v is not a string secret", id)
+	}
+	if !hasField {
+		return *output.SecretString, nil
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(*output.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("%v is not a JSON object of strings: %w", id, err)
+	}
+	secret, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("%v has no field %q", id, field)
+	}
+	return secret, nil
+}
+
+// parameter fetches the named parameter from SSM Parameter Store, decrypting
+// it if it is a SecureString.
+func (s *secrets) parameter(ctx context.Context, name, region string) (string, error) {
+	if parsed, err := arn.Parse(name); err == nil {
+		region = parsed.Region
+	}
+	client := ssm.NewFromConfig(s.cfg, func(o *ssm.Options) {
+		o.Region = region
+	})
+	output, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           &name,
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if output.Parameter == nil || output.Parameter.Value == nil {
+		return "", errors.New("parameter has no value")
+	}
+	return *output.Parameter.Value, nil
+}
+
+// secretFlags returns the flags of the job that may refer to a secret, by
+// name.
+func (c *jobConfig) secretFlags() map[string]*string {
+	flags := map[string]*string{
+		"agent-token":      &c.agentToken,
+		"tautulli-api-key": &c.tautulliAPIKey,
+		"healthcheck-url":  &c.healthcheckURL,
+		"smtp-password":    &c.smtpPassword,
+	}
+	for i := range c.webhookURLs {
+		flags[fmt.Sprintf("webhook-url #%d", i+1)] = &c.webhookURLs[i]
+	}
+	return flags
+}
+
+// resolveSecrets replaces references in the job's secret flags with the
+// secrets they refer to.
+func (c *jobConfig) resolveSecrets(ctx context.Context, s *secrets) error {
+	for name, value := range c.secretFlags() {
+		secret, err := s.resolve(ctx, *value, c.region)
+		if err != nil {
+			return fmt.Errorf("failed to fetch -%v: %w", name, err)
+		}
+		*value = secret
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gebn/plexbackup/backup"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is where init writes the config file if -config is not
+// set.
+const defaultConfigFile = "/etc/plexbackup.yaml"
+
+// snapDirectory is the location of the 'Plex Media Server' directory when
+// Plex is installed as a snap.
+const snapDirectory = "/var/snap/plexmediaserver/common/Library/Application Support/Plex Media Server"
+
+// setupTestName is appended to the prefix to form the key of the object
+// written to test access to the bucket.
+const setupTestName = "plexbackup-init-test"
+
+// setup detects how Plex is installed, asks for anything it cannot detect or
+// that was not provided as a flag in cmdline, tests access to the bucket, then
+// writes the resulting -config file. On systemd hosts, it offers to install a
+// timer running the backup daily, as install-unit would.
+func setup(ctx context.Context, w io.Writer, fs *flag.FlagSet, cmdline map[string]bool) error {
+	p := &prompter{
+		in:  bufio.NewReader(os.Stdin),
+		out: w,
+	}
+	c := defaultJob
+	values := map[string]any{}
+
+	if !cmdline["platform"] {
+		c.platform = detectPlatform()
+	}
+	if c.platform != "" {
+		plat, ok := platforms[c.platform]
+		if !ok {
+			return configError{fmt.Errorf("unknown -platform %q, must be unraid or qnap", c.platform)}
+		}
+		fmt.Fprintf(w, "Plex is running on %v, and will be stopped with %v.\n", c.platform, strings.Join(plat.stop(plat.service), " "))
+		values["platform"] = c.platform
+	} else if !c.noPause {
+		if len(c.services) == 0 {
+			service, err := backup.DetectService(ctx, backup.ExecRunner{})
+			if err != nil {
+				fmt.Fprintf(w, "Could not find how Plex is installed: %v.\n", err)
+				if service, err = p.ask("systemd unit running Plex: "); err != nil {
+					return err
+				}
+			}
+			c.services = stringsFlag{service}
+		}
+		kind := "a package"
+		if strings.HasPrefix(c.services[0], "snap.") {
+			kind = "a snap"
+		}
+		fmt.Fprintf(w, "Plex is installed as %v, running as %v.\n", kind, c.services[0])
+		values["service"] = []string(c.services)
+	} else {
+		values["no-pause"] = true
+	}
+
+	directories := []string(c.directories)
+	if len(directories) == 0 {
+		directory := defaultDirectory
+		if c.platform != "" {
+			directory = platforms[c.platform].directory
+		} else if len(c.services) > 0 && strings.HasPrefix(c.services[0], "snap.") {
+			directory = snapDirectory
+		}
+		if _, err := os.Stat(directory); err != nil {
+			answer, err := p.ask(fmt.Sprintf("%v not found; Plex Media Server directory: ", directory))
+			if err != nil {
+				return err
+			}
+			directory = answer
+		}
+		directories = []string{directory}
+	}
+	for _, directory := range directories {
+		if _, err := os.Stat(directory); err != nil {
+			return fmt.Errorf("invalid directory: %w", err)
+		}
+	}
+	fmt.Fprintf(w, "Backing up %v.\n", strings.Join(directories, ", "))
+	values["directory"] = directories
+
+	if !cmdline["bucket"] {
+		bucket, err := p.ask("S3 bucket to upload backups to: ")
+		if err != nil {
+			return err
+		}
+		if bucket == "" {
+			return ErrNoBucket
+		}
+		c.bucket = bucket
+	}
+	if !cmdline["region"] {
+		region, err := p.askDefault("Region of the bucket", c.region)
+		if err != nil {
+			return err
+		}
+		c.region = region
+	}
+	if !cmdline["prefix"] {
+		prefix := c.prefix
+		if hostname, err := os.Hostname(); err == nil {
+			prefix += strings.ToLower(hostname) + "-"
+		}
+		prefix, err := p.askDefault("Prefix of the backups", prefix)
+		if err != nil {
+			return err
+		}
+		c.prefix = prefix
+	}
+	values["bucket"] = c.bucket
+	values["region"] = c.region
+	values["prefix"] = c.prefix
+
+	fmt.Fprintf(w, "Testing access to s3://%v/%v...\n", c.bucket, c.prefix)
+	if err := testAccess(ctx, c); err != nil {
+		return fmt.Errorf("%w; check the bucket, and the credentials in the environment, ~/.aws or the instance role", err)
+	}
+	fmt.Fprintln(w, "Listed, wrote and deleted an object successfully.")
+
+	path := configFile
+	if path == "" {
+		path = defaultConfigFile
+	}
+	// The timer's working directory is unrelated to ours.
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if err := writeConfigFile(p, path, values); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Wrote %v; back up with: %v backup -config %v\n", path, os.Args[0], path)
+
+	if c.platform != "" {
+		fmt.Fprintln(w, "Schedule the backup with the platform's own tooling, e.g. the User Scripts plugin on Unraid, or crontab on QNAP, running as root.")
+		return nil
+	}
+	answer, err := p.askDefault(fmt.Sprintf("Install a systemd timer backing up at %v? [y/n]", unitOnCalendar), "y")
+	if err != nil || !strings.HasPrefix(strings.ToLower(answer), "y") {
+		return err
+	}
+	if !cmdline["unit-user"] && len(c.services) > 0 {
+		if owner, err := backup.ServiceOwner(ctx, backup.ExecRunner{}, c.services[0]); err == nil {
+			unitUser, _, _ = strings.Cut(owner, ":")
+		}
+	}
+	unitInstall = os.Geteuid() == 0
+	if !unitInstall {
+		fmt.Fprintf(w, "Not running as root, so the units are printed instead; install them as root with: %v install-unit -config %v -unit-install\n", os.Args[0], path)
+	}
+	if err := fs.Set("config", path); err != nil {
+		return err
+	}
+	return installUnit(w, fs, map[string]bool{"config": true}, []*jobConfig{c})
+}
+
+// askDefault asks question, returning def if the answer is empty.
+func (p *prompter) askDefault(question, def string) (string, error) {
+	answer, err := p.ask(fmt.Sprintf("%v [%v]: ", question, def))
+	if err != nil || answer == "" {
+		return def, err
+	}
+	return answer, nil
+}
+
+// testAccess checks the job can list, write and delete objects under its
+// prefix, as a backup does.
+func testAccess(ctx context.Context, c *jobConfig) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := c.s3Client(cfg)
+	if _, err := backup.ListBackups(ctx, client, c.bucket, c.prefix); err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+	key := c.prefix + setupTestName
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &c.bucket,
+		Key:    &key,
+		Body:   strings.NewReader("written by plexbackup init\n"),
+	}); err != nil {
+		return fmt.Errorf("failed to write %v: %w", key, err)
+	}
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &c.bucket,
+		Key:    &key,
+	}); err != nil {
+		return fmt.Errorf("failed to delete %v: %w", key, err)
+	}
+	return nil
+}
+
+// writeConfigFile writes values to path as YAML, asking before overwriting an
+// existing file.
+func writeConfigFile(p *prompter, path string, values map[string]any) error {
+	if _, err := os.Stat(path); err == nil {
+		answer, err := p.askDefault(fmt.Sprintf("%v exists; overwrite it? [y/n]", path), "n")
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(strings.ToLower(answer), "y") {
+			return errors.New("not overwriting " + path)
+		}
+	}
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	header := "# Written by plexbackup init. Every flag may be set here; see plexbackup -help.\n"
+	return os.WriteFile(path, append([]byte(header), data...), 0644)
+}
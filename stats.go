@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// month is the period growth rates are expressed over.
+const month = 30 * 24 * time.Hour
+
+// stats writes the size history of each job's backups to w from its catalog,
+// including backups since pruned, followed by how quickly the backup and
+// Plex's library databases are growing, and how the compression ratio has
+// changed, so runaway metadata growth can be noticed.
+func stats(ctx context.Context, w io.Writer, configs []*jobConfig, names []string) error {
+	var errs []error
+	for i, c := range configs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		label := "s3://" + c.bucket + "/" + c.prefix
+		if names[i] != "" {
+			label = names[i] + " (" + label + ")"
+		}
+		fmt.Fprintln(w, label)
+		if err := statsJob(ctx, w, c); err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// statsJob writes the size history of a single job's backups.
+func statsJob(ctx context.Context, w io.Writer, c *jobConfig) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	catalog, _, err := backup.ReadCatalog(ctx, c.s3Client(cfg), c.bucket, c.prefix)
+	if err != nil {
+		return fmt.Errorf("failed to read catalog: %w", err)
+	}
+	if len(catalog.Backups) == 0 {
+		fmt.Fprintln(w, "no backups in the catalog")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "time\tuncompressed\tcompressed\tratio\tdatabase\tstatus\t")
+	var databases []*backup.CatalogEntry
+	for _, entry := range catalog.Backups {
+		database := "?"
+		if entry.DatabaseBytes > 0 {
+			database = formatBytes(entry.DatabaseBytes)
+			databases = append(databases, entry)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%.2f\t%v\t%v\t\n",
+			entry.Time.Local().Format(time.DateTime),
+			formatBytes(entry.UncompressedBytes),
+			formatBytes(entry.CompressedBytes),
+			ratio(entry),
+			database,
+			entry.Status)
+	}
+	tw.Flush()
+
+	first, last := catalog.Backups[0], catalog.Backups[len(catalog.Backups)-1]
+	elapsed := last.Time.Sub(first.Time)
+	if elapsed <= 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "Over %v: uncompressed %v, compressed %v, ratio %.2f to %.2f\n",
+		formatDays(elapsed),
+		formatGrowth(first.UncompressedBytes, last.UncompressedBytes, elapsed),
+		formatGrowth(first.CompressedBytes, last.CompressedBytes, elapsed),
+		ratio(first), ratio(last))
+	if len(databases) > 1 {
+		first, last := databases[0], databases[len(databases)-1]
+		elapsed := last.Time.Sub(first.Time)
+		if elapsed <= 0 {
+			return nil
+		}
+		fmt.Fprintf(w, "Over %v: database %v\n",
+			formatDays(elapsed),
+			formatGrowth(first.DatabaseBytes, last.DatabaseBytes, elapsed))
+	}
+	return nil
+}
+
+// ratio returns the compression ratio of the backup described by entry, or 0
+// if it is empty.
+func ratio(entry *backup.CatalogEntry) float64 {
+	if entry.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(entry.UncompressedBytes) / float64(entry.CompressedBytes)
+}
+
+// formatGrowth describes the change in size from from to to over elapsed, as
+// a total and a monthly rate, e.g. "+1.2 GiB (+300.0 MiB/month)".
+func formatGrowth(from, to uint64, elapsed time.Duration) string {
+	sign, delta := "+", to-from
+	if to < from {
+		sign, delta = "-", from-to
+	}
+	perMonth := uint64(float64(delta) * float64(month) / float64(elapsed))
+	return fmt.Sprintf("%v%v (%v%v/month)", sign, formatBytes(delta), sign, formatBytes(perMonth))
+}
+
+// formatDays formats d as a whole number of days, or a duration if shorter.
+func formatDays(d time.Duration) string {
+	if d < 24*time.Hour {
+		return d.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%.0f days", d.Hours()/24)
+}
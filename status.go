@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	runsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "plexbackup",
+		Name:      "runs_total",
+		Help:      "Backups attempted by the daemon, by job and result.",
+	}, []string{"job", "result"})
+	lastRunTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "plexbackup",
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Unix time at which the most recent backup of each job finished.",
+	}, []string{"job"})
+	lastSuccessTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "plexbackup",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time at which the most recent successful backup of each job finished.",
+	}, []string{"job"})
+	lastRunDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "plexbackup",
+		Name:      "last_run_duration_seconds",
+		Help:      "Wall-clock duration of the most recent backup of each job.",
+	}, []string{"job"})
+	lastBackupBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "plexbackup",
+		Name:      "last_backup_bytes",
+		Help:      "Size of the most recent successful backup of each job, by stage.",
+	}, []string{"job", "stage"})
+	lastDatabaseBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "plexbackup",
+		Name:      "last_database_bytes",
+		Help:      "Size of Plex's library databases when the most recent successful backup of each job was taken.",
+	}, []string{"job"})
+	lastDowntime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "plexbackup",
+		Name:      "last_downtime_seconds",
+		Help:      "Time the service was stopped for during the most recent successful backup of each job.",
+	}, []string{"job"})
+	consecutiveFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "plexbackup",
+		Name:      "consecutive_failures",
+		Help:      "Number of backups of each job in a row that have failed.",
+	}, []string{"job"})
+	nextRunTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "plexbackup",
+		Name:      "next_run_timestamp_seconds",
+		Help:      "Unix time at which the next backup is scheduled.",
+	})
+	buildInfoGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "plexbackup",
+		Name:      "build_info",
+		Help:      "Always 1, labelled with the version of the running binary.",
+		ConstLabels: prometheus.Labels{
+			"version":   build.Version,
+			"commit":    build.Commit,
+			"goversion": build.GoVersion,
+		},
+	}, func() float64 { return 1 })
+)
+
+// runRecord describes a single completed backup attempt.
+type runRecord struct {
+	Job               string    `json:"job,omitempty"`
+	Start             time.Time `json:"start"`
+	End               time.Time `json:"end"`
+	Result            string    `json:"result"`
+	Error             string    `json:"error,omitempty"`
+	Key               string    `json:"key,omitempty"`
+	UncompressedBytes uint64    `json:"uncompressed_bytes,omitempty"`
+	CompressedBytes   uint64    `json:"compressed_bytes,omitempty"`
+	DatabaseBytes     uint64    `json:"database_bytes,omitempty"`
+	DowntimeSeconds   float64   `json:"downtime_seconds,omitempty"`
+
+	// ConsecutiveFailures and ResumesAt are set while the job is failing,
+	// the latter once its scheduled runs are suspended.
+	ConsecutiveFailures int       `json:"consecutive_failures,omitempty"`
+	ResumesAt           time.Time `json:"resumes_at,omitzero"`
+}
+
+// status tracks the daemon's state, exposing it via HTTP. It is safe for
+// concurrent use.
+type status struct {
+	// mu guards running, nextRun, lastRuns and history.
+	mu       sync.Mutex
+	running  bool
+	nextRun  time.Time
+	lastRuns []*runRecord
+	history  *history
+
+	// runNow receives a value when a backup is requested outside the
+	// schedule. It must be created with a buffer of one, so a request
+	// made while a backup is in progress is queued.
+	runNow chan struct{}
+}
+
+// newStatus returns the status of a daemon recording runs in h, restoring
+// the last run of each job from it.
+func newStatus(h *history) *status {
+	s := &status{
+		history: h,
+		runNow:  make(chan struct{}, 1),
+	}
+	for _, record := range h.runs {
+		if record.Result != "skipped" {
+			s.setLastRun(record)
+		}
+	}
+	return s
+}
+
+// trigger requests the daemon back up all jobs as soon as possible. It
+// returns false if a request is already queued.
+func (s *status) trigger() bool {
+	select {
+	case s.runNow <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// scheduled records the time of the next run.
+func (s *status) scheduled(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextRun = next
+	nextRunTimestamp.Set(float64(next.UnixNano()) / 1e9)
+}
+
+// setRunning records whether the daemon is backing up.
+func (s *status) setRunning(running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = running
+}
+
+// skipped records a scheduled run of the named job was skipped by its breaker,
+// returning an error if the history could not be saved.
+func (s *status) skipped(job string, b *breaker) error {
+	now := time.Now()
+	record := &runRecord{
+		Job:                 job,
+		Start:               now,
+		End:                 now,
+		Result:              "skipped",
+		ConsecutiveFailures: b.failures,
+		ResumesAt:           b.resumes,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runsTotal.WithLabelValues(job, record.Result).Inc()
+	return s.history.add(record)
+}
+
+// completed records the outcome of a run of the named job, and the state of
+// its breaker, which may be nil. It returns an error if the history could not
+// be saved.
+func (s *status) completed(job string, start time.Time, result *backup.Result, err error, b *breaker) error {
+	record := &runRecord{
+		Job:    job,
+		Start:  start,
+		End:    time.Now(),
+		Result: "success",
+	}
+	if err != nil {
+		record.Result = "failure"
+		record.Error = err.Error()
+	}
+	if result != nil {
+		record.Key = result.Key
+		record.UncompressedBytes = result.UncompressedBytes
+		record.CompressedBytes = result.CompressedBytes
+		record.DatabaseBytes = result.DatabaseBytes
+		record.DowntimeSeconds = result.Downtime.Seconds()
+	}
+	if b != nil {
+		record.ConsecutiveFailures = b.failures
+		record.ResumesAt = b.resumes
+		consecutiveFailures.WithLabelValues(job).Set(float64(b.failures))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setLastRun(record)
+
+	runsTotal.WithLabelValues(job, record.Result).Inc()
+	lastRunTimestamp.WithLabelValues(job).Set(float64(record.End.UnixNano()) / 1e9)
+	lastRunDuration.WithLabelValues(job).Set(record.End.Sub(record.Start).Seconds())
+	if err == nil {
+		lastSuccessTimestamp.WithLabelValues(job).Set(float64(record.End.UnixNano()) / 1e9)
+		lastBackupBytes.WithLabelValues(job, "uncompressed").Set(float64(record.UncompressedBytes))
+		lastBackupBytes.WithLabelValues(job, "compressed").Set(float64(record.CompressedBytes))
+		if record.DatabaseBytes > 0 {
+			lastDatabaseBytes.WithLabelValues(job).Set(float64(record.DatabaseBytes))
+		}
+		lastDowntime.WithLabelValues(job).Set(record.DowntimeSeconds)
+	}
+	return s.history.add(record)
+}
+
+// setLastRun replaces the last run of record's job. The caller must hold mu.
+func (s *status) setLastRun(record *runRecord) {
+	for i, existing := range s.lastRuns {
+		if existing.Job == record.Job {
+			s.lastRuns[i] = record
+			return
+		}
+	}
+	s.lastRuns = append(s.lastRuns, record)
+}
+
+// ServeHTTP renders the status as JSON.
+func (s *status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	doc := struct {
+		Running  bool         `json:"running"`
+		NextRun  time.Time    `json:"next_run"`
+		LastRuns []*runRecord `json:"last_runs"`
+		History  []*runRecord `json:"history"`
+	}{
+		Running:  s.running,
+		NextRun:  s.nextRun,
+		LastRuns: s.lastRuns,
+		History:  slices.Clone(s.history.runs),
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(&doc)
+}
+
+// serveStatus serves /healthz, /metrics and /status on addr until ctx is
+// cancelled, along with a page listing the backups of each job, and /run to
+// request a backup.
+func serveStatus(ctx context.Context, logger *slog.Logger, addr string, s *status, jobs []*job) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		runsTotal,
+		lastRunTimestamp,
+		lastSuccessTimestamp,
+		lastRunDuration,
+		lastBackupBytes,
+		lastDatabaseBytes,
+		lastDowntime,
+		consecutiveFailures,
+		nextRunTimestamp,
+		buildInfoGauge)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.Handle("/status", s)
+	mux.Handle("GET /{$}", &historyPage{
+		logger: logger,
+		jobs:   jobs,
+		status: s,
+	})
+	mux.Handle("POST /run", &runHandler{
+		logger: logger,
+		jobs:   jobs,
+		status: s,
+		token:  runToken,
+	})
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	logger.InfoContext(ctx, "serving status", slog.String("addr", addr))
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.ErrorContext(ctx, "status server failed",
+			slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// verifyBackups downloads the backup at -key, or the newest, of each job and
+// reads every file in it, checking its digest against the catalog, so a backup
+// can be proven restorable without restoring it.
+func verifyBackups(ctx context.Context, logger *slog.Logger, w io.Writer, configs []*jobConfig, names []string) error {
+	var errs []error
+	for i, c := range configs {
+		if err := verifyJob(ctx, logger, w, c); err != nil {
+			if names[i] != "" {
+				err = fmt.Errorf("job %v: %w", names[i], err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// verifyJob verifies a single job's backup.
+func verifyJob(ctx context.Context, logger *slog.Logger, w io.Writer, c *jobConfig) error {
+	cfg, err := c.awsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	client := c.s3Client(cfg)
+	key, digest, err := resolveKey(ctx, client, c)
+	if err != nil {
+		return err
+	}
+	logger.InfoContext(ctx, "verifying backup",
+		slog.String("key", key))
+	entries, err := backup.Verify(ctx, client, kmsClient(cfg), c.bucket, key, digest)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "verified s3://%v/%v: %v entries\n", c.bucket, key, entries)
+	return nil
+}
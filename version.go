@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gebn/go-stamp/v2"
+)
+
+// buildInfo describes the running binary. It combines the stamp variables set
+// by the Makefile's -ldflags with the build info embedded by the Go toolchain,
+// which is available even for go install builds. It is written as JSON by
+// -version -json, so deployment tooling can check the running version.
+type buildInfo struct {
+	// Module is the path of the main module, e.g. for go install.
+	Module string `json:"module,omitempty"`
+
+	Version string `json:"version,omitempty"`
+
+	// SemVer is Version parsed, or nil if it is not a semantic version.
+	SemVer *semVer `json:"semver,omitempty"`
+
+	Commit string `json:"commit,omitempty"`
+	Branch string `json:"branch,omitempty"`
+
+	// Dirty indicates the working tree had uncommitted changes.
+	Dirty bool `json:"dirty"`
+
+	// Time is when the binary was built, or nil if unknown.
+	Time *time.Time `json:"build_time,omitempty"`
+
+	// User and Host identify where the binary was built, if stamped.
+	User string `json:"user,omitempty"`
+	Host string `json:"host,omitempty"`
+
+	GoVersion string   `json:"go_version"`
+	Compiler  string   `json:"compiler"`
+	Platform  string   `json:"platform"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// build describes the running binary.
+var build = readBuildInfo()
+
+// readBuildInfo returns the stamp variables, with any unset filled from the
+// toolchain's build info.
+func readBuildInfo() *buildInfo {
+	info := &buildInfo{
+		Version:   stamp.Version,
+		Commit:    stamp.Commit,
+		Branch:    stamp.Branch,
+		User:      stamp.User,
+		Host:      stamp.Host,
+		GoVersion: runtime.Version(),
+		Compiler:  runtime.Compiler,
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if t := stamp.Time(); !t.IsZero() {
+		info.Time = &t
+	}
+	// The Makefile's version comes from git describe --dirty.
+	info.Dirty = isDirty(info.Version)
+	embedded, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Module = embedded.Main.Path
+	info.GoVersion = embedded.GoVersion
+	for _, setting := range embedded.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		case "vcs.modified":
+			if setting.Value == "true" {
+				info.Dirty = true
+			}
+		case "-compiler":
+			info.Compiler = setting.Value
+		case "-tags":
+			if setting.Value != "" {
+				info.Tags = strings.Split(setting.Value, ",")
+			}
+		}
+	}
+	if info.Version == "" {
+		// A release or pseudo-version, which the toolchain marks
+		// "+dirty" if modified, or "(devel)" if unknown.
+		if v := embedded.Main.Version; v != "" && v != "(devel)" {
+			info.Version = v
+		} else if len(info.Commit) >= 12 {
+			info.Version = info.Commit[:12]
+			if info.Dirty {
+				info.Version += "-dirty"
+			}
+		}
+	}
+	info.SemVer = parseSemVer(info.Version)
+	return info
+}
+
+// semVer is a semantic version, e.g. "v1.2.0-rc.1+dirty".
+type semVer struct {
+	Major int `json:"major"`
+	Minor int `json:"minor"`
+	Patch int `json:"patch"`
+
+	// Prerelease follows the first hyphen, e.g. "3-g157ed0b" for a commit
+	// described by git as after v1.2.0, or the timestamp and commit of a
+	// pseudo-version.
+	Prerelease string `json:"prerelease,omitempty"`
+
+	// Build follows the plus sign, e.g. "dirty".
+	Build string `json:"build,omitempty"`
+}
+
+// parseSemVer parses version, which starts with "v" like a Go module version,
+// returning nil if it is not a semantic version.
+func parseSemVer(version string) *semVer {
+	version, ok := strings.CutPrefix(version, "v")
+	if !ok || version == "" {
+		return nil
+	}
+	v := &semVer{}
+	version, v.Build, _ = strings.Cut(version, "+")
+	version, v.Prerelease, _ = strings.Cut(version, "-")
+	fields := strings.Split(version, ".")
+	if len(fields) != 3 {
+		return nil
+	}
+	for i, n := range []*int{&v.Major, &v.Minor, &v.Patch} {
+		// Leading zeros are not allowed.
+		f := fields[i]
+		if f == "" || len(f) > 1 && f[0] == '0' {
+			return nil
+		}
+		var err error
+		if *n, err = strconv.Atoi(f); err != nil {
+			return nil
+		}
+	}
+	return v
+}
+
+// String returns a human-readable summary, e.g. "v1.2.0 (157ed0b, master),
+// built with go1.25.0 gc for linux/amd64 by george@dev on
+// 2025-02-01T22:45:21Z", with the full commit. Unknown details are omitted.
+func (b *buildInfo) String() string {
+	var sb strings.Builder
+	version := b.Version
+	if version == "" {
+		version = "unknown version"
+	}
+	sb.WriteString(version)
+	var revision []string
+	if b.Commit != "" {
+		revision = append(revision, b.Commit)
+	}
+	if b.Branch != "" {
+		revision = append(revision, b.Branch)
+	}
+	if b.Dirty && !isDirty(b.Version) {
+		revision = append(revision, "modified")
+	}
+	if len(revision) > 0 {
+		fmt.Fprintf(&sb, " (%v)", strings.Join(revision, ", "))
+	}
+	fmt.Fprintf(&sb, ", built with %v %v for %v", b.GoVersion, b.Compiler, b.Platform)
+	if len(b.Tags) > 0 {
+		fmt.Fprintf(&sb, " with tags %v", strings.Join(b.Tags, ","))
+	}
+	if b.User != "" || b.Host != "" {
+		fmt.Fprintf(&sb, " by %v@%v", b.User, b.Host)
+	}
+	if b.Time != nil {
+		fmt.Fprintf(&sb, " on %v", b.Time.UTC().Format(time.RFC3339))
+	}
+	return sb.String()
+}
+
+// isDirty returns whether version indicates it was built with uncommitted
+// changes.
+func isDirty(version string) bool {
+	return strings.HasSuffix(version, "-dirty") || strings.HasSuffix(version, "+dirty")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gebn/plexbackup/backup"
+)
+
+// historyTemplate renders the backups of each job, newest first.
+var historyTemplate = template.Must(template.New("history").Funcs(template.FuncMap{
+	"bytes":    formatBytes,
+	"duration": formatSeconds,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>plexbackup</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.3em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+.pruned { color: #999; }
+.failure { color: #c00; }
+</style>
+</head>
+<body>
+<h1>plexbackup</h1>
+<form method="post" action="/run">
+<input type="hidden" name="redirect" value="/">
+<p>Next backup: {{.NextRun.Format "Mon 2 Jan 15:04 MST"}}{{if .CanRun}} <button type="submit">Run now</button>{{end}}</p>
+</form>
+{{range .Jobs}}
+<h2>{{if .Name}}{{.Name}}{{else}}Backups{{end}}</h2>
+{{with .LastRun}}{{if .Error}}<p class="failure">Last run at {{.End.Format "Mon 2 Jan 15:04"}} failed: {{.Error}}</p>{{end}}{{end}}
+{{if .Error}}<p class="failure">Failed to read catalog: {{.Error}}</p>{{end}}
+<table>
+<tr><th>Time</th><th>Size</th><th>Uncompressed</th><th>Duration</th><th>Downtime</th><th>Plex version</th><th>Status</th></tr>
+{{range .Backups}}
+<tr{{if eq .Status "pruned"}} class="pruned"{{end}}><td title="{{.Key}}">{{.Time.Local.Format "Mon 2 Jan 2006 15:04"}}{{with .Label}} ({{.}}){{end}}</td><td>{{bytes .CompressedBytes}}</td><td>{{bytes .UncompressedBytes}}</td><td>{{duration .DurationSeconds}}</td><td>{{duration .DowntimeSeconds}}</td><td>{{.PlexVersion}}</td><td>{{.Status}}</td></tr>
+{{else}}
+<tr><td colspan="7">No backups recorded.</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// historyPage renders the catalog of each job as an HTML page, for those who
+// would rather not read logs or JSON.
+type historyPage struct {
+	logger *slog.Logger
+	jobs   []*job
+	status *status
+}
+
+// jobHistory is the data rendered for a single job.
+type jobHistory struct {
+	Name    string
+	LastRun *runRecord
+	Backups []*backup.CatalogEntry
+	Error   error
+}
+
+// ServeHTTP implements http.Handler.
+func (p *historyPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.status.mu.Lock()
+	nextRun := p.status.nextRun
+	lastRuns := slices.Clone(p.status.lastRuns)
+	p.status.mu.Unlock()
+
+	data := struct {
+		NextRun time.Time
+		CanRun  bool
+		Jobs    []*jobHistory
+	}{
+		NextRun: nextRun,
+		CanRun:  runToken != "",
+	}
+	for _, j := range p.jobs {
+		history := &jobHistory{
+			Name: j.name,
+		}
+		for _, record := range lastRuns {
+			if record.Job == j.name {
+				history.LastRun = record
+			}
+		}
+		catalog, _, err := backup.ReadCatalog(r.Context(), j.client, j.opts.Bucket, j.opts.Prefix)
+		if err != nil {
+			history.Error = err
+		} else {
+			history.Backups = slices.Clone(catalog.Backups)
+			slices.Reverse(history.Backups)
+		}
+		data.Jobs = append(data.Jobs, history)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := historyTemplate.Execute(w, &data); err != nil {
+		p.logger.WarnContext(r.Context(), "failed to render history",
+			slog.String("error", err.Error()))
+	}
+}
+
+// runHandler requests a backup of every job, e.g. from Home Assistant before
+// updating Plex. Requests must be authorised by token, and are refused if a
+// backup is already queued or running, including one started outside the
+// daemon that holds a job's lock file.
+type runHandler struct {
+	logger *slog.Logger
+	jobs   []*job
+	status *status
+	token  string
+}
+
+// ServeHTTP implements http.Handler.
+func (h *runHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.token == "" {
+		http.Error(w, "/run is disabled; set -run-token to enable it", http.StatusForbidden)
+		return
+	}
+	if !authorised(r, h.token) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="plexbackup"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.status.mu.Lock()
+	running := h.status.running
+	h.status.mu.Unlock()
+	if running || slices.ContainsFunc(h.jobs, (*job).locked) {
+		http.Error(w, "a backup is already running", http.StatusConflict)
+		return
+	}
+	if !h.status.trigger() {
+		http.Error(w, "a backup is already queued", http.StatusConflict)
+		return
+	}
+	h.logger.InfoContext(r.Context(), "backup requested",
+		slog.String("remote_addr", r.RemoteAddr))
+	if r.FormValue("redirect") == "/" {
+		// Submitted from the history page.
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("backup queued\n"))
+}
+
+// formatSeconds formats a duration recorded in seconds, or returns the empty
+// string if it is unknown.
+func formatSeconds(seconds float64) string {
+	if seconds == 0 {
+		return ""
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}